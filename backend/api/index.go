@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"github.com/muratayousuke/ai-flashcards/controllers"
 	"github.com/muratayousuke/ai-flashcards/middleware"
 	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -43,10 +45,15 @@ func setupRouter() *gin.Engine {
 	}
 
 	// Auto migrate
-	if err := db.AutoMigrate(&models.User{}, &models.Deck{}, &models.Card{}, &models.AnswerRecord{}, &models.Subscription{}, &models.CardPreview{}); err != nil {
+	if err := db.AutoMigrate(&models.User{}, &models.Deck{}, &models.Card{}, &models.AnswerRecord{}, &models.Subscription{}, &models.CardPreview{}, &models.CardRevision{}, &models.Media{}, &models.NoteType{}, &models.Note{}, &models.Tag{}, &models.GenerationJob{}); err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
+	// 既存カードを組み込みの Basic ノートに移行
+	if err := services.MigrateCardsToNotes(db); err != nil {
+		log.Fatal("Failed to migrate cards to notes:", err)
+	}
+
 	r := gin.New()
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
@@ -55,6 +62,13 @@ func setupRouter() *gin.Engine {
 	// コントローラーの初期化
 	deckController := controllers.NewDeckController(db)
 	cardController := controllers.NewCardController(db)
+	duplicateController := controllers.NewDuplicateController(db)
+	mediaController := controllers.NewMediaController(db)
+	noteController := controllers.NewNoteController(db)
+	importController := controllers.NewImportController(db)
+	exportController := controllers.NewExportController(db)
+	backupController := controllers.NewBackupController(db)
+	accountController := controllers.NewAccountController(db)
 	webhookController := controllers.NewWebhookController(db)
 
 	// AI生成コントローラーの初期化
@@ -62,6 +76,8 @@ func setupRouter() *gin.Engine {
 	if err != nil {
 		log.Fatal("Failed to initialize AI generate controller:", err)
 	}
+	// 関数はレスポンス後に停止するため、ジョブは JOB_QUEUE=redis で常駐サーバーのワーカーに処理させる
+	aiGenerateController.StartServerlessJobWorkers(context.Background())
 
 	// 音声転写コントローラーの初期化
 	audioTranscribeController, err := controllers.NewAudioTranscribeController(db)
@@ -72,9 +88,18 @@ func setupRouter() *gin.Engine {
 	// 認証が必要なAPIルート
 	api := r.Group("/api")
 	api.Use(middleware.AuthMiddleware())
+	provisioner := services.NewUserProvisioner(db, services.NewClerkAPIUserLookup())
+	api.Use(middleware.ProvisionUser(provisioner))
 
 	deckController.RegisterRoutes(api)
 	cardController.RegisterRoutes(api)
+	duplicateController.RegisterRoutes(api)
+	mediaController.RegisterRoutes(api)
+	noteController.RegisterRoutes(api)
+	importController.RegisterRoutes(api)
+	exportController.RegisterRoutes(api)
+	backupController.RegisterRoutes(api)
+	accountController.RegisterRoutes(api)
 	aiGenerateController.RegisterRoutes(api)
 	audioTranscribeController.RegisterRoutes(api)
 
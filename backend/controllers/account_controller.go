@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/handlers"
+	"gorm.io/gorm"
+)
+
+type AccountController struct {
+	handler *handlers.AccountHandler
+}
+
+func NewAccountController(db *gorm.DB) *AccountController {
+	return &AccountController{
+		handler: handlers.NewAccountHandler(db),
+	}
+}
+
+func (c *AccountController) RegisterRoutes(api *gin.RouterGroup) {
+	api.GET("/account/data", c.handler.DownloadData)
+}
@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"context"
+
 	"github.com/gin-gonic/gin"
 	"github.com/muratayousuke/ai-flashcards/handlers"
 	"gorm.io/gorm"
@@ -24,14 +26,52 @@ func NewAIGenerateController(db *gorm.DB) (*AIGenerateController, error) {
 func (c *AIGenerateController) RegisterRoutes(api *gin.RouterGroup) {
 	// 統合されたエンドポイント - テキスト、画像、音声すべてを処理
 	api.POST("/cards/ai_generate", c.handler.GenerateCards)
+	api.POST("/cards/ai_generate/stream", c.handler.GenerateCardsStream)
 	
 	// プレビュー機能のエンドポイント
 	api.POST("/cards/ai_preview", c.handler.GeneratePreview)
+	api.POST("/cards/ai_preview/stream", c.handler.GeneratePreviewStream)
 	api.POST("/cards/ai_confirm", c.handler.ConfirmPreview)
 	api.POST("/cards/ai_regenerate", c.handler.RegenerateWithFeedback)
+
+	// 非同期ジョブのエンドポイント
+	api.POST("/cards/ai_generate/jobs", c.handler.SubmitGenerateJob)
+	api.POST("/cards/ai_preview/jobs", c.handler.SubmitPreviewJob)
+	api.GET("/jobs/:id", c.handler.GetJob)
+	api.POST("/jobs/:id/cancel", c.handler.CancelJob)
 }
 
 // GetGenerateCardsHandler returns the handler function for external use
 func (c *AIGenerateController) GetGenerateCardsHandler() gin.HandlerFunc {
 	return c.handler.GenerateCards
 }
+
+// GetSubmitGenerateJobHandler returns the job submission handler function for external use
+func (c *AIGenerateController) GetSubmitGenerateJobHandler() gin.HandlerFunc {
+	return c.handler.SubmitGenerateJob
+}
+
+// GetJobHandler returns the job status handler function for external use
+func (c *AIGenerateController) GetJobHandler() gin.HandlerFunc {
+	return c.handler.GetJob
+}
+
+// GetCancelJobHandler returns the job cancellation handler function for external use
+func (c *AIGenerateController) GetCancelJobHandler() gin.HandlerFunc {
+	return c.handler.CancelJob
+}
+
+// StartJobWorkers starts the workers running generation jobs in this process
+func (c *AIGenerateController) StartJobWorkers(ctx context.Context, workers int) {
+	c.handler.StartJobWorkers(ctx, workers)
+}
+
+// StartServerlessJobWorkers sets up generation jobs for a serverless function
+func (c *AIGenerateController) StartServerlessJobWorkers(ctx context.Context) {
+	c.handler.StartServerlessJobWorkers(ctx)
+}
+
+// GetGenerateCardsStreamHandler returns the streaming handler function for external use
+func (c *AIGenerateController) GetGenerateCardsStreamHandler() gin.HandlerFunc {
+	return c.handler.GenerateCardsStream
+}
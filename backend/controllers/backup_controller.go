@@ -0,0 +1,22 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/handlers"
+	"gorm.io/gorm"
+)
+
+type BackupController struct {
+	handler *handlers.BackupHandler
+}
+
+func NewBackupController(db *gorm.DB) *BackupController {
+	return &BackupController{
+		handler: handlers.NewBackupHandler(db),
+	}
+}
+
+func (c *BackupController) RegisterRoutes(api *gin.RouterGroup) {
+	api.GET("/backup", c.handler.Backup)
+	api.POST("/backup/restore", c.handler.Restore)
+}
@@ -19,7 +19,12 @@ func NewCardController(db *gorm.DB) *CardController {
 func (c *CardController) RegisterRoutes(api *gin.RouterGroup) {
 	api.POST("/decks/:deckId/cards", c.handler.CreateCard)
 	api.GET("/decks/:deckId/cards", c.handler.ListCards)
+	api.GET("/cards/:cardId", c.handler.GetCard)
 	api.PUT("/cards/:cardId", c.handler.UpdateCard)
+	api.PATCH("/cards/:cardId", c.handler.PatchCard)
+	api.POST("/decks/:deckId/cards/bulk_update", c.handler.BulkUpdateCards)
+	api.GET("/cards/:cardId/revisions", c.handler.ListRevisions)
+	api.POST("/cards/:cardId/revisions/:revisionId/revert", c.handler.RevertCard)
 	api.DELETE("/cards/:cardId", c.handler.DeleteCard)
 	api.POST("/cards/:cardId/learning", c.handler.RecordLearning)
 	api.POST("/decks/:deckId/cards/:cardId/answer", c.handler.RecordAnswer)
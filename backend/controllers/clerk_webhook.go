@@ -2,21 +2,33 @@ package controllers
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"log"
 	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
 	svix "github.com/svix/svix-webhooks/go"
 	"gorm.io/gorm"
 )
 
 type ClerkWebhookHandler struct {
-	db *gorm.DB
+	db             *gorm.DB
+	accountService *services.AccountService
 }
 
 func NewClerkWebhookHandler(db *gorm.DB) *ClerkWebhookHandler {
-	return &ClerkWebhookHandler{db: db}
+	return NewClerkWebhookHandlerWithAccountService(db, services.NewAccountService(db, services.NewMediaStorageFromEnv()))
+}
+
+// NewClerkWebhookHandlerWithAccountService creates the handler with the given account service
+func NewClerkWebhookHandlerWithAccountService(db *gorm.DB, accountService *services.AccountService) *ClerkWebhookHandler {
+	return &ClerkWebhookHandler{
+		db:             db,
+		accountService: accountService,
+	}
 }
 
 func (h *ClerkWebhookHandler) Handle(ctx *gin.Context) {
@@ -51,14 +63,8 @@ func (h *ClerkWebhookHandler) Handle(ctx *gin.Context) {
 	ctx.Request.Body = io.NopCloser(bytes.NewBuffer(payload))
 
 	var event struct {
-		Type string `json:"type"`
-		Data struct {
-			ID             string `json:"id"`
-			EmailAddresses []struct {
-				EmailAddress string `json:"email_address"`
-			} `json:"email_addresses"`
-			FirstName string `json:"first_name"`
-		} `json:"data"`
+		Type string        `json:"type"`
+		Data clerkUserData `json:"data"`
 	}
 
 	if err := ctx.ShouldBindJSON(&event); err != nil {
@@ -66,27 +72,86 @@ func (h *ClerkWebhookHandler) Handle(ctx *gin.Context) {
 		return
 	}
 
-	if event.Type == "user.created" {
+	if event.Type == "user.created" || event.Type == "user.updated" {
+		email := event.Data.primaryEmail()
 		// メールアドレスがない場合はスキップ
-		if len(event.Data.EmailAddresses) == 0 {
+		if email == "" {
 			ctx.JSON(400, gin.H{"error": "No email address provided"})
 			return
 		}
 
-		user := models.User{
-			Email:   event.Data.EmailAddresses[0].EmailAddress,
-			Name:    event.Data.FirstName,
+		_, created, err := services.UpsertClerkUser(h.db, services.ClerkProfile{
 			ClerkID: event.Data.ID,
+			Email:   email,
+			Name:    event.Data.FirstName,
+		})
+		if errors.Is(err, services.ErrEmailInUse) {
+			// 再送しても解決しないため受信済みとして応答する。
+			// 古いユーザーのメールアドレスは、このユーザーの初回リクエストで解放される
+			log.Printf("Skipped %s of Clerk user %s: %v", event.Type, event.Data.ID, err)
+			ctx.JSON(200, gin.H{"message": "Email is already used by another user"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		if created {
+			ctx.JSON(200, gin.H{"message": "User created successfully"})
+		} else {
+			ctx.JSON(200, gin.H{"message": "User updated successfully"})
+		}
+		return
+	}
+
+	if event.Type == "user.deleted" {
+		var user models.User
+		err := h.db.Where("clerk_id = ?", event.Data.ID).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// 作成前または削除済みのユーザー（再送を含む）
+			ctx.JSON(200, gin.H{"message": "User not found"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": err.Error()})
+			return
 		}
 
-		if err := h.db.Create(&user).Error; err != nil {
+		if err := h.accountService.DeleteAccount(ctx.Request.Context(), &user); err != nil {
+			log.Printf("Failed to delete data of user %d: %v", user.ID, err)
 			ctx.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
 
-		ctx.JSON(200, gin.H{"message": "User created successfully"})
+		ctx.JSON(200, gin.H{"message": "User deleted successfully"})
 		return
 	}
 
 	ctx.JSON(200, gin.H{"message": "Event processed"})
 }
+
+// clerkUserData is the user object of Clerk user events
+type clerkUserData struct {
+	ID                    string `json:"id"`
+	PrimaryEmailAddressID string `json:"primary_email_address_id"`
+	EmailAddresses        []struct {
+		ID           string `json:"id"`
+		EmailAddress string `json:"email_address"`
+	} `json:"email_addresses"`
+	FirstName string `json:"first_name"`
+}
+
+// primaryEmail returns the primary email address, falling back to the first
+// one for payloads without primary_email_address_id
+func (d *clerkUserData) primaryEmail() string {
+	for _, address := range d.EmailAddresses {
+		if address.ID != "" && address.ID == d.PrimaryEmailAddressID {
+			return address.EmailAddress
+		}
+	}
+	if len(d.EmailAddresses) > 0 {
+		return d.EmailAddresses[0].EmailAddress
+	}
+	return ""
+}
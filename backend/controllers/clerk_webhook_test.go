@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	svix "github.com/svix/svix-webhooks/go"
+)
+
+var clerkTestSecret = "whsec_" + base64.StdEncoding.EncodeToString([]byte("clerk-webhook-test-secret"))
+
+// postClerkEvent sends a webhook event signed like Clerk (Svix) does
+func postClerkEvent(t *testing.T, r *gin.Engine, event any) *httptest.ResponseRecorder {
+	payload, err := json.Marshal(event)
+	require.NoError(t, err)
+
+	wh, err := svix.NewWebhook(clerkTestSecret)
+	require.NoError(t, err)
+	now := time.Now()
+	signature, err := wh.Sign("msg_test", now, payload)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("svix-id", "msg_test")
+	req.Header.Set("svix-timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("svix-signature", signature)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestClerkWebhookUserDeleted(t *testing.T) {
+	t.Setenv("CLERK_WEBHOOK_SECRET", clerkTestSecret)
+	t.Setenv("MEDIA_STORAGE_DIR", t.TempDir())
+
+	db, cleanup := test.SetupTestDB()
+	defer cleanup()
+
+	storage := services.NewMediaStorageFromEnv()
+	canceler := &test.FakeSubscriptionCanceler{}
+	r := test.SetupRouter()
+	r.POST("/webhook", NewClerkWebhookHandlerWithAccountService(db, services.NewAccountServiceWithCanceler(db, storage, canceler)).Handle)
+
+	user := test.CreateTestUser(db)
+	other := &models.User{ClerkID: "other_clerk_id", Email: "other@example.com", Name: "Other"}
+	require.NoError(t, db.Create(other).Error)
+
+	deck := &models.Deck{UserID: user.ID, Title: "Deck"}
+	require.NoError(t, db.Create(deck).Error)
+	card := &models.Card{DeckID: deck.ID, Front: "front", Back: "back"}
+	require.NoError(t, services.CreateBasicCard(db, user.ID, card))
+	require.NoError(t, db.Model(card).Association("Tags").Append(&models.Tag{UserID: user.ID, Name: "tag"}))
+	require.NoError(t, db.Create(&models.AnswerRecord{UserID: user.ID, DeckID: deck.ID, CardID: card.ID, AnswerDate: time.Now()}).Error)
+	require.NoError(t, db.Create(&models.CardRevision{CardID: card.ID, UserID: user.ID, Front: "old", Back: "old", Source: "manual"}).Error)
+	require.NoError(t, db.Create(&models.Subscription{
+		UserID: user.ID, Email: user.Email, StripeSubscriptionID: "sub_1", StripeCustomerID: "cus_1",
+		Status: "active", PlanType: "basic", CurrentPeriodStart: time.Now(), CurrentPeriodEnd: time.Now(),
+	}).Error)
+
+	media := &models.Media{UserID: user.ID, CardID: &card.ID, Filename: "a.png", MimeType: "image/png", Size: 1}
+	require.NoError(t, services.NewMediaService(db, storage).Attach(context.Background(), media, strings.NewReader("x")))
+
+	otherDeck := &models.Deck{UserID: other.ID, Title: "Kept"}
+	require.NoError(t, db.Create(otherDeck).Error)
+
+	event := map[string]any{"type": "user.deleted", "data": map[string]any{"id": user.ClerkID, "deleted": true}}
+
+	t.Run("サブスクリプションを解約できなければ何も削除しない", func(t *testing.T) {
+		canceler.Err = errors.New("stripe unavailable")
+		defer func() { canceler.Err = nil }()
+
+		w := postClerkEvent(t, r, event)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+		var decks int64
+		db.Model(&models.Deck{}).Where("user_id = ?", user.ID).Count(&decks)
+		assert.Equal(t, int64(1), decks)
+		require.NoError(t, db.First(&models.User{}, user.ID).Error)
+	})
+
+	t.Run("所有データを削除しユーザーを匿名化する", func(t *testing.T) {
+		w := postClerkEvent(t, r, event)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		for _, model := range []any{
+			&models.Deck{}, &models.Note{}, &models.Tag{}, &models.AnswerRecord{}, &models.Media{},
+		} {
+			var count int64
+			require.NoError(t, db.Unscoped().Model(model).Where("user_id = ?", user.ID).Count(&count).Error)
+			assert.Zero(t, count, "%T", model)
+		}
+
+		var cards, revisions, cardTags int64
+		db.Unscoped().Model(&models.Card{}).Where("id = ?", card.ID).Count(&cards)
+		db.Unscoped().Model(&models.CardRevision{}).Where("card_id = ?", card.ID).Count(&revisions)
+		db.Table("card_tags").Where("card_id = ?", card.ID).Count(&cardTags)
+		assert.Zero(t, cards)
+		assert.Zero(t, revisions)
+		assert.Zero(t, cardTags)
+
+		_, err := storage.Open(context.Background(), media.StorageKey)
+		assert.ErrorIs(t, err, services.ErrMediaNotFound)
+
+		var deleted models.User
+		require.NoError(t, db.Unscoped().First(&deleted, user.ID).Error)
+		assert.True(t, deleted.DeletedAt.Valid)
+		assert.NotEqual(t, user.Email, deleted.Email)
+		assert.NotEqual(t, user.ClerkID, deleted.ClerkID)
+		assert.Empty(t, deleted.Name)
+
+		var subscription models.Subscription
+		require.NoError(t, db.Unscoped().Where("stripe_subscription_id = ?", "sub_1").First(&subscription).Error)
+		assert.True(t, subscription.DeletedAt.Valid)
+		assert.NotEqual(t, user.Email, subscription.Email)
+		assert.Equal(t, "canceled", subscription.Status)
+		assert.Equal(t, []string{"sub_1"}, canceler.Canceled)
+
+		var kept int64
+		db.Model(&models.Deck{}).Where("user_id = ?", other.ID).Count(&kept)
+		assert.Equal(t, int64(1), kept)
+	})
+
+	t.Run("再送されても成功する", func(t *testing.T) {
+		w := postClerkEvent(t, r, event)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, canceler.Canceled, 1)
+	})
+
+	t.Run("署名が不正な場合は処理しない", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/webhook", strings.NewReader(`{"type":"user.deleted","data":{"id":"other_clerk_id"}}`))
+		req.Header.Set("svix-id", "msg_test")
+		req.Header.Set("svix-timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+		req.Header.Set("svix-signature", "v1,invalid")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		var count int64
+		db.Model(&models.User{}).Where("id = ?", other.ID).Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+}
+
+func clerkUserEvent(eventType, clerkID, firstName, primaryID string, emails map[string]string) map[string]any {
+	addresses := []map[string]string{}
+	for _, id := range []string{"idn_1", "idn_2"} {
+		if email, ok := emails[id]; ok {
+			addresses = append(addresses, map[string]string{"id": id, "email_address": email})
+		}
+	}
+	return map[string]any{
+		"type": eventType,
+		"data": map[string]any{
+			"id":                       clerkID,
+			"first_name":               firstName,
+			"primary_email_address_id": primaryID,
+			"email_addresses":          addresses,
+		},
+	}
+}
+
+func TestClerkWebhookUserSync(t *testing.T) {
+	t.Setenv("CLERK_WEBHOOK_SECRET", clerkTestSecret)
+
+	db, cleanup := test.SetupTestDB()
+	defer cleanup()
+
+	r := test.SetupRouter()
+	r.POST("/webhook", NewClerkWebhookHandler(db).Handle)
+
+	created := clerkUserEvent("user.created", "user_sync", "Taro", "idn_1", map[string]string{"idn_1": "taro@example.com"})
+
+	t.Run("user.created でユーザーを作成する", func(t *testing.T) {
+		w := postClerkEvent(t, r, created)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var user models.User
+		require.NoError(t, db.Where("clerk_id = ?", "user_sync").First(&user).Error)
+		assert.Equal(t, "taro@example.com", user.Email)
+		assert.Equal(t, "Taro", user.Name)
+	})
+
+	t.Run("user.created の再送は失敗しない", func(t *testing.T) {
+		w := postClerkEvent(t, r, created)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var count int64
+		db.Model(&models.User{}).Where("clerk_id = ?", "user_sync").Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("user.updated でプライマリのメールアドレスと名前を反映する", func(t *testing.T) {
+		w := postClerkEvent(t, r, clerkUserEvent("user.updated", "user_sync", "Taro Y", "idn_2", map[string]string{
+			"idn_1": "taro@example.com",
+			"idn_2": "new@example.com",
+		}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var user models.User
+		require.NoError(t, db.Where("clerk_id = ?", "user_sync").First(&user).Error)
+		assert.Equal(t, "new@example.com", user.Email)
+		assert.Equal(t, "Taro Y", user.Name)
+	})
+
+	t.Run("未登録のユーザーの user.updated は作成として扱う", func(t *testing.T) {
+		w := postClerkEvent(t, r, clerkUserEvent("user.updated", "user_late", "Hanako", "idn_1", map[string]string{"idn_1": "hanako@example.com"}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var count int64
+		db.Model(&models.User{}).Where("clerk_id = ?", "user_late").Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("他のユーザーのメールアドレスには変更せず再送させない", func(t *testing.T) {
+		w := postClerkEvent(t, r, clerkUserEvent("user.updated", "user_late", "Hanako", "idn_1", map[string]string{"idn_1": "new@example.com"}))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "already used")
+
+		var user models.User
+		require.NoError(t, db.Where("clerk_id = ?", "user_late").First(&user).Error)
+		assert.Equal(t, "hanako@example.com", user.Email)
+	})
+
+	t.Run("メールアドレスがない", func(t *testing.T) {
+		w := postClerkEvent(t, r, clerkUserEvent("user.created", "user_none", "", "", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
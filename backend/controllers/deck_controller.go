@@ -21,6 +21,7 @@ func (c *DeckController) RegisterRoutes(api *gin.RouterGroup) {
 	api.GET("/decks", c.handler.List)
 	api.GET("/decks/:deckId", c.handler.Get)
 	api.PUT("/decks/:deckId", c.handler.Update)
+	api.PATCH("/decks/:deckId", c.handler.Patch)
 	api.DELETE("/decks/:deckId", c.handler.Delete)
 	api.GET("/decks/:deckId/stats", c.handler.GetStats)
 }
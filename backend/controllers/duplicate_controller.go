@@ -0,0 +1,22 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/handlers"
+	"gorm.io/gorm"
+)
+
+type DuplicateController struct {
+	handler *handlers.DuplicateHandler
+}
+
+func NewDuplicateController(db *gorm.DB) *DuplicateController {
+	return &DuplicateController{
+		handler: handlers.NewDuplicateHandler(db),
+	}
+}
+
+func (c *DuplicateController) RegisterRoutes(api *gin.RouterGroup) {
+	api.GET("/duplicates", c.handler.Report)
+	api.GET("/decks/:deckId/duplicates", c.handler.DeckReport)
+}
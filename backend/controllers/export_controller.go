@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/handlers"
+	"gorm.io/gorm"
+)
+
+type ExportController struct {
+	handler *handlers.ExportHandler
+}
+
+func NewExportController(db *gorm.DB) *ExportController {
+	return &ExportController{
+		handler: handlers.NewExportHandler(db),
+	}
+}
+
+func (c *ExportController) RegisterRoutes(api *gin.RouterGroup) {
+	api.GET("/decks/:deckId/export/anki", c.handler.ExportDeckAnki)
+	api.GET("/export/anki", c.handler.ExportAllAnki)
+	api.GET("/decks/:deckId/export/cards", c.handler.ExportDeckCards)
+	api.GET("/export/history", c.handler.ExportHistory)
+}
@@ -0,0 +1,22 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/handlers"
+	"gorm.io/gorm"
+)
+
+type ImportController struct {
+	handler *handlers.ImportHandler
+}
+
+func NewImportController(db *gorm.DB) *ImportController {
+	return &ImportController{
+		handler: handlers.NewImportHandler(db),
+	}
+}
+
+func (c *ImportController) RegisterRoutes(api *gin.RouterGroup) {
+	api.POST("/import/anki", c.handler.ImportAnki)
+	api.POST("/import/csv", c.handler.ImportCSV)
+}
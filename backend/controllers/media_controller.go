@@ -0,0 +1,23 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/handlers"
+	"gorm.io/gorm"
+)
+
+type MediaController struct {
+	handler *handlers.MediaHandler
+}
+
+func NewMediaController(db *gorm.DB) *MediaController {
+	return &MediaController{
+		handler: handlers.NewMediaHandler(db),
+	}
+}
+
+func (c *MediaController) RegisterRoutes(api *gin.RouterGroup) {
+	api.POST("/cards/:cardId/media", c.handler.Upload)
+	api.GET("/media/:mediaId", c.handler.Serve)
+	api.DELETE("/media/:mediaId", c.handler.Delete)
+}
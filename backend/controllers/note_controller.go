@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/handlers"
+	"gorm.io/gorm"
+)
+
+type NoteController struct {
+	handler *handlers.NoteHandler
+}
+
+func NewNoteController(db *gorm.DB) *NoteController {
+	return &NoteController{
+		handler: handlers.NewNoteHandler(db),
+	}
+}
+
+func (c *NoteController) RegisterRoutes(api *gin.RouterGroup) {
+	api.GET("/note_types", c.handler.ListNoteTypes)
+	api.POST("/note_types", c.handler.CreateNoteType)
+	api.GET("/note_types/:noteTypeId", c.handler.GetNoteType)
+	api.PUT("/note_types/:noteTypeId", c.handler.UpdateNoteType)
+	api.DELETE("/note_types/:noteTypeId", c.handler.DeleteNoteType)
+	api.POST("/decks/:deckId/notes", c.handler.CreateNote)
+	api.GET("/decks/:deckId/notes", c.handler.ListNotes)
+	api.GET("/notes/:noteId", c.handler.GetNote)
+	api.PUT("/notes/:noteId", c.handler.UpdateNote)
+	api.DELETE("/notes/:noteId", c.handler.DeleteNote)
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"gorm.io/gorm"
+)
+
+type AccountHandler struct {
+	BaseHandler
+	accountService *services.AccountService
+}
+
+func NewAccountHandler(db *gorm.DB) *AccountHandler {
+	return &AccountHandler{
+		BaseHandler:    BaseHandler{db: db},
+		accountService: services.NewAccountService(db, services.NewMediaStorageFromEnv()),
+	}
+}
+
+// DownloadData downloads all personal data of the user as a zip of JSON
+// files and media
+func (h *AccountHandler) DownloadData(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	name := fmt.Sprintf("flashcards-data-%s", time.Now().UTC().Format("20060102"))
+	writeAttachmentHeader(ctx, "application/zip", name, "zip")
+	if err := h.accountService.ExportData(ctx.Request.Context(), user, ctx.Writer); err != nil {
+		// ヘッダーは送信済みのため、ログに残して接続を打ち切る
+		log.Printf("Failed to export account data: %v", err)
+		ctx.Abort()
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadAccountData(t *testing.T) {
+	t.Setenv("MEDIA_STORAGE_DIR", t.TempDir())
+
+	db, cleanup := test.SetupTestDB()
+	defer cleanup()
+
+	user := test.CreateTestUser(db)
+	deck := test.CreateTestDeck(db, user.ID)
+	require.NoError(t, services.CreateBasicCard(db, user.ID, &models.Card{DeckID: deck.ID, Front: "front", Back: "back"}))
+	require.NoError(t, db.Create(&models.Subscription{
+		UserID: user.ID, Email: user.Email, StripeSubscriptionID: "sub_1", StripeCustomerID: "cus_1",
+		Status: "active", PlanType: "premium", CurrentPeriodStart: time.Now(), CurrentPeriodEnd: time.Now(),
+	}).Error)
+
+	handler := NewAccountHandler(db)
+	r := test.SetupRouter()
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(user.ClerkID))
+	api.GET("/account/data", handler.DownloadData)
+
+	req, _ := http.NewRequest("GET", "/api/account/data", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	require.Contains(t, files, "manifest.json")
+	require.Contains(t, files, "data.json")
+	require.Contains(t, files, "account.json")
+
+	var account services.AccountData
+	require.NoError(t, json.Unmarshal(files["account.json"], &account))
+	assert.Equal(t, user.Email, account.Email)
+	require.Len(t, account.Subscriptions, 1)
+	assert.Equal(t, "premium", account.Subscriptions[0].PlanType)
+
+	var data struct {
+		Cards []models.Card `json:"cards"`
+	}
+	require.NoError(t, json.Unmarshal(files["data.json"], &data))
+	require.Len(t, data.Cards, 1)
+	assert.Equal(t, "front", data.Cards[0].Front)
+}
@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/muratayousuke/ai-flashcards/services"
+)
+
+// Limits of a single model call. Larger requests are split into chunks that
+// are generated concurrently and merged into one deck.
+const (
+	maxCardsPerChunk    = 20   // 出力トークンの上限に収まるカード数
+	maxChunkSourceRunes = 6000 // 1回に送る入力テキストの文字数
+	chunkWorkers        = 3    // 同時に生成するチャンク数
+)
+
+// 分割生成の場合にプロンプトへ追加する指示
+const (
+	chunkSegmentInstruction = `
+
+これは長い入力を%d個に分割したうちの%d番目の部分です。この部分に書かれている内容のみからカードを作成してください。`
+
+	chunkBatchInstruction = `
+
+これは全%d回に分けた生成の%d回目です。他の回とカードが重複しないよう、内容を%d等分した%d番目の部分を中心にカードを作成してください。`
+)
+
+// chunkGenerator generates the deck information of one chunk
+type chunkGenerator func(ctx context.Context, chunk *generationInput) (*GeneratedDeckInfo, error)
+
+// generateInChunks generates a request that fits a single model call as is.
+// Larger requests are split by planChunks, generated by a bounded number of
+// workers and merged into one deck without duplicate cards. The first
+// failing chunk cancels the others.
+func (h *AIGenerateHandler) generateInChunks(ctx context.Context, input *generationInput, generate chunkGenerator) (*GeneratedDeckInfo, error) {
+	chunks := planChunks(input)
+	if len(chunks) == 1 {
+		return generate(ctx, chunks[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// 並行するチャンクの出力はストリームに流さず、完了したチャンクごとにまとめて送る
+	stream := generationStreamFrom(ctx)
+	chunkCtx := withGenerationStream(ctx, nil)
+
+	var (
+		wg       sync.WaitGroup
+		failOnce sync.Once
+		firstErr error
+	)
+	results := make([]*GeneratedDeckInfo, len(chunks))
+	workers := make(chan struct{}, chunkWorkers)
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case workers <- struct{}{}:
+				defer func() { <-workers }()
+			case <-ctx.Done():
+				return
+			}
+
+			deckInfo, err := generate(chunkCtx, chunk)
+			if err != nil {
+				failOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = deckInfo
+			if stream != nil {
+				stream.add(deckInfo)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	merged := h.mergeChunks(results, input.MaxCards)
+	if stream != nil {
+		stream.progress(streamStageSaving)
+	}
+	return merged, nil
+}
+
+// mergeChunks joins the chunk results in order and keeps at most maxCards
+// cards. Cards repeating an earlier front are dropped, as are near-duplicates
+// of a card from another chunk. Similar cards of the same chunk were made
+// distinct by the model and are kept.
+func (h *AIGenerateHandler) mergeChunks(results []*GeneratedDeckInfo, maxCards int) *GeneratedDeckInfo {
+	index := h.detector.NewEmptyIndex()
+
+	merged := &GeneratedDeckInfo{}
+	for i, result := range results {
+		if merged.Title == "" {
+			merged.Title = result.Title
+			merged.Description = result.Description
+		}
+		// インデックスのデッキIDにはチャンクの番号を入れる
+		chunk := uint(i + 1)
+		for _, card := range result.Cards {
+			if len(merged.Cards) >= maxCards {
+				return merged
+			}
+			if isChunkDuplicate(index.Match(card.Front), chunk) {
+				continue
+			}
+			index.Add(0, chunk, card.Front)
+			merged.Cards = append(merged.Cards, card)
+		}
+	}
+	return merged
+}
+
+func isChunkDuplicate(matches []services.DuplicateMatch, chunk uint) bool {
+	for _, match := range matches {
+		if match.Exact || match.DeckID != chunk {
+			return true
+		}
+	}
+	return false
+}
+
+// planChunks splits a request into the model calls that generate it. Long
+// text, documents and subtitles are split into source segments, and the
+// cards of each segment into batches of at most maxCardsPerChunk. Each chunk
+// is a copy of the input with the part of the work it covers; the segment of
+// a document or subtitle chunk is its page text or cue lines in Prompt.
+func planChunks(input *generationInput) []*generationInput {
+	var split func(size int) []string
+	switch input.Type {
+	case "text", "html":
+		split = func(size int) []string { return splitSource(input.Prompt, size) }
+	case "document":
+		split = func(size int) []string { return splitDocument(input.Pages, size) }
+	case "subtitles":
+		split = func(size int) []string { return splitSubtitles(input.Cues, size) }
+	}
+
+	segments := []string{input.Prompt}
+	if split != nil {
+		// カード数より部分が多くならないよう、必要なら1部分あたりの文字数を増やす
+		size := maxChunkSourceRunes
+		segments = split(size)
+		for len(segments) > max(input.MaxCards, 1) {
+			size *= 2
+			segments = split(size)
+		}
+	}
+
+	counts := distributeCards(input.MaxCards, segments)
+	var chunks []*generationInput
+	for i, segment := range segments {
+		batches := max((counts[i]+maxCardsPerChunk-1)/maxCardsPerChunk, 1)
+		for b := 0; b < batches; b++ {
+			chunk := *input
+			chunk.Prompt = segment
+			chunk.MaxCards = counts[i]*(b+1)/batches - counts[i]*b/batches
+			if len(segments) > 1 {
+				chunk.chunkInstruction += fmt.Sprintf(chunkSegmentInstruction, len(segments), i+1)
+			}
+			if batches > 1 {
+				chunk.chunkInstruction += fmt.Sprintf(chunkBatchInstruction, batches, b+1, batches, b+1)
+			}
+			chunks = append(chunks, &chunk)
+		}
+	}
+	return chunks
+}
+
+// distributeCards shares total cards among the segments in proportion to
+// their length, giving each segment at least one card
+func distributeCards(total int, segments []string) []int {
+	counts := make([]int, len(segments))
+	if len(segments) == 1 {
+		counts[0] = total
+		return counts
+	}
+
+	var totalRunes, cumulative int
+	for _, segment := range segments {
+		totalRunes += utf8.RuneCountInString(segment)
+	}
+	extra := total - len(segments)
+
+	assigned := 0
+	for i, segment := range segments {
+		cumulative += utf8.RuneCountInString(segment)
+		target := i + 1 + extra*cumulative/max(totalRunes, 1)
+		if i == len(segments)-1 {
+			target = total
+		}
+		counts[i] = target - assigned
+		assigned = target
+	}
+	return counts
+}
+
+// splitDocument splits the pages of a document into segments of about size
+// runes. Segments break between pages where possible, and every part of a
+// page keeps its page marker.
+func splitDocument(pages []services.DocumentPage, size int) []string {
+	var (
+		segments []string
+		current  strings.Builder
+		runes    int
+	)
+	flush := func() {
+		if segment := strings.TrimSpace(current.String()); segment != "" {
+			segments = append(segments, segment)
+		}
+		current.Reset()
+		runes = 0
+	}
+
+	for _, page := range pages {
+		if page.Text == "" {
+			continue
+		}
+		for _, part := range splitSource(page.Text, size) {
+			block := formatDocumentPages([]services.DocumentPage{{Number: page.Number, Text: part}}) + "\n\n"
+			n := utf8.RuneCountInString(block)
+			if runes > 0 && runes+n > size {
+				flush()
+			}
+			current.WriteString(block)
+			runes += n
+		}
+	}
+	flush()
+
+	// テキストのないPDFは添付ファイルのみから生成する
+	if len(segments) == 0 {
+		return []string{""}
+	}
+	return segments
+}
+
+// splitSubtitles splits the cues of subtitles into segments of about size
+// runes, breaking between cues
+func splitSubtitles(cues []services.SubtitleCue, size int) []string {
+	var (
+		segments []string
+		current  []services.SubtitleCue
+		runes    int
+	)
+	flush := func() {
+		if len(current) > 0 {
+			segments = append(segments, formatSubtitleCues(current))
+		}
+		current = nil
+		runes = 0
+	}
+
+	for _, cue := range cues {
+		n := utf8.RuneCountInString(formatSubtitleCues([]services.SubtitleCue{cue})) + 1
+		if runes > 0 && runes+n > size {
+			flush()
+		}
+		current = append(current, cue)
+		runes += n
+	}
+	flush()
+
+	if len(segments) == 0 {
+		return []string{""}
+	}
+	return segments
+}
+
+// splitSource splits text into segments of at most size runes, breaking at
+// paragraphs where possible, then at the ends of sentences and only then
+// in the middle of a sentence
+func splitSource(text string, size int) []string {
+	if utf8.RuneCountInString(text) <= size {
+		return []string{text}
+	}
+
+	var (
+		segments []string
+		current  strings.Builder
+		runes    int
+	)
+	flush := func() {
+		if segment := strings.TrimSpace(current.String()); segment != "" {
+			segments = append(segments, segment)
+		}
+		current.Reset()
+		runes = 0
+	}
+
+	for _, piece := range sourcePieces(text, size) {
+		n := utf8.RuneCountInString(piece)
+		if runes > 0 && runes+n > size {
+			flush()
+		}
+		current.WriteString(piece)
+		runes += n
+	}
+	flush()
+	return segments
+}
+
+// sourcePieces splits text into paragraphs, and paragraphs longer than size
+// into sentences and then into pieces of size runes. Joining the pieces
+// gives back the text.
+func sourcePieces(text string, size int) []string {
+	var pieces []string
+	for _, paragraph := range strings.SplitAfter(text, "\n\n") {
+		if utf8.RuneCountInString(paragraph) <= size {
+			pieces = append(pieces, paragraph)
+			continue
+		}
+		for _, sentence := range splitSentences(paragraph) {
+			for utf8.RuneCountInString(sentence) > size {
+				cut := len(string([]rune(sentence)[:size]))
+				pieces = append(pieces, sentence[:cut])
+				sentence = sentence[cut:]
+			}
+			pieces = append(pieces, sentence)
+		}
+	}
+	return pieces
+}
+
+// splitSentences splits text after sentence-ending punctuation and line breaks
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	runes := []rune(text)
+	offset := 0
+	for i, r := range runes {
+		offset += utf8.RuneLen(r)
+		end := false
+		switch r {
+		case '。', '！', '？', '\n':
+			end = true
+		case '.', '!', '?':
+			// 小数点などで区切らないよう、空白が続く場合のみ文末とみなす
+			end = i+1 < len(runes) && unicode.IsSpace(runes[i+1])
+		}
+		if end {
+			sentences = append(sentences, text[start:offset])
+			start = offset
+		}
+	}
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+	return sentences
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSource(t *testing.T) {
+	t.Run("短いテキストは分割しない", func(t *testing.T) {
+		assert.Equal(t, []string{"光合成"}, splitSource("光合成", 10))
+	})
+
+	t.Run("段落の区切りで分割する", func(t *testing.T) {
+		text := "一段落目です。\n\n二段落目です。\n\n三段落目です。"
+		assert.Equal(t, []string{"一段落目です。", "二段落目です。", "三段落目です。"}, splitSource(text, 10))
+	})
+
+	t.Run("長い段落は文末で分割する", func(t *testing.T) {
+		text := "最初の文です。次の文です。Third sentence. 3.14 is pi."
+		segments := splitSource(text, 16)
+		assert.Equal(t, []string{"最初の文です。次の文です。", "Third sentence.", "3.14 is pi."}, segments)
+	})
+
+	t.Run("区切りのない文は文字数で分割する", func(t *testing.T) {
+		text := strings.Repeat("あ", 25)
+		segments := splitSource(text, 10)
+		require.Len(t, segments, 3)
+		assert.Equal(t, strings.Repeat("あ", 10), segments[0])
+		assert.Equal(t, strings.Repeat("あ", 5), segments[2])
+	})
+}
+
+func TestPlanChunks(t *testing.T) {
+	t.Run("少ないカード数は1回で生成する", func(t *testing.T) {
+		chunks := planChunks(&generationInput{Type: "text", Prompt: "光合成", MaxCards: 20})
+		require.Len(t, chunks, 1)
+		assert.Equal(t, 20, chunks[0].MaxCards)
+		assert.Empty(t, chunks[0].chunkInstruction)
+	})
+
+	t.Run("多いカード数は均等なバッチに分ける", func(t *testing.T) {
+		chunks := planChunks(&generationInput{Type: "image", MaxCards: 45})
+		require.Len(t, chunks, 3)
+		for i, chunk := range chunks {
+			assert.Equal(t, 15, chunk.MaxCards)
+			assert.Contains(t, chunk.chunkInstruction, fmt.Sprintf("全3回に分けた生成の%d回目", i+1))
+		}
+	})
+
+	t.Run("長いテキストは部分ごとに文字数に応じたカード数で生成する", func(t *testing.T) {
+		long := strings.Repeat("長い段落の文章です。", maxChunkSourceRunes/10)
+		text := long + "\n\n" + long + "\n\n短い段落です。"
+		chunks := planChunks(&generationInput{Type: "text", Prompt: text, MaxCards: 30})
+		require.Len(t, chunks, 3)
+
+		total := 0
+		for i, chunk := range chunks {
+			assert.LessOrEqual(t, len([]rune(chunk.Prompt)), maxChunkSourceRunes)
+			assert.Contains(t, chunk.chunkInstruction, fmt.Sprintf("3個に分割したうちの%d番目", i+1))
+			total += chunk.MaxCards
+		}
+		assert.Equal(t, 30, total)
+		assert.Greater(t, chunks[0].MaxCards, chunks[2].MaxCards)
+	})
+
+	t.Run("文書はページの区切りで分割しページ番号を付ける", func(t *testing.T) {
+		long := strings.Repeat("文", maxChunkSourceRunes-100)
+		pages := []services.DocumentPage{{Number: 1, Text: "表紙"}, {Number: 2, Text: ""}, {Number: 3, Text: long + "\n\n" + long}}
+		chunks := planChunks(&generationInput{Type: "document", Pages: pages, MaxCards: 10})
+		require.Len(t, chunks, 2)
+		assert.Equal(t, "[p.1]\n表紙\n\n[p.3]\n"+long, chunks[0].Prompt)
+		assert.Equal(t, "[p.3]\n"+long, chunks[1].Prompt)
+		assert.Equal(t, 10, chunks[0].MaxCards+chunks[1].MaxCards)
+	})
+
+	t.Run("字幕はキューの区切りで分割する", func(t *testing.T) {
+		line := strings.Repeat("字", 990)
+		var cues []services.SubtitleCue
+		for i := 1; i <= 8; i++ {
+			cues = append(cues, services.SubtitleCue{Index: i, Start: time.Duration(i) * time.Minute, Text: line})
+		}
+		chunks := planChunks(&generationInput{Type: "subtitles", Cues: cues, MaxCards: 8})
+		require.Len(t, chunks, 2)
+		assert.True(t, strings.HasPrefix(chunks[0].Prompt, "[1 00:01:00] "+line+"\n[2 00:02:00] "))
+		assert.True(t, strings.HasPrefix(chunks[1].Prompt, "[6 00:06:00] "))
+		assert.Equal(t, 8, chunks[0].MaxCards+chunks[1].MaxCards)
+	})
+
+	t.Run("カード数より多い部分には分けない", func(t *testing.T) {
+		text := strings.Repeat(strings.Repeat("文", maxChunkSourceRunes-10)+"\n\n", 4)
+		chunks := planChunks(&generationInput{Type: "text", Prompt: text, MaxCards: 2})
+		require.Len(t, chunks, 2)
+		assert.Equal(t, 1, chunks[0].MaxCards)
+		assert.Equal(t, 1, chunks[1].MaxCards)
+	})
+}
+
+func TestGenerateInChunks(t *testing.T) {
+	t.Run("チャンクの結果を重複なく1つのデッキにまとめる", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Responses: []string{
+			`{"title": "光合成", "description": "説明", "cards": [{"front": "光合成とは", "back": "A"}]}`,
+			`{"title": "光合成", "description": "説明", "cards": [{"front": "光合成とは？", "back": "A"}, {"front": "呼吸とは", "back": "B"}]}`,
+			`{"title": "光合成", "description": "説明", "cards": [{"front": "葉緑体とは", "back": "C"}]}`,
+		}}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成", "maxCards": "45"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Len(t, llm.Prompts(), 3)
+
+		var decks []models.Deck
+		require.NoError(t, db.Where("user_id = ?", user.ID).Find(&decks).Error)
+		require.Len(t, decks, 1)
+		assert.Equal(t, "光合成", decks[0].Title)
+
+		var fronts []string
+		require.NoError(t, db.Model(&models.Card{}).Where("deck_id = ?", decks[0].ID).Pluck("front", &fronts).Error)
+		assert.Len(t, fronts, 3)
+		assert.Contains(t, fronts, "呼吸とは")
+		assert.Contains(t, fronts, "葉緑体とは")
+	})
+
+	t.Run("ストリーミングでは完了したチャンクごとにカードを送る", func(t *testing.T) {
+		llm := services.NewFakeLLMProvider()
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_preview/stream", map[string]string{"prompt": "光合成", "maxCards": "45"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		events := parseSSE(t, w.Body.String())
+		names := eventNames(events)
+		require.Equal(t, "done", names[len(names)-1], w.Body.String())
+
+		var decks, cards int
+		for _, name := range names {
+			switch name {
+			case "deck":
+				decks++
+			case "card":
+				cards++
+			}
+		}
+		assert.Equal(t, 1, decks)
+		assert.Equal(t, 9, cards)
+
+		// 全てのチャンクが同じカードを返すため、保存されるのは1チャンク分になる
+		var done PreviewResponse
+		require.NoError(t, json.Unmarshal([]byte(events[len(events)-1].Data), &done))
+		assert.Len(t, done.Cards, 3)
+	})
+
+	t.Run("いずれかのチャンクが失敗した場合は保存しない", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Err: errors.New("quota exceeded")}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成", "maxCards": "45"}, "", "", nil)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), "quota exceeded")
+
+		var count int64
+		require.NoError(t, db.Model(&models.Deck{}).Where("user_id = ?", user.ID).Count(&count).Error)
+		assert.Zero(t, count)
+	})
+}
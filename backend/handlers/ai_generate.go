@@ -4,43 +4,81 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
 	"gorm.io/gorm"
 
 	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/ratelimit"
+	"github.com/muratayousuke/ai-flashcards/services"
 )
 
 type AIGenerateHandler struct {
-	db           *gorm.DB
-	geminiClient *genai.Client
+	db       *gorm.DB
+	llm      services.LLMProvider
+	detector *services.DuplicateDetector
+	jobs     *services.JobRunner
+	fetcher  services.PageFetcher
+	refund   func(ratelimit.Charge) // ジョブのリクエストを制限回数に返却する
 }
 
 type AIGenerateRequest struct {
 	Prompt   string `json:"prompt" binding:"required"`
 	DeckID   string `json:"deckId"`
 	MaxCards int    `json:"maxCards" binding:"required,min=1,max=100"`
+	Markup   bool   `json:"markup"` // 数式・ふりがな記法での生成を求める
 }
 
 type AIGenerateResponse struct {
-	Cards []models.Card `json:"cards"`
-	Deck  *models.Deck  `json:"deck,omitempty"`
+	Cards    []models.Card               `json:"cards"`
+	Deck     *models.Deck                `json:"deck,omitempty"`
+	Skipped  []services.FlaggedDuplicate `json:"skipped,omitempty"`  // 既存のカードと重複したため作成しなかったカード
+	Rejected []RejectedCard              `json:"rejected,omitempty"` // 無効または安全でないため作成しなかったカード
+}
+
+// RejectedCard is a generated card left out because it is invalid or unsafe
+type RejectedCard struct {
+	Front  string `json:"front"`
+	Reason string `json:"reason"`
 }
 
 type GeneratedCard struct {
 	Front string `json:"front"`
 	Back  string `json:"back"`
+	Page  int    `json:"page,omitempty"` // 文書から生成した場合の根拠のページ
+	Cue   int    `json:"cue,omitempty"`  // 字幕から生成した場合の根拠のキュー番号
+
+	cue *services.SubtitleCue // Cue の番号の字幕（resolveSubtitleCues で設定する）
+}
+
+// sourceRef returns where in the source the card comes from, or ""
+func (c *GeneratedCard) sourceRef() string {
+	switch {
+	case c.Page > 0:
+		return fmt.Sprintf("p.%d", c.Page)
+	case c.cue != nil:
+		return c.cue.Timestamp()
+	}
+	return ""
+}
+
+// sourceText returns the source sentence of the card, or ""
+func (c *GeneratedCard) sourceText() string {
+	if c.cue != nil {
+		return c.cue.Text
+	}
+	return ""
 }
 
 type GeneratedDeckInfo struct {
@@ -49,23 +87,22 @@ type GeneratedDeckInfo struct {
 	Cards       []GeneratedCard `json:"cards"`
 }
 
-type AIGenerateConfig struct {
-	APIKey      string
-	MaxTokens   int
-	Temperature float64
-}
-
 type PreviewResponse struct {
 	SessionID       string               `json:"sessionId"`
 	DeckTitle       string               `json:"deckTitle"`
 	DeckDescription string               `json:"deckDescription"`
 	Cards           []models.CardPreview `json:"cards"`
 	ExpiresAt       time.Time            `json:"expiresAt"`
+
+	Skipped  []services.FlaggedDuplicate `json:"skipped,omitempty"`  // 既存のカードと重複したため除いたカード
+	Rejected []RejectedCard              `json:"rejected,omitempty"` // 無効なため除いたカード
 }
 
 type ConfirmPreviewRequest struct {
-	SessionID string `json:"sessionId" binding:"required"`
-	DeckID    string `json:"deckId"`
+	SessionID      string `json:"sessionId" binding:"required"`
+	DeckID         string `json:"deckId"`
+	DuplicateCheck string `json:"duplicateCheck" binding:"omitempty,oneof=skip flag"` // skip: 重複を除外, flag: 重複を報告
+	DuplicateScope string `json:"duplicateScope" binding:"omitempty,oneof=deck all"`
 }
 
 type RegenerateRequest struct {
@@ -138,43 +175,190 @@ const (
 
 重要：JSON形式のみを返し、他の説明は含めないでください。`
 
-	MaxImageSize = 20 * 1024 * 1024 // 20MB
-	MaxAudioSize = 50 * 1024 * 1024 // 50MB
+	DocumentAnalysisPrompt = `以下の文書の内容から、教育的価値の高いフラッシュカードを%d枚生成し、適切なデッキ名と説明も作成してください。
+
+文書の各ページは [p.ページ番号] の行から始まります。各カードの "page" には、そのカードの根拠となるページ番号を数値で入れてください。
+
+文書:
+%s
+
+以下のJSON形式で返してください：
+{
+  "title": "デッキのタイトル（文書の内容に基づいて）",
+  "description": "デッキの説明（文書から学べる内容を説明）",
+  "cards": [
+    {
+      "front": "質問や学習ポイント",
+      "back": "詳細な説明や答え",
+      "page": 1
+    }
+  ]
+}
+
+重要：JSON形式のみを返し、他の説明は含めないでください。`
+
+	ArticleAnalysisPrompt = `以下のWebページの記事の内容から、教育的価値の高いフラッシュカードを%d枚生成し、適切なデッキ名と説明も作成してください。
+
+記事のタイトル: %s
+
+本文:
+%s
+
+以下のJSON形式で返してください：
+{
+  "title": "デッキのタイトル（記事の内容に基づいて）",
+  "description": "デッキの説明（記事から学べる内容を説明）",
+  "cards": [
+    {
+      "front": "質問や学習ポイント",
+      "back": "詳細な説明や答え"
+    }
+  ]
+}
+
+重要：JSON形式のみを返し、他の説明は含めないでください。`
+
+	SubtitleAnalysisPrompt = `以下の動画の字幕から、語学学習者向けのフラッシュカードを%d枚生成し、適切なデッキ名と説明も作成してください。
+
+学習者のレベル: %s
+
+字幕の各行は [キュー番号 時刻] から始まります。次の方針でカードを作成してください：
+- このレベルの学習者が覚えるべき語彙・表現と、学習に役立つ文を字幕から選ぶ（易しすぎるものや難しすぎるものは選ばない）
+- 語彙のカードは front に語や表現、back に読み方・意味・字幕での使われ方を書く
+- 文のカードは front に字幕の文、back に意味と文法や表現のポイントを書く
+- 各カードの "cue" には、その語や文が現れる字幕のキュー番号を数値で入れる
+
+字幕:
+%s
+
+以下のJSON形式で返してください：
+{
+  "title": "デッキのタイトル（動画の内容とレベルに基づいて）",
+  "description": "デッキの説明（字幕から学べる語彙や表現を説明）",
+  "cards": [
+    {
+      "front": "語・表現または字幕の文",
+      "back": "読み方・意味・解説",
+      "cue": 1
+    }
+  ]
+}
+
+重要：JSON形式のみを返し、他の説明は含めないでください。`
+
+	// テキストを抽出できないページがある文書を添付する場合にプロンプトへ追加する指示
+	DocumentAttachmentInstruction = `
+
+文書のPDFファイルを添付しています。上記にテキストがないページ（スキャンした紙面や図など）は添付ファイルから読み取ってください。`
+
+	// 再生成時にプロンプトへ追加するフィードバックの指示
+	RegenerateFeedbackInstruction = `
+
+ユーザーフィードバック: %s
+前回の生成結果に対するフィードバックを反映して、デッキ名・説明・カードを改善してください。`
+
+	// markup=true 指定時にプロンプトへ追加する記法の指示
+	MarkupPromptInstruction = `
+
+記法について：
+- 数式は LaTeX で、文中の数式は $...$、独立した数式は $$...$$ で囲んでください
+- 数式以外で $ を使う場合は \$ と書いてください
+- 漢字の読みを示す場合は 漢字[かんじ] の形式でふりがなを付けてください（読みはひらがなかカタカナのみ）
+- 漢字とかなが混ざった語に読みを付ける場合は ｜お茶[おちゃ] のように ｜ で開始位置を示してください`
+
+	MaxGeneratedCards = 100 // 1回の生成で作成できるカードの上限
+
+	MaxImageSize    = 20 * 1024 * 1024 // 20MB
+	MaxAudioSize    = 50 * 1024 * 1024 // 50MB
+	MaxDocumentSize = 30 * 1024 * 1024 // 30MB
+	MaxHTMLSize     = 5 * 1024 * 1024  // 5MB
+	MaxSubtitleSize = 2 * 1024 * 1024  // 2MB
+
+	DefaultSubtitleLevel = "中級" // 字幕から生成する場合にレベルの指定がないときのレベル
+	MaxSubtitleLevelLen  = 50   // レベルの指定の最大文字数
 )
 
 var (
-	AllowedImageTypes = []string{"image/png", "image/jpeg", "image/webp", "image/heic", "image/heif"}
-	AllowedAudioTypes = []string{"audio/wav", "audio/mp3", "audio/aiff", "audio/aac", "audio/ogg", "audio/flac"}
+	AllowedImageTypes    = []string{"image/png", "image/jpeg", "image/webp", "image/heic", "image/heif"}
+	AllowedAudioTypes    = []string{"audio/wav", "audio/mp3", "audio/aiff", "audio/aac", "audio/ogg", "audio/flac"}
+	AllowedDocumentTypes = []string{services.MIMETypePDF, services.MIMETypeDOCX}
+	AllowedHTMLTypes     = []string{"text/html", "application/xhtml+xml"}
+	// .srt はブラウザによって MIME タイプが付かないため application/octet-stream も受け付ける（内容は解析時に検証する）
+	AllowedSubtitleTypes = []string{"application/x-subrip", "application/srt", "text/srt", "text/vtt", "text/plain", "application/octet-stream"}
 )
 
-func getDefaultConfig() AIGenerateConfig {
-	return AIGenerateConfig{
-		APIKey:      os.Getenv("GEMINI_API_KEY"),
-		MaxTokens:   3000,
-		Temperature: 0.7,
-	}
-}
+var (
+	errInvalidAIInput    = errors.New("テキスト、画像、音声、文書、Webページ、または字幕のいずれかを入力してください")
+	errInvalidDeckID     = errors.New("無効なデッキID")
+	errDeckNotFound      = errors.New("デッキが見つかりません")
+	errNoValidCards      = errors.New("有効なカードが生成されませんでした")
+	errAllCardsDuplicate = errors.New("すべてのカードが既存のカードと重複しています")
+)
+
+// 生成時のサンプリング設定
+var (
+	deckGenerationOptions = services.LLMOptions{Temperature: 0.7, MaxTokens: 3000}
+	cardGenerationOptions = services.LLMOptions{Temperature: 0.7, MaxTokens: 2000}
+)
 
-func newAIGenerateClient(config AIGenerateConfig) (*genai.Client, error) {
-	client, err := genai.NewClient(context.Background(), option.WithAPIKey(config.APIKey))
+func NewAIGenerateHandler(db *gorm.DB) (*AIGenerateHandler, error) {
+	// LLMプロバイダーの初期化
+	llm, err := services.NewLLMProviderFromEnv(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	return client, nil
-}
 
-func NewAIGenerateHandler(db *gorm.DB) (*AIGenerateHandler, error) {
-	// Gemini APIクライアントの初期化
-	geminiConfig := getDefaultConfig()
-	client, err := newAIGenerateClient(geminiConfig)
+	// 非同期ジョブのキューの初期化
+	queue, err := services.NewJobQueueFromEnv()
 	if err != nil {
 		return nil, err
 	}
+	return NewAIGenerateHandlerWithProvider(db, llm, queue), nil
+}
 
-	return &AIGenerateHandler{
-		db:           db,
-		geminiClient: client,
-	}, nil
+// NewAIGenerateHandlerWithProvider creates the handler with the given LLM provider and job queue
+func NewAIGenerateHandlerWithProvider(db *gorm.DB, llm services.LLMProvider, queue services.JobQueue) *AIGenerateHandler {
+	h := &AIGenerateHandler{
+		db:       db,
+		llm:      llm,
+		detector: services.NewDuplicateDetector(db),
+		fetcher:  services.NewPageFetcherFromEnv(),
+		refund:   ratelimit.Refund,
+	}
+	h.jobs = services.NewJobRunner(db, queue, h.processJob)
+	return h
+}
+
+// generate sends the prompt to the LLM, attaching the file when one is given.
+// When the request is streamed, the output is passed on as it arrives.
+func (h *AIGenerateHandler) generate(ctx context.Context, prompt string, fileData []byte, mimeType string, opts services.LLMOptions) (string, error) {
+	var media []services.LLMMedia
+	if fileData != nil {
+		media = []services.LLMMedia{{MIMEType: mimeType, Data: fileData}}
+	}
+
+	if stream := generationStreamFrom(ctx); stream != nil {
+		return h.llm.GenerateStream(ctx, prompt, media, opts, stream.write)
+	}
+
+	if media == nil {
+		return h.llm.GenerateText(ctx, prompt, opts)
+	}
+	return h.llm.GenerateMultimodal(ctx, prompt, media, opts)
+}
+
+// markupRequested reports whether the form asks for math/furigana markup
+func markupRequested(c *gin.Context) bool {
+	markup, _ := strconv.ParseBool(c.PostForm("markup"))
+	return markup
+}
+
+// withMarkupInstruction appends the markup instruction to a prompt when enabled
+func withMarkupInstruction(prompt string, enabled bool) string {
+	if !enabled {
+		return prompt
+	}
+	return prompt + MarkupPromptInstruction
 }
 
 // 統合されたカード生成エンドポイント
@@ -183,27 +367,7 @@ func (h *AIGenerateHandler) GenerateCards(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 120*time.Second)
 	defer cancel()
 
-	// 入力タイプの判定
-	inputType := h.determineInputType(c)
-
-	var resp *AIGenerateResponse
-	var err error
-
-	switch inputType {
-	case "text":
-		resp, err = h.handleTextInput(ctx, c)
-	case "image":
-		resp, err = h.handleImageInput(ctx, c)
-	case "audio":
-		resp, err = h.handleAudioInput(ctx, c)
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Invalid input",
-			"message": "テキスト、画像、または音声のいずれかを入力してください",
-		})
-		return
-	}
-
+	resp, err := h.runGenerate(ctx, c)
 	if err != nil {
 		h.handleError(c, ctx, err)
 		return
@@ -216,6 +380,54 @@ func (h *AIGenerateHandler) GenerateCards(c *gin.Context) {
 	})
 }
 
+// 入力に応じてカードを生成
+func (h *AIGenerateHandler) runGenerate(ctx context.Context, c *gin.Context) (*AIGenerateResponse, error) {
+	input, err := h.parseGenerationInput(c)
+	if err != nil {
+		return nil, err
+	}
+	return h.generateFromInput(ctx, input)
+}
+
+// generationInput is a parsed generation request. It does not depend on the
+// HTTP request, so it can also be processed by a background job.
+type generationInput struct {
+	ClerkID  string `json:"clerkId"`
+	Type     string `json:"type"`             // text, image, audio, document, html, subtitles
+	Prompt   string `json:"prompt,omitempty"` // html の場合は抽出した記事の本文
+	Title    string `json:"title,omitempty"`  // html の場合の記事のタイトル
+	NewDeck  bool   `json:"newDeck"`
+	DeckID   string `json:"deckId,omitempty"`
+	MaxCards int    `json:"maxCards"`
+	Markup   bool   `json:"markup"`
+	MIMEType string `json:"mimeType,omitempty"`
+	FileData []byte `json:"-"`
+
+	// 文書から抽出したページのテキスト。FileData はテキストのないページがある PDF の場合のみ保持する
+	Pages []services.DocumentPage `json:"pages,omitempty"`
+
+	// 字幕のキューと学習者のレベル
+	Cues  []services.SubtitleCue `json:"cues,omitempty"`
+	Level string                 `json:"level,omitempty"`
+
+	// ジョブの受付時に制限回数に数えたリクエスト
+	Charge *ratelimit.Charge `json:"charge,omitempty"`
+
+	chunkInstruction string // 分割生成の場合にプロンプトへ追加する指示
+	feedback         string // 再生成の場合のユーザーフィードバック
+}
+
+// originalPrompt is the source kept with preview cards for regeneration
+func (input *generationInput) originalPrompt() string {
+	switch input.Type {
+	case "document":
+		return formatDocumentPages(input.Pages)
+	case "subtitles":
+		return formatSubtitleSource(input.Level, input.Cues)
+	}
+	return input.Prompt
+}
+
 // 入力タイプの判定
 func (h *AIGenerateHandler) determineInputType(c *gin.Context) string {
 	// 画像ファイルの確認
@@ -228,201 +440,476 @@ func (h *AIGenerateHandler) determineInputType(c *gin.Context) string {
 		return "audio"
 	}
 
+	// 文書ファイルの確認
+	if _, _, err := c.Request.FormFile("document"); err == nil {
+		return "document"
+	}
+
+	// HTMLファイル・貼り付けたHTML・URLの確認
+	if _, _, err := c.Request.FormFile("html"); err == nil {
+		return "html"
+	}
+	if c.PostForm("html") != "" || c.PostForm("url") != "" {
+		return "html"
+	}
+
+	// 字幕ファイル・貼り付けた字幕の確認
+	if _, _, err := c.Request.FormFile("subtitles"); err == nil {
+		return "subtitles"
+	}
+	if c.PostForm("subtitles") != "" {
+		return "subtitles"
+	}
+
 	// デフォルトはテキスト
 	return "text"
 }
 
-// テキスト入力の処理
-func (h *AIGenerateHandler) handleTextInput(ctx context.Context, c *gin.Context) (*AIGenerateResponse, error) {
-	// フォームデータからの取得
-	prompt := c.PostForm("prompt")
-	if prompt == "" {
-		return nil, fmt.Errorf("プロンプトを入力してください")
-	}
-
-	deckOption := c.PostForm("deckOption")
-	deckID := c.PostForm("deckId")
+// フォームから生成パラメータを取得
+func (h *AIGenerateHandler) parseGenerationInput(c *gin.Context) (*generationInput, error) {
+	input := &generationInput{Type: h.determineInputType(c)}
 
-	maxCards, _ := strconv.Atoi(c.PostForm("maxCards"))
-	if maxCards == 0 {
-		maxCards = 20
+	switch input.Type {
+	case "text":
+		input.Prompt = c.PostForm("prompt")
+		if input.Prompt == "" {
+			return nil, fmt.Errorf("プロンプトを入力してください")
+		}
+	case "image", "audio":
+		if err := h.readInputFile(c, input); err != nil {
+			return nil, err
+		}
+	case "document":
+		if err := h.readInputFile(c, input); err != nil {
+			return nil, err
+		}
+		if err := readDocumentPages(input); err != nil {
+			return nil, err
+		}
+	case "html":
+		if err := h.readArticle(c, input); err != nil {
+			return nil, err
+		}
+	case "subtitles":
+		if err := h.readSubtitles(c, input); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errInvalidAIInput
 	}
 
-	// 新規作成の場合
-	if deckOption == "new" || deckID == "" {
-		return h.generateNewDeckWithCards(ctx, c, prompt, maxCards, "text", nil, "")
+	userID, exists := c.Get("userID")
+	if !exists {
+		return nil, fmt.Errorf("ユーザー認証情報が見つかりません")
 	}
+	clerkID, ok := userID.(string)
+	if !ok {
+		return nil, fmt.Errorf("無効なユーザーID形式")
+	}
+	input.ClerkID = clerkID
 
-	// 既存デッキに追加の場合
-	req := AIGenerateRequest{
-		Prompt:   prompt,
-		DeckID:   deckID,
-		MaxCards: maxCards,
+	// パラメータ取得
+	input.DeckID = c.PostForm("deckId")
+	input.NewDeck = c.PostForm("deckOption") == "new" || input.DeckID == ""
+	input.Markup = markupRequested(c)
+	input.MaxCards, _ = strconv.Atoi(c.PostForm("maxCards"))
+	if input.MaxCards <= 0 {
+		input.MaxCards = 20
 	}
+	input.MaxCards = min(input.MaxCards, MaxGeneratedCards)
 
-	return h.generateCards(ctx, &req, "text")
+	return input, nil
 }
 
-// 画像入力の処理
-func (h *AIGenerateHandler) handleImageInput(ctx context.Context, c *gin.Context) (*AIGenerateResponse, error) {
+// 画像・音声・文書ファイルの読み込み
+func (h *AIGenerateHandler) readInputFile(c *gin.Context, input *generationInput) error {
 	// ファイルの取得
-	file, header, err := c.Request.FormFile("image")
+	file, header, err := c.Request.FormFile(input.Type)
 	if err != nil {
-		return nil, fmt.Errorf("画像ファイルの取得に失敗: %w", err)
+		switch input.Type {
+		case "image":
+			return fmt.Errorf("画像ファイルの取得に失敗: %w", err)
+		case "document":
+			return fmt.Errorf("文書ファイルの取得に失敗: %w", err)
+		default:
+			return fmt.Errorf("音声ファイルの取得に失敗: %w", err)
+		}
 	}
 	defer file.Close()
 
 	// ファイル検証
-	if err := h.validateImageFile(header); err != nil {
-		return nil, err
+	switch input.Type {
+	case "image":
+		err = h.validateImageFile(header)
+	case "document":
+		err = h.validateDocumentFile(header)
+	default:
+		err = h.validateAudioFile(header)
+	}
+	if err != nil {
+		return err
 	}
 
 	// ファイルデータ読み込み
-	fileData, err := io.ReadAll(file)
+	input.FileData, err = io.ReadAll(file)
 	if err != nil {
-		return nil, fmt.Errorf("ファイル読み込みエラー: %w", err)
+		return fmt.Errorf("ファイル読み込みエラー: %w", err)
 	}
+	input.MIMEType = header.Header.Get("Content-Type")
+	return nil
+}
 
-	// パラメータ取得
-	deckOption := c.PostForm("deckOption")
-	deckID := c.PostForm("deckId")
+// readArticle extracts the article of an uploaded HTML file, pasted markup
+// or a page fetched from a URL
+func (h *AIGenerateHandler) readArticle(c *gin.Context, input *generationInput) error {
+	var markup []byte
+	if file, header, err := c.Request.FormFile("html"); err == nil {
+		defer file.Close()
+		if err := h.validateHTMLFile(header); err != nil {
+			return err
+		}
+		if markup, err = io.ReadAll(file); err != nil {
+			return fmt.Errorf("ファイル読み込みエラー: %w", err)
+		}
+	} else if pasted := c.PostForm("html"); pasted != "" {
+		if len(pasted) > MaxHTMLSize {
+			return fmt.Errorf("HTMLが大きすぎます（最大5MB）")
+		}
+		markup = []byte(pasted)
+	} else {
+		if markup, err = h.fetcher.Fetch(c.Request.Context(), c.PostForm("url")); err != nil {
+			return err
+		}
+	}
 
-	maxCards, _ := strconv.Atoi(c.PostForm("maxCards"))
-	if maxCards == 0 {
-		maxCards = 20
+	article, err := services.ExtractArticle(markup)
+	if err != nil {
+		return err
 	}
+	input.Prompt = article.Text
+	input.Title = article.Title
+	return nil
+}
 
-	// 新規作成の場合
-	if deckOption == "new" || deckID == "" {
-		return h.generateNewDeckWithCards(ctx, c, "", maxCards, "image", fileData, header.Header.Get("Content-Type"))
+// readSubtitles parses an uploaded or pasted SRT/WebVTT file and reads the
+// level of the learner
+func (h *AIGenerateHandler) readSubtitles(c *gin.Context, input *generationInput) error {
+	var data []byte
+	if file, header, err := c.Request.FormFile("subtitles"); err == nil {
+		defer file.Close()
+		if err := h.validateSubtitleFile(header); err != nil {
+			return err
+		}
+		if data, err = io.ReadAll(file); err != nil {
+			return fmt.Errorf("ファイル読み込みエラー: %w", err)
+		}
+	} else {
+		pasted := c.PostForm("subtitles")
+		if len(pasted) > MaxSubtitleSize {
+			return fmt.Errorf("字幕が大きすぎます（最大2MB）")
+		}
+		data = []byte(pasted)
 	}
 
-	// 既存デッキに追加の場合
-	return h.generateCardsFromInlineData(ctx, fileData, header.Header.Get("Content-Type"), deckID, maxCards, "image")
+	cues, err := services.ParseSubtitles(data)
+	if err != nil {
+		return err
+	}
+	input.Cues = cues
+
+	input.Level = strings.Join(strings.Fields(c.PostForm("level")), " ")
+	if input.Level == "" {
+		input.Level = DefaultSubtitleLevel
+	}
+	if utf8.RuneCountInString(input.Level) > MaxSubtitleLevelLen {
+		return fmt.Errorf("レベルは%d文字以内で指定してください", MaxSubtitleLevelLen)
+	}
+	return nil
 }
 
-// 音声入力の処理
-func (h *AIGenerateHandler) handleAudioInput(ctx context.Context, c *gin.Context) (*AIGenerateResponse, error) {
-	// ファイルの取得
-	file, header, err := c.Request.FormFile("audio")
+// readDocumentPages extracts the pages of an uploaded document. The file
+// itself is only kept for PDFs with pages that have no text, so that the
+// model can read them as images.
+func readDocumentPages(input *generationInput) error {
+	pages, err := services.ExtractDocumentPages(input.FileData, input.MIMEType)
 	if err != nil {
-		return nil, fmt.Errorf("音声ファイルの取得に失敗: %w", err)
+		return err
 	}
-	defer file.Close()
 
-	// ファイル検証
-	if err := h.validateAudioFile(header); err != nil {
-		return nil, err
+	textPages := 0
+	for _, page := range pages {
+		if page.Text != "" {
+			textPages++
+		}
+	}
+	if textPages == 0 && input.MIMEType != services.MIMETypePDF {
+		return fmt.Errorf("%w: テキストが含まれていません", services.ErrInvalidDocument)
+	}
+	if textPages == len(pages) {
+		input.FileData = nil
 	}
+	input.Pages = pages
+	return nil
+}
 
-	// ファイルデータ読み込み
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("ファイル読み込みエラー: %w", err)
+// formatDocumentPages joins the text of the pages, each headed by its page marker
+func formatDocumentPages(pages []services.DocumentPage) string {
+	var b strings.Builder
+	for _, page := range pages {
+		if page.Text == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "[p.%d]\n%s\n\n", page.Number, page.Text)
 	}
+	return strings.TrimSpace(b.String())
+}
 
-	// パラメータ取得
-	deckOption := c.PostForm("deckOption")
-	deckID := c.PostForm("deckId")
+// documentPagePattern matches a page marker written by formatDocumentPages
+var documentPagePattern = regexp.MustCompile(`^\[p\.(\d+)\]$`)
 
-	maxCards, _ := strconv.Atoi(c.PostForm("maxCards"))
-	if maxCards == 0 {
-		maxCards = 20
+// parseDocumentPages reads back the pages written by formatDocumentPages
+func parseDocumentPages(source string) []services.DocumentPage {
+	var pages []services.DocumentPage
+	for _, line := range strings.Split(source, "\n") {
+		if match := documentPagePattern.FindStringSubmatch(line); match != nil {
+			number, _ := strconv.Atoi(match[1])
+			pages = append(pages, services.DocumentPage{Number: number})
+			continue
+		}
+		if len(pages) > 0 {
+			page := &pages[len(pages)-1]
+			page.Text += line + "\n"
+		}
+	}
+	for i := range pages {
+		pages[i].Text = strings.TrimSpace(pages[i].Text)
 	}
+	return pages
+}
+
+// subtitleLevelPrefix heads the level line of formatSubtitleSource
+const subtitleLevelPrefix = "レベル: "
+
+// subtitleLinePattern matches a cue line written by formatSubtitleCues
+var subtitleLinePattern = regexp.MustCompile(`^\[(\d+) (\d+):(\d{2}):(\d{2})\] (.*)$`)
+
+// formatSubtitleCues writes each cue on a line headed by its number and start time
+func formatSubtitleCues(cues []services.SubtitleCue) string {
+	var b strings.Builder
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "[%d %s] %s\n", cue.Index, cue.Timestamp(), cue.Text)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// formatSubtitleSource is the source of a subtitle generation kept with the
+// preview cards: the level of the learner followed by the cues
+func formatSubtitleSource(level string, cues []services.SubtitleCue) string {
+	return subtitleLevelPrefix + level + "\n\n" + formatSubtitleCues(cues)
+}
+
+// parseSubtitleSource reads back the level and cues written by formatSubtitleSource
+func parseSubtitleSource(source string) (string, []services.SubtitleCue) {
+	header, body, _ := strings.Cut(source, "\n\n")
+
+	var cues []services.SubtitleCue
+	for _, line := range strings.Split(body, "\n") {
+		match := subtitleLinePattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(match[1])
+		hours, _ := strconv.Atoi(match[2])
+		minutes, _ := strconv.Atoi(match[3])
+		seconds, _ := strconv.Atoi(match[4])
+		cues = append(cues, services.SubtitleCue{
+			Index: index,
+			Start: time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second,
+			Text:  match[5],
+		})
+	}
+	return strings.TrimPrefix(header, subtitleLevelPrefix), cues
+}
 
+// 生成パラメータに応じてカードを生成
+func (h *AIGenerateHandler) generateFromInput(ctx context.Context, input *generationInput) (*AIGenerateResponse, error) {
 	// 新規作成の場合
-	if deckOption == "new" || deckID == "" {
-		return h.generateNewDeckWithCards(ctx, c, "", maxCards, "audio", fileData, header.Header.Get("Content-Type"))
+	if input.NewDeck {
+		return h.generateNewDeckWithCards(ctx, input)
 	}
 
 	// 既存デッキに追加の場合
-	return h.generateCardsFromInlineData(ctx, fileData, header.Header.Get("Content-Type"), deckID, maxCards, "audio")
+	return h.generateIntoDeck(ctx, input)
 }
 
 // 新規デッキとカードを同時生成
-func (h *AIGenerateHandler) generateNewDeckWithCards(ctx context.Context, c *gin.Context, prompt string, maxCards int, generationType string, fileData []byte, mimeType string) (*AIGenerateResponse, error) {
-	// プロンプト選択
+func (h *AIGenerateHandler) generateNewDeckWithCards(ctx context.Context, input *generationInput) (*AIGenerateResponse, error) {
+	deckInfo, err := h.generateInChunks(ctx, input, h.generateDeckChunk)
+	if err != nil {
+		return nil, err
+	}
+	withInputTitle(deckInfo, input)
+
+	skipped, err := h.skipKnownSubtitleCards(ctx, input, deckInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// レスポンス処理
+	resp, err := h.processNewDeckResponse(ctx, input, deckInfo)
+	if err != nil {
+		return nil, err
+	}
+	resp.Skipped = skipped
+	return resp, nil
+}
+
+// generateDeckChunk generates a deck with its cards from one chunk of the input
+func (h *AIGenerateHandler) generateDeckChunk(ctx context.Context, chunk *generationInput) (*GeneratedDeckInfo, error) {
+	promptTemplate, err := analysisPrompt(chunk)
+	if err != nil {
+		return nil, err
+	}
+	promptTemplate = withMarkupInstruction(promptTemplate, chunk.Markup)
+	if chunk.feedback != "" {
+		promptTemplate += fmt.Sprintf(RegenerateFeedbackInstruction, chunk.feedback)
+	}
+	promptTemplate += chunk.chunkInstruction
+
+	schema := deckResponseSchema
+	switch chunk.Type {
+	case "document":
+		schema = documentDeckResponseSchema
+	case "subtitles":
+		schema = subtitleDeckResponseSchema
+	}
+
+	// コンテンツ生成（メディアファイルの場合は添付する）
+	var deckInfo GeneratedDeckInfo
+	if err := h.generateJSON(ctx, promptTemplate, chunk.FileData, chunk.MIMEType, deckGenerationOptions, schema, &deckInfo); err != nil {
+		return nil, err
+	}
+	checkSourcePages(deckInfo.Cards, chunk.Pages)
+	resolveSubtitleCues(deckInfo.Cards, chunk.Cues)
+	return &deckInfo, nil
+}
+
+// 入力タイプに応じたデッキ生成プロンプト
+func analysisPrompt(input *generationInput) (string, error) {
 	var promptTemplate string
-	switch generationType {
+	switch input.Type {
 	case "text":
-		promptTemplate = fmt.Sprintf(TextAnalysisPrompt, maxCards, prompt)
+		promptTemplate = fmt.Sprintf(TextAnalysisPrompt, input.MaxCards, input.Prompt)
 	case "image":
-		promptTemplate = fmt.Sprintf(ImageAnalysisPrompt, maxCards)
+		promptTemplate = fmt.Sprintf(ImageAnalysisPrompt, input.MaxCards)
 	case "audio":
-		promptTemplate = fmt.Sprintf(AudioAnalysisPrompt, maxCards)
+		promptTemplate = fmt.Sprintf(AudioAnalysisPrompt, input.MaxCards)
+	case "document":
+		promptTemplate = documentPrompt(input)
+	case "html":
+		promptTemplate = fmt.Sprintf(ArticleAnalysisPrompt, input.MaxCards, input.Title, input.Prompt)
+	case "subtitles":
+		promptTemplate = subtitlePrompt(input)
 	default:
-		return nil, fmt.Errorf("サポートされていない生成タイプ: %s", generationType)
+		return "", fmt.Errorf("サポートされていない生成タイプ: %s", input.Type)
 	}
+	return promptTemplate, nil
+}
 
-	// Gemini APIモデルの取得
-	model := h.geminiClient.GenerativeModel("gemini-2.0-flash")
-	model.SetTemperature(0.7)
-	model.SetMaxOutputTokens(3000)
+// withInputTitle names the deck after the source when it has a title, such
+// as the article of an HTML page
+func withInputTitle(deckInfo *GeneratedDeckInfo, input *generationInput) {
+	if input.Title != "" {
+		deckInfo.Title = input.Title
+	}
+}
 
-	var resp *genai.GenerateContentResponse
-	var err error
+// documentPrompt builds the prompt of a document chunk. planChunks puts the
+// page text of the chunk into Prompt.
+func documentPrompt(input *generationInput) string {
+	prompt := fmt.Sprintf(DocumentAnalysisPrompt, input.MaxCards, input.Prompt)
+	if input.FileData != nil {
+		prompt += DocumentAttachmentInstruction
+	}
+	return prompt
+}
 
-	// コンテンツ生成
-	if generationType == "text" {
-		resp, err = model.GenerateContent(ctx, genai.Text(promptTemplate))
-	} else {
-		// メディアファイルの場合
-		parts := []genai.Part{
-			genai.Text(promptTemplate),
-			genai.Blob{
-				MIMEType: mimeType,
-				Data:     fileData,
-			},
+// subtitlePrompt builds the prompt of a subtitle chunk. planChunks puts the
+// cue lines of the chunk into Prompt.
+func subtitlePrompt(input *generationInput) string {
+	return fmt.Sprintf(SubtitleAnalysisPrompt, input.MaxCards, input.Level, input.Prompt)
+}
+
+// resolveSubtitleCues links the cards to the cues they name and drops cue
+// numbers that are not cues of the subtitles
+func resolveSubtitleCues(cards []GeneratedCard, cues []services.SubtitleCue) {
+	for i := range cards {
+		if n := cards[i].Cue; n >= 1 && n <= len(cues) && cues[n-1].Index == n {
+			cards[i].cue = &cues[n-1]
+		} else {
+			cards[i].Cue = 0
 		}
-		resp, err = model.GenerateContent(ctx, parts...)
 	}
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("AI生成エラー: %w", err)
+// skipKnownSubtitleCards applies skipKnownCards to a subtitle generation.
+// Learners meet many words they have already studied in videos, so cards
+// from subtitles are checked against all of the user's decks.
+func (h *AIGenerateHandler) skipKnownSubtitleCards(ctx context.Context, input *generationInput, deckInfo *GeneratedDeckInfo) ([]services.FlaggedDuplicate, error) {
+	if input.Type != "subtitles" {
+		return nil, nil
 	}
 
-	// レスポンス処理
-	return h.processNewDeckResponse(c, resp, generationType)
+	var user models.User
+	if err := h.db.WithContext(ctx).Where("clerk_id = ?", input.ClerkID).First(&user).Error; err != nil {
+		return nil, fmt.Errorf("ユーザーが見つかりません: %w", err)
+	}
+	return h.skipKnownCards(ctx, user.ID, deckInfo)
 }
 
-// 新規デッキレスポンスの処理
-func (h *AIGenerateHandler) processNewDeckResponse(c *gin.Context, resp *genai.GenerateContentResponse, generationType string) (*AIGenerateResponse, error) {
-	ctx := c.Request.Context()
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, fmt.Errorf("AIからの応答が空です")
+// skipKnownCards drops the generated cards that duplicate a card in any of
+// the user's decks and returns the skipped cards with their matches
+func (h *AIGenerateHandler) skipKnownCards(ctx context.Context, userID uint, deckInfo *GeneratedDeckInfo) ([]services.FlaggedDuplicate, error) {
+	index, err := h.detector.NewIndex(userID, 0, services.DuplicateScopeAll)
+	if err != nil {
+		return nil, fmt.Errorf("重複チェックエラー: %w", err)
 	}
 
-	// レスポンステキストの取得
-	responseText := ""
-	for _, part := range resp.Candidates[0].Content.Parts {
-		if textPart, ok := part.(genai.Text); ok {
-			responseText += string(textPart)
+	var kept []GeneratedCard
+	var skipped []services.FlaggedDuplicate
+	for _, card := range deckInfo.Cards {
+		if matches := index.Match(card.Front); len(matches) > 0 {
+			skipped = append(skipped, services.FlaggedDuplicate{Front: card.Front, Matches: matches})
+			continue
 		}
+		kept = append(kept, card)
 	}
 
-	// JSONの抽出
-	responseText = h.extractJSON(responseText)
-
-	// JSONのパース
-	var deckInfo GeneratedDeckInfo
-	if err := json.Unmarshal([]byte(responseText), &deckInfo); err != nil {
-		return nil, fmt.Errorf("レスポンスパースエラー: %w, レスポンス: %s", err, responseText)
+	if len(kept) == 0 && len(skipped) > 0 {
+		return nil, errAllCardsDuplicate
 	}
+	deckInfo.Cards = kept
+	return skipped, nil
+}
 
-	// ユーザーIDの取得
-	userID, exists := c.Get("userID")
-	if !exists {
-		return nil, fmt.Errorf("ユーザー認証情報が見つかりません")
+// checkSourcePages drops page references that are not pages of the document
+func checkSourcePages(cards []GeneratedCard, pages []services.DocumentPage) {
+	last := 0
+	if len(pages) > 0 {
+		last = pages[len(pages)-1].Number
 	}
-
-	userIDStr, ok := userID.(string)
-	if !ok {
-		return nil, fmt.Errorf("無効なユーザーID形式")
+	for i := range cards {
+		if cards[i].Page < 1 || cards[i].Page > last {
+			cards[i].Page = 0
+		}
 	}
+}
 
+// 新規デッキレスポンスの処理
+func (h *AIGenerateHandler) processNewDeckResponse(ctx context.Context, input *generationInput, deckInfo *GeneratedDeckInfo) (*AIGenerateResponse, error) {
 	// ユーザーIDをuintに変換（ClerkのユーザーIDは文字列なので、ユーザーテーブルから取得する必要がある）
 	var user models.User
-	if err := h.db.WithContext(ctx).Where("clerk_id = ?", userIDStr).First(&user).Error; err != nil {
+	if err := h.db.WithContext(ctx).Where("clerk_id = ?", input.ClerkID).First(&user).Error; err != nil {
 		return nil, fmt.Errorf("ユーザーが見つかりません: %w", err)
 	}
 
@@ -437,159 +924,145 @@ func (h *AIGenerateHandler) processNewDeckResponse(c *gin.Context, resp *genai.G
 		return nil, fmt.Errorf("デッキ作成エラー: %w", err)
 	}
 
-	// カードの検証と変換
-	var cards []models.Card
-	for _, genCard := range deckInfo.Cards {
-		if err := h.validateCard(&genCard); err != nil {
-			continue // 無効なカードはスキップ
-		}
-
-		card := models.Card{
-			DeckID:         deck.ID,
-			Front:          genCard.Front,
-			Back:           genCard.Back,
-			GenerationType: generationType,
-		}
-		cards = append(cards, card)
-	}
-
-	if len(cards) == 0 {
-		return nil, fmt.Errorf("有効なカードが生成されませんでした")
-	}
-
-	// カードの保存
-	if err := h.saveCards(ctx, cards); err != nil {
-		return nil, fmt.Errorf("カード保存エラー: %w", err)
+	// カードの検証・変換と保存
+	cards, rejected, err := h.processCardsResponse(ctx, deckInfo.Cards, user.ID, deck.ID, input.Type, input.Markup)
+	if err != nil {
+		return nil, err
 	}
 
 	return &AIGenerateResponse{
-		Cards: cards,
-		Deck:  &deck,
+		Cards:    cards,
+		Deck:     &deck,
+		Rejected: rejected,
 	}, nil
 }
 
-func (h *AIGenerateHandler) generateCards(ctx context.Context, req *AIGenerateRequest, generationType string) (*AIGenerateResponse, error) {
-	// DeckIDをuintに変換
-	deckID, err := strconv.ParseUint(req.DeckID, 10, 32)
+// 既存デッキへのカード生成
+func (h *AIGenerateHandler) generateIntoDeck(ctx context.Context, input *generationInput) (*AIGenerateResponse, error) {
+	// AIを呼び出す前にデッキの所有者を確認する
+	user, deck, err := h.targetDeck(ctx, input)
 	if err != nil {
-		return nil, fmt.Errorf("無効なデッキID: %w", err)
+		return nil, err
 	}
 
-	// プロンプトテンプレートの構築
-	prompt := fmt.Sprintf(`
-以下の指示に基づいてフラッシュカードを%d枚生成してください：
-%s
-
-各カードは以下のJSON配列形式で返してください：
-[
-  {
-    "front": "カードの表面（質問や単語）",
-    "back": "カードの裏面（解答や説明）"
-  }
-]
-
-重要な注意事項：
-- 必ずJSON配列形式で返してください
-- 他の説明文は含めないでください
-- frontとbackは必須フィールドです
-- 各カードの内容は簡潔で分かりやすくしてください
-`, req.MaxCards, req.Prompt)
-
-	// Gemini APIモデルの取得
-	model := h.geminiClient.GenerativeModel("gemini-2.0-flash")
-	model.SetTemperature(0.7)
-	model.SetMaxOutputTokens(2000)
+	deckInfo, err := h.generateInChunks(ctx, input, h.generateCardChunk)
+	if err != nil {
+		return nil, err
+	}
 
-	// コンテンツ生成
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	skipped, err := h.skipKnownSubtitleCards(ctx, input, deckInfo)
 	if err != nil {
-		return nil, fmt.Errorf("AI生成エラー: %w", err)
+		return nil, err
 	}
 
 	// レスポンス処理
-	cards, err := h.processGeminiResponse(ctx, resp, uint(deckID), generationType)
+	cards, rejected, err := h.processCardsResponse(ctx, deckInfo.Cards, user.ID, deck.ID, input.Type, input.Markup)
 	if err != nil {
 		return nil, err
 	}
 
-	return &AIGenerateResponse{Cards: cards}, nil
+	return &AIGenerateResponse{Cards: cards, Skipped: skipped, Rejected: rejected}, nil
 }
 
-func (h *AIGenerateHandler) generateCardsFromInlineData(ctx context.Context, fileData []byte, mimeType, deckID string, maxCards int, generationType string) (*AIGenerateResponse, error) {
+// targetDeck returns the user and the existing deck the input adds cards to.
+// A deck of another user is reported as not found.
+func (h *AIGenerateHandler) targetDeck(ctx context.Context, input *generationInput) (*models.User, *models.Deck, error) {
 	// DeckIDをuintに変換
-	deckIDUint, err := strconv.ParseUint(deckID, 10, 32)
+	deckID, err := strconv.ParseUint(input.DeckID, 10, 32)
 	if err != nil {
-		return nil, fmt.Errorf("無効なデッキID: %w", err)
-	}
-
-	// プロンプト選択
-	var promptTemplate string
-	switch generationType {
-	case "image":
-		promptTemplate = ImageAnalysisPrompt
-	case "audio":
-		promptTemplate = AudioAnalysisPrompt
-	default:
-		return nil, fmt.Errorf("サポートされていない生成タイプ: %s", generationType)
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidDeckID, err)
 	}
 
-	prompt := fmt.Sprintf(promptTemplate, maxCards)
-
-	// Gemini APIモデルの取得
-	model := h.geminiClient.GenerativeModel("gemini-2.0-flash")
-	model.SetTemperature(0.7)
-	model.SetMaxOutputTokens(2000)
-
-	// コンテンツ生成（インラインデータ）
-	parts := []genai.Part{
-		genai.Text(prompt),
-		genai.Blob{
-			MIMEType: mimeType,
-			Data:     fileData,
-		},
+	var user models.User
+	if err := h.db.WithContext(ctx).Where("clerk_id = ?", input.ClerkID).First(&user).Error; err != nil {
+		return nil, nil, fmt.Errorf("ユーザーが見つかりません: %w", err)
 	}
 
-	resp, err := model.GenerateContent(ctx, parts...)
-	if err != nil {
-		return nil, fmt.Errorf("AI生成エラー: %w", err)
+	var deck models.Deck
+	if err := h.db.WithContext(ctx).Where("id = ? AND user_id = ?", deckID, user.ID).First(&deck).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errDeckNotFound
+		}
+		return nil, nil, fmt.Errorf("デッキ取得エラー: %w", err)
 	}
+	return &user, &deck, nil
+}
 
-	// レスポンス処理
-	cards, err := h.processGeminiResponse(ctx, resp, uint(deckIDUint), generationType)
+// generateCardChunk generates cards for an existing deck from one chunk of the input
+func (h *AIGenerateHandler) generateCardChunk(ctx context.Context, chunk *generationInput) (*GeneratedDeckInfo, error) {
+	prompt, err := cardsPrompt(chunk)
 	if err != nil {
 		return nil, err
 	}
+	prompt = withMarkupInstruction(prompt, chunk.Markup) + chunk.chunkInstruction
 
-	return &AIGenerateResponse{Cards: cards}, nil
-}
-
-func (h *AIGenerateHandler) processGeminiResponse(ctx context.Context, resp *genai.GenerateContentResponse, deckID uint, generationType string) ([]models.Card, error) {
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, fmt.Errorf("AIからの応答が空です")
+	schema := cardsResponseSchema
+	switch chunk.Type {
+	case "document":
+		schema = documentCardsResponseSchema
+	case "subtitles":
+		schema = subtitleCardsResponseSchema
 	}
 
-	// レスポンステキストの取得
-	responseText := ""
-	for _, part := range resp.Candidates[0].Content.Parts {
-		if textPart, ok := part.(genai.Text); ok {
-			responseText += string(textPart)
-		}
+	// コンテンツ生成（メディアファイルの場合は添付する）
+	var cards generatedCards
+	if err := h.generateJSON(ctx, prompt, chunk.FileData, chunk.MIMEType, cardGenerationOptions, schema, &cards); err != nil {
+		return nil, err
 	}
+	checkSourcePages(cards, chunk.Pages)
+	resolveSubtitleCues(cards, chunk.Cues)
+	return &GeneratedDeckInfo{Cards: cards}, nil
+}
+
+// 入力タイプに応じた既存デッキ向けのカード生成プロンプト
+func cardsPrompt(input *generationInput) (string, error) {
+	switch input.Type {
+	case "text":
+		return fmt.Sprintf(`
+以下の指示に基づいてフラッシュカードを%d枚生成してください：
+%s
 
-	// JSONの抽出
-	responseText = h.extractJSON(responseText)
+以下のJSON形式で返してください：
+{
+  "cards": [
+    {
+      "front": "カードの表面（質問や単語）",
+      "back": "カードの裏面（解答や説明）"
+    }
+  ]
+}
 
-	// JSONのパース
-	var generatedCards []GeneratedCard
-	if err := json.Unmarshal([]byte(responseText), &generatedCards); err != nil {
-		return nil, fmt.Errorf("レスポンスパースエラー: %w, レスポンス: %s", err, responseText)
+重要な注意事項：
+- 必ずJSON形式で返してください
+- 他の説明文は含めないでください
+- frontとbackは必須フィールドです
+- 各カードの内容は簡潔で分かりやすくしてください
+`, input.MaxCards, input.Prompt), nil
+	case "image":
+		return fmt.Sprintf(ImageAnalysisPrompt, input.MaxCards), nil
+	case "audio":
+		return fmt.Sprintf(AudioAnalysisPrompt, input.MaxCards), nil
+	case "document":
+		return documentPrompt(input), nil
+	case "html":
+		return fmt.Sprintf(ArticleAnalysisPrompt, input.MaxCards, input.Title, input.Prompt), nil
+	case "subtitles":
+		return subtitlePrompt(input), nil
+	default:
+		return "", fmt.Errorf("サポートされていない生成タイプ: %s", input.Type)
 	}
+}
 
+// processCardsResponse saves the valid generated cards in the user's deck and
+// returns the cards left out with the reason
+func (h *AIGenerateHandler) processCardsResponse(ctx context.Context, generatedCards []GeneratedCard, userID, deckID uint, generationType string, markup bool) ([]models.Card, []RejectedCard, error) {
 	// カードの検証と変換
 	var cards []models.Card
+	var rejected []RejectedCard
 	for _, genCard := range generatedCards {
 		if err := h.validateCard(&genCard); err != nil {
-			continue // 無効なカードはスキップ
+			rejected = append(rejected, RejectedCard{Front: genCard.Front, Reason: err.Error()})
+			continue
 		}
 
 		card := models.Card{
@@ -597,49 +1070,74 @@ func (h *AIGenerateHandler) processGeminiResponse(ctx context.Context, resp *gen
 			Front:          genCard.Front,
 			Back:           genCard.Back,
 			GenerationType: generationType,
+			SourceRef:      genCard.sourceRef(),
+			SourceText:     genCard.sourceText(),
+			ContentFormat:  services.ContentFormatMarkdown,
+			Markup:         markup,
+		}
+		if err := services.SanitizeCard(&card); err != nil {
+			// 安全でないカードは作成しない
+			rejected = append(rejected, RejectedCard{Front: genCard.Front, Reason: err.Error()})
+			continue
 		}
 		cards = append(cards, card)
 	}
 
 	if len(cards) == 0 {
-		return nil, fmt.Errorf("有効なカードが生成されませんでした")
+		return nil, rejected, errNoValidCards
 	}
 
 	// データベースに保存
-	if err := h.saveCards(ctx, cards); err != nil {
-		return nil, fmt.Errorf("カード保存エラー: %w", err)
+	if err := h.saveCards(ctx, userID, cards); err != nil {
+		return nil, nil, fmt.Errorf("カード保存エラー: %w", err)
 	}
 
-	return cards, nil
+	return cards, rejected, nil
 }
 
-func (h *AIGenerateHandler) extractJSON(responseText string) string {
-	responseText = strings.TrimSpace(responseText)
-	if strings.Contains(responseText, "```json") {
-		start := strings.Index(responseText, "```json") + 7
-		end := strings.LastIndex(responseText, "```")
-		if start < end {
-			responseText = responseText[start:end]
+func (h *AIGenerateHandler) validateImageFile(header *multipart.FileHeader) error {
+	// ファイルサイズチェック
+	if header.Size > MaxImageSize {
+		return fmt.Errorf("ファイルサイズが大きすぎます（最大20MB）")
+	}
+
+	// MIMEタイプチェック
+	contentType := header.Header.Get("Content-Type")
+	for _, allowed := range AllowedImageTypes {
+		if contentType == allowed {
+			return nil
 		}
-	} else if strings.Contains(responseText, "```") {
-		start := strings.Index(responseText, "```") + 3
-		end := strings.LastIndex(responseText, "```")
-		if start < end {
-			responseText = responseText[start:end]
+	}
+
+	return fmt.Errorf("サポートされていないファイル形式: %s", contentType)
+}
+
+func (h *AIGenerateHandler) validateAudioFile(header *multipart.FileHeader) error {
+	// ファイルサイズチェック
+	if header.Size > MaxAudioSize {
+		return fmt.Errorf("ファイルサイズが大きすぎます（最大50MB）")
+	}
+
+	// MIMEタイプチェック
+	contentType := header.Header.Get("Content-Type")
+	for _, allowed := range AllowedAudioTypes {
+		if contentType == allowed {
+			return nil
 		}
 	}
-	return strings.TrimSpace(responseText)
+
+	return fmt.Errorf("サポートされていないファイル形式: %s", contentType)
 }
 
-func (h *AIGenerateHandler) validateImageFile(header *multipart.FileHeader) error {
+func (h *AIGenerateHandler) validateDocumentFile(header *multipart.FileHeader) error {
 	// ファイルサイズチェック
-	if header.Size > MaxImageSize {
-		return fmt.Errorf("ファイルサイズが大きすぎます（最大20MB）")
+	if header.Size > MaxDocumentSize {
+		return fmt.Errorf("ファイルサイズが大きすぎます（最大30MB）")
 	}
 
 	// MIMEタイプチェック
 	contentType := header.Header.Get("Content-Type")
-	for _, allowed := range AllowedImageTypes {
+	for _, allowed := range AllowedDocumentTypes {
 		if contentType == allowed {
 			return nil
 		}
@@ -648,16 +1146,33 @@ func (h *AIGenerateHandler) validateImageFile(header *multipart.FileHeader) erro
 	return fmt.Errorf("サポートされていないファイル形式: %s", contentType)
 }
 
-func (h *AIGenerateHandler) validateAudioFile(header *multipart.FileHeader) error {
+func (h *AIGenerateHandler) validateHTMLFile(header *multipart.FileHeader) error {
+	// ファイルサイズチェック
+	if header.Size > MaxHTMLSize {
+		return fmt.Errorf("ファイルサイズが大きすぎます（最大5MB）")
+	}
+
+	// MIMEタイプチェック（charset などのパラメータは無視する）
+	contentType, _, _ := strings.Cut(header.Header.Get("Content-Type"), ";")
+	for _, allowed := range AllowedHTMLTypes {
+		if strings.TrimSpace(contentType) == allowed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("サポートされていないファイル形式: %s", contentType)
+}
+
+func (h *AIGenerateHandler) validateSubtitleFile(header *multipart.FileHeader) error {
 	// ファイルサイズチェック
-	if header.Size > MaxAudioSize {
-		return fmt.Errorf("ファイルサイズが大きすぎます（最大50MB）")
+	if header.Size > MaxSubtitleSize {
+		return fmt.Errorf("ファイルサイズが大きすぎます（最大2MB）")
 	}
 
-	// MIMEタイプチェック
-	contentType := header.Header.Get("Content-Type")
-	for _, allowed := range AllowedAudioTypes {
-		if contentType == allowed {
+	// MIMEタイプチェック（charset などのパラメータは無視する）
+	contentType, _, _ := strings.Cut(header.Header.Get("Content-Type"), ";")
+	for _, allowed := range AllowedSubtitleTypes {
+		if strings.TrimSpace(contentType) == allowed {
 			return nil
 		}
 	}
@@ -681,32 +1196,126 @@ func (h *AIGenerateHandler) validateCard(card *GeneratedCard) error {
 	return nil
 }
 
-func (h *AIGenerateHandler) saveCards(ctx context.Context, cards []models.Card) error {
-	return h.db.WithContext(ctx).Create(&cards).Error
+// saveCards saves cards of a single deck, each with a Basic note of the
+// user. The caller has checked that the deck belongs to the user.
+func (h *AIGenerateHandler) saveCards(ctx context.Context, userID uint, cards []models.Card) error {
+	if len(cards) == 0 {
+		return nil
+	}
+	return services.CreateBasicCards(h.db.WithContext(ctx), userID, cards)
 }
 
 func (h *AIGenerateHandler) handleError(c *gin.Context, ctx context.Context, err error) {
+	refundProviderFailure(c, err)
+	status, body := aiErrorResponse(ctx, err)
+	writeAIError(c, status, body)
+}
+
+// writeAIError sends an error response, passing on the provider's Retry-After
+func writeAIError(c *gin.Context, status int, body gin.H) {
+	if retryAfter, ok := body["retryAfter"]; ok {
+		c.Header("Retry-After", fmt.Sprint(retryAfter))
+	}
+	c.JSON(status, body)
+}
+
+// refundProviderFailure keeps requests the AI provider failed to serve from
+// counting towards the user's rate limit
+func refundProviderFailure(c *gin.Context, err error) {
+	if services.IsRetryableLLMError(err) {
+		ratelimit.MarkRefund(c)
+	}
+}
+
+// llmErrorResponse maps a classified provider failure to its status code and body
+func llmErrorResponse(err error) (int, gin.H, bool) {
+	switch {
+	case services.IsRetryableLLMError(err):
+		body := gin.H{
+			"error":   "AI service unavailable",
+			"message": err.Error(),
+		}
+		if retryAfter := services.LLMRetryAfter(err); retryAfter > 0 {
+			body["retryAfter"] = int(math.Ceil(retryAfter.Seconds()))
+		}
+		return http.StatusServiceUnavailable, body, true
+	case errors.Is(err, services.ErrLLMBlocked):
+		return http.StatusUnprocessableEntity, gin.H{
+			"error":   "Content blocked",
+			"message": err.Error(),
+		}, true
+	default:
+		return 0, nil, false
+	}
+}
+
+// aiErrorResponse maps a generation error to its status code and body
+func aiErrorResponse(ctx context.Context, err error) (int, gin.H) {
 	switch {
 	case ctx.Err() == context.DeadlineExceeded:
-		c.JSON(http.StatusRequestTimeout, gin.H{
+		return http.StatusRequestTimeout, gin.H{
 			"error":   "Request timeout",
 			"message": "AI generation took too long",
-		})
-	case strings.Contains(err.Error(), "無効なデッキID"):
-		c.JSON(http.StatusBadRequest, gin.H{
+		}
+	case errors.Is(err, errInvalidAIInput):
+		return http.StatusBadRequest, gin.H{
+			"error":   "Invalid input",
+			"message": err.Error(),
+		}
+	case errors.Is(err, services.ErrInvalidDocument), errors.Is(err, services.ErrUnsupportedDocument), errors.Is(err, services.ErrDocumentTooLong):
+		return http.StatusBadRequest, gin.H{
+			"error":   "Invalid document",
+			"message": err.Error(),
+		}
+	case errors.Is(err, services.ErrNoArticleContent), errors.Is(err, services.ErrPageURLNotAllowed),
+		errors.Is(err, services.ErrPageNotFound), errors.Is(err, services.ErrPageFetchDisabled):
+		return http.StatusBadRequest, gin.H{
+			"error":   "Invalid page",
+			"message": err.Error(),
+		}
+	case errors.Is(err, services.ErrInvalidSubtitles), errors.Is(err, services.ErrSubtitlesTooLong):
+		return http.StatusBadRequest, gin.H{
+			"error":   "Invalid subtitles",
+			"message": err.Error(),
+		}
+	case errors.Is(err, services.ErrPageFetchFailed):
+		return http.StatusBadGateway, gin.H{
+			"error":   "Page fetch failed",
+			"message": err.Error(),
+		}
+	case errors.Is(err, services.ErrLLMInputUnsupported):
+		return http.StatusBadRequest, gin.H{
+			"error":   "Unsupported input",
+			"message": err.Error(),
+		}
+	case errors.Is(err, errInvalidDeckID):
+		return http.StatusBadRequest, gin.H{
 			"error":   "Invalid deck ID",
 			"message": err.Error(),
-		})
-	case strings.Contains(err.Error(), "有効なカードが生成されませんでした"):
-		c.JSON(http.StatusUnprocessableEntity, gin.H{
+		}
+	case errors.Is(err, errDeckNotFound):
+		return http.StatusNotFound, gin.H{
+			"error":   "Deck not found",
+			"message": err.Error(),
+		}
+	case errors.Is(err, errNoValidCards):
+		return http.StatusUnprocessableEntity, gin.H{
 			"error":   "No valid cards generated",
 			"message": err.Error(),
-		})
+		}
+	case errors.Is(err, errAllCardsDuplicate):
+		return http.StatusConflict, gin.H{
+			"error":   "All cards are duplicates",
+			"message": err.Error(),
+		}
 	default:
-		c.JSON(http.StatusInternalServerError, gin.H{
+		if status, body, ok := llmErrorResponse(err); ok {
+			return status, body
+		}
+		return http.StatusInternalServerError, gin.H{
 			"error":   "Internal server error",
 			"message": err.Error(),
-		})
+		}
 	}
 }
 
@@ -715,27 +1324,7 @@ func (h *AIGenerateHandler) GeneratePreview(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 120*time.Second)
 	defer cancel()
 
-	// 入力タイプの判定
-	inputType := h.determineInputType(c)
-
-	var previewResp *PreviewResponse
-	var err error
-
-	switch inputType {
-	case "text":
-		previewResp, err = h.handleTextPreview(ctx, c)
-	case "image":
-		previewResp, err = h.handleImagePreview(ctx, c)
-	case "audio":
-		previewResp, err = h.handleAudioPreview(ctx, c)
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Invalid input",
-			"message": "テキスト、画像、または音声のいずれかを入力してください",
-		})
-		return
-	}
-
+	previewResp, err := h.runPreview(ctx, c)
 	if err != nil {
 		h.handleError(c, ctx, err)
 		return
@@ -747,6 +1336,15 @@ func (h *AIGenerateHandler) GeneratePreview(c *gin.Context) {
 	})
 }
 
+// 入力に応じてプレビューを生成
+func (h *AIGenerateHandler) runPreview(ctx context.Context, c *gin.Context) (*PreviewResponse, error) {
+	input, err := h.parseGenerationInput(c)
+	if err != nil {
+		return nil, err
+	}
+	return h.previewFromInput(ctx, input)
+}
+
 // プレビュー確定エンドポイント
 func (h *AIGenerateHandler) ConfirmPreview(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
@@ -811,6 +1409,7 @@ func (h *AIGenerateHandler) ConfirmPreview(c *gin.Context) {
 
 	// デッキの作成または取得
 	var deck models.Deck
+	var existingDeckID uint64
 	if req.DeckID != "" {
 		// 既存デッキに追加
 		deckID, err := strconv.ParseUint(req.DeckID, 10, 32)
@@ -829,37 +1428,104 @@ func (h *AIGenerateHandler) ConfirmPreview(c *gin.Context) {
 			})
 			return
 		}
-	} else {
-		// 新規デッキ作成
-		deck = models.Deck{
-			UserID:      user.ID,
-			Title:       previewCards[0].DeckTitle,
-			Description: previewCards[0].DeckDescription,
-		}
+		existingDeckID = deckID
+	}
 
-		if err := h.db.WithContext(ctx).Create(&deck).Error; err != nil {
+	// 重複チェック
+	var duplicates, skipped []services.FlaggedDuplicate
+	if req.DuplicateCheck != "" {
+		index, err := h.detector.NewIndex(user.ID, uint(existingDeckID), req.DuplicateScope)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "Failed to create deck",
-				"message": "デッキ作成に失敗しました",
+				"error":   "Duplicate check failed",
+				"message": "重複チェックに失敗しました",
+			})
+			return
+		}
+
+		var kept []models.CardPreview
+		for _, previewCard := range previewCards {
+			matches := index.Match(previewCard.Front)
+			index.Add(0, deck.ID, previewCard.Front)
+
+			if len(matches) == 0 {
+				kept = append(kept, previewCard)
+				continue
+			}
+
+			flagged := services.FlaggedDuplicate{Front: previewCard.Front, Matches: matches}
+			if req.DuplicateCheck == services.DuplicateCheckSkip {
+				skipped = append(skipped, flagged)
+				continue
+			}
+			duplicates = append(duplicates, flagged)
+			kept = append(kept, previewCard)
+		}
+
+		if len(kept) == 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "All cards are duplicates",
+				"message": "すべてのカードが既存のカードと重複しています",
+				"skipped": skipped,
 			})
 			return
 		}
+		previewCards = kept
 	}
 
 	// プレビューカードを正式なカードに変換
 	var cards []models.Card
+	var rejected []RejectedCard
 	for _, previewCard := range previewCards {
 		card := models.Card{
-			DeckID:         deck.ID,
 			Front:          previewCard.Front,
 			Back:           previewCard.Back,
 			GenerationType: previewCard.GenerationType,
+			SourceRef:      previewCard.SourceRef,
+			SourceText:     previewCard.SourceText,
+			ContentFormat:  services.ContentFormatMarkdown,
+			Markup:         previewCard.Markup,
+		}
+		if err := services.SanitizeCard(&card); err != nil {
+			// 安全でないカードは作成しない
+			rejected = append(rejected, RejectedCard{Front: previewCard.Front, Reason: err.Error()})
+			continue
 		}
 		cards = append(cards, card)
 	}
 
+	if len(cards) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":    "No valid cards generated",
+			"message":  errNoValidCards.Error(),
+			"rejected": rejected,
+		})
+		return
+	}
+
+	if existingDeckID == 0 {
+		// 新規デッキ作成
+		deck = models.Deck{
+			UserID:      user.ID,
+			Title:       previewCards[0].DeckTitle,
+			Description: previewCards[0].DeckDescription,
+		}
+
+		if err := h.db.WithContext(ctx).Create(&deck).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to create deck",
+				"message": "デッキ作成に失敗しました",
+			})
+			return
+		}
+	}
+
+	for i := range cards {
+		cards[i].DeckID = deck.ID
+	}
+
 	// カードの保存
-	if err := h.db.WithContext(ctx).Create(&cards).Error; err != nil {
+	if err := services.CreateBasicCards(h.db.WithContext(ctx), user.ID, cards); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to save cards",
 			"message": "カードの保存に失敗しました",
@@ -876,8 +1542,11 @@ func (h *AIGenerateHandler) ConfirmPreview(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data": gin.H{
-			"deck":  deck,
-			"cards": cards,
+			"deck":       deck,
+			"cards":      cards,
+			"duplicates": duplicates,
+			"skipped":    skipped,
+			"rejected":   rejected,
 		},
 	})
 }
@@ -944,50 +1613,46 @@ func (h *AIGenerateHandler) RegenerateWithFeedback(c *gin.Context) {
 		return
 	}
 
-	// フィードバック付きプロンプトの作成
+	// 元のプレビューの生成条件
 	originalPrompt := existingPreview[0].OriginalPrompt
 	generationType := existingPreview[0].GenerationType
+	markup := existingPreview[0].Markup
 
-	var promptTemplate string
+	// 元の入力を復元し、初回の生成と同じく分割して再生成する
+	input := &generationInput{
+		Type:     generationType,
+		MaxCards: len(existingPreview),
+		Markup:   markup,
+		feedback: req.Feedback,
+	}
 	switch generationType {
 	case "text":
-		promptTemplate = fmt.Sprintf(`以下のトピックについて、フィードバックを反映して教育的価値の高いフラッシュカードを%d枚生成し、適切なデッキ名と説明も作成してください：
-
-トピック: %s
-
-ユーザーフィードバック: %s
-
-以下のJSON形式で返してください：
-{
-  "title": "デッキのタイトル（フィードバックを反映して改善）",
-  "description": "デッキの説明（フィードバックを反映して改善）",
-  "cards": [
-    {
-      "front": "質問や学習ポイント",
-      "back": "詳細な説明や答え"
-    }
-  ]
-}
-
-重要：JSON形式のみを返し、他の説明は含めないでください。`, len(existingPreview), originalPrompt, req.Feedback)
+		input.Prompt = originalPrompt
+	case "html":
+		// 記事の本文は OriginalPrompt に、タイトルはデッキ名に保存されている
+		input.Prompt = originalPrompt
+		input.Title = existingPreview[0].DeckTitle
+	case "subtitles":
+		// 学習者のレベルと字幕のキューは OriginalPrompt に保存されている
+		input.Level, input.Cues = parseSubtitleSource(originalPrompt)
+	case "document":
+		// 元の文書のページのテキストは OriginalPrompt に保存されている
+		input.Pages = parseDocumentPages(originalPrompt)
+		if len(input.Pages) == 0 {
+			// スキャンしたPDFなど、添付ファイルのみから生成したプレビュー
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "No source text",
+				"message": "テキストを抽出できなかった文書のプレビューは再生成できません",
+			})
+			return
+		}
 	case "image", "audio":
-		promptTemplate = fmt.Sprintf(`前回の生成結果に対するフィードバックを反映して、教育的価値の高いフラッシュカードを%d枚再生成し、適切なデッキ名と説明も作成してください。
-
-ユーザーフィードバック: %s
-
-以下のJSON形式で返してください：
-{
-  "title": "デッキのタイトル（フィードバックを反映して改善）",
-  "description": "デッキの説明（フィードバックを反映して改善）",
-  "cards": [
-    {
-      "front": "質問や学習ポイント",
-      "back": "詳細な説明や答え"
-    }
-  ]
-}
-
-重要：JSON形式のみを返し、他の説明は含めないでください。`, len(existingPreview), req.Feedback)
+		// メディアファイルはプレビューに保存していないため、元の入力を復元できない
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":   "No source text",
+			"message": "画像・音声から生成したプレビューは再生成できません",
+		})
+		return
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "Unsupported generation type",
@@ -996,26 +1661,29 @@ func (h *AIGenerateHandler) RegenerateWithFeedback(c *gin.Context) {
 		return
 	}
 
-	// Gemini APIで再生成
-	model := h.geminiClient.GenerativeModel("gemini-2.0-flash")
-	model.SetTemperature(0.7)
-	model.SetMaxOutputTokens(3000)
-
-	resp, err := model.GenerateContent(ctx, genai.Text(promptTemplate))
+	// LLMで再生成（ページ番号や字幕のキューの検証も初回の生成と同じく行われる）
+	deckInfo, err := h.generateInChunks(ctx, input, h.generateDeckChunk)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "AI generation failed",
-			"message": "AI生成に失敗しました",
-		})
+		h.handleError(c, ctx, err)
 		return
 	}
+	withInputTitle(deckInfo, input)
+
+	var skipped []services.FlaggedDuplicate
+	if generationType == "subtitles" {
+		if skipped, err = h.skipKnownCards(ctx, user.ID, deckInfo); err != nil {
+			h.handleError(c, ctx, err)
+			return
+		}
+	}
 
 	// レスポンス処理
-	previewResp, err := h.processRegenerateResponse(ctx, resp, user.ID, generationType, originalPrompt, req.SessionID)
+	previewResp, err := h.processRegenerateResponse(ctx, deckInfo, user.ID, generationType, originalPrompt, req.SessionID, markup)
 	if err != nil {
 		h.handleError(c, ctx, err)
 		return
 	}
+	previewResp.Skipped = skipped
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -1023,179 +1691,51 @@ func (h *AIGenerateHandler) RegenerateWithFeedback(c *gin.Context) {
 	})
 }
 
-// テキストプレビュー処理
-func (h *AIGenerateHandler) handleTextPreview(ctx context.Context, c *gin.Context) (*PreviewResponse, error) {
-	prompt := c.PostForm("prompt")
-	if prompt == "" {
-		return nil, fmt.Errorf("プロンプトを入力してください")
-	}
-
-	maxCards, _ := strconv.Atoi(c.PostForm("maxCards"))
-	if maxCards == 0 {
-		maxCards = 20
-	}
-
-	userIDStr, exists := c.Get("userID")
-	if !exists {
-		return nil, fmt.Errorf("ユーザー認証情報が見つかりません")
-	}
-
-	userID, ok := userIDStr.(string)
-	if !ok {
-		return nil, fmt.Errorf("無効なユーザーID形式")
-	}
-
+// 生成パラメータに応じてプレビューを生成
+func (h *AIGenerateHandler) previewFromInput(ctx context.Context, input *generationInput) (*PreviewResponse, error) {
 	var user models.User
-	if err := h.db.WithContext(ctx).Where("clerk_id = ?", userID).First(&user).Error; err != nil {
+	if err := h.db.WithContext(ctx).Where("clerk_id = ?", input.ClerkID).First(&user).Error; err != nil {
 		return nil, fmt.Errorf("ユーザーが見つかりません: %w", err)
 	}
 
-	promptTemplate := fmt.Sprintf(TextAnalysisPrompt, maxCards, prompt)
-
-	return h.generatePreviewCards(ctx, promptTemplate, user.ID, "text", prompt, nil, "")
-}
-
-// 画像プレビュー処理
-func (h *AIGenerateHandler) handleImagePreview(ctx context.Context, c *gin.Context) (*PreviewResponse, error) {
-	file, header, err := c.Request.FormFile("image")
+	deckInfo, err := h.generateInChunks(ctx, input, h.generateDeckChunk)
 	if err != nil {
-		return nil, fmt.Errorf("画像ファイルの取得に失敗: %w", err)
-	}
-	defer file.Close()
-
-	if err := h.validateImageFile(header); err != nil {
 		return nil, err
 	}
+	withInputTitle(deckInfo, input)
 
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("ファイル読み込みエラー: %w", err)
-	}
-
-	maxCards, _ := strconv.Atoi(c.PostForm("maxCards"))
-	if maxCards == 0 {
-		maxCards = 20
-	}
-
-	userIDStr, exists := c.Get("userID")
-	if !exists {
-		return nil, fmt.Errorf("ユーザー認証情報が見つかりません")
-	}
-
-	userID, ok := userIDStr.(string)
-	if !ok {
-		return nil, fmt.Errorf("無効なユーザーID形式")
-	}
-
-	var user models.User
-	if err := h.db.WithContext(ctx).Where("clerk_id = ?", userID).First(&user).Error; err != nil {
-		return nil, fmt.Errorf("ユーザーが見つかりません: %w", err)
+	var skipped []services.FlaggedDuplicate
+	if input.Type == "subtitles" {
+		if skipped, err = h.skipKnownCards(ctx, user.ID, deckInfo); err != nil {
+			return nil, err
+		}
 	}
 
-	promptTemplate := fmt.Sprintf(ImageAnalysisPrompt, maxCards)
-
-	return h.generatePreviewCards(ctx, promptTemplate, user.ID, "image", "", fileData, header.Header.Get("Content-Type"))
-}
-
-// 音声プレビュー処理
-func (h *AIGenerateHandler) handleAudioPreview(ctx context.Context, c *gin.Context) (*PreviewResponse, error) {
-	file, header, err := c.Request.FormFile("audio")
+	previewResp, err := h.savePreviewCards(ctx, deckInfo, user.ID, input.Type, input.originalPrompt(), input.Markup)
 	if err != nil {
-		return nil, fmt.Errorf("音声ファイルの取得に失敗: %w", err)
-	}
-	defer file.Close()
-
-	if err := h.validateAudioFile(header); err != nil {
 		return nil, err
 	}
-
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("ファイル読み込みエラー: %w", err)
-	}
-
-	maxCards, _ := strconv.Atoi(c.PostForm("maxCards"))
-	if maxCards == 0 {
-		maxCards = 20
-	}
-
-	userIDStr, exists := c.Get("userID")
-	if !exists {
-		return nil, fmt.Errorf("ユーザー認証情報が見つかりません")
-	}
-
-	userID, ok := userIDStr.(string)
-	if !ok {
-		return nil, fmt.Errorf("無効なユーザーID形式")
-	}
-
-	var user models.User
-	if err := h.db.WithContext(ctx).Where("clerk_id = ?", userID).First(&user).Error; err != nil {
-		return nil, fmt.Errorf("ユーザーが見つかりません: %w", err)
-	}
-
-	promptTemplate := fmt.Sprintf(AudioAnalysisPrompt, maxCards)
-
-	return h.generatePreviewCards(ctx, promptTemplate, user.ID, "audio", "", fileData, header.Header.Get("Content-Type"))
+	previewResp.Skipped = skipped
+	return previewResp, nil
 }
 
-// プレビューカード生成の共通処理
-func (h *AIGenerateHandler) generatePreviewCards(ctx context.Context, promptTemplate string, userID uint, generationType string, originalPrompt string, fileData []byte, mimeType string) (*PreviewResponse, error) {
+// プレビューカード保存の共通処理
+func (h *AIGenerateHandler) savePreviewCards(ctx context.Context, deckInfo *GeneratedDeckInfo, userID uint, generationType string, originalPrompt string, markup bool) (*PreviewResponse, error) {
 	// セッションIDの生成
 	sessionID, err := h.generateSessionID()
 	if err != nil {
 		return nil, fmt.Errorf("セッションID生成エラー: %w", err)
 	}
 
-	// Gemini APIモデルの取得
-	model := h.geminiClient.GenerativeModel("gemini-2.0-flash")
-	model.SetTemperature(0.7)
-	model.SetMaxOutputTokens(3000)
-
-	var resp *genai.GenerateContentResponse
-
-	// コンテンツ生成
-	if generationType == "text" {
-		resp, err = model.GenerateContent(ctx, genai.Text(promptTemplate))
-	} else {
-		parts := []genai.Part{
-			genai.Text(promptTemplate),
-			genai.Blob{
-				MIMEType: mimeType,
-				Data:     fileData,
-			},
-		}
-		resp, err = model.GenerateContent(ctx, parts...)
-	}
-
-	if err != nil {
-		return nil, fmt.Errorf("AI生成エラー: %w", err)
-	}
-
-	// レスポンステキストの取得
-	responseText := ""
-	for _, part := range resp.Candidates[0].Content.Parts {
-		if textPart, ok := part.(genai.Text); ok {
-			responseText += string(textPart)
-		}
-	}
-
-	// JSONの抽出
-	responseText = h.extractJSON(responseText)
-
-	// JSONのパース
-	var deckInfo GeneratedDeckInfo
-	if err := json.Unmarshal([]byte(responseText), &deckInfo); err != nil {
-		return nil, fmt.Errorf("レスポンスパースエラー: %w, レスポンス: %s", err, responseText)
-	}
-
 	// プレビューカードの作成
 	expiresAt := time.Now().Add(24 * time.Hour) // 24時間後に期限切れ
 	var previewCards []models.CardPreview
 
+	var rejected []RejectedCard
 	for _, genCard := range deckInfo.Cards {
 		if err := h.validateCard(&genCard); err != nil {
-			continue // 無効なカードはスキップ
+			rejected = append(rejected, RejectedCard{Front: genCard.Front, Reason: err.Error()})
+			continue
 		}
 
 		previewCard := models.CardPreview{
@@ -1205,15 +1745,18 @@ func (h *AIGenerateHandler) generatePreviewCards(ctx context.Context, promptTemp
 			Front:           genCard.Front,
 			Back:            genCard.Back,
 			GenerationType:  generationType,
+			SourceRef:       genCard.sourceRef(),
+			SourceText:      genCard.sourceText(),
 			SessionID:       sessionID,
 			ExpiresAt:       expiresAt,
 			OriginalPrompt:  originalPrompt,
+			Markup:          markup,
 		}
 		previewCards = append(previewCards, previewCard)
 	}
 
 	if len(previewCards) == 0 {
-		return nil, fmt.Errorf("有効なカードが生成されませんでした")
+		return nil, errNoValidCards
 	}
 
 	// プレビューカードの保存
@@ -1227,32 +1770,12 @@ func (h *AIGenerateHandler) generatePreviewCards(ctx context.Context, promptTemp
 		DeckDescription: deckInfo.Description,
 		Cards:           previewCards,
 		ExpiresAt:       expiresAt,
+		Rejected:        rejected,
 	}, nil
 }
 
 // 再生成レスポンス処理
-func (h *AIGenerateHandler) processRegenerateResponse(ctx context.Context, resp *genai.GenerateContentResponse, userID uint, generationType string, originalPrompt string, sessionID string) (*PreviewResponse, error) {
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, fmt.Errorf("AIからの応答が空です")
-	}
-
-	// レスポンステキストの取得
-	responseText := ""
-	for _, part := range resp.Candidates[0].Content.Parts {
-		if textPart, ok := part.(genai.Text); ok {
-			responseText += string(textPart)
-		}
-	}
-
-	// JSONの抽出
-	responseText = h.extractJSON(responseText)
-
-	// JSONのパース
-	var deckInfo GeneratedDeckInfo
-	if err := json.Unmarshal([]byte(responseText), &deckInfo); err != nil {
-		return nil, fmt.Errorf("レスポンスパースエラー: %w, レスポンス: %s", err, responseText)
-	}
-
+func (h *AIGenerateHandler) processRegenerateResponse(ctx context.Context, deckInfo *GeneratedDeckInfo, userID uint, generationType string, originalPrompt string, sessionID string, markup bool) (*PreviewResponse, error) {
 	// 既存プレビューカードの削除
 	if err := h.db.WithContext(ctx).Where("session_id = ?", sessionID).Delete(&models.CardPreview{}).Error; err != nil {
 		return nil, fmt.Errorf("既存プレビューカード削除エラー: %w", err)
@@ -1262,8 +1785,10 @@ func (h *AIGenerateHandler) processRegenerateResponse(ctx context.Context, resp
 	expiresAt := time.Now().Add(24 * time.Hour)
 	var previewCards []models.CardPreview
 
+	var rejected []RejectedCard
 	for _, genCard := range deckInfo.Cards {
 		if err := h.validateCard(&genCard); err != nil {
+			rejected = append(rejected, RejectedCard{Front: genCard.Front, Reason: err.Error()})
 			continue
 		}
 
@@ -1274,15 +1799,18 @@ func (h *AIGenerateHandler) processRegenerateResponse(ctx context.Context, resp
 			Front:           genCard.Front,
 			Back:            genCard.Back,
 			GenerationType:  generationType,
+			SourceRef:       genCard.sourceRef(),
+			SourceText:      genCard.sourceText(),
 			SessionID:       sessionID,
 			ExpiresAt:       expiresAt,
 			OriginalPrompt:  originalPrompt,
+			Markup:          markup,
 		}
 		previewCards = append(previewCards, previewCard)
 	}
 
 	if len(previewCards) == 0 {
-		return nil, fmt.Errorf("有効なカードが生成されませんでした")
+		return nil, errNoValidCards
 	}
 
 	// プレビューカードの保存
@@ -1296,6 +1824,7 @@ func (h *AIGenerateHandler) processRegenerateResponse(ctx context.Context, resp
 		DeckDescription: deckInfo.Description,
 		Cards:           previewCards,
 		ExpiresAt:       expiresAt,
+		Rejected:        rejected,
 	}, nil
 }
 
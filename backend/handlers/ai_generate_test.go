@@ -0,0 +1,629 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/muratayousuke/ai-flashcards/test/fixtures"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func setupAIGenerateTestRouter(t *testing.T, llm services.LLMProvider) (*gin.Engine, *gorm.DB, *models.User, func()) {
+	db, cleanup := test.SetupTestDB()
+
+	user := test.CreateTestUser(db)
+	t.Setenv("MEDIA_STORAGE_DIR", t.TempDir())
+
+	handler := NewAIGenerateHandlerWithProvider(db, llm, services.NewMemoryJobQueue())
+	transcribeHandler := NewAudioTranscribeHandlerWithProvider(llm)
+
+	r := test.SetupRouter()
+
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(user.ClerkID))
+	api.POST("/cards/ai_generate", handler.GenerateCards)
+	api.POST("/cards/ai_generate/stream", handler.GenerateCardsStream)
+	api.POST("/cards/ai_preview", handler.GeneratePreview)
+	api.POST("/cards/ai_preview/stream", handler.GeneratePreviewStream)
+	api.POST("/cards/ai_confirm", handler.ConfirmPreview)
+	api.POST("/cards/ai_regenerate", handler.RegenerateWithFeedback)
+	api.POST("/audio/transcribe", transcribeHandler.TranscribeAudio)
+
+	return r, db, user, cleanup
+}
+
+// postAIForm posts a multipart form, attaching the file under fileField when given
+func postAIForm(r *gin.Engine, path string, fields map[string]string, fileField, mimeType string, data []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newAIFormRequest(path, fields, fileField, mimeType, data))
+	return w
+}
+
+func newAIFormRequest(path string, fields map[string]string, fileField, mimeType string, data []byte) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for key, value := range fields {
+		_ = mw.WriteField(key, value)
+	}
+	if fileField != "" {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="upload"`, fileField))
+		header.Set("Content-Type", mimeType)
+		part, _ := mw.CreatePart(header)
+		_, _ = part.Write(data)
+	}
+	_ = mw.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, path, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestAIGenerateWithFakeProvider(t *testing.T) {
+	t.Run("テキストから新規デッキとカードを生成", func(t *testing.T) {
+		llm := services.NewFakeLLMProvider()
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成", "maxCards": "3"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var deck models.Deck
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&deck).Error)
+		assert.Equal(t, "Fake deck", deck.Title)
+
+		var count int64
+		require.NoError(t, db.Model(&models.Card{}).Where("deck_id = ?", deck.ID).Count(&count).Error)
+		assert.Equal(t, int64(3), count)
+
+		prompts := llm.Prompts()
+		require.Len(t, prompts, 1)
+		assert.Contains(t, prompts[0], "光合成")
+	})
+
+	t.Run("既存デッキに画像からカードを追加", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: `[{"front": "Q", "back": "A"}]`}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		deck := models.Deck{UserID: user.ID, Title: "既存デッキ"}
+		require.NoError(t, db.Create(&deck).Error)
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"deckId": fmt.Sprint(deck.ID)}, "image", "image/png", []byte("png"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var cards []models.Card
+		require.NoError(t, db.Where("deck_id = ?", deck.ID).Find(&cards).Error)
+		require.Len(t, cards, 1)
+		assert.Equal(t, "image", cards[0].GenerationType)
+	})
+
+	t.Run("記法が不正なカードは理由とともに返す", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: `{"title": "数学", "description": "説明", "cards": [` +
+			`{"front": "$x + 1", "back": "閉じていない数式"}, {"front": "$x^2$ の微分", "back": "$2x$"}]}`}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "微分", "markup": "true"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp struct {
+			Data AIGenerateResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Data.Cards, 1)
+		require.Len(t, resp.Data.Rejected, 1)
+		assert.Equal(t, "$x + 1", resp.Data.Rejected[0].Front)
+		assert.Contains(t, resp.Data.Rejected[0].Reason, "front")
+
+		// 確定時に安全でないと判定されたカードも返す
+		previews := []models.CardPreview{
+			{UserID: user.ID, DeckTitle: "数学", Front: "$x + 1", Back: "A", GenerationType: "text", SessionID: "session", ExpiresAt: time.Now().Add(time.Hour), Markup: true},
+			{UserID: user.ID, DeckTitle: "数学", Front: "$y$", Back: "B", GenerationType: "text", SessionID: "session", ExpiresAt: time.Now().Add(time.Hour), Markup: true},
+		}
+		require.NoError(t, db.Create(&previews).Error)
+
+		body, _ := json.Marshal(map[string]string{"sessionId": "session"})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cards/ai_confirm", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var confirmed struct {
+			Data struct {
+				Cards    []models.Card  `json:"cards"`
+				Rejected []RejectedCard `json:"rejected"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &confirmed))
+		require.Len(t, confirmed.Data.Cards, 1)
+		assert.Equal(t, "$y$", confirmed.Data.Cards[0].Front)
+		require.Len(t, confirmed.Data.Rejected, 1)
+		assert.Equal(t, "$x + 1", confirmed.Data.Rejected[0].Front)
+	})
+
+	t.Run("プレビュー・再生成・確定", func(t *testing.T) {
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_preview", map[string]string{"prompt": "元素記号"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var preview struct {
+			Data PreviewResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preview))
+		assert.Len(t, preview.Data.Cards, 3)
+
+		body, _ := json.Marshal(map[string]string{"sessionId": preview.Data.SessionID, "feedback": "もっと簡単に"})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cards/ai_regenerate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		body, _ = json.Marshal(map[string]string{"sessionId": preview.Data.SessionID})
+		req, _ = http.NewRequest(http.MethodPost, "/api/cards/ai_confirm", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var deck models.Deck
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&deck).Error)
+		var count int64
+		require.NoError(t, db.Model(&models.Card{}).Where("deck_id = ?", deck.ID).Count(&count).Error)
+		assert.Equal(t, int64(3), count)
+	})
+
+	t.Run("プロバイダーのエラー", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Err: errors.New("quota exceeded")}
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成"}, "", "", nil)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), "quota exceeded")
+	})
+
+	t.Run("AIサービスの混雑は503で再試行時間を返す", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Err: &services.LLMError{
+			Kind:       services.ErrLLMRateLimited,
+			RetryAfter: 1500 * time.Millisecond,
+			Err:        errors.New("quota exceeded"),
+		}}
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成"}, "", "", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+		var body map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, "AI service unavailable", body["error"])
+		assert.EqualValues(t, 2, body["retryAfter"])
+
+		w = postAIForm(r, "/api/audio/transcribe", nil, "audio", "audio/wav", []byte("wave"))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("ブロックされた入力は422を返す", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Err: &services.LLMError{Kind: services.ErrLLMBlocked, Err: errors.New("safety")}}
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成"}, "", "", nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "Content blocked")
+	})
+
+	t.Run("無効なデッキID", func(t *testing.T) {
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成", "deckId": "abc"}, "", "", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid deck ID")
+	})
+
+	t.Run("他のユーザーのデッキには生成しない", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: `[{"front": "Q", "back": "A"}]`}
+		r, db, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		other := models.User{ClerkID: "other_clerk_id", Email: "other@example.com"}
+		require.NoError(t, db.Create(&other).Error)
+		deck := models.Deck{UserID: other.ID, Title: "他人のデッキ"}
+		require.NoError(t, db.Create(&deck).Error)
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成", "deckId": fmt.Sprint(deck.ID)}, "", "", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "Deck not found")
+		assert.Empty(t, llm.Prompts())
+
+		var count int64
+		require.NoError(t, db.Model(&models.Card{}).Where("deck_id = ?", deck.ID).Count(&count).Error)
+		assert.Zero(t, count)
+	})
+
+	t.Run("音声の文字起こし", func(t *testing.T) {
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		w := postAIForm(r, "/api/audio/transcribe", nil, "audio", "audio/wav", []byte("wave"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "fake transcript of 4 bytes of audio/wav")
+	})
+}
+
+func TestGenerateFromDocument(t *testing.T) {
+	deckResponse := `{"title": "光合成", "description": "説明", "cards": [` +
+		`{"front": "光合成とは", "back": "光で糖を作る", "page": 1}, {"front": "葉緑体とは", "back": "光合成の場", "page": 2}, {"front": "呼吸とは", "back": "糖を分解する", "page": 9}]}`
+
+	t.Run("ページごとのテキストから生成してページを記録する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: deckResponse}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		document := fixtures.BuildDOCXPages(t, "光合成は光のエネルギーで糖を作る。", "葉緑体で行われる。")
+		w := postAIForm(r, "/api/cards/ai_generate", nil, "document", services.MIMETypeDOCX, document)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		prompts := llm.Prompts()
+		require.Len(t, prompts, 1)
+		assert.Contains(t, prompts[0], "[p.1]\n光合成は光のエネルギーで糖を作る。")
+		assert.Contains(t, prompts[0], "[p.2]\n葉緑体で行われる。")
+		assert.NotContains(t, prompts[0], "添付")
+
+		var deck models.Deck
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&deck).Error)
+		var cards []models.Card
+		require.NoError(t, db.Where("deck_id = ?", deck.ID).Order("id").Find(&cards).Error)
+		require.Len(t, cards, 3)
+		assert.Equal(t, "document", cards[0].GenerationType)
+		assert.Equal(t, "p.1", cards[0].SourceRef)
+		assert.Equal(t, "p.2", cards[1].SourceRef)
+		assert.Empty(t, cards[2].SourceRef, "存在しないページは記録しない")
+	})
+
+	t.Run("プレビューの確定でページを引き継ぐ", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: deckResponse}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_preview", nil, "document", services.MIMETypeDOCX, fixtures.BuildDOCXPages(t, "一ページ目", "二ページ目"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var preview struct {
+			Data PreviewResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preview))
+		require.Len(t, preview.Data.Cards, 3)
+		assert.Equal(t, "p.2", preview.Data.Cards[1].SourceRef)
+		assert.Contains(t, preview.Data.Cards[0].OriginalPrompt, "[p.2]\n二ページ目")
+
+		body, _ := json.Marshal(map[string]string{"sessionId": preview.Data.SessionID, "feedback": "もっと簡単に"})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cards/ai_regenerate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, llm.Prompts()[1], "[p.1]\n一ページ目")
+		assert.Contains(t, llm.Prompts()[1], "もっと簡単に")
+
+		var regenerated struct {
+			Data PreviewResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &regenerated))
+		require.Len(t, regenerated.Data.Cards, 3)
+		assert.Empty(t, regenerated.Data.Cards[2].SourceRef, "存在しないページは記録しない")
+
+		body, _ = json.Marshal(map[string]string{"sessionId": preview.Data.SessionID})
+		req, _ = http.NewRequest(http.MethodPost, "/api/cards/ai_confirm", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var deck models.Deck
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&deck).Error)
+		var card models.Card
+		require.NoError(t, db.Where("deck_id = ? AND front = ?", deck.ID, "葉緑体とは").First(&card).Error)
+		assert.Equal(t, "p.2", card.SourceRef)
+	})
+
+	t.Run("長い文書のプレビューは分割して再生成する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: deckResponse}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		pages := []services.DocumentPage{
+			{Number: 1, Text: strings.Repeat("あ", 5000)},
+			{Number: 2, Text: strings.Repeat("い", 5000)},
+			{Number: 3, Text: strings.Repeat("う", 5000)},
+		}
+		regenerateDocumentPreview := func(originalPrompt string) *httptest.ResponseRecorder {
+			sessionID := fmt.Sprintf("session-%d", len(originalPrompt))
+			for i := 0; i < 3; i++ {
+				require.NoError(t, db.Create(&models.CardPreview{
+					UserID: user.ID, DeckTitle: "文書", Front: fmt.Sprintf("Q%d", i), Back: "A",
+					GenerationType: "document", SessionID: sessionID, ExpiresAt: time.Now().Add(time.Hour),
+					OriginalPrompt: originalPrompt,
+				}).Error)
+			}
+
+			body, _ := json.Marshal(map[string]string{"sessionId": sessionID, "feedback": "もっと簡単に"})
+			req, _ := http.NewRequest(http.MethodPost, "/api/cards/ai_regenerate", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		w := regenerateDocumentPreview(formatDocumentPages(pages))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		prompts := llm.Prompts()
+		require.Len(t, prompts, 3)
+		for _, prompt := range prompts {
+			assert.Contains(t, prompt, "もっと簡単に")
+			assert.False(t, strings.Contains(prompt, "[p.1]") && strings.Contains(prompt, "[p.3]"), "文書全体を1回で送らない")
+		}
+
+		// テキストのない文書からは再生成できない
+		w = regenerateDocumentPreview("")
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Len(t, llm.Prompts(), 3)
+	})
+
+	t.Run("読み込めない文書は生成しない", func(t *testing.T) {
+		llm := services.NewFakeLLMProvider()
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", nil, "document", services.MIMETypeDOCX, []byte("broken"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid document")
+
+		w = postAIForm(r, "/api/cards/ai_generate", nil, "document", "text/plain", []byte("text"))
+		assert.Contains(t, w.Body.String(), "サポートされていないファイル形式")
+		assert.Empty(t, llm.Prompts())
+	})
+}
+
+func TestGenerateFromHTML(t *testing.T) {
+	page := `<html><head><title>光合成 | 理科ブログ</title><script>track("secret")</script></head><body>
+<nav>ホーム カテゴリ</nav>
+<article><h1>光合成のしくみ</h1>
+<p>植物は光のエネルギーで二酸化炭素と水から糖を作る。</p>
+<div class="ad">今だけ半額</div>
+</article>
+<footer>© 理科ブログ</footer>
+</body></html>`
+
+	t.Run("貼り付けたHTMLの本文から生成して記事のタイトルをデッキ名にする", func(t *testing.T) {
+		llm := services.NewFakeLLMProvider()
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"html": page}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		prompts := llm.Prompts()
+		require.Len(t, prompts, 1)
+		assert.Contains(t, prompts[0], "植物は光のエネルギーで二酸化炭素と水から糖を作る。")
+		for _, chrome := range []string{"ホーム", "今だけ半額", "track", "©"} {
+			assert.NotContains(t, prompts[0], chrome)
+		}
+
+		var deck models.Deck
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&deck).Error)
+		assert.Equal(t, "光合成のしくみ", deck.Title)
+		var card models.Card
+		require.NoError(t, db.Where("deck_id = ?", deck.ID).First(&card).Error)
+		assert.Equal(t, "html", card.GenerationType)
+	})
+
+	t.Run("URLのページを取得して生成する", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "example.com", "posts"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com", "posts", "1"), []byte(page), 0o644))
+		t.Setenv("PAGE_FETCHER", services.PageFetcherLocal)
+		t.Setenv("PAGE_FETCHER_DIR", dir)
+
+		llm := services.NewFakeLLMProvider()
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_preview", map[string]string{"url": "https://example.com/posts/1"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var preview struct {
+			Data PreviewResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preview))
+		assert.Equal(t, "光合成のしくみ", preview.Data.DeckTitle)
+		require.Len(t, llm.Prompts(), 1)
+		assert.Contains(t, llm.Prompts()[0], "二酸化炭素と水から糖を作る")
+
+		w = postAIForm(r, "/api/cards/ai_generate", map[string]string{"url": "https://example.com/posts/2"}, "", "", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid page")
+
+		w = postAIForm(r, "/api/cards/ai_generate", map[string]string{"url": "ftp://example.com/posts/1"}, "", "", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Len(t, llm.Prompts(), 1)
+	})
+
+	t.Run("長い記事のプレビューは分割して再生成する", func(t *testing.T) {
+		llm := services.NewFakeLLMProvider()
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		regeneratePreview := func(generationType, originalPrompt string) *httptest.ResponseRecorder {
+			sessionID := "session-" + generationType
+			for i := 0; i < 3; i++ {
+				require.NoError(t, db.Create(&models.CardPreview{
+					UserID: user.ID, DeckTitle: "記事", Front: fmt.Sprintf("Q%d", i), Back: "A",
+					GenerationType: generationType, SessionID: sessionID, ExpiresAt: time.Now().Add(time.Hour),
+					OriginalPrompt: originalPrompt,
+				}).Error)
+			}
+
+			body, _ := json.Marshal(map[string]string{"sessionId": sessionID, "feedback": "もっと簡単に"})
+			req, _ := http.NewRequest(http.MethodPost, "/api/cards/ai_regenerate", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		article := strings.Repeat("あ", 5000) + "\n\n" + strings.Repeat("い", 5000) + "\n\n" + strings.Repeat("う", 5000)
+		w := regeneratePreview("html", article)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var regenerated struct {
+			Data PreviewResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &regenerated))
+		assert.Equal(t, "記事", regenerated.Data.DeckTitle)
+
+		prompts := llm.Prompts()
+		require.Len(t, prompts, 3)
+		for _, prompt := range prompts {
+			assert.Equal(t, 1, strings.Count(prompt, "もっと簡単に"))
+			assert.False(t, strings.Contains(prompt, strings.Repeat("あ", 100)) && strings.Contains(prompt, strings.Repeat("う", 100)), "記事全体を1回で送らない")
+		}
+
+		// メディアファイルは保存していないため再生成できない
+		w = regeneratePreview("image", "")
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Len(t, llm.Prompts(), 3)
+	})
+}
+
+func TestGenerateFromSubtitles(t *testing.T) {
+	srt := "1\n00:00:01,000 --> 00:00:03,000\n今日は雨ですね。\n\n" +
+		"2\n00:01:05,500 --> 00:01:08,000\n<i>傘を持って</i>\nいきましょう。\n"
+	deckResponse := `{"title": "雨の日の会話", "description": "説明", "cards": [` +
+		`{"front": "雨", "back": "あめ", "cue": 1}, {"front": "傘", "back": "かさ", "cue": 2}, ` +
+		`{"front": "今日は雨ですね。", "back": "It's rainy today.", "cue": 1}, {"front": "天気", "back": "てんき", "cue": 9}]}`
+
+	t.Run("レベルを指定して生成し字幕の文と時刻を記録する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: deckResponse}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		// 既に学習しているカードは作成しない
+		deck := test.CreateTestDeck(db, user.ID)
+		require.NoError(t, db.Create(&models.Card{DeckID: deck.ID, Front: "雨", Back: "rain"}).Error)
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"level": "JLPT N3"}, "subtitles", "application/x-subrip", []byte(srt))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		prompts := llm.Prompts()
+		require.Len(t, prompts, 1)
+		assert.Contains(t, prompts[0], "学習者のレベル: JLPT N3")
+		assert.Contains(t, prompts[0], "[1 00:00:01] 今日は雨ですね。\n[2 00:01:05] 傘を持っていきましょう。")
+
+		var resp struct {
+			Data AIGenerateResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Data.Skipped, 1)
+		assert.Equal(t, "雨", resp.Data.Skipped[0].Front)
+
+		var cards []models.Card
+		require.NoError(t, db.Where("deck_id = ?", resp.Data.Deck.ID).Order("id").Find(&cards).Error)
+		require.Len(t, cards, 3)
+		assert.Equal(t, "subtitles", cards[0].GenerationType)
+		assert.Equal(t, "傘", cards[0].Front)
+		assert.Equal(t, "00:01:05", cards[0].SourceRef)
+		assert.Equal(t, "傘を持っていきましょう。", cards[0].SourceText)
+		assert.Equal(t, "00:00:01", cards[1].SourceRef)
+		assert.Empty(t, cards[2].SourceRef, "存在しないキューは記録しない")
+		assert.Empty(t, cards[2].SourceText)
+	})
+
+	t.Run("プレビューの再生成と確定で字幕の文と時刻を引き継ぐ", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: deckResponse}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		vtt := "WEBVTT\n\n" + strings.ReplaceAll(srt, ",", ".")
+		w := postAIForm(r, "/api/cards/ai_preview", map[string]string{"subtitles": vtt}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var preview struct {
+			Data PreviewResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preview))
+		require.Len(t, preview.Data.Cards, 4)
+		assert.Equal(t, "00:01:05", preview.Data.Cards[1].SourceRef)
+		assert.Contains(t, llm.Prompts()[0], "学習者のレベル: "+DefaultSubtitleLevel)
+
+		body, _ := json.Marshal(map[string]string{"sessionId": preview.Data.SessionID, "feedback": "文のカードを増やして"})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cards/ai_regenerate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, llm.Prompts()[1], "[2 00:01:05] 傘を持っていきましょう。")
+		assert.Contains(t, llm.Prompts()[1], "文のカードを増やして")
+
+		body, _ = json.Marshal(map[string]string{"sessionId": preview.Data.SessionID})
+		req, _ = http.NewRequest(http.MethodPost, "/api/cards/ai_confirm", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var card models.Card
+		require.NoError(t, db.Joins("JOIN decks ON decks.id = cards.deck_id").
+			Where("decks.user_id = ? AND cards.front = ?", user.ID, "傘").First(&card).Error)
+		assert.Equal(t, "00:01:05", card.SourceRef)
+		assert.Equal(t, "傘を持っていきましょう。", card.SourceText)
+	})
+
+	t.Run("すべて既存のカードと重複する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: `[{"front": "雨", "back": "あめ", "cue": 1}]`}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		deck := test.CreateTestDeck(db, user.ID)
+		require.NoError(t, db.Create(&models.Card{DeckID: deck.ID, Front: "雨", Back: "rain"}).Error)
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"deckId": fmt.Sprint(deck.ID)}, "subtitles", "text/vtt", []byte("WEBVTT\n\n00:01.000 --> 00:02.000\n雨\n"))
+		assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "All cards are duplicates")
+	})
+
+	t.Run("字幕として読み込めない", func(t *testing.T) {
+		llm := services.NewFakeLLMProvider()
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", nil, "subtitles", "text/vtt", []byte("WEBVTT\n\nNOTE 字幕なし\n"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid subtitles")
+		assert.Empty(t, llm.Prompts())
+	})
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/ratelimit"
+	"github.com/muratayousuke/ai-flashcards/services"
+)
+
+// Kinds of generation jobs
+const (
+	jobKindGenerate = "generate"
+	jobKindPreview  = "preview"
+)
+
+// jobResponse is a job with its result decoded, which has the same content as
+// the data of the corresponding synchronous endpoint
+type jobResponse struct {
+	*models.GenerationJob
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+func newJobResponse(job *models.GenerationJob) jobResponse {
+	resp := jobResponse{GenerationJob: job}
+	if job.Result != "" {
+		resp.Result = json.RawMessage(job.Result)
+	}
+	return resp
+}
+
+// StartJobWorkers starts the workers running generation jobs in this process
+func (h *AIGenerateHandler) StartJobWorkers(ctx context.Context, workers int) {
+	h.jobs.Start(ctx, workers)
+}
+
+// StartServerlessJobWorkers sets up jobs for a serverless function, which is
+// frozen once it has responded and so cannot run jobs in the background.
+// Jobs are accepted only with a shared queue, whose jobs the workers of a
+// long-running server pick up; JOB_WORKERS defaults to 0.
+func (h *AIGenerateHandler) StartServerlessJobWorkers(ctx context.Context) {
+	if !services.SharedJobQueueFromEnv() {
+		h.jobs.DisableSubmit()
+	}
+	h.jobs.Start(ctx, services.JobWorkersFromEnv(0))
+}
+
+// ジョブとしてカードを生成するエンドポイント
+func (h *AIGenerateHandler) SubmitGenerateJob(c *gin.Context) {
+	h.submitJob(c, jobKindGenerate)
+}
+
+// ジョブとしてプレビューを生成するエンドポイント
+func (h *AIGenerateHandler) SubmitPreviewJob(c *gin.Context) {
+	h.submitJob(c, jobKindPreview)
+}
+
+func (h *AIGenerateHandler) submitJob(c *gin.Context, kind string) {
+	ctx := c.Request.Context()
+
+	input, err := h.parseGenerationInput(c)
+	if err != nil {
+		h.handleError(c, ctx, err)
+		return
+	}
+
+	var user models.User
+	if err := h.db.WithContext(ctx).Where("clerk_id = ?", input.ClerkID).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "Unauthorized",
+			"message": "ユーザーが見つかりません",
+		})
+		return
+	}
+
+	// 既存デッキへの生成は登録前にデッキの所有者を確認する
+	if kind == jobKindGenerate && !input.NewDeck {
+		if _, _, err := h.targetDeck(ctx, input); err != nil {
+			h.handleError(c, ctx, err)
+			return
+		}
+	}
+
+	// 実行時に AI サービスの障害で失敗した場合に返却できるよう、数えたリクエストを保持する
+	if charge, ok := ratelimit.ChargeOf(c); ok {
+		input.Charge = &charge
+	}
+
+	payload, err := json.Marshal(input)
+	if err != nil {
+		h.handleError(c, ctx, err)
+		return
+	}
+
+	job := models.GenerationJob{UserID: user.ID, Kind: kind, Input: string(payload)}
+	if err := h.jobs.Submit(ctx, &job, input.FileData); err != nil {
+		if errors.Is(err, services.ErrJobsUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":   "Background jobs unavailable",
+				"message": "この環境では非同期ジョブを利用できません（JOB_QUEUE=redis が必要です）",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to submit job",
+			"message": "ジョブの登録に失敗しました",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"data":    newJobResponse(&job),
+	})
+}
+
+// ジョブの状態取得エンドポイント
+func (h *AIGenerateHandler) GetJob(c *gin.Context) {
+	user, jobID, ok := h.jobRequest(c)
+	if !ok {
+		return
+	}
+
+	job, err := h.jobs.Get(c.Request.Context(), user.ID, jobID)
+	if err != nil {
+		h.handleJobError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    newJobResponse(job),
+	})
+}
+
+// ジョブのキャンセルエンドポイント
+func (h *AIGenerateHandler) CancelJob(c *gin.Context) {
+	user, jobID, ok := h.jobRequest(c)
+	if !ok {
+		return
+	}
+
+	job, err := h.jobs.Cancel(c.Request.Context(), user.ID, jobID)
+	if errors.Is(err, services.ErrJobFinished) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Job already finished",
+			"message": "ジョブはすでに終了しています",
+			"data":    newJobResponse(job),
+		})
+		return
+	}
+	if err != nil {
+		h.handleJobError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    newJobResponse(job),
+	})
+}
+
+// jobRequest returns the user and the job ID of a job endpoint request
+func (h *AIGenerateHandler) jobRequest(c *gin.Context) (*models.User, uint, bool) {
+	jobID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid job ID",
+			"message": "無効なジョブIDです",
+		})
+		return nil, 0, false
+	}
+
+	var user models.User
+	if err := h.db.WithContext(c.Request.Context()).Where("clerk_id = ?", c.GetString("userID")).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "Unauthorized",
+			"message": "ユーザーが見つかりません",
+		})
+		return nil, 0, false
+	}
+	return &user, uint(jobID), true
+}
+
+func (h *AIGenerateHandler) handleJobError(c *gin.Context, err error) {
+	if errors.Is(err, services.ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Job not found",
+			"message": "ジョブが見つかりません",
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":   "Internal server error",
+		"message": err.Error(),
+	})
+}
+
+// processJob runs a generation job on a worker. Progress is reported through
+// the same stream as the Server-Sent Events endpoints. A job the AI provider
+// failed to serve is given back to the user's rate limit, as the request
+// endpoints do.
+func (h *AIGenerateHandler) processJob(ctx context.Context, job *models.GenerationJob, media []byte, progress services.JobProgressFunc) (result any, err error) {
+	var input generationInput
+	if err := json.Unmarshal([]byte(job.Input), &input); err != nil {
+		return nil, fmt.Errorf("invalid job input: %w", err)
+	}
+	input.FileData = media
+
+	defer func() {
+		if input.Charge != nil && services.IsRetryableLLMError(err) {
+			h.refund(*input.Charge)
+		}
+	}()
+
+	stage := streamStageGenerating
+	stream := h.newGenerationStream(func(event string, data any) error {
+		switch v := data.(type) {
+		case generationProgress:
+			stage = v.Stage
+			progress(v.Stage, v.Cards)
+		case streamedCard:
+			progress(stage, v.Index+1)
+		}
+		return nil
+	})
+	stream.progress(streamStageGenerating)
+	ctx = withGenerationStream(ctx, stream)
+
+	switch job.Kind {
+	case jobKindGenerate:
+		resp, err := h.generateFromInput(ctx, &input)
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	case jobKindPreview:
+		resp, err := h.previewFromInput(ctx, &input)
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+}
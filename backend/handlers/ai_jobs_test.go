@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/ratelimit"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type jobTestResponse struct {
+	Data struct {
+		ID     uint            `json:"id"`
+		Kind   string          `json:"kind"`
+		Status string          `json:"status"`
+		Stage  string          `json:"stage"`
+		Cards  int             `json:"cards"`
+		Error  string          `json:"error"`
+		Result json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+func setupAIJobTestRouter(t *testing.T, llm services.LLMProvider) (*gin.Engine, *gorm.DB, *AIGenerateHandler, func()) {
+	t.Setenv("MEDIA_STORAGE_DIR", t.TempDir())
+
+	db, cleanup := test.SetupTestDB()
+
+	user := test.CreateTestUser(db)
+	handler := NewAIGenerateHandlerWithProvider(db, llm, services.NewMemoryJobQueue())
+	handler.jobs.CancelPollInterval = 10 * time.Millisecond
+
+	r := test.SetupRouter()
+
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(user.ClerkID))
+	// レート制限のミドルウェアと同様にリクエストを数える
+	api.Use(func(c *gin.Context) {
+		ratelimit.SetCharge(c, ratelimit.Charge{UserID: user.ClerkID, Endpoint: "ai_generate", Hourly: true, At: time.Now()})
+	})
+	api.POST("/cards/ai_generate/jobs", handler.SubmitGenerateJob)
+	api.POST("/cards/ai_preview/jobs", handler.SubmitPreviewJob)
+	api.GET("/jobs/:id", handler.GetJob)
+	api.POST("/jobs/:id/cancel", handler.CancelJob)
+
+	return r, db, handler, cleanup
+}
+
+// startJobWorkers runs one worker until the test ends
+func startJobWorkers(t *testing.T, handler *AIGenerateHandler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler.StartJobWorkers(ctx, 1)
+}
+
+func getJob(t *testing.T, r *gin.Engine, jobID uint) (int, jobTestResponse) {
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/api/jobs/%d", jobID), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp jobTestResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return w.Code, resp
+}
+
+func cancelJob(t *testing.T, r *gin.Engine, jobID uint) (int, jobTestResponse) {
+	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/api/jobs/%d/cancel", jobID), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp jobTestResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return w.Code, resp
+}
+
+func submitJob(t *testing.T, r *gin.Engine, path string, fields map[string]string, fileField, mimeType string, data []byte) jobTestResponse {
+	w := postAIForm(r, path, fields, fileField, mimeType, data)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var resp jobTestResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NotZero(t, resp.Data.ID)
+	return resp
+}
+
+// waitForJobStatus polls the job until it has the status
+func waitForJobStatus(t *testing.T, r *gin.Engine, jobID uint, status string) jobTestResponse {
+	var resp jobTestResponse
+	require.Eventually(t, func() bool {
+		_, resp = getJob(t, r, jobID)
+		return resp.Data.Status == status
+	}, 5*time.Second, 10*time.Millisecond, "job did not become %s", status)
+	return resp
+}
+
+func TestGenerationJobs(t *testing.T) {
+	t.Run("カード生成ジョブの結果を取得できる", func(t *testing.T) {
+		r, db, handler, cleanup := setupAIJobTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		submitted := submitJob(t, r, "/api/cards/ai_generate/jobs", map[string]string{"prompt": "光合成"}, "", "", nil)
+		assert.Equal(t, services.JobStatusQueued, submitted.Data.Status)
+		assert.Equal(t, jobKindGenerate, submitted.Data.Kind)
+
+		startJobWorkers(t, handler)
+		done := waitForJobStatus(t, r, submitted.Data.ID, services.JobStatusSucceeded)
+		assert.Equal(t, 3, done.Data.Cards)
+		assert.Equal(t, streamStageSaving, done.Data.Stage)
+
+		var result AIGenerateResponse
+		require.NoError(t, json.Unmarshal(done.Data.Result, &result))
+		require.NotNil(t, result.Deck)
+		assert.Equal(t, "Fake deck", result.Deck.Title)
+		assert.Len(t, result.Cards, 3)
+
+		var count int64
+		require.NoError(t, db.Model(&models.Card{}).Where("deck_id = ?", result.Deck.ID).Count(&count).Error)
+		assert.Equal(t, int64(3), count)
+	})
+
+	t.Run("画像のプレビュージョブは入力ファイルを削除する", func(t *testing.T) {
+		r, db, handler, cleanup := setupAIJobTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		submitted := submitJob(t, r, "/api/cards/ai_preview/jobs", nil, "image", "image/png", []byte("png"))
+		var job models.GenerationJob
+		require.NoError(t, db.First(&job, submitted.Data.ID).Error)
+		assert.Equal(t, []byte("png"), job.Media)
+
+		startJobWorkers(t, handler)
+		done := waitForJobStatus(t, r, submitted.Data.ID, services.JobStatusSucceeded)
+
+		var preview PreviewResponse
+		require.NoError(t, json.Unmarshal(done.Data.Result, &preview))
+		assert.NotEmpty(t, preview.SessionID)
+		assert.Len(t, preview.Cards, 3)
+
+		require.NoError(t, db.First(&job, submitted.Data.ID).Error)
+		assert.Empty(t, job.Media)
+	})
+
+	t.Run("失敗したジョブはエラーを記録する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: "not json"}
+		r, _, handler, cleanup := setupAIJobTestRouter(t, llm)
+		defer cleanup()
+		startJobWorkers(t, handler)
+
+		submitted := submitJob(t, r, "/api/cards/ai_generate/jobs", map[string]string{"prompt": "光合成"}, "", "", nil)
+		done := waitForJobStatus(t, r, submitted.Data.ID, services.JobStatusFailed)
+		assert.Contains(t, done.Data.Error, "レスポンスパースエラー")
+		assert.Empty(t, done.Data.Result)
+	})
+
+	t.Run("AIサービスの障害で失敗したジョブは制限回数を返却する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Err: &services.LLMError{Kind: services.ErrLLMUnavailable, Err: errors.New("overloaded")}}
+		r, _, handler, cleanup := setupAIJobTestRouter(t, llm)
+		defer cleanup()
+
+		refunded := make(chan ratelimit.Charge, 1)
+		handler.refund = func(charge ratelimit.Charge) { refunded <- charge }
+		startJobWorkers(t, handler)
+
+		submitted := submitJob(t, r, "/api/cards/ai_generate/jobs", map[string]string{"prompt": "光合成"}, "", "", nil)
+		waitForJobStatus(t, r, submitted.Data.ID, services.JobStatusFailed)
+
+		select {
+		case charge := <-refunded:
+			assert.Equal(t, "ai_generate", charge.Endpoint)
+			assert.True(t, charge.Hourly)
+		case <-time.After(time.Second):
+			t.Fatal("charge was not refunded")
+		}
+	})
+
+	t.Run("入力が原因で失敗したジョブは制限回数を返却しない", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: "not json"}
+		r, _, handler, cleanup := setupAIJobTestRouter(t, llm)
+		defer cleanup()
+
+		refunded := make(chan ratelimit.Charge, 1)
+		handler.refund = func(charge ratelimit.Charge) { refunded <- charge }
+		startJobWorkers(t, handler)
+
+		submitted := submitJob(t, r, "/api/cards/ai_generate/jobs", map[string]string{"prompt": "光合成"}, "", "", nil)
+		waitForJobStatus(t, r, submitted.Data.ID, services.JobStatusFailed)
+		assert.Empty(t, refunded)
+	})
+
+	t.Run("実行中のジョブをキャンセルする", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Delay: time.Minute}
+		r, db, handler, cleanup := setupAIJobTestRouter(t, llm)
+		defer cleanup()
+		startJobWorkers(t, handler)
+
+		submitted := submitJob(t, r, "/api/cards/ai_generate/jobs", map[string]string{"prompt": "光合成"}, "", "", nil)
+		waitForJobStatus(t, r, submitted.Data.ID, services.JobStatusRunning)
+
+		code, resp := cancelJob(t, r, submitted.Data.ID)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, services.JobStatusCanceled, resp.Data.Status)
+
+		// 中断されたワーカーがキャンセル状態を上書きしない
+		time.Sleep(100 * time.Millisecond)
+		assert.Len(t, llm.Prompts(), 1)
+		_, resp = getJob(t, r, submitted.Data.ID)
+		assert.Equal(t, services.JobStatusCanceled, resp.Data.Status)
+
+		var count int64
+		require.NoError(t, db.Model(&models.Deck{}).Count(&count).Error)
+		assert.Equal(t, int64(0), count)
+
+		code, _ = cancelJob(t, r, submitted.Data.ID)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("待機中のジョブをキャンセルすると実行されない", func(t *testing.T) {
+		llm := services.NewFakeLLMProvider()
+		r, _, handler, cleanup := setupAIJobTestRouter(t, llm)
+		defer cleanup()
+
+		submitted := submitJob(t, r, "/api/cards/ai_generate/jobs", map[string]string{"prompt": "光合成"}, "", "", nil)
+		code, _ := cancelJob(t, r, submitted.Data.ID)
+		require.Equal(t, http.StatusOK, code)
+
+		startJobWorkers(t, handler)
+		time.Sleep(50 * time.Millisecond)
+
+		_, resp := getJob(t, r, submitted.Data.ID)
+		assert.Equal(t, services.JobStatusCanceled, resp.Data.Status)
+		assert.Empty(t, llm.Prompts())
+	})
+
+	t.Run("再起動前に失われたジョブを回復する", func(t *testing.T) {
+		llm := services.NewFakeLLMProvider()
+		r, db, _, cleanup := setupAIJobTestRouter(t, llm)
+		defer cleanup()
+
+		// ワーカーのいないプロセスで受け付けたジョブ
+		submitted := submitJob(t, r, "/api/cards/ai_generate/jobs", map[string]string{"prompt": "光合成"}, "", "", nil)
+		old := time.Now().Add(-time.Hour)
+		require.NoError(t, db.Model(&models.GenerationJob{}).Where("id = ?", submitted.Data.ID).
+			UpdateColumns(map[string]any{"created_at": old, "updated_at": old}).Error)
+
+		var user models.User
+		require.NoError(t, db.First(&user).Error)
+		crashed := models.GenerationJob{UserID: user.ID, Kind: jobKindGenerate, Status: services.JobStatusRunning, Input: "{}", StartedAt: &old}
+		require.NoError(t, db.Create(&crashed).Error)
+
+		// 空のキューで再起動したプロセス
+		restarted := NewAIGenerateHandlerWithProvider(db, llm, services.NewMemoryJobQueue())
+		startJobWorkers(t, restarted)
+
+		done := waitForJobStatus(t, r, submitted.Data.ID, services.JobStatusSucceeded)
+		assert.Equal(t, 3, done.Data.Cards)
+
+		_, resp := getJob(t, r, crashed.ID)
+		assert.Equal(t, services.JobStatusFailed, resp.Data.Status)
+		assert.Equal(t, "job was interrupted", resp.Data.Error)
+	})
+
+	t.Run("他のユーザーのジョブは取得できない", func(t *testing.T) {
+		r, db, _, cleanup := setupAIJobTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		other := models.User{ClerkID: "other_clerk_id", Email: "other@example.com"}
+		require.NoError(t, db.Create(&other).Error)
+		job := models.GenerationJob{UserID: other.ID, Kind: jobKindGenerate, Status: services.JobStatusQueued, Input: "{}"}
+		require.NoError(t, db.Create(&job).Error)
+
+		code, _ := getJob(t, r, job.ID)
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = cancelJob(t, r, job.ID)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("サーバーレスでは共有キューがなければジョブを受け付けない", func(t *testing.T) {
+		t.Setenv("JOB_QUEUE", "")
+		t.Setenv("JOB_WORKERS", "")
+		r, db, handler, cleanup := setupAIJobTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		handler.StartServerlessJobWorkers(ctx)
+
+		w := postAIForm(r, "/api/cards/ai_generate/jobs", map[string]string{"prompt": "光合成"}, "", "", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		var count int64
+		require.NoError(t, db.Model(&models.GenerationJob{}).Count(&count).Error)
+		assert.Zero(t, count)
+	})
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/muratayousuke/ai-flashcards/services"
+)
+
+// Structured output schemas of GeneratedCard and GeneratedDeckInfo. Every
+// schema has an object at the root, so that providers can enforce it strictly.
+var (
+	generatedCardSchema = &services.JSONSchema{
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"front": {Type: "string"},
+			"back":  {Type: "string"},
+		},
+		Required: []string{"front", "back"},
+	}
+
+	cardsResponseSchema = &services.JSONSchema{
+		Name: "flashcards",
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"cards": {Type: "array", Items: generatedCardSchema},
+		},
+		Required: []string{"cards"},
+	}
+
+	deckResponseSchema = &services.JSONSchema{
+		Name: "flashcard_deck",
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"title":       {Type: "string"},
+			"description": {Type: "string"},
+			"cards":       {Type: "array", Items: generatedCardSchema},
+		},
+		Required: []string{"title", "description", "cards"},
+	}
+)
+
+// Schemas of cards generated from a document, which carry their source page
+var (
+	documentCardSchema = &services.JSONSchema{
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"front": {Type: "string"},
+			"back":  {Type: "string"},
+			"page":  {Type: "integer"},
+		},
+		Required: []string{"front", "back", "page"},
+	}
+
+	documentCardsResponseSchema = &services.JSONSchema{
+		Name: "flashcards",
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"cards": {Type: "array", Items: documentCardSchema},
+		},
+		Required: []string{"cards"},
+	}
+
+	documentDeckResponseSchema = &services.JSONSchema{
+		Name: "flashcard_deck",
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"title":       {Type: "string"},
+			"description": {Type: "string"},
+			"cards":       {Type: "array", Items: documentCardSchema},
+		},
+		Required: []string{"title", "description", "cards"},
+	}
+)
+
+// Schemas of cards generated from subtitles, which carry their source cue
+var (
+	subtitleCardSchema = &services.JSONSchema{
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"front": {Type: "string"},
+			"back":  {Type: "string"},
+			"cue":   {Type: "integer"},
+		},
+		Required: []string{"front", "back", "cue"},
+	}
+
+	subtitleCardsResponseSchema = &services.JSONSchema{
+		Name: "flashcards",
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"cards": {Type: "array", Items: subtitleCardSchema},
+		},
+		Required: []string{"cards"},
+	}
+
+	subtitleDeckResponseSchema = &services.JSONSchema{
+		Name: "flashcard_deck",
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"title":       {Type: "string"},
+			"description": {Type: "string"},
+			"cards":       {Type: "array", Items: subtitleCardSchema},
+		},
+		Required: []string{"title", "description", "cards"},
+	}
+)
+
+// generatedCards is the answer of a generation into an existing deck: the
+// {"cards": [...]} object of the schema or, from models that do not follow
+// the schema, a bare array of cards
+type generatedCards []GeneratedCard
+
+func (c *generatedCards) UnmarshalJSON(data []byte) error {
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		return json.Unmarshal(data, (*[]GeneratedCard)(c))
+	}
+
+	var answer struct {
+		Cards []GeneratedCard `json:"cards"`
+	}
+	if err := json.Unmarshal(data, &answer); err != nil {
+		return err
+	}
+	*c = answer.Cards
+	return nil
+}
+
+// 解析に失敗した応答を再生成する際にプロンプトへ追加する指示
+const jsonRetryInstruction = `
+
+前回の応答はJSONとして解析できませんでした（%v）。
+指定された形式のJSONのみを、説明文やコードブロックを付けずに返してください。`
+
+// responseParseError is returned when a model answer is not the expected JSON
+type responseParseError struct {
+	err      error
+	response string
+}
+
+func (e *responseParseError) Error() string {
+	return fmt.Sprintf("レスポンスパースエラー: %v, レスポンス: %s", e.err, e.response)
+}
+
+func (e *responseParseError) Unwrap() error {
+	return e.err
+}
+
+// generateJSON generates an answer constrained to the schema and decodes it
+// into v. An answer that cannot be repaired is regenerated once with the
+// parse error fed back to the model.
+func (h *AIGenerateHandler) generateJSON(ctx context.Context, prompt string, fileData []byte, mimeType string, opts services.LLMOptions, schema *services.JSONSchema, v any) error {
+	opts.Schema = schema
+	stream := generationStreamFrom(ctx)
+
+	responseText, err := h.generate(ctx, prompt, fileData, mimeType, opts)
+	if err != nil {
+		return fmt.Errorf("AI生成エラー: %w", err)
+	}
+
+	parseErr := decodeGeneratedJSON(responseText, v)
+	if parseErr != nil {
+		if stream != nil {
+			stream.restart()
+		}
+		responseText, err = h.generate(ctx, prompt+fmt.Sprintf(jsonRetryInstruction, parseErr.err), fileData, mimeType, opts)
+		if err != nil {
+			return fmt.Errorf("AI生成エラー: %w", err)
+		}
+		if parseErr = decodeGeneratedJSON(responseText, v); parseErr != nil {
+			return parseErr
+		}
+	}
+
+	if stream != nil {
+		stream.progress(streamStageSaving)
+	}
+	return nil
+}
+
+// decodeGeneratedJSON repairs a model answer and decodes it into v. Prose
+// around the value may contain brackets of its own, so each possible start
+// of the value is tried until one decodes.
+func decodeGeneratedJSON(responseText string, v any) *responseParseError {
+	candidates := jsonCandidates(responseText)
+	if len(candidates) == 0 {
+		candidates = []string{strings.TrimSpace(responseText)}
+	}
+
+	var firstErr error
+	target := reflect.TypeOf(v).Elem()
+	for _, candidate := range candidates {
+		// 失敗した候補の途中までの値が残らないよう、候補ごとに新しい値へ読み込む
+		decoded := reflect.New(target)
+		err := json.Unmarshal([]byte(candidate), decoded.Interface())
+		if err == nil {
+			reflect.ValueOf(v).Elem().Set(decoded.Elem())
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return &responseParseError{err: firstErr, response: responseText}
+}
+
+// jsonCandidates returns the repaired JSON values starting at each '{' or '['
+// of a model answer that is not inside an earlier value, most likely first:
+// the value inside a code fence comes before those in the surrounding prose.
+func jsonCandidates(text string) []string {
+	var candidates []string
+	fenceStart, fenceEnd := -1, -1
+	if fence := strings.Index(text, "```"); fence >= 0 {
+		// コードブロックの言語指定（```json）の行は飛ばす
+		if newline := strings.IndexByte(text[fence:], '\n'); newline >= 0 {
+			body := fence + newline + 1
+			if i := strings.IndexAny(text[body:], "{["); i >= 0 {
+				fenceStart = body + i
+				var candidate string
+				candidate, fenceEnd = repairJSONAt(text, fenceStart)
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	for i := 0; i < len(text); {
+		if i == fenceStart {
+			i = fenceEnd
+			continue
+		}
+		if text[i] != '{' && text[i] != '[' {
+			i++
+			continue
+		}
+		// 値の内側の括弧から始めると、一部だけの値を全体と取り違えるので値の後から探す
+		candidate, end := repairJSONAt(text, i)
+		candidates = append(candidates, candidate)
+		i = end
+	}
+	return candidates
+}
+
+// repairJSONAt extracts the JSON value starting at start and fixes the
+// mistakes models commonly make: prose or code fences after the value,
+// trailing commas, raw line breaks inside strings and output cut off at the
+// token limit. A truncated answer is closed after its last complete element.
+// It also returns the offset in text just after the value.
+func repairJSONAt(text string, start int) (string, int) {
+	var (
+		out       []byte
+		stack     []byte // 開いている '{' と '['
+		inString  bool
+		escaped   bool
+		safeLen   int    // 最後に完結した要素までの出力の長さ
+		safeStack []byte // その時点で開いている括弧
+	)
+	for i := start; i < len(text); i++ {
+		ch := text[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			case ch == '\n':
+				out = append(out, `\n`...)
+				continue
+			case ch == '\r':
+				continue
+			case ch == '\t':
+				out = append(out, `\t`...)
+				continue
+			}
+			out = append(out, ch)
+			continue
+		}
+
+		switch ch {
+		case '"':
+			inString = true
+		case '{', '[':
+			stack = append(stack, ch)
+		case '}', ']':
+			if len(stack) == 0 {
+				return string(out), i
+			}
+			out = trimTrailingComma(out)
+			stack = stack[:len(stack)-1]
+			out = append(out, ch)
+			if len(stack) == 0 {
+				// 値の後に続く文章やコードブロックの終わりは無視する
+				return string(out), i + 1
+			}
+			safeLen = len(out)
+			safeStack = append(safeStack[:0], stack...)
+			continue
+		}
+		out = append(out, ch)
+	}
+
+	// 途中で途切れた応答は最後に完結した要素までで閉じる
+	if safeLen == 0 {
+		return string(out), len(text)
+	}
+	out = trimTrailingComma(out[:safeLen])
+	for i := len(safeStack) - 1; i >= 0; i-- {
+		if safeStack[i] == '{' {
+			out = append(out, '}')
+		} else {
+			out = append(out, ']')
+		}
+	}
+	return string(out), len(text)
+}
+
+// trimTrailingComma removes a comma left before a closing bracket
+func trimTrailingComma(out []byte) []byte {
+	trimmed := strings.TrimRight(string(out), " \t\r\n")
+	if strings.HasSuffix(trimmed, ",") {
+		return []byte(strings.TrimSuffix(trimmed, ","))
+	}
+	return out
+}
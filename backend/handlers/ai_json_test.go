@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONCandidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "正しいJSONはそのまま",
+			input:    `[{"front": "Q", "back": "A"}]`,
+			expected: `[{"front": "Q", "back": "A"}]`,
+		},
+		{
+			name:     "コードブロック",
+			input:    "```json\n{\"title\": \"T\", \"cards\": []}\n```",
+			expected: `{"title": "T", "cards": []}`,
+		},
+		{
+			name:     "前後の文章",
+			input:    "以下がカードです。\n[{\"front\": \"Q\", \"back\": \"A\"}]\nお役に立てば幸いです。",
+			expected: `[{"front": "Q", "back": "A"}]`,
+		},
+		{
+			name:     "末尾のカンマ",
+			input:    `{"cards": [{"front": "Q", "back": "A",}, ], }`,
+			expected: `{"cards": [{"front": "Q", "back": "A"}]}`,
+		},
+		{
+			name:     "文字列中の改行",
+			input:    "[{\"front\": \"Q\", \"back\": \"1行目\n2行目\"}]",
+			expected: `[{"front": "Q", "back": "1行目\n2行目"}]`,
+		},
+		{
+			name:     "途中で途切れた配列",
+			input:    `{"title": "T", "description": "D", "cards": [{"front": "Q1", "back": "A1"}, {"front": "Q2", "ba`,
+			expected: `{"title": "T", "description": "D", "cards": [{"front": "Q1", "back": "A1"}]}`,
+		},
+		{
+			name:     "括弧を含む文字列",
+			input:    `[{"front": "配列 [1, 2]", "back": "{\"a\": 1}"}] 補足 ]`,
+			expected: `[{"front": "配列 [1, 2]", "back": "{\"a\": 1}"}]`,
+		},
+		{
+			name:     "コードブロック前の文章の括弧",
+			input:    "配列[1]について{簡潔に}まとめました。\n```json\n{\"title\": \"T\", \"cards\": []}\n```",
+			expected: `{"title": "T", "cards": []}`,
+		},
+	}
+
+	t.Run("値の外側の括弧ごとに候補を返す", func(t *testing.T) {
+		candidates := jsonCandidates(`{"a": [1]} と [2]`)
+		assert.Equal(t, []string{`{"a": [1]}`, `[2]`}, candidates)
+		assert.Empty(t, jsonCandidates("JSONはありません"))
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates := jsonCandidates(tt.input)
+			require.NotEmpty(t, candidates)
+			assert.Equal(t, tt.expected, candidates[0])
+			assert.True(t, json.Valid([]byte(candidates[0])), candidates[0])
+		})
+	}
+}
+
+func TestDecodeGeneratedJSON(t *testing.T) {
+	t.Run("文章中の括弧を飛ばして読み込める値を探す", func(t *testing.T) {
+		var deck GeneratedDeckInfo
+		err := decodeGeneratedJSON("配列[1]と{a}の違いのデッキです。\n{\"title\": \"T\", \"description\": \"D\", \"cards\": [{\"front\": \"Q\", \"back\": \"A\"}]}", &deck)
+		require.Nil(t, err)
+		assert.Equal(t, "T", deck.Title)
+		require.Len(t, deck.Cards, 1)
+		assert.Equal(t, "Q", deck.Cards[0].Front)
+	})
+
+	t.Run("読み込めない候補の値は残さない", func(t *testing.T) {
+		var cards []GeneratedCard
+		err := decodeGeneratedJSON("[{\"front\": \"X\", \"back\": 1}] ではなく [{\"front\": \"Q\", \"back\": \"A\"}]", &cards)
+		require.Nil(t, err)
+		require.Len(t, cards, 1)
+		assert.Equal(t, "Q", cards[0].Front)
+		assert.Equal(t, "A", cards[0].Back)
+	})
+
+	t.Run("既存デッキ向けのカードはオブジェクトと配列のどちらも読み込める", func(t *testing.T) {
+		for _, answer := range []string{
+			`{"cards": [{"front": "Q", "back": "A", "page": 2}]}`,
+			`[{"front": "Q", "back": "A", "page": 2}]`,
+		} {
+			var cards generatedCards
+			require.Nil(t, decodeGeneratedJSON(answer, &cards), answer)
+			require.Len(t, cards, 1)
+			assert.Equal(t, "Q", cards[0].Front)
+			assert.Equal(t, 2, cards[0].Page)
+		}
+	})
+
+	t.Run("どの候補も読み込めなければ最初のエラーを返す", func(t *testing.T) {
+		var deck GeneratedDeckInfo
+		err := decodeGeneratedJSON("[1] です", &deck)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "[1] です")
+	})
+}
+
+func TestGenerateJSONRetry(t *testing.T) {
+	t.Run("解析できない応答はエラーを伝えて再生成する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Responses: []string{"申し訳ありません。カードを生成できません。"}}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		prompts := llm.Prompts()
+		require.Len(t, prompts, 2)
+		assert.NotContains(t, prompts[0], "前回の応答はJSONとして解析できませんでした")
+		assert.Contains(t, prompts[1], "前回の応答はJSONとして解析できませんでした")
+
+		var count int64
+		require.NoError(t, db.Model(&models.Deck{}).Where("user_id = ?", user.ID).Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("修復できる応答は再生成しない", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: "```json\n[{\"front\": \"Q1\", \"back\": \"A1\"}, {\"front\": \"Q2\", \"ba"}
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		deck := models.Deck{UserID: user.ID, Title: "既存デッキ"}
+		require.NoError(t, db.Create(&deck).Error)
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成", "deckId": fmt.Sprint(deck.ID)}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Len(t, llm.Prompts(), 1)
+
+		var cards []models.Card
+		require.NoError(t, db.Where("deck_id = ?", deck.ID).Find(&cards).Error)
+		require.Len(t, cards, 1)
+		assert.Equal(t, "Q1", cards[0].Front)
+	})
+
+	t.Run("再生成でも解析できなければ失敗する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: "not json"}
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate", map[string]string{"prompt": "光合成"}, "", "", nil)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), "レスポンスパースエラー")
+		assert.Len(t, llm.Prompts(), 2)
+	})
+
+	t.Run("ストリーミングでは再生成をprogressイベントで通知する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Responses: []string{`{"title": "T", "cards": [{"front": "Q", "back": "A"}], "note": oops}`}}
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate/stream", map[string]string{"prompt": "光合成"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		events := parseSSE(t, w.Body.String())
+		names := eventNames(events)
+		require.Equal(t, "done", names[len(names)-1], w.Body.String())
+
+		var retrying int
+		for i, e := range events {
+			if e.Name != "progress" {
+				continue
+			}
+			var progress generationProgress
+			require.NoError(t, json.Unmarshal([]byte(e.Data), &progress))
+			if progress.Stage == streamStageRetrying {
+				retrying = i
+			}
+		}
+		require.NotZero(t, retrying)
+
+		// 再生成後のカードは0番から送り直す
+		var card streamedCard
+		require.Equal(t, "deck", events[retrying+1].Name)
+		require.Equal(t, "card", events[retrying+2].Name)
+		require.NoError(t, json.Unmarshal([]byte(events[retrying+2].Data), &card))
+		assert.Equal(t, 0, card.Index)
+		assert.Equal(t, "Fake question 1", card.Front)
+	})
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stages reported by progress events of a streamed generation
+const (
+	streamStageGenerating = "generating"
+	streamStageRetrying   = "retrying"
+	streamStageSaving     = "saving"
+)
+
+// Server-Sent Events of a streamed generation, in the order they are sent:
+//
+//	progress {"stage": "generating"}
+//	deck     {"title", "description"}                 新規デッキの場合のみ
+//	card     {"index", "front", "back", "sourceRef"}  カードが1枚解析されるごと
+//	progress {"stage": "saving", "cards"}
+//	done     GenerateCards / GeneratePreview の data と同じ内容
+//
+// On failure an error event with the body of the non-streaming response is
+// sent instead of done. Card events are provisional; done holds the cards
+// that were actually saved. When the answer cannot be parsed, a progress
+// event with the stage "retrying" is sent and the deck and card events start
+// over from index 0. With structured output the deck event may follow the
+// cards, as some models order the properties alphabetically. A large request
+// generated in chunks sends the deck and cards of each chunk as it completes.
+
+// GenerateCardsStream is GenerateCards streaming its progress as Server-Sent Events
+func (h *AIGenerateHandler) GenerateCardsStream(c *gin.Context) {
+	h.streamGeneration(c, func(ctx context.Context) (any, error) {
+		return h.runGenerate(ctx, c)
+	})
+}
+
+// GeneratePreviewStream is GeneratePreview streaming its progress as Server-Sent Events
+func (h *AIGenerateHandler) GeneratePreviewStream(c *gin.Context) {
+	h.streamGeneration(c, func(ctx context.Context) (any, error) {
+		return h.runPreview(ctx, c)
+	})
+}
+
+func (h *AIGenerateHandler) streamGeneration(c *gin.Context, run func(ctx context.Context) (any, error)) {
+	// クライアントが切断するとリクエストのコンテキストがキャンセルされ、生成も中断される
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 120*time.Second)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	sse := &sseWriter{w: c.Writer, cancel: cancel}
+	stream := h.newGenerationStream(sse.send)
+	stream.progress(streamStageGenerating)
+
+	result, err := run(withGenerationStream(ctx, stream))
+	if err != nil {
+		refundProviderFailure(c, err)
+		status, body := aiErrorResponse(ctx, err)
+		body["status"] = status
+		sse.send("error", body)
+		return
+	}
+	sse.send("done", result)
+}
+
+// sseWriter writes Server-Sent Events to the response
+type sseWriter struct {
+	w      gin.ResponseWriter
+	cancel context.CancelFunc
+	err    error // 書き込みに失敗した場合のエラー
+}
+
+// send writes an event. A failed write means the client has gone away, so
+// the generation is cancelled.
+func (s *sseWriter) send(event string, data any) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		s.err = err
+		s.cancel()
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+type streamedDeck struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+type streamedCard struct {
+	Index     int    `json:"index"`
+	Front     string `json:"front"`
+	Back      string `json:"back"`
+	SourceRef string `json:"sourceRef,omitempty"`
+}
+
+type generationProgress struct {
+	Stage string `json:"stage"`
+	Cards int    `json:"cards"`
+}
+
+// generationStream turns the output of a streamed generation into deck, card
+// and progress events and passes them to emit
+type generationStream struct {
+	emit     func(event string, data any) error
+	validate func(card *GeneratedCard) error
+	parser   *cardStreamParser
+	cards    int
+
+	mu       sync.Mutex // 並行して生成したチャンクの結果を送る add を直列化する
+	deckSent bool
+}
+
+func (h *AIGenerateHandler) newGenerationStream(emit func(event string, data any) error) *generationStream {
+	return &generationStream{
+		emit:     emit,
+		validate: h.validateCard,
+		parser:   newCardStreamParser(),
+	}
+}
+
+type generationStreamKey struct{}
+
+func withGenerationStream(ctx context.Context, stream *generationStream) context.Context {
+	return context.WithValue(ctx, generationStreamKey{}, stream)
+}
+
+// generationStreamFrom returns the stream of a streamed request, or nil
+func generationStreamFrom(ctx context.Context) *generationStream {
+	stream, _ := ctx.Value(generationStreamKey{}).(*generationStream)
+	return stream
+}
+
+func (s *generationStream) progress(stage string) {
+	s.emit("progress", generationProgress{Stage: stage, Cards: s.cards})
+}
+
+// restart discards the output so far before the answer is regenerated
+func (s *generationStream) restart() {
+	s.parser = newCardStreamParser()
+	s.cards = 0
+	s.progress(streamStageRetrying)
+}
+
+// write receives model output and sends the deck and cards completed by it
+func (s *generationStream) write(chunk string) error {
+	deck, cards := s.parser.write(chunk)
+	if deck != nil {
+		if err := s.emit("deck", deck); err != nil {
+			return err
+		}
+	}
+	for _, card := range cards {
+		if s.validate(&card) != nil {
+			continue
+		}
+		if err := s.emit("card", streamedCard{Index: s.cards, Front: card.Front, Back: card.Back, SourceRef: card.sourceRef()}); err != nil {
+			return err
+		}
+		s.cards++
+	}
+	return nil
+}
+
+// add sends the deck and cards of a chunk generated without streaming. It
+// may be called concurrently.
+func (s *generationStream) add(deckInfo *GeneratedDeckInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.deckSent && deckInfo.Title != "" {
+		s.deckSent = true
+		s.emit("deck", streamedDeck{Title: deckInfo.Title, Description: deckInfo.Description})
+	}
+	for _, card := range deckInfo.Cards {
+		if s.validate(&card) != nil {
+			continue
+		}
+		s.emit("card", streamedCard{Index: s.cards, Front: card.Front, Back: card.Back, SourceRef: card.sourceRef()})
+		s.cards++
+	}
+}
+
+var (
+	streamTitlePattern       = regexp.MustCompile(`"title"\s*:\s*("(?:[^"\\]|\\.)*")`)
+	streamDescriptionPattern = regexp.MustCompile(`"description"\s*:\s*("(?:[^"\\]|\\.)*")`)
+)
+
+// cardStreamParser extracts cards from a JSON response while it is still
+// being received. Cards are the objects directly inside an array, so the
+// deck object, the cards object and a plain card array are all handled. Text
+// before the JSON, such as a code fence, is skipped.
+type cardStreamParser struct {
+	buf       []byte
+	pos       int    // 次に走査する位置
+	stack     []byte // 開いている '{' と '['
+	inString  bool
+	escaped   bool
+	cardStart int // 解析中のカードの開始位置（なければ -1）
+	cardDepth int
+	isDeck    bool // 最上位がオブジェクト（新規デッキ形式）かどうか
+	deckSent  bool
+}
+
+func newCardStreamParser() *cardStreamParser {
+	return &cardStreamParser{cardStart: -1}
+}
+
+// write appends a chunk and returns the deck information once it is known
+// and the cards completed by the chunk
+func (p *cardStreamParser) write(chunk string) (*streamedDeck, []GeneratedCard) {
+	p.buf = append(p.buf, chunk...)
+
+	var cards []GeneratedCard
+	for ; p.pos < len(p.buf); p.pos++ {
+		ch := p.buf[p.pos]
+		if p.inString {
+			switch {
+			case p.escaped:
+				p.escaped = false
+			case ch == '\\':
+				p.escaped = true
+			case ch == '"':
+				p.inString = false
+			}
+			continue
+		}
+
+		switch ch {
+		case '"':
+			p.inString = len(p.stack) > 0
+		case '{', '[':
+			if len(p.stack) == 0 {
+				p.isDeck = ch == '{'
+			}
+			if ch == '{' && p.cardStart < 0 && len(p.stack) > 0 && p.stack[len(p.stack)-1] == '[' {
+				p.cardStart = p.pos
+				p.cardDepth = len(p.stack)
+			}
+			p.stack = append(p.stack, ch)
+		case '}', ']':
+			if len(p.stack) == 0 {
+				continue
+			}
+			p.stack = p.stack[:len(p.stack)-1]
+			if p.cardStart >= 0 && len(p.stack) == p.cardDepth {
+				var card GeneratedCard
+				if err := json.Unmarshal(p.buf[p.cardStart:p.pos+1], &card); err == nil {
+					cards = append(cards, card)
+				}
+				p.cardStart = -1
+			}
+		}
+	}
+
+	return p.deck(len(cards) > 0), cards
+}
+
+// deck returns the title and description the first time both are complete,
+// or as soon as cards start arriving
+func (p *cardStreamParser) deck(cardsFound bool) *streamedDeck {
+	if p.deckSent || !p.isDeck {
+		return nil
+	}
+
+	var deck streamedDeck
+	title := streamTitlePattern.FindSubmatch(p.buf)
+	description := streamDescriptionPattern.FindSubmatch(p.buf)
+	if title == nil || (description == nil && !cardsFound) {
+		return nil
+	}
+	_ = json.Unmarshal(title[1], &deck.Title)
+	if description != nil {
+		_ = json.Unmarshal(description[1], &deck.Description)
+	}
+
+	p.deckSent = true
+	return &deck
+}
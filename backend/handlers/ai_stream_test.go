@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	Name string
+	Data string
+}
+
+func parseSSE(t *testing.T, body string) []sseEvent {
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			current.Name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.Data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, current)
+			current = sseEvent{}
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func eventNames(events []sseEvent) []string {
+	names := make([]string, 0, len(events))
+	for _, e := range events {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestCardStreamParser(t *testing.T) {
+	t.Run("1文字ずつ受信してもデッキとカードを抽出できる", func(t *testing.T) {
+		response := "```json\n" + `{"title": "元素 \"記号\"", "description": "説明", "cards": [` +
+			`{"front": "H は { ?", "back": "水素"}, {"front": "He", "back": "ヘリウム [希ガス]"}]}` + "\n```"
+
+		parser := newCardStreamParser()
+		var deck *streamedDeck
+		var cards []GeneratedCard
+		for _, r := range response {
+			d, c := parser.write(string(r))
+			if d != nil {
+				require.Nil(t, deck, "deck must be reported once")
+				require.Empty(t, cards, "deck must be reported before cards")
+				deck = d
+			}
+			cards = append(cards, c...)
+		}
+
+		require.NotNil(t, deck)
+		assert.Equal(t, `元素 "記号"`, deck.Title)
+		assert.Equal(t, "説明", deck.Description)
+		require.Len(t, cards, 2)
+		assert.Equal(t, "H は { ?", cards[0].Front)
+		assert.Equal(t, "ヘリウム [希ガス]", cards[1].Back)
+	})
+
+	t.Run("カード配列形式", func(t *testing.T) {
+		parser := newCardStreamParser()
+		deck, cards := parser.write(`[{"front": "Q1", "back": "A1"}, {"front": "Q2", `)
+		assert.Nil(t, deck)
+		require.Len(t, cards, 1)
+
+		deck, cards = parser.write(`"back": "A2"}]`)
+		assert.Nil(t, deck)
+		require.Len(t, cards, 1)
+		assert.Equal(t, "Q2", cards[0].Front)
+	})
+}
+
+func TestGenerateCardsStream(t *testing.T) {
+	t.Run("デッキとカードを順に送信して保存する", func(t *testing.T) {
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate/stream", map[string]string{"prompt": "光合成"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+		events := parseSSE(t, w.Body.String())
+		assert.Equal(t, []string{"progress", "deck", "card", "card", "card", "progress", "done"}, eventNames(events))
+
+		var deck streamedDeck
+		require.NoError(t, json.Unmarshal([]byte(events[1].Data), &deck))
+		assert.Equal(t, "Fake deck", deck.Title)
+
+		var card streamedCard
+		require.NoError(t, json.Unmarshal([]byte(events[4].Data), &card))
+		assert.Equal(t, 2, card.Index)
+		assert.Equal(t, "Fake question 3", card.Front)
+
+		var done AIGenerateResponse
+		require.NoError(t, json.Unmarshal([]byte(events[6].Data), &done))
+		assert.Len(t, done.Cards, 3)
+
+		var count int64
+		require.NoError(t, db.Model(&models.Deck{}).Where("user_id = ?", user.ID).Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("プレビューのストリーミング", func(t *testing.T) {
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_preview/stream", map[string]string{"prompt": "元素記号"}, "", "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		events := parseSSE(t, w.Body.String())
+		require.NotEmpty(t, events)
+		last := events[len(events)-1]
+		require.Equal(t, "done", last.Name, w.Body.String())
+
+		var preview PreviewResponse
+		require.NoError(t, json.Unmarshal([]byte(last.Data), &preview))
+		assert.NotEmpty(t, preview.SessionID)
+
+		var count int64
+		require.NoError(t, db.Model(&models.CardPreview{}).Where("user_id = ?", user.ID).Count(&count).Error)
+		assert.Equal(t, int64(3), count)
+	})
+
+	t.Run("エラーはerrorイベントで送信する", func(t *testing.T) {
+		llm := &services.FakeLLMProvider{Response: `{"title": "T", "description": "D", "cards": []}`}
+		r, _, _, cleanup := setupAIGenerateTestRouter(t, llm)
+		defer cleanup()
+
+		w := postAIForm(r, "/api/cards/ai_generate/stream", map[string]string{"prompt": "光合成"}, "", "", nil)
+		events := parseSSE(t, w.Body.String())
+		last := events[len(events)-1]
+		require.Equal(t, "error", last.Name)
+
+		var body map[string]any
+		require.NoError(t, json.Unmarshal([]byte(last.Data), &body))
+		assert.EqualValues(t, http.StatusUnprocessableEntity, body["status"])
+		assert.Equal(t, "No valid cards generated", body["error"])
+	})
+
+	t.Run("クライアントが切断すると生成を中断する", func(t *testing.T) {
+		r, db, user, cleanup := setupAIGenerateTestRouter(t, services.NewFakeLLMProvider())
+		defer cleanup()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := newAIFormRequest("/api/cards/ai_generate/stream", map[string]string{"prompt": "光合成"}, "", "", nil)
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.NotContains(t, eventNames(parseSSE(t, w.Body.String())), "done")
+
+		var count int64
+		require.NoError(t, db.Model(&models.Deck{}).Where("user_id = ?", user.ID).Count(&count).Error)
+		assert.Equal(t, int64(0), count)
+	})
+}
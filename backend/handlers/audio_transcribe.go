@@ -2,20 +2,20 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
+
+	"github.com/muratayousuke/ai-flashcards/services"
 )
 
 type AudioTranscribeHandler struct {
-	geminiClient *genai.Client
+	llm services.LLMProvider
 }
 
 type AudioTranscribeResponse struct {
@@ -40,15 +40,17 @@ var (
 )
 
 func NewAudioTranscribeHandler() (*AudioTranscribeHandler, error) {
-	// Gemini APIクライアントの初期化
-	client, err := genai.NewClient(context.Background(), option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
+	// LLMプロバイダーの初期化
+	llm, err := services.NewLLMProviderFromEnv(context.Background())
 	if err != nil {
 		return nil, err
 	}
+	return NewAudioTranscribeHandlerWithProvider(llm), nil
+}
 
-	return &AudioTranscribeHandler{
-		geminiClient: client,
-	}, nil
+// NewAudioTranscribeHandlerWithProvider creates the handler with the given LLM provider
+func NewAudioTranscribeHandlerWithProvider(llm services.LLMProvider) *AudioTranscribeHandler {
+	return &AudioTranscribeHandler{llm: llm}
 }
 
 // 音声をテキストに変換するエンドポイント
@@ -104,38 +106,15 @@ func (h *AudioTranscribeHandler) TranscribeAudio(c *gin.Context) {
 }
 
 func (h *AudioTranscribeHandler) transcribeAudioData(ctx context.Context, fileData []byte, mimeType string) (string, error) {
-	// Gemini APIモデルの取得
-	model := h.geminiClient.GenerativeModel("gemini-2.0-flash")
-	model.SetTemperature(0.1) // 文字起こしは正確性を重視
-	model.SetMaxOutputTokens(2000)
-
-	// コンテンツ生成
-	parts := []genai.Part{
-		genai.Text(AudioTranscribePrompt),
-		genai.Blob{
-			MIMEType: mimeType,
-			Data:     fileData,
-		},
-	}
-
-	resp, err := model.GenerateContent(ctx, parts...)
+	text, err := h.llm.Transcribe(ctx, AudioTranscribePrompt, services.LLMMedia{
+		MIMEType: mimeType,
+		Data:     fileData,
+	})
 	if err != nil {
 		return "", fmt.Errorf("AI文字起こしエラー: %w", err)
 	}
 
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return "", fmt.Errorf("AIからの応答が空です")
-	}
-
-	// レスポンステキストの取得
-	responseText := ""
-	for _, part := range resp.Candidates[0].Content.Parts {
-		if textPart, ok := part.(genai.Text); ok {
-			responseText += string(textPart)
-		}
-	}
-
-	return responseText, nil
+	return text, nil
 }
 
 func (h *AudioTranscribeHandler) validateAudioFile(header *multipart.FileHeader) error {
@@ -156,12 +135,25 @@ func (h *AudioTranscribeHandler) validateAudioFile(header *multipart.FileHeader)
 }
 
 func (h *AudioTranscribeHandler) handleError(c *gin.Context, ctx context.Context, err error) {
+	refundProviderFailure(c, err)
+	if ctx.Err() == nil {
+		if status, body, ok := llmErrorResponse(err); ok {
+			writeAIError(c, status, body)
+			return
+		}
+	}
+
 	switch {
 	case ctx.Err() == context.DeadlineExceeded:
 		c.JSON(http.StatusRequestTimeout, gin.H{
 			"error":   "Request timeout",
 			"message": "音声の文字起こしに時間がかかりすぎました",
 		})
+	case errors.Is(err, services.ErrLLMInputUnsupported):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Unsupported input",
+			"message": err.Error(),
+		})
 	default:
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Internal server error",
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"gorm.io/gorm"
+)
+
+type BackupHandler struct {
+	BaseHandler
+	backupService *services.BackupService
+}
+
+func NewBackupHandler(db *gorm.DB) *BackupHandler {
+	return &BackupHandler{
+		BaseHandler:   BaseHandler{db: db},
+		backupService: services.NewBackupService(db, services.NewMediaStorageFromEnv()),
+	}
+}
+
+// Backup downloads everything the user owns as a versioned zip archive
+func (h *BackupHandler) Backup(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	name := fmt.Sprintf("flashcards-backup-%s", time.Now().UTC().Format("20060102"))
+	writeAttachmentHeader(ctx, "application/zip", name, "zip")
+	if err := h.backupService.Backup(ctx.Request.Context(), user, ctx.Writer); err != nil {
+		// ヘッダーは送信済みのため、ログに残して接続を打ち切る
+		log.Printf("Failed to write backup: %v", err)
+		ctx.Abort()
+	}
+}
+
+// Restore imports a backup archive into the current user's account
+func (h *BackupHandler) Restore(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	file, header, err := ctx.Request.FormFile("file")
+	if err != nil {
+		handleError(ctx, http.StatusBadRequest, "File is required")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > services.MaxBackupSize {
+		handleError(ctx, http.StatusRequestEntityTooLarge, "File is too large (max 500MB)")
+		return
+	}
+
+	report, err := h.backupService.Restore(ctx.Request.Context(), user.ID, file, header.Size)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidBackup) || errors.Is(err, services.ErrUnsupportedBackupVersion) {
+			handleError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, report)
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func setupBackupTestRouter(db *gorm.DB, clerkID string) *gin.Engine {
+	backupHandler := NewBackupHandler(db)
+
+	r := test.SetupRouter()
+
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(clerkID))
+	api.GET("/backup", backupHandler.Backup)
+	api.POST("/backup/restore", backupHandler.Restore)
+
+	return r
+}
+
+func postBackup(r *gin.Engine, archive []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "backup.zip")
+	part.Write(archive)
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", "/api/backup/restore", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	t.Setenv("MEDIA_STORAGE_DIR", t.TempDir())
+
+	db, cleanup := test.SetupTestDB()
+	defer cleanup()
+
+	user := test.CreateTestUser(db)
+	other := &models.User{ClerkID: "other_clerk_id", Email: "other@example.com", Name: "Other"}
+	require.NoError(t, db.Create(other).Error)
+
+	parent := &models.Deck{UserID: user.ID, Title: "Languages"}
+	require.NoError(t, db.Create(parent).Error)
+	child := &models.Deck{UserID: user.ID, Title: "Japanese", ParentID: &parent.ID}
+	require.NoError(t, db.Create(child).Error)
+
+	reviewed := time.Date(2026, 5, 1, 8, 0, 0, 0, time.UTC)
+	card := &models.Card{DeckID: parent.ID, Front: "hello", Back: "こんにちは", Status: "learning", ReviewCount: 2, LastReview: &reviewed}
+	require.NoError(t, services.CreateBasicCard(db, user.ID, card))
+	require.NoError(t, db.Model(card).Association("Tags").Append(&models.Tag{UserID: user.ID, Name: "greeting"}))
+	require.NoError(t, db.Create(&models.CardRevision{CardID: card.ID, UserID: user.ID, Front: "hi", Back: "やあ", Source: "manual"}).Error)
+	require.NoError(t, db.Create(&models.AnswerRecord{
+		UserID: user.ID, DeckID: parent.ID, CardID: card.ID, IsCorrect: true, StudyTime: 6, AnswerDate: reviewed,
+	}).Error)
+
+	mediaService := services.NewMediaService(db, services.NewMediaStorageFromEnv())
+	require.NoError(t, mediaService.Attach(context.Background(), &models.Media{
+		UserID: user.ID, CardID: &card.ID, Side: services.MediaSideFront, Filename: "hello.mp3", MimeType: "audio/mpeg", Size: 5,
+	}, strings.NewReader("audio")))
+
+	noteService := services.NewNoteService(db, mediaService)
+	noteType := &models.NoteType{
+		UserID:    &user.ID,
+		Name:      "Vocabulary",
+		Fields:    []string{"Word", "Meaning"},
+		Templates: []models.CardTemplate{{Name: "Recognition", Front: "{{Word}}", Back: "{{Meaning}}"}},
+	}
+	require.NoError(t, noteService.CreateNoteType(noteType))
+	require.NoError(t, noteService.CreateNote(context.Background(), noteType, &models.Note{
+		UserID: user.ID, DeckID: child.ID, Fields: map[string]string{"Word": "猫", "Meaning": "cat"},
+	}))
+
+	// 別ユーザーのデータは含まれない
+	foreign := &models.Deck{UserID: other.ID, Title: "Foreign"}
+	require.NoError(t, db.Create(foreign).Error)
+
+	req, _ := http.NewRequest("GET", "/api/backup", nil)
+	w := httptest.NewRecorder()
+	setupBackupTestRouter(db, user.ClerkID).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "flashcards-backup-")
+	archive := w.Body.Bytes()
+
+	t.Run("バージョン付きのアーカイブを出力する", func(t *testing.T) {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		require.NoError(t, err)
+
+		var manifest services.BackupManifest
+		var data struct {
+			Decks []models.Deck `json:"decks"`
+		}
+		names := []string{}
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+			rc, _ := f.Open()
+			content, _ := io.ReadAll(rc)
+			rc.Close()
+			switch f.Name {
+			case "manifest.json":
+				require.NoError(t, json.Unmarshal(content, &manifest))
+			case "data.json":
+				require.NoError(t, json.Unmarshal(content, &data))
+			}
+		}
+		assert.Len(t, names, 3)
+		assert.Equal(t, services.BackupFormatVersion, manifest.Version)
+		assert.Equal(t, user.Email, manifest.Email)
+		require.Len(t, data.Decks, 2)
+		assert.Equal(t, "Languages", data.Decks[0].Title)
+	})
+
+	t.Run("別のアカウントに ID を振り直して復元する", func(t *testing.T) {
+		w := postBackup(setupBackupTestRouter(db, other.ClerkID), archive)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var report services.BackupRestoreReport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, services.BackupRestoreReport{
+			Decks: 2, Tags: 1, NoteTypes: 1, Notes: 2, Cards: 2, CardRevisions: 1, AnswerRecords: 1, Media: 1,
+		}, report)
+
+		var decks []models.Deck
+		require.NoError(t, db.Where("user_id = ? AND title <> ?", other.ID, "Foreign").Order("id").Find(&decks).Error)
+		require.Len(t, decks, 2)
+		assert.NotEqual(t, parent.ID, decks[0].ID)
+		require.NotNil(t, decks[1].ParentID)
+		assert.Equal(t, decks[0].ID, *decks[1].ParentID)
+
+		var restored models.Card
+		require.NoError(t, db.Preload("Tags").Preload("Media").Where("deck_id = ?", decks[0].ID).First(&restored).Error)
+		assert.Equal(t, "hello", restored.Front)
+		assert.Equal(t, "learning", restored.Status)
+		assert.Equal(t, 2, restored.ReviewCount)
+		require.Len(t, restored.Tags, 1)
+		assert.Equal(t, other.ID, restored.Tags[0].UserID)
+		require.Len(t, restored.Media, 1)
+		assert.Equal(t, other.ID, restored.Media[0].UserID)
+		assert.NotEqual(t, card.ID, restored.ID)
+
+		content, err := mediaService.Open(context.Background(), &restored.Media[0])
+		require.NoError(t, err)
+		data, _ := io.ReadAll(content)
+		content.Close()
+		assert.Equal(t, "audio", string(data))
+
+		var record models.AnswerRecord
+		require.NoError(t, db.Where("user_id = ?", other.ID).First(&record).Error)
+		assert.Equal(t, restored.ID, record.CardID)
+		assert.Equal(t, decks[0].ID, record.DeckID)
+
+		var note models.Note
+		require.NoError(t, db.Preload("Cards").Where("deck_id = ?", decks[1].ID).First(&note).Error)
+		assert.Equal(t, "猫", note.Fields["Word"])
+		require.Len(t, note.Cards, 1)
+		assert.Equal(t, "猫", note.Cards[0].Front)
+
+		var noteType models.NoteType
+		require.NoError(t, db.First(&noteType, note.NoteTypeID).Error)
+		assert.Equal(t, other.ID, *noteType.UserID)
+	})
+
+	t.Run("削除済みのカードの学習履歴は復元しない", func(t *testing.T) {
+		owner := &models.User{ClerkID: "owner_clerk_id", Email: "owner@example.com", Name: "Owner"}
+		require.NoError(t, db.Create(owner).Error)
+		restorer := &models.User{ClerkID: "restorer_clerk_id", Email: "restorer@example.com", Name: "Restorer"}
+		require.NoError(t, db.Create(restorer).Error)
+
+		deck := &models.Deck{UserID: owner.ID, Title: "Deleted cards"}
+		require.NoError(t, db.Create(deck).Error)
+		kept := &models.Card{DeckID: deck.ID, Front: "kept", Back: "残る"}
+		require.NoError(t, services.CreateBasicCard(db, owner.ID, kept))
+		deleted := &models.Card{DeckID: deck.ID, Front: "deleted", Back: "消える"}
+		require.NoError(t, services.CreateBasicCard(db, owner.ID, deleted))
+		for _, cardID := range []uint{kept.ID, deleted.ID} {
+			require.NoError(t, db.Create(&models.AnswerRecord{
+				UserID: owner.ID, DeckID: deck.ID, CardID: cardID, IsCorrect: true, AnswerDate: reviewed,
+			}).Error)
+		}
+		require.NoError(t, db.Delete(deleted).Error)
+
+		req, _ := http.NewRequest("GET", "/api/backup", nil)
+		w := httptest.NewRecorder()
+		setupBackupTestRouter(db, owner.ClerkID).ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = postBackup(setupBackupTestRouter(db, restorer.ClerkID), w.Body.Bytes())
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var report services.BackupRestoreReport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, 1, report.Cards)
+		assert.Equal(t, 1, report.AnswerRecords)
+
+		var records []models.AnswerRecord
+		require.NoError(t, db.Where("user_id = ?", restorer.ID).Find(&records).Error)
+		require.Len(t, records, 1)
+		var restored models.Card
+		require.NoError(t, db.First(&restored, records[0].CardID).Error)
+		assert.Equal(t, "kept", restored.Front)
+	})
+
+	t.Run("不正なアーカイブ", func(t *testing.T) {
+		r := setupBackupTestRouter(db, other.ClerkID)
+		assert.Equal(t, http.StatusBadRequest, postBackup(r, []byte("not a zip")).Code)
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		f, _ := zw.Create("manifest.json")
+		f.Write([]byte(`{"format":"ai-flashcards-backup","version":99}`))
+		zw.Close()
+
+		w := postBackup(r, buf.Bytes())
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "unsupported backup version")
+
+		// 展開後のサイズが上限を超えるメディア
+		buf.Reset()
+		zw = zip.NewWriter(&buf)
+		f, _ = zw.Create("manifest.json")
+		f.Write([]byte(`{"format":"ai-flashcards-backup","version":1}`))
+		f, _ = zw.Create("data.json")
+		f.Write([]byte(`{"media":[{"id":1,"filename":"huge.mp3","mimeType":"audio/mpeg"}]}`))
+		f, _ = zw.CreateRaw(&zip.FileHeader{Name: "media/1", Method: zip.Store, CompressedSize64: 5, UncompressedSize64: services.MaxMediaSize + 1})
+		f.Write([]byte("audio"))
+		zw.Close()
+
+		w = postBackup(r, buf.Bytes())
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "media/1 is too large")
+
+		// アップロードでは受け付けない種類のメディア
+		w = postBackup(r, mediaBackup(t, `{"id":1,"filename":"page.html","mimeType":"text/html","size":4}`, "<b/>"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "unsupported type")
+	})
+
+	t.Run("メディアのサイズは実際の内容から記録する", func(t *testing.T) {
+		restorer := &models.User{ClerkID: "size_clerk_id", Email: "size@example.com"}
+		require.NoError(t, db.Create(restorer).Error)
+
+		w := postBackup(setupBackupTestRouter(db, restorer.ClerkID),
+			mediaBackup(t, `{"id":1,"filename":"a.png","mimeType":"image/png","size":999999}`, "png"))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var media models.Media
+		require.NoError(t, db.Where("user_id = ?", restorer.ID).First(&media).Error)
+		assert.Equal(t, int64(3), media.Size)
+	})
+}
+
+// mediaBackup builds a backup archive holding a single media file
+func mediaBackup(t *testing.T, media, content string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range map[string]string{
+		"manifest.json": `{"format":"ai-flashcards-backup","version":1}`,
+		"data.json":     `{"media":[` + media + `]}`,
+		"media/1":       content,
+	} {
+		f, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -13,20 +15,35 @@ import (
 
 type CardHandler struct {
 	BaseHandler
-	statsService *services.StatsService
+	statsService    *services.StatsService
+	revisionService *services.CardRevisionService
+	detector        *services.DuplicateDetector
+	mediaService    *services.MediaService
 }
 
 func NewCardHandler(db *gorm.DB) *CardHandler {
 	return &CardHandler{
-		BaseHandler:  BaseHandler{db: db},
-		statsService: services.NewStatsService(db),
+		BaseHandler:     BaseHandler{db: db},
+		statsService:    services.NewStatsService(db),
+		revisionService: services.NewCardRevisionService(db),
+		detector:        services.NewDuplicateDetector(db),
+		mediaService:    services.NewMediaService(db, services.NewMediaStorageFromEnv()),
 	}
 }
 
 type createCardRequest struct {
-	Front string `json:"front" binding:"required"`
-	Back  string `json:"back" binding:"required"`
-	Hint  string `json:"hint"`
+	Front          string `json:"front" binding:"required"`
+	Back           string `json:"back" binding:"required"`
+	Hint           string `json:"hint"`
+	ContentFormat  string `json:"contentFormat" binding:"omitempty,oneof=plain markdown"`
+	Markup         bool   `json:"markup"`
+	DuplicateCheck string `json:"duplicateCheck" binding:"omitempty,oneof=skip flag"`
+	DuplicateScope string `json:"duplicateScope" binding:"omitempty,oneof=deck all"`
+}
+
+type createCardResponse struct {
+	*models.Card
+	Duplicates []services.DuplicateMatch `json:"duplicates,omitempty"`
 }
 
 func (h *CardHandler) CreateCard(ctx *gin.Context) {
@@ -58,19 +75,47 @@ func (h *CardHandler) CreateCard(ctx *gin.Context) {
 		return
 	}
 
+	var duplicates []services.DuplicateMatch
+	if req.DuplicateCheck != "" {
+		duplicates, err = h.detector.FindMatches(user.ID, deck.ID, req.DuplicateScope, req.Front)
+		if err != nil {
+			handleError(ctx, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if len(duplicates) > 0 && req.DuplicateCheck == services.DuplicateCheckSkip {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":      "Duplicate card",
+				"duplicates": duplicates,
+			})
+			return
+		}
+	}
+
 	card := &models.Card{
-		DeckID: uint(deckID),
-		Front:  req.Front,
-		Back:   req.Back,
-		Hint:   req.Hint,
+		DeckID:        uint(deckID),
+		Front:         req.Front,
+		Back:          req.Back,
+		Hint:          req.Hint,
+		ContentFormat: req.ContentFormat,
+		Markup:        req.Markup,
 	}
 
-	if err := h.db.Create(card).Error; err != nil {
+	if err := services.SanitizeCard(card); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := services.CreateBasicCard(h.db, user.ID, card); err != nil {
 		handleError(ctx, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, card)
+	if !renderIfRequested(ctx, card) {
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, createCardResponse{Card: card, Duplicates: duplicates})
 }
 
 func (h *CardHandler) ListCards(ctx *gin.Context) {
@@ -97,18 +142,27 @@ func (h *CardHandler) ListCards(ctx *gin.Context) {
 	}
 
 	var cards []models.Card
-	if err := h.db.Where("deck_id = ?", deckID).Find(&cards).Error; err != nil {
+	if err := h.db.Preload("Media").Where("deck_id = ?", deckID).Find(&cards).Error; err != nil {
 		handleError(ctx, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	for i := range cards {
+		if !renderIfRequested(ctx, &cards[i]) {
+			return
+		}
+	}
+
 	ctx.JSON(http.StatusOK, cards)
 }
 
 type updateCardRequest struct {
-	Front string `json:"front"`
-	Back  string `json:"back"`
-	Hint  string `json:"hint"`
+	Front         string `json:"front"`
+	Back          string `json:"back"`
+	Hint          string `json:"hint"`
+	ContentFormat string `json:"contentFormat" binding:"omitempty,oneof=plain markdown"`
+	Markup        *bool  `json:"markup"`
+	Source        string `json:"source" binding:"omitempty,oneof=manual ai"`
 }
 
 func (h *CardHandler) UpdateCard(ctx *gin.Context) {
@@ -139,12 +193,146 @@ func (h *CardHandler) UpdateCard(ctx *gin.Context) {
 		return
 	}
 
+	if !checkIfMatch(ctx, card.Version) {
+		return
+	}
+
 	var req updateCardRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
 		handleError(ctx, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	before := card
+	req.apply(&card)
+
+	if err := services.SanitizeCard(&card); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.saveWithRevision(&before, &card, user.ID, req.source()); err != nil {
+		handleSaveError(ctx, err)
+		return
+	}
+
+	if !renderIfRequested(ctx, &card) {
+		return
+	}
+
+	setETag(ctx, card.Version)
+	ctx.JSON(http.StatusOK, card)
+}
+
+func (h *CardHandler) GetCard(ctx *gin.Context) {
+	cardID, ok := parseIDParam(ctx, "cardId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	card, ok := h.findOwnedCard(ctx, cardID, user.ID)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Model(card).Association("Media").Find(&card.Media); err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !renderIfRequested(ctx, card) {
+		return
+	}
+
+	setETag(ctx, card.Version)
+	ctx.JSON(http.StatusOK, card)
+}
+
+// PatchCard applies a JSON merge patch to a card.
+// null or "" clears the hint; front and back cannot be cleared.
+func (h *CardHandler) PatchCard(ctx *gin.Context) {
+	cardID, ok := parseIDParam(ctx, "cardId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	card, ok := h.findOwnedCard(ctx, cardID, user.ID)
+	if !ok {
+		return
+	}
+
+	if !checkIfMatch(ctx, card.Version) {
+		return
+	}
+
+	patch, ok := bindMergePatch(ctx, "front", "back", "hint", "contentFormat", "markup")
+	if !ok {
+		return
+	}
+
+	if !patch.checkVersion(ctx, card.Version) {
+		return
+	}
+
+	before := *card
+	if err := patch.stringField("front", &card.Front, true); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := patch.stringField("back", &card.Back, true); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := patch.stringField("hint", &card.Hint, false); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := patch.stringField("contentFormat", &card.ContentFormat, false); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := patch.boolField("markup", &card.Markup); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// すべての項目を反映してから検証する
+	if err := services.SanitizeCard(card); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	source := ctx.DefaultQuery("source", services.RevisionSourceManual)
+	if source != services.RevisionSourceManual && source != services.RevisionSourceAI {
+		handleError(ctx, http.StatusBadRequest, "Invalid source")
+		return
+	}
+
+	if err := h.saveWithRevision(&before, card, user.ID, source); err != nil {
+		handleSaveError(ctx, err)
+		return
+	}
+
+	if !renderIfRequested(ctx, card) {
+		return
+	}
+
+	setETag(ctx, card.Version)
+	ctx.JSON(http.StatusOK, card)
+}
+
+// apply copies the non-empty fields of the request onto the card
+func (req *updateCardRequest) apply(card *models.Card) {
 	if req.Front != "" {
 		card.Front = req.Front
 	}
@@ -154,12 +342,191 @@ func (h *CardHandler) UpdateCard(ctx *gin.Context) {
 	if req.Hint != "" {
 		card.Hint = req.Hint
 	}
+	if req.ContentFormat != "" {
+		card.ContentFormat = req.ContentFormat
+	}
+	if req.Markup != nil {
+		card.Markup = *req.Markup
+	}
+}
+
+// renderIfRequested fills pre-rendered HTML when the request has render=html
+func renderIfRequested(ctx *gin.Context, card *models.Card) bool {
+	if ctx.Query("render") != "html" {
+		return true
+	}
+	if err := services.RenderCard(card); err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	return true
+}
+
+func (req *updateCardRequest) source() string {
+	if req.Source == "" {
+		return services.RevisionSourceManual
+	}
+	return req.Source
+}
+
+// saveWithRevision saves the card, bumping its version, and records a revision if its content changed
+func (h *CardHandler) saveWithRevision(before, card *models.Card, userID uint, source string) error {
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		return h.saveCardTx(tx, before, card, userID, source)
+	})
+}
+
+func (h *CardHandler) saveCardTx(tx *gorm.DB, before, card *models.Card, userID uint, source string) error {
+	card.Version = before.Version + 1
+	if err := services.SaveVersioned(tx, card, before.Version); err != nil {
+		return err
+	}
+	if err := services.SyncNoteFromCard(tx, card); err != nil {
+		return err
+	}
+	return h.revisionService.RecordChange(tx, before, card, userID, source)
+}
+
+type bulkUpdateCardItem struct {
+	ID      uint `json:"id" binding:"required"`
+	Version uint `json:"version"` // 指定された場合は楽観的排他制御を行う
+	updateCardRequest
+}
+
+type bulkUpdateCardsRequest struct {
+	Cards  []bulkUpdateCardItem `json:"cards" binding:"required,min=1,dive"`
+	Source string               `json:"source" binding:"omitempty,oneof=manual ai"`
+}
+
+func (h *CardHandler) BulkUpdateCards(ctx *gin.Context) {
+	deckID, ok := parseIDParam(ctx, "deckId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var deck models.Deck
+	if err := h.db.First(&deck, deckID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Deck not found")
+		return
+	}
+
+	if !h.validateOwnership(&deck, user.ID) {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	var req bulkUpdateCardsRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var cards []models.Card
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		for _, item := range req.Cards {
+			var card models.Card
+			if err := tx.Where("id = ? AND deck_id = ?", item.ID, deckID).First(&card).Error; err != nil {
+				return fmt.Errorf("card %d not found in deck", item.ID)
+			}
+
+			if item.Version != 0 && item.Version != card.Version {
+				return services.ErrVersionConflict
+			}
+
+			source := item.source()
+			if item.Source == "" && req.Source != "" {
+				source = req.Source
+			}
+
+			before := card
+			item.apply(&card)
+			if err := services.SanitizeCard(&card); err != nil {
+				return fmt.Errorf("card %d: %w", item.ID, err)
+			}
+			if err := h.saveCardTx(tx, &before, &card, user.ID, source); err != nil {
+				return err
+			}
+			cards = append(cards, card)
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, services.ErrVersionConflict) {
+			handleSaveError(ctx, err)
+			return
+		}
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, cards)
+}
+
+func (h *CardHandler) ListRevisions(ctx *gin.Context) {
+	cardID, ok := parseIDParam(ctx, "cardId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
 
-	if err := h.db.Save(&card).Error; err != nil {
+	card, ok := h.findOwnedCard(ctx, cardID, user.ID)
+	if !ok {
+		return
+	}
+
+	revisions, err := h.revisionService.ListRevisions(card.ID)
+	if err != nil {
 		handleError(ctx, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	ctx.JSON(http.StatusOK, revisions)
+}
+
+func (h *CardHandler) RevertCard(ctx *gin.Context) {
+	cardID, ok := parseIDParam(ctx, "cardId")
+	if !ok {
+		return
+	}
+
+	revisionID, ok := parseIDParam(ctx, "revisionId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	card, ok := h.findOwnedCard(ctx, cardID, user.ID)
+	if !ok {
+		return
+	}
+
+	if !checkIfMatch(ctx, card.Version) {
+		return
+	}
+
+	if err := h.revisionService.Revert(card, uint(revisionID), user.ID); err != nil {
+		if errors.Is(err, services.ErrRevisionNotFound) {
+			handleError(ctx, http.StatusNotFound, "Revision not found")
+			return
+		}
+		handleSaveError(ctx, err)
+		return
+	}
+
+	setETag(ctx, card.Version)
 	ctx.JSON(http.StatusOK, card)
 }
 
@@ -257,10 +624,27 @@ func (h *CardHandler) DeleteCard(ctx *gin.Context) {
 		return
 	}
 
-	if err := h.db.Delete(&card).Error; err != nil {
+	// カードと添付メディアの参照をまとめて削除し、ファイルはコミット後に削除する
+	var mediaKeys []string
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		keys, err := h.mediaService.DeleteForCards(tx, []uint{card.ID})
+		if err != nil {
+			return err
+		}
+		mediaKeys = keys
+		if err := tx.Delete(&card).Error; err != nil {
+			return err
+		}
+		if card.NoteID != nil {
+			return services.PruneNotes(tx, *card.NoteID)
+		}
+		return nil
+	})
+	if err != nil {
 		handleError(ctx, http.StatusInternalServerError, err.Error())
 		return
 	}
+	h.mediaService.RemoveObjects(ctx.Request.Context(), mediaKeys)
 
 	ctx.Status(http.StatusOK)
 }
@@ -307,7 +691,8 @@ func (h *CardHandler) RecordLearning(ctx *gin.Context) {
 	now := time.Now()
 	card.LastReview = &now
 
-	if err := h.db.Save(&card).Error; err != nil {
+	// 学習記録は内容を変更しないため、バージョンを上げずに該当カラムのみ更新する
+	if err := h.db.Model(&card).Select("review_count", "last_review").Updates(&card).Error; err != nil {
 		handleError(ctx, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
 	"github.com/muratayousuke/ai-flashcards/test"
 	"github.com/stretchr/testify/assert"
 )
@@ -161,3 +162,315 @@ func TestRecordLearning(t *testing.T) {
 	
 	assert.Equal(t, 1, updatedCard.ReviewCount)
 }
+
+func setupCardRevisionTestRouter() (*gin.Engine, *CardHandler, func()) {
+	db, cleanup := test.SetupTestDB()
+
+	user := test.CreateTestUser(db)
+	test.CreateTestDeck(db, user.ID)
+
+	handler := NewCardHandler(db)
+
+	r := test.SetupRouter()
+
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(user.ClerkID))
+
+	api.PUT("/cards/:cardId", handler.UpdateCard)
+	api.POST("/decks/:deckId/cards/bulk_update", handler.BulkUpdateCards)
+	api.GET("/cards/:cardId/revisions", handler.ListRevisions)
+	api.POST("/cards/:cardId/revisions/:revisionId/revert", handler.RevertCard)
+
+	return r, handler, cleanup
+}
+
+func TestCardRevisions(t *testing.T) {
+	r, handler, cleanup := setupCardRevisionTestRouter()
+	defer cleanup()
+
+	db := handler.BaseHandler.db
+	card := test.CreateTestCard(db, 1)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"front":  "AI Front",
+		"source": "ai",
+	})
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/cards/%d", card.ID), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/cards/%d/revisions", card.ID), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var revisions []struct {
+		ID     uint   `json:"id"`
+		Front  string `json:"front"`
+		Source string `json:"source"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &revisions))
+	assert.Len(t, revisions, 2)
+	assert.Equal(t, "AI Front", revisions[0].Front)
+	assert.Equal(t, "ai", revisions[0].Source)
+	assert.Equal(t, "Test Front", revisions[1].Front)
+	assert.Equal(t, "manual", revisions[1].Source)
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/cards/%d/revisions/%d/revert", card.ID, revisions[1].ID), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var reverted struct {
+		Front string
+	}
+	db.Table("cards").Where("id = ?", card.ID).First(&reverted)
+	assert.Equal(t, "Test Front", reverted.Front)
+
+	var count int64
+	db.Table("card_revisions").Where("card_id = ? AND source = ?", card.ID, "revert").Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestCardRevisionsUnchangedContent(t *testing.T) {
+	r, handler, cleanup := setupCardRevisionTestRouter()
+	defer cleanup()
+
+	db := handler.BaseHandler.db
+	card := test.CreateTestCard(db, 1)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"front": card.Front,
+	})
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/cards/%d", card.ID), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var count int64
+	db.Table("card_revisions").Where("card_id = ?", card.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestBulkUpdateCards(t *testing.T) {
+	r, handler, cleanup := setupCardRevisionTestRouter()
+	defer cleanup()
+
+	db := handler.BaseHandler.db
+	first := test.CreateTestCard(db, 1)
+	second := test.CreateTestCard(db, 1)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"source": "ai",
+		"cards": []map[string]interface{}{
+			{"id": first.ID, "back": "Bulk Back 1"},
+			{"id": second.ID, "back": "Bulk Back 2", "source": "manual"},
+		},
+	})
+	req, _ := http.NewRequest("POST", "/api/decks/1/cards/bulk_update", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var sources []string
+	db.Table("card_revisions").Where("card_id = ? AND back LIKE ?", first.ID, "Bulk%").Pluck("source", &sources)
+	assert.Equal(t, []string{"ai"}, sources)
+
+	sources = nil
+	db.Table("card_revisions").Where("card_id = ? AND back LIKE ?", second.ID, "Bulk%").Pluck("source", &sources)
+	assert.Equal(t, []string{"manual"}, sources)
+
+	t.Run("デッキに存在しないカードの場合", func(t *testing.T) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"cards": []map[string]interface{}{
+				{"id": 9999, "back": "Missing"},
+			},
+		})
+		req, _ := http.NewRequest("POST", "/api/decks/1/cards/bulk_update", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestPatchCard(t *testing.T) {
+	r, handler, cleanup := setupCardRevisionTestRouter()
+	defer cleanup()
+
+	r.PATCH("/api/cards/:cardId", test.MockAuthMiddleware("test_clerk_id"), handler.PatchCard)
+
+	db := handler.BaseHandler.db
+	card := test.CreateTestCard(db, 1)
+
+	patch := func(body string, ifMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("/api/cards/%d", card.ID), bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("nullでヒントを削除できる場合", func(t *testing.T) {
+		w := patch(`{"hint": null}`, `"1"`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+		var updated struct {
+			Front   string
+			Hint    string
+			Version uint
+		}
+		db.Table("cards").Where("id = ?", card.ID).First(&updated)
+		assert.Equal(t, "Test Front", updated.Front)
+		assert.Equal(t, "", updated.Hint)
+		assert.Equal(t, uint(2), updated.Version)
+	})
+
+	t.Run("古いETagの場合", func(t *testing.T) {
+		w := patch(`{"hint": "stale"}`, `"1"`)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	})
+
+	t.Run("古いversionの場合", func(t *testing.T) {
+		w := patch(`{"hint": "stale", "version": 1}`, "")
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	})
+
+	t.Run("必須フィールドを空にする場合", func(t *testing.T) {
+		w := patch(`{"front": ""}`, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("未知のフィールドの場合", func(t *testing.T) {
+		w := patch(`{"status": "mastered"}`, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestCreateCardDuplicateCheck(t *testing.T) {
+	r, handler, cleanup := setupCardTestRouter()
+	defer cleanup()
+
+	db := handler.BaseHandler.db
+	test.CreateTestCard(db, 1)
+
+	create := func(body map[string]interface{}) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/api/decks/1/cards", bytes.NewBuffer(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("skipの場合は重複カードを作成しない", func(t *testing.T) {
+		w := create(map[string]interface{}{
+			"front":          "ｔｅｓｔ　ｆｒｏｎｔ",
+			"back":           "Back",
+			"duplicateCheck": "skip",
+		})
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		var count int64
+		db.Table("cards").Where("deck_id = ?", 1).Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("flagの場合は作成して重複を報告する", func(t *testing.T) {
+		w := create(map[string]interface{}{
+			"front":          "Test Front!",
+			"back":           "Back",
+			"duplicateCheck": "flag",
+		})
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response struct {
+			ID         uint `json:"id"`
+			Duplicates []struct {
+				Exact bool `json:"exact"`
+			} `json:"duplicates"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.NotZero(t, response.ID)
+		assert.Len(t, response.Duplicates, 1)
+		assert.True(t, response.Duplicates[0].Exact)
+	})
+}
+
+func TestCreateMarkdownCardRendered(t *testing.T) {
+	r, _, cleanup := setupCardTestRouter()
+	defer cleanup()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"front":         "**Go** <script>alert(1)</script>",
+		"back":          "[docs](javascript:alert(1))",
+		"contentFormat": "markdown",
+	})
+	req, _ := http.NewRequest("POST", "/api/decks/1/cards?render=html", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response struct {
+		Front         string `json:"front"`
+		Back          string `json:"back"`
+		ContentFormat string `json:"contentFormat"`
+		Rendered      struct {
+			Front string `json:"front"`
+		} `json:"rendered"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "markdown", response.ContentFormat)
+	assert.Equal(t, "**Go** alert(1)", response.Front)
+	assert.Equal(t, "[docs](#)", response.Back)
+	assert.Equal(t, "<p><strong>Go</strong> alert(1)</p>\n", response.Rendered.Front)
+}
+
+func TestCreateMarkupCard(t *testing.T) {
+	r, _, cleanup := setupCardTestRouter()
+	defer cleanup()
+
+	t.Run("ふりがなが構造化データとして返される", func(t *testing.T) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"front":  "漢字[かんじ]の読み",
+			"back":   "$e^{i\\pi} = -1$",
+			"markup": true,
+		})
+		req, _ := http.NewRequest("POST", "/api/decks/1/cards?render=html", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response models.Card
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.True(t, response.Markup)
+		assert.Equal(t, []models.Furigana{{Base: "漢字", Reading: "かんじ"}}, response.Rendered.Furigana.Front)
+		assert.Contains(t, response.Rendered.Back, `<span class="math math-inline">e^{i\pi} = -1</span>`)
+	})
+
+	t.Run("不正な記法は拒否される", func(t *testing.T) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"front":  "漢字[kanji]",
+			"back":   "answer",
+			"markup": true,
+		})
+		req, _ := http.NewRequest("POST", "/api/decks/1/cards", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
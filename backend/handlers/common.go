@@ -1,11 +1,17 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
 	"gorm.io/gorm"
 )
 
@@ -46,7 +52,149 @@ func (h *BaseHandler) validateOwnership(deck *models.Deck, userID uint) bool {
 	return deck.UserID == userID
 }
 
+// findOwnedCard loads a card and verifies that its deck belongs to the user
+func (h *BaseHandler) findOwnedCard(ctx *gin.Context, cardID uint64, userID uint) (*models.Card, bool) {
+	var card models.Card
+	if err := h.db.First(&card, cardID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Card not found")
+		return nil, false
+	}
+
+	var deck models.Deck
+	if err := h.db.First(&deck, card.DeckID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Deck not found")
+		return nil, false
+	}
+
+	if !h.validateOwnership(&deck, userID) {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return nil, false
+	}
+
+	return &card, true
+}
+
+// handleSaveError maps errors from versioned saves to responses
+func handleSaveError(ctx *gin.Context, err error) {
+	if errors.Is(err, services.ErrVersionConflict) {
+		handleError(ctx, http.StatusPreconditionFailed, "Resource has been modified")
+		return
+	}
+	handleError(ctx, http.StatusInternalServerError, err.Error())
+}
+
 // handleError handles common error responses
 func handleError(ctx *gin.Context, status int, message string) {
 	ctx.JSON(status, gin.H{"error": message})
 }
+
+// setETag sets the ETag header from a record version
+func setETag(ctx *gin.Context, version uint) {
+	ctx.Header("ETag", fmt.Sprintf(`"%d"`, version))
+}
+
+// checkIfMatch verifies the If-Match header against the current version.
+// A missing header always matches.
+func checkIfMatch(ctx *gin.Context, version uint) bool {
+	header := ctx.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+
+	current := strconv.FormatUint(uint64(version), 10)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		if strings.Trim(tag, `"`) == current {
+			return true
+		}
+	}
+
+	handleError(ctx, http.StatusPreconditionFailed, "Resource has been modified")
+	return false
+}
+
+// mergePatch holds a JSON merge patch (RFC 7386) document
+type mergePatch map[string]json.RawMessage
+
+// bindMergePatch parses the request body as a JSON merge patch object
+func bindMergePatch(ctx *gin.Context, allowed ...string) (mergePatch, bool) {
+	var patch mergePatch
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&patch); err != nil || patch == nil {
+		handleError(ctx, http.StatusBadRequest, "Request body must be a JSON object")
+		return nil, false
+	}
+
+	for key := range patch {
+		if key != "version" && !slices.Contains(allowed, key) {
+			handleError(ctx, http.StatusBadRequest, fmt.Sprintf("Unknown field: %s", key))
+			return nil, false
+		}
+	}
+
+	return patch, true
+}
+
+// stringField applies a string member of the patch to target.
+// null and "" clear the field; clearing a required field is an error.
+func (p mergePatch) stringField(key string, target *string, required bool) error {
+	raw, ok := p[key]
+	if !ok {
+		return nil
+	}
+
+	var value *string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return fmt.Errorf("%s must be a string or null", key)
+	}
+
+	if value == nil || *value == "" {
+		if required {
+			return fmt.Errorf("%s cannot be empty", key)
+		}
+		*target = ""
+		return nil
+	}
+
+	*target = *value
+	return nil
+}
+
+// boolField applies a boolean member of the patch to target; null sets false
+func (p mergePatch) boolField(key string, target *bool) error {
+	raw, ok := p[key]
+	if !ok {
+		return nil
+	}
+
+	var value *bool
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return fmt.Errorf("%s must be a boolean or null", key)
+	}
+
+	*target = value != nil && *value
+	return nil
+}
+
+// checkVersion verifies the optional "version" member of the patch
+func (p mergePatch) checkVersion(ctx *gin.Context, version uint) bool {
+	raw, ok := p["version"]
+	if !ok {
+		return true
+	}
+
+	var expected uint
+	if err := json.Unmarshal(raw, &expected); err != nil {
+		handleError(ctx, http.StatusBadRequest, "version must be a number")
+		return false
+	}
+
+	if expected != version {
+		handleError(ctx, http.StatusPreconditionFailed, "Resource has been modified")
+		return false
+	}
+	return true
+}
@@ -7,7 +7,6 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
-	"github.com/muratayousuke/ai-flashcards/models"
 	"github.com/muratayousuke/ai-flashcards/test"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/gorm"
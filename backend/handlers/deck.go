@@ -24,6 +24,7 @@ func NewDeckHandler(db *gorm.DB) *DeckHandler {
 type createDeckRequest struct {
 	Title       string `json:"title" binding:"required"`
 	Description string `json:"description"`
+	ParentID    *uint  `json:"parentId"` // サブデッキとして作成する場合の親デッキ
 }
 
 func (h *DeckHandler) Create(ctx *gin.Context) {
@@ -38,10 +39,23 @@ func (h *DeckHandler) Create(ctx *gin.Context) {
 		return
 	}
 
+	if req.ParentID != nil {
+		var parent models.Deck
+		if err := h.db.First(&parent, *req.ParentID).Error; err != nil {
+			handleError(ctx, http.StatusBadRequest, "Parent deck not found")
+			return
+		}
+		if !h.validateOwnership(&parent, user.ID) {
+			handleError(ctx, http.StatusForbidden, "Access denied")
+			return
+		}
+	}
+
 	deck := &models.Deck{
 		UserID:      user.ID,
 		Title:       req.Title,
 		Description: req.Description,
+		ParentID:    req.ParentID,
 	}
 
 	if err := h.db.Create(deck).Error; err != nil {
@@ -89,6 +103,7 @@ func (h *DeckHandler) Get(ctx *gin.Context) {
 		return
 	}
 
+	setETag(ctx, deck.Version)
 	ctx.JSON(http.StatusOK, deck)
 }
 
@@ -119,6 +134,10 @@ func (h *DeckHandler) Update(ctx *gin.Context) {
 		return
 	}
 
+	if !checkIfMatch(ctx, deck.Version) {
+		return
+	}
+
 	var req updateDeckRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
 		handleError(ctx, http.StatusBadRequest, err.Error())
@@ -132,11 +151,69 @@ func (h *DeckHandler) Update(ctx *gin.Context) {
 		deck.Description = req.Description
 	}
 
-	if err := h.db.Save(&deck).Error; err != nil {
-		handleError(ctx, http.StatusInternalServerError, err.Error())
+	h.saveDeck(ctx, &deck)
+}
+
+// Patch applies a JSON merge patch to a deck.
+// null or "" clears the description; the title cannot be cleared.
+func (h *DeckHandler) Patch(ctx *gin.Context) {
+	deckID, ok := parseIDParam(ctx, "deckId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var deck models.Deck
+	if err := h.db.First(&deck, deckID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Deck not found")
+		return
+	}
+
+	if !h.validateOwnership(&deck, user.ID) {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	if !checkIfMatch(ctx, deck.Version) {
+		return
+	}
+
+	patch, ok := bindMergePatch(ctx, "title", "description")
+	if !ok {
+		return
+	}
+
+	if !patch.checkVersion(ctx, deck.Version) {
+		return
+	}
+
+	if err := patch.stringField("title", &deck.Title, true); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := patch.stringField("description", &deck.Description, false); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.saveDeck(ctx, &deck)
+}
+
+// saveDeck saves the deck with a version check and writes the response
+func (h *DeckHandler) saveDeck(ctx *gin.Context, deck *models.Deck) {
+	expected := deck.Version
+	deck.Version = expected + 1
+
+	if err := services.SaveVersioned(h.db, deck, expected); err != nil {
+		handleSaveError(ctx, err)
 		return
 	}
 
+	setETag(ctx, deck.Version)
 	ctx.JSON(http.StatusOK, deck)
 }
 
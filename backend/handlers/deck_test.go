@@ -164,3 +164,37 @@ func TestDeleteDeck(t *testing.T) {
 	assert.NoError(t, result.Error)
 	assert.NotNil(t, deletedDeck.DeletedAt, "Deck should be soft deleted (DeletedAt should not be nil)")
 }
+
+func TestPatchDeck(t *testing.T) {
+	r, handler, cleanup := setupDeckTestRouter()
+	defer cleanup()
+
+	r.PATCH("/api/decks/:deckId", test.MockAuthMiddleware("test_clerk_id"), handler.Patch)
+
+	db := handler.BaseHandler.db
+
+	var user models.User
+	db.Where("clerk_id = ?", "test_clerk_id").First(&user)
+	deck := test.CreateTestDeck(db, user.ID)
+
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("/api/decks/%d", deck.ID), bytes.NewBufferString(`{"description": ""}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", `"1"`)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var updatedDeck models.Deck
+	db.First(&updatedDeck, deck.ID)
+	assert.Equal(t, "Test Deck", updatedDeck.Title)
+	assert.Equal(t, "", updatedDeck.Description)
+	assert.Equal(t, uint(2), updatedDeck.Version)
+
+	req, _ = http.NewRequest("PATCH", fmt.Sprintf("/api/decks/%d", deck.ID), bytes.NewBufferString(`{"title": "Stale"}`))
+	req.Header.Set("If-Match", `"1"`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+}
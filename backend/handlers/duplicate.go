@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"gorm.io/gorm"
+)
+
+type DuplicateHandler struct {
+	BaseHandler
+	detector *services.DuplicateDetector
+}
+
+func NewDuplicateHandler(db *gorm.DB) *DuplicateHandler {
+	return &DuplicateHandler{
+		BaseHandler: BaseHandler{db: db},
+		detector:    services.NewDuplicateDetector(db),
+	}
+}
+
+// DeckReport lists duplicate groups that involve the deck's cards.
+// scope=all also compares against the user's other decks.
+func (h *DuplicateHandler) DeckReport(ctx *gin.Context) {
+	deckID, ok := parseIDParam(ctx, "deckId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var deck models.Deck
+	if err := h.db.First(&deck, deckID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Deck not found")
+		return
+	}
+
+	if !h.validateOwnership(&deck, user.ID) {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	scope := ctx.DefaultQuery("scope", services.DuplicateScopeDeck)
+	if scope != services.DuplicateScopeDeck && scope != services.DuplicateScopeAll {
+		handleError(ctx, http.StatusBadRequest, "Invalid scope")
+		return
+	}
+
+	detector, ok := h.detectorFromQuery(ctx)
+	if !ok {
+		return
+	}
+
+	groups, err := detector.Report(user.ID, deck.ID, scope)
+	if err != nil {
+		if errors.Is(err, services.ErrTooManyCardsForReport) {
+			handleError(ctx, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"groups": groups})
+}
+
+// Report lists duplicate groups across all of the user's decks
+func (h *DuplicateHandler) Report(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	detector, ok := h.detectorFromQuery(ctx)
+	if !ok {
+		return
+	}
+
+	groups, err := detector.Report(user.ID, 0, services.DuplicateScopeAll)
+	if err != nil {
+		if errors.Is(err, services.ErrTooManyCardsForReport) {
+			handleError(ctx, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"groups": groups})
+}
+
+func (h *DuplicateHandler) detectorFromQuery(ctx *gin.Context) (*services.DuplicateDetector, bool) {
+	raw := ctx.Query("threshold")
+	if raw == "" {
+		return h.detector, true
+	}
+
+	threshold, err := strconv.ParseFloat(raw, 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		handleError(ctx, http.StatusBadRequest, "threshold must be between 0 and 1")
+		return nil, false
+	}
+	return h.detector.WithThreshold(threshold), true
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"gorm.io/gorm"
+)
+
+type ExportHandler struct {
+	BaseHandler
+	ankiExporter *services.AnkiExporter
+	dataExporter *services.DataExporter
+}
+
+func NewExportHandler(db *gorm.DB) *ExportHandler {
+	return &ExportHandler{
+		BaseHandler:  BaseHandler{db: db},
+		ankiExporter: services.NewAnkiExporter(db, services.NewMediaStorageFromEnv()),
+		dataExporter: services.NewDataExporter(db),
+	}
+}
+
+// ExportDeckAnki downloads a deck and its subdecks as an Anki .apkg package
+func (h *ExportHandler) ExportDeckAnki(ctx *gin.Context) {
+	deckID, ok := parseIDParam(ctx, "deckId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var deck models.Deck
+	if err := h.db.First(&deck, deckID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Deck not found")
+		return
+	}
+
+	if !h.validateOwnership(&deck, user.ID) {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	decks, err := services.DeckTree(h.db, &deck)
+	if err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.writeAnkiPackage(ctx, decks, deck.Title)
+}
+
+// ExportAllAnki downloads all decks of the user as an Anki .apkg package
+func (h *ExportHandler) ExportAllAnki(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var decks []models.Deck
+	if err := h.db.Where("user_id = ?", user.ID).Order("id").Find(&decks).Error; err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if len(decks) == 0 {
+		handleError(ctx, http.StatusNotFound, "No decks to export")
+		return
+	}
+
+	h.writeAnkiPackage(ctx, decks, "flashcards")
+}
+
+func (h *ExportHandler) writeAnkiPackage(ctx *gin.Context, decks []models.Deck, name string) {
+	writeAttachmentHeader(ctx, "application/apkg", name, "apkg")
+
+	if err := h.ankiExporter.Export(ctx.Request.Context(), decks, ctx.Writer); err != nil {
+		// ヘッダーは送信済みのため、ログに残して接続を打ち切る
+		log.Printf("Failed to export Anki package: %v", err)
+		ctx.Abort()
+	}
+}
+
+// ExportDeckCards downloads the cards of a deck and its subdecks as CSV or JSON
+func (h *ExportHandler) ExportDeckCards(ctx *gin.Context) {
+	deckID, ok := parseIDParam(ctx, "deckId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	format, ok := exportFormatFromQuery(ctx)
+	if !ok {
+		return
+	}
+
+	var deck models.Deck
+	if err := h.db.First(&deck, deckID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Deck not found")
+		return
+	}
+
+	if !h.validateOwnership(&deck, user.ID) {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	decks, err := services.DeckTree(h.db, &deck)
+	if err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeAttachmentHeader(ctx, exportContentType(format), deck.Title, format)
+	if err := h.dataExporter.ExportCards(ctx.Request.Context(), decks, format, ctx.Writer); err != nil {
+		log.Printf("Failed to export cards: %v", err)
+		ctx.Abort()
+	}
+}
+
+// ExportHistory downloads the answer records of the user as CSV or JSON.
+// from and to (YYYY-MM-DD or RFC3339) limit the range, with a date for to
+// including the whole day, and deckId limits it to one deck.
+func (h *ExportHandler) ExportHistory(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	format, ok := exportFormatFromQuery(ctx)
+	if !ok {
+		return
+	}
+
+	filter := services.AnswerExportFilter{UserID: user.ID}
+	if filter.From, ok = parseExportTime(ctx, "from", false); !ok {
+		return
+	}
+	if filter.To, ok = parseExportTime(ctx, "to", true); !ok {
+		return
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		handleError(ctx, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	if value := ctx.Query("deckId"); value != "" {
+		deckID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			handleError(ctx, http.StatusBadRequest, "Invalid deck ID")
+			return
+		}
+
+		var deck models.Deck
+		if err := h.db.First(&deck, deckID).Error; err != nil {
+			handleError(ctx, http.StatusNotFound, "Deck not found")
+			return
+		}
+		if !h.validateOwnership(&deck, user.ID) {
+			handleError(ctx, http.StatusForbidden, "Access denied")
+			return
+		}
+		filter.DeckID = deck.ID
+	}
+
+	writeAttachmentHeader(ctx, exportContentType(format), "history", format)
+	if err := h.dataExporter.ExportAnswers(ctx.Request.Context(), filter, format, ctx.Writer); err != nil {
+		log.Printf("Failed to export history: %v", err)
+		ctx.Abort()
+	}
+}
+
+// writeAttachmentHeader starts a file download. The body is written by the caller.
+func writeAttachmentHeader(ctx *gin.Context, contentType, name, ext string) {
+	ctx.Header("Content-Type", contentType)
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"export.%s\"; filename*=UTF-8''%s", ext, url.PathEscape(name+"."+ext)))
+	ctx.Status(http.StatusOK)
+}
+
+func exportFormatFromQuery(ctx *gin.Context) (string, bool) {
+	format := ctx.DefaultQuery("format", services.ExportFormatCSV)
+	if !services.ValidExportFormat(format) {
+		handleError(ctx, http.StatusBadRequest, services.ErrInvalidExportFormat.Error())
+		return "", false
+	}
+	return format, true
+}
+
+func exportContentType(format string) string {
+	if format == services.ExportFormatJSON {
+		return "application/json; charset=utf-8"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// parseExportTime parses an optional date or RFC3339 time query parameter.
+// A date is a day in the server's time zone (TZ); with endOfDay set, it
+// refers to the end of that day.
+func parseExportTime(ctx *gin.Context, key string, endOfDay bool) (time.Time, bool) {
+	value := ctx.Query(key)
+	if value == "" {
+		return time.Time{}, true
+	}
+	// 文字列で比較するデータベースでも正しく比較できるよう UTC に揃える
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), true
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		handleError(ctx, http.StatusBadRequest, key+" must be a date (YYYY-MM-DD) or an RFC3339 time")
+		return time.Time{}, false
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t.UTC(), true
+}
@@ -0,0 +1,355 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupExportTestRouter(t *testing.T) (*gin.Engine, *gorm.DB, *models.User, func()) {
+	t.Setenv("MEDIA_STORAGE_DIR", t.TempDir())
+
+	db, cleanup := test.SetupTestDB()
+
+	user := test.CreateTestUser(db)
+	exportHandler := NewExportHandler(db)
+	importHandler := NewImportHandler(db)
+
+	r := test.SetupRouter()
+
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(user.ClerkID))
+	api.GET("/decks/:deckId/export/anki", exportHandler.ExportDeckAnki)
+	api.GET("/export/anki", exportHandler.ExportAllAnki)
+	api.POST("/import/anki", importHandler.ImportAnki)
+	api.GET("/decks/:deckId/export/cards", exportHandler.ExportDeckCards)
+	api.GET("/export/history", exportHandler.ExportHistory)
+
+	return r, db, user, cleanup
+}
+
+// openExportedCollection extracts the collection of a package and returns its database and media list
+func openExportedCollection(t *testing.T, pkg []byte) (*gorm.DB, map[string]string) {
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	require.NoError(t, err)
+
+	colPath := filepath.Join(t.TempDir(), "collection.anki2")
+	var media map[string]string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+
+		switch f.Name {
+		case "collection.anki2":
+			require.NoError(t, os.WriteFile(colPath, data, 0o600))
+		case "media":
+			require.NoError(t, json.Unmarshal(data, &media))
+		}
+	}
+
+	col, err := gorm.Open(sqlite.Open(colPath), &gorm.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		sqlDB, _ := col.DB()
+		sqlDB.Close()
+	})
+	return col, media
+}
+
+func TestExportAnki(t *testing.T) {
+	r, db, user, cleanup := setupExportTestRouter(t)
+	defer cleanup()
+
+	parent := &models.Deck{UserID: user.ID, Title: "Languages"}
+	require.NoError(t, db.Create(parent).Error)
+	child := &models.Deck{UserID: user.ID, Title: "Japanese", ParentID: &parent.ID}
+	require.NoError(t, db.Create(child).Error)
+	other := &models.Deck{UserID: user.ID, Title: "Other"}
+	require.NoError(t, db.Create(other).Error)
+
+	reviewed := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	basic := &models.Card{
+		DeckID:        parent.ID,
+		Front:         "**Hello**",
+		Back:          "world",
+		ContentFormat: services.ContentFormatMarkdown,
+		Status:        "mastered",
+		ReviewCount:   3,
+		LastReview:    &reviewed,
+	}
+	require.NoError(t, services.CreateBasicCard(db, user.ID, basic))
+	require.NoError(t, db.Model(basic).Association("Tags").Append(&models.Tag{UserID: user.ID, Name: "greeting"}))
+	require.NoError(t, db.Create(&models.AnswerRecord{
+		UserID: user.ID, DeckID: parent.ID, CardID: basic.ID, IsCorrect: true, StudyTime: 4, AnswerDate: reviewed,
+	}).Error)
+
+	mediaService := services.NewMediaService(db, services.NewMediaStorageFromEnv())
+	require.NoError(t, mediaService.Attach(context.Background(), &models.Media{
+		UserID: user.ID, CardID: &basic.ID, Side: services.MediaSideBack, Filename: "cat.png", MimeType: "image/png", Size: 4,
+	}, strings.NewReader("\x89PNG")))
+
+	noteService := services.NewNoteService(db, mediaService)
+	noteType := &models.NoteType{
+		UserID: &user.ID,
+		Name:   "Vocabulary",
+		Fields: []string{"Word", "Meaning"},
+		Templates: []models.CardTemplate{
+			{Name: "Recognition", Front: "{{Word}}", Back: "{{Meaning}}"},
+			{Name: "Production", Front: "{{Meaning}}", Back: "{{Word}}"},
+		},
+	}
+	require.NoError(t, noteService.CreateNoteType(noteType))
+	require.NoError(t, noteService.CreateNote(context.Background(), noteType, &models.Note{
+		UserID:        user.ID,
+		DeckID:        child.ID,
+		Fields:        map[string]string{"Word": "漢字[かんじ]", "Meaning": "$x^2$"},
+		ContentFormat: services.ContentFormatMarkdown,
+		Markup:        true,
+	}))
+
+	outside := &models.Card{DeckID: other.ID, Front: "outside", Back: "deck"}
+	require.NoError(t, services.CreateBasicCard(db, user.ID, outside))
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/decks/%d/export/anki", parent.ID), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "Languages.apkg")
+	pkg := w.Body.Bytes()
+
+	t.Run("デッキとサブデッキのカードが含まれる", func(t *testing.T) {
+		col, media := openExportedCollection(t, pkg)
+
+		var decks string
+		col.Raw("SELECT decks FROM col").Scan(&decks)
+		assert.Contains(t, decks, `"Languages::Japanese"`)
+		assert.NotContains(t, decks, `"Other"`)
+
+		var notes []struct {
+			Tags string
+			Flds string
+		}
+		col.Raw("SELECT tags, flds FROM notes ORDER BY id").Scan(&notes)
+		require.Len(t, notes, 2)
+		assert.Equal(t, " greeting ", notes[0].Tags)
+		assert.Equal(t, "<strong>Hello</strong>\x1fworld<img src=\"1_cat.png\">\x1f", notes[0].Flds)
+		assert.Contains(t, notes[1].Flds, "<ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>")
+		assert.Contains(t, notes[1].Flds, `\(x^2\)`)
+
+		var cards []struct {
+			Ord  int
+			Type int
+			Ivl  int
+			Reps int
+		}
+		col.Raw("SELECT ord, type, ivl, reps FROM cards ORDER BY id").Scan(&cards)
+		require.Len(t, cards, 3)
+		assert.Equal(t, 2, cards[0].Type)
+		assert.Equal(t, 21, cards[0].Ivl)
+		assert.Equal(t, 3, cards[0].Reps)
+		assert.Equal(t, 0, cards[1].Type)
+		assert.Equal(t, 1, cards[2].Ord)
+
+		var revlogs int64
+		col.Raw("SELECT COUNT(*) FROM revlog").Scan(&revlogs)
+		assert.Equal(t, int64(1), revlogs)
+
+		assert.Equal(t, map[string]string{"0": "1_cat.png"}, media)
+	})
+
+	t.Run("エクスポートしたパッケージを再インポートできる", func(t *testing.T) {
+		w := postAnkiPackage(r, pkg, map[string]string{"includeReviews": "true"})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var report services.AnkiImportReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		assert.Equal(t, 2, report.Decks)
+		assert.Equal(t, 1, report.NoteTypes)
+		assert.Equal(t, 3, report.Cards)
+		assert.Equal(t, 1, report.Media)
+		assert.Equal(t, 1, report.Reviews)
+		assert.Empty(t, report.Skipped)
+
+		var imported models.Card
+		require.NoError(t, db.Where("deck_id = ?", report.DeckIDs[0]).First(&imported).Error)
+		assert.Equal(t, "**Hello**", imported.Front)
+		assert.Equal(t, "world", imported.Back)
+		assert.Equal(t, "mastered", imported.Status)
+
+		var note models.Note
+		require.NoError(t, db.Where("deck_id = ? AND markup = ?", report.DeckIDs[1], true).First(&note).Error)
+		assert.Equal(t, "漢字[かんじ]", note.Fields["Word"])
+		assert.Equal(t, "$x^2$", note.Fields["Meaning"])
+	})
+
+	t.Run("全デッキをエクスポートできる", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/export/anki", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		col, _ := openExportedCollection(t, w.Body.Bytes())
+		var decks string
+		col.Raw("SELECT decks FROM col").Scan(&decks)
+		assert.Contains(t, decks, `"Other"`)
+	})
+}
+
+func TestExportCards(t *testing.T) {
+	r, db, user, cleanup := setupExportTestRouter(t)
+	defer cleanup()
+
+	deck := &models.Deck{UserID: user.ID, Title: "英単語"}
+	require.NoError(t, db.Create(deck).Error)
+	child := &models.Deck{UserID: user.ID, Title: "動詞", ParentID: &deck.ID}
+	require.NoError(t, db.Create(child).Error)
+
+	reviewed := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	card := &models.Card{DeckID: deck.ID, Front: "apple, \"red\"", Back: "りんご", Status: "learning", ReviewCount: 2, LastReview: &reviewed}
+	require.NoError(t, services.CreateBasicCard(db, user.ID, card))
+	require.NoError(t, db.Model(card).Association("Tags").Append(&models.Tag{UserID: user.ID, Name: "fruit"}))
+	require.NoError(t, services.CreateBasicCard(db, user.ID, &models.Card{DeckID: child.ID, Front: "run", Back: "走る"}))
+
+	t.Run("CSV でサブデッキのカードも出力する", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/decks/%d/export/cards", deck.ID), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/csv")
+		assert.Contains(t, w.Header().Get("Content-Disposition"), ".csv")
+
+		records, err := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		assert.Equal(t, "front", records[0][3])
+		assert.Equal(t, []string{
+			fmt.Sprintf("%d", card.ID), fmt.Sprintf("%d", deck.ID), "英単語", "apple, \"red\"", "りんご", "", "plain",
+			"learning", "2", "2026-03-01T09:00:00Z", "fruit",
+		}, records[1][:11])
+		assert.Equal(t, "動詞", records[2][2])
+	})
+
+	t.Run("JSON で出力する", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/decks/%d/export/cards?format=json", child.ID), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var rows []services.CardExportRow
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rows))
+		require.Len(t, rows, 1)
+		assert.Equal(t, "run", rows[0].Front)
+		assert.Equal(t, "new", rows[0].Status)
+		assert.Empty(t, rows[0].Tags)
+	})
+
+	t.Run("不正な形式", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/decks/%d/export/cards?format=xml", deck.ID), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestExportHistory(t *testing.T) {
+	r, db, user, cleanup := setupExportTestRouter(t)
+	defer cleanup()
+
+	deck := &models.Deck{UserID: user.ID, Title: "英単語"}
+	require.NoError(t, db.Create(deck).Error)
+	other := &models.Deck{UserID: user.ID, Title: "その他"}
+	require.NoError(t, db.Create(other).Error)
+
+	card := &models.Card{DeckID: deck.ID, Front: "apple", Back: "りんご"}
+	require.NoError(t, services.CreateBasicCard(db, user.ID, card))
+
+	for _, record := range []models.AnswerRecord{
+		{UserID: user.ID, DeckID: deck.ID, CardID: card.ID, IsCorrect: true, StudyTime: 5, AnswerDate: time.Date(2026, 4, 1, 10, 0, 0, 0, time.UTC)},
+		{UserID: user.ID, DeckID: deck.ID, CardID: card.ID, IsCorrect: false, StudyTime: 8, AnswerDate: time.Date(2026, 4, 2, 23, 0, 0, 0, time.UTC)},
+		{UserID: user.ID, DeckID: other.ID, CardID: 9999, IsCorrect: true, StudyTime: 3, AnswerDate: time.Date(2026, 4, 2, 12, 0, 0, 0, time.UTC)},
+		{UserID: user.ID, DeckID: deck.ID, CardID: card.ID, IsCorrect: true, StudyTime: 4, AnswerDate: time.Date(2026, 4, 3, 0, 0, 0, 0, time.UTC)},
+	} {
+		require.NoError(t, db.Create(&record).Error)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/export/history?"+query, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("期間を指定して JSON で出力する", func(t *testing.T) {
+		w := get("format=json&from=2026-04-02&to=2026-04-02")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var rows []services.AnswerExportRow
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rows))
+		require.Len(t, rows, 2)
+		assert.Equal(t, "その他", rows[0].Deck)
+		assert.Empty(t, rows[0].Front)
+		assert.Equal(t, "apple", rows[1].Front)
+		assert.False(t, rows[1].IsCorrect)
+	})
+
+	t.Run("日付はサーバーのタイムゾーンの1日とする", func(t *testing.T) {
+		local := time.Local
+		time.Local = time.FixedZone("JST", 9*60*60)
+		defer func() { time.Local = local }()
+
+		// 日本時間の 4/3 は UTC の 4/2 15:00 から 4/3 15:00 まで
+		w := get(fmt.Sprintf("format=json&deckId=%d&from=2026-04-03&to=2026-04-03", deck.ID))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var rows []services.AnswerExportRow
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rows))
+		require.Len(t, rows, 2)
+		assert.True(t, rows[0].AnswerDate.Equal(time.Date(2026, 4, 2, 23, 0, 0, 0, time.UTC)))
+		assert.True(t, rows[1].AnswerDate.Equal(time.Date(2026, 4, 3, 0, 0, 0, 0, time.UTC)))
+	})
+
+	t.Run("デッキを指定して CSV で出力する", func(t *testing.T) {
+		w := get(fmt.Sprintf("deckId=%d", deck.ID))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		records, err := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 4)
+		assert.Equal(t, []string{"id", "answerDate", "deckId", "deck", "cardId", "front", "isCorrect", "studyTime"}, records[0])
+		assert.Equal(t, "2026-04-01T10:00:00Z", records[1][1])
+		assert.Equal(t, "true", records[1][6])
+	})
+
+	t.Run("該当なしの場合は空の配列", func(t *testing.T) {
+		w := get("format=json&from=2025-01-01&to=2025-01-31")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, "[]", w.Body.String())
+	})
+
+	t.Run("不正な期間", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, get("from=yesterday").Code)
+		assert.Equal(t, http.StatusBadRequest, get("from=2026-04-03&to=2026-04-01").Code)
+	})
+}
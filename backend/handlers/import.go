@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"gorm.io/gorm"
+)
+
+type ImportHandler struct {
+	BaseHandler
+	ankiImporter *services.AnkiImporter
+	csvImporter  *services.CSVImporter
+}
+
+func NewImportHandler(db *gorm.DB) *ImportHandler {
+	return &ImportHandler{
+		BaseHandler:  BaseHandler{db: db},
+		ankiImporter: services.NewAnkiImporter(db, services.NewMediaStorageFromEnv()),
+		csvImporter:  services.NewCSVImporter(db),
+	}
+}
+
+// ImportAnki imports the decks, notes, media and optionally the review
+// history of an Anki .apkg package
+func (h *ImportHandler) ImportAnki(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	file, header, err := ctx.Request.FormFile("file")
+	if err != nil {
+		handleError(ctx, http.StatusBadRequest, "File is required")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > services.MaxAnkiPackageSize {
+		handleError(ctx, http.StatusRequestEntityTooLarge, "File is too large (max 200MB)")
+		return
+	}
+
+	includeReviews, ok := formBool(ctx, "includeReviews", false)
+	if !ok {
+		return
+	}
+
+	duplicateCheck, duplicateScope, ok := duplicateOptions(ctx)
+	if !ok {
+		return
+	}
+
+	opts := services.AnkiImportOptions{
+		IncludeReviews: includeReviews,
+		DuplicateCheck: duplicateCheck,
+		DuplicateScope: duplicateScope,
+	}
+
+	report, err := h.ankiImporter.Import(ctx.Request.Context(), user.ID, file, header.Size, opts)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidAnkiPackage) || errors.Is(err, services.ErrUnsupportedAnkiPackage) {
+			handleError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, report)
+}
+
+// ImportCSV imports cards from a CSV/TSV file. By default it only returns a
+// preview of the parsed rows with their validation errors; with dryRun=false
+// the rows are imported into an existing deck (deckId) or a new one (deckTitle).
+// duplicateCheck and duplicateScope mark, skip or report rows duplicating
+// existing cards as the Anki import does.
+func (h *ImportHandler) ImportCSV(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	file, header, err := ctx.Request.FormFile("file")
+	if err != nil {
+		handleError(ctx, http.StatusBadRequest, "File is required")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > services.MaxCSVImportSize {
+		handleError(ctx, http.StatusRequestEntityTooLarge, "File is too large (max 10MB)")
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, services.MaxCSVImportSize))
+	if err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dryRun, ok := formBool(ctx, "dryRun", true)
+	if !ok {
+		return
+	}
+	skipInvalid, ok := formBool(ctx, "skipInvalid", false)
+	if !ok {
+		return
+	}
+	hasHeader, ok := formBool(ctx, "hasHeader", false)
+	if !ok {
+		return
+	}
+	duplicateCheck, duplicateScope, ok := duplicateOptions(ctx)
+	if !ok {
+		return
+	}
+
+	opts := services.CSVImportOptions{
+		Delimiter:      ctx.PostForm("delimiter"),
+		Encoding:       ctx.PostForm("encoding"),
+		HasHeader:      hasHeader,
+		ContentFormat:  ctx.PostForm("contentFormat"),
+		DuplicateCheck: duplicateCheck,
+		DuplicateScope: duplicateScope,
+	}
+	if strings.HasSuffix(strings.ToLower(header.Filename), ".tsv") && opts.Delimiter == "" {
+		opts.Delimiter = "\t"
+	}
+	if mapping := ctx.PostForm("mapping"); mapping != "" {
+		if err := json.Unmarshal([]byte(mapping), &opts.Mapping); err != nil {
+			handleError(ctx, http.StatusBadRequest, "mapping must be a JSON object of column names or indexes")
+			return
+		}
+	}
+
+	preview, err := services.ParseCSV(data, opts)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidCSV) || errors.Is(err, services.ErrUnsupportedCharset) || errors.Is(err, services.ErrInvalidContentFormat) {
+			handleError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// プレビューでもデッキが指定されていれば、そのデッキのカードとの重複を確認する
+	var deck *models.Deck
+	if !dryRun || (opts.DuplicateCheck != "" && ctx.PostForm("deckId") != "") {
+		if deck, ok = h.importTargetDeck(ctx, user.ID); !ok {
+			return
+		}
+	}
+
+	var deckID uint
+	if deck != nil {
+		deckID = deck.ID
+	}
+	if err := h.csvImporter.MarkDuplicates(user.ID, deckID, preview, opts); err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if dryRun {
+		ctx.JSON(http.StatusOK, preview)
+		return
+	}
+
+	result, err := h.csvImporter.Commit(ctx.Request.Context(), user.ID, deck, preview, opts, skipInvalid)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrCSVInvalidRows):
+			ctx.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "preview": preview})
+		case errors.Is(err, services.ErrInvalidCSV):
+			handleError(ctx, http.StatusBadRequest, err.Error())
+		default:
+			handleError(ctx, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, result)
+}
+
+// importTargetDeck returns the deck of the deckId form field, or a new
+// unsaved deck titled by deckTitle
+func (h *ImportHandler) importTargetDeck(ctx *gin.Context, userID uint) (*models.Deck, bool) {
+	if value := ctx.PostForm("deckId"); value != "" {
+		deckID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			handleError(ctx, http.StatusBadRequest, "Invalid deck ID")
+			return nil, false
+		}
+
+		var deck models.Deck
+		if err := h.db.First(&deck, deckID).Error; err != nil {
+			handleError(ctx, http.StatusNotFound, "Deck not found")
+			return nil, false
+		}
+		if !h.validateOwnership(&deck, userID) {
+			handleError(ctx, http.StatusForbidden, "Access denied")
+			return nil, false
+		}
+		return &deck, true
+	}
+
+	title := strings.TrimSpace(ctx.PostForm("deckTitle"))
+	if title == "" {
+		handleError(ctx, http.StatusBadRequest, "deckId or deckTitle is required")
+		return nil, false
+	}
+	return &models.Deck{UserID: userID, Title: title}, true
+}
+
+// duplicateOptions parses the optional duplicateCheck and duplicateScope form fields
+func duplicateOptions(ctx *gin.Context) (string, string, bool) {
+	check, scope := ctx.PostForm("duplicateCheck"), ctx.PostForm("duplicateScope")
+	switch check {
+	case "", services.DuplicateCheckSkip, services.DuplicateCheckFlag:
+	default:
+		handleError(ctx, http.StatusBadRequest, "duplicateCheck must be skip or flag")
+		return "", "", false
+	}
+	switch scope {
+	case "", services.DuplicateScopeDeck, services.DuplicateScopeAll:
+	default:
+		handleError(ctx, http.StatusBadRequest, "duplicateScope must be deck or all")
+		return "", "", false
+	}
+	return check, scope, true
+}
+
+// formBool parses an optional boolean form field
+func formBool(ctx *gin.Context, key string, defaultValue bool) (bool, bool) {
+	value := ctx.PostForm(key)
+	if value == "" {
+		return defaultValue, true
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		handleError(ctx, http.StatusBadRequest, key+" must be a boolean")
+		return false, false
+	}
+	return parsed, true
+}
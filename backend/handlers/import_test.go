@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupImportTestRouter(t *testing.T) (*gin.Engine, *gorm.DB, *models.User, func()) {
+	t.Setenv("MEDIA_STORAGE_DIR", t.TempDir())
+
+	db, cleanup := test.SetupTestDB()
+
+	user := test.CreateTestUser(db)
+	importHandler := NewImportHandler(db)
+
+	r := test.SetupRouter()
+
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(user.ClerkID))
+	api.POST("/import/anki", importHandler.ImportAnki)
+	api.POST("/import/csv", importHandler.ImportCSV)
+
+	return r, db, user, cleanup
+}
+
+const ankiTestModels = `{
+	"1001": {"name": "Basic", "type": 0,
+		"flds": [{"name": "Front", "ord": 0}, {"name": "Back", "ord": 1}],
+		"tmpls": [{"name": "Card 1", "ord": 0, "qfmt": "{{Front}}", "afmt": "{{FrontSide}}<hr id=answer>{{Back}}"}]},
+	"1002": {"name": "Vocab", "type": 0,
+		"flds": [{"name": "Word", "ord": 0}, {"name": "Meaning", "ord": 1}, {"name": "Audio", "ord": 2}],
+		"tmpls": [
+			{"name": "Recognition", "ord": 0, "qfmt": "{{Word}}{{Audio}}", "afmt": "{{FrontSide}}\n\n<hr id=answer>\n\n{{Meaning}}"},
+			{"name": "Production", "ord": 1, "qfmt": "{{Meaning}}", "afmt": "{{FrontSide}}<hr id=answer>{{text:Word}}{{Tags}}"}]},
+	"1003": {"name": "Cloze", "type": 1,
+		"flds": [{"name": "Text", "ord": 0}, {"name": "Back Extra", "ord": 1}],
+		"tmpls": [{"name": "Cloze", "ord": 0, "qfmt": "{{cloze:Text}}", "afmt": "{{cloze:Text}}<br>{{Back Extra}}"}]}
+}`
+
+const ankiTestDecks = `{
+	"1": {"name": "Default", "desc": ""},
+	"2": {"name": "日本語::語彙", "desc": "<b>JLPT</b> N5"}
+}`
+
+// buildAnkiPackage writes a minimal legacy (schema 11) collection and zips it with media
+func buildAnkiPackage(t *testing.T) []byte {
+	dir := t.TempDir()
+	colPath := filepath.Join(dir, "collection.anki2")
+
+	col, err := gorm.Open(sqlite.Open(colPath), &gorm.Config{})
+	require.NoError(t, err)
+	for _, stmt := range []string{
+		"CREATE TABLE col (id INTEGER PRIMARY KEY, models TEXT, decks TEXT)",
+		"CREATE TABLE notes (id INTEGER PRIMARY KEY, mid INTEGER, tags TEXT, flds TEXT)",
+		"CREATE TABLE cards (id INTEGER PRIMARY KEY, nid INTEGER, did INTEGER, ord INTEGER, type INTEGER, ivl INTEGER, reps INTEGER)",
+		"CREATE TABLE revlog (id INTEGER PRIMARY KEY, cid INTEGER, ease INTEGER, time INTEGER)",
+	} {
+		require.NoError(t, col.Exec(stmt).Error)
+	}
+	require.NoError(t, col.Exec("INSERT INTO col VALUES (1, ?, ?)", ankiTestModels, ankiTestDecks).Error)
+
+	notes := []struct {
+		id   int64
+		mid  int64
+		tags string
+		flds string
+	}{
+		{1, 1001, " math ", "What is <b>2*3</b>?\x1f6<div><img src=\"cat.png\"></div>"},
+		{2, 1002, " animal japanese ", "猫\x1fcat\x1f[sound:neko.mp3]"},
+		{3, 1003, "", "{{c1::Tokyo}} is the capital of {{c2::Japan::country}}\x1f"},
+		{4, 9999, "", "orphan"},
+	}
+	for _, n := range notes {
+		require.NoError(t, col.Exec("INSERT INTO notes VALUES (?, ?, ?, ?)", n.id, n.mid, n.tags, n.flds).Error)
+	}
+	for _, c := range [][]int64{
+		// id, nid, did, ord, type, ivl, reps
+		{10, 1, 1, 0, 2, 30, 5},
+		{20, 2, 2, 0, 1, 0, 1},
+		{21, 2, 2, 1, 0, 0, 0},
+		{30, 3, 1, 0, 0, 0, 0},
+		{31, 3, 1, 1, 0, 0, 0},
+		{40, 4, 1, 0, 0, 0, 0},
+	} {
+		require.NoError(t, col.Exec("INSERT INTO cards VALUES (?, ?, ?, ?, ?, ?, ?)", c[0], c[1], c[2], c[3], c[4], c[5], c[6]).Error)
+	}
+	for _, r := range [][]int64{
+		{1700000000000, 10, 3, 5000},
+		{1700000100000, 10, 1, 3000},
+		{1700000200000, 20, 0, 0}, // 手動のスケジュール変更
+	} {
+		require.NoError(t, col.Exec("INSERT INTO revlog VALUES (?, ?, ?, ?)", r[0], r[1], r[2], r[3]).Error)
+	}
+	sqlDB, _ := col.DB()
+	sqlDB.Close()
+
+	colData, err := os.ReadFile(colPath)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string][]byte{
+		"collection.anki2": colData,
+		"media":            []byte(`{"0": "cat.png"}`),
+		"0":                []byte("\x89PNG\r\n\x1a\nfake"),
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write(content)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func postAnkiPackage(r *gin.Engine, pkg []byte, fields map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "deck.apkg")
+	part.Write(pkg)
+	for key, value := range fields {
+		mw.WriteField(key, value)
+	}
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", "/api/import/anki", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestImportAnki(t *testing.T) {
+	r, db, user, cleanup := setupImportTestRouter(t)
+	defer cleanup()
+
+	pkg := buildAnkiPackage(t)
+
+	w := postAnkiPackage(r, pkg, map[string]string{"includeReviews": "true"})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var report services.AnkiImportReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+
+	t.Run("件数が報告される", func(t *testing.T) {
+		assert.Equal(t, 3, report.Decks)
+		assert.Equal(t, 1, report.NoteTypes)
+		assert.Equal(t, 3, report.Notes)
+		assert.Equal(t, 5, report.Cards)
+		assert.Equal(t, 3, report.Tags)
+		assert.Equal(t, 1, report.Media)
+		assert.Equal(t, 2, report.Reviews)
+
+		var kinds []string
+		for _, skipped := range report.Skipped {
+			kinds = append(kinds, skipped.Kind+":"+skipped.Name)
+		}
+		assert.ElementsMatch(t, []string{"note:", "media:neko.mp3"}, kinds)
+	})
+
+	t.Run("デッキ階層が作成される", func(t *testing.T) {
+		var parent, child models.Deck
+		require.NoError(t, db.Where("user_id = ? AND title = ?", user.ID, "日本語").First(&parent).Error)
+		require.NoError(t, db.Where("user_id = ? AND title = ?", user.ID, "語彙").First(&child).Error)
+		assert.Nil(t, parent.ParentID)
+		assert.Equal(t, parent.ID, *child.ParentID)
+		assert.Equal(t, "**JLPT** N5", child.Description)
+	})
+
+	t.Run("Basic モデルは組み込みのノートタイプになる", func(t *testing.T) {
+		var card models.Card
+		require.NoError(t, db.Preload("Media").Preload("Tags").Where("front LIKE ?", "What is%").First(&card).Error)
+		assert.Equal(t, `What is **2\*3**?`, card.Front)
+		assert.Equal(t, "6", card.Back)
+		assert.Equal(t, services.ContentFormatMarkdown, card.ContentFormat)
+		assert.Equal(t, "mastered", card.Status)
+		assert.Equal(t, 5, card.ReviewCount)
+		require.NotNil(t, card.LastReview)
+		assert.Equal(t, int64(1700000100000), card.LastReview.UnixMilli())
+
+		require.Len(t, card.Media, 1)
+		assert.Equal(t, "cat.png", card.Media[0].Filename)
+		assert.Equal(t, services.MediaSideBack, card.Media[0].Side)
+		require.Len(t, card.Tags, 1)
+		assert.Equal(t, "math", card.Tags[0].Name)
+
+		var records []models.AnswerRecord
+		db.Where("card_id = ?", card.ID).Order("answer_date").Find(&records)
+		require.Len(t, records, 2)
+		assert.True(t, records[0].IsCorrect)
+		assert.Equal(t, 5, records[0].StudyTime)
+		assert.False(t, records[1].IsCorrect)
+	})
+
+	t.Run("独自モデルはノートタイプとして取り込まれる", func(t *testing.T) {
+		var noteType models.NoteType
+		require.NoError(t, db.Where("user_id = ? AND name = ?", user.ID, "Vocab").First(&noteType).Error)
+		assert.Equal(t, []string{"Word", "Meaning", "Audio"}, noteType.Fields)
+		assert.Equal(t, "{{Meaning}}", noteType.Templates[0].Back)
+		assert.Equal(t, "{{Word}}", noteType.Templates[1].Back)
+
+		var note models.Note
+		require.NoError(t, db.Preload("Cards.Tags").Where("note_type_id = ?", noteType.ID).First(&note).Error)
+		require.Len(t, note.Cards, 2)
+		for _, card := range note.Cards {
+			assert.Len(t, card.Tags, 2)
+		}
+		assert.Equal(t, "猫", note.Cards[0].Front)
+		assert.Equal(t, "learning", note.Cards[0].Status)
+		assert.Equal(t, "cat", note.Cards[1].Front)
+		assert.Equal(t, "new", note.Cards[1].Status)
+	})
+
+	t.Run("穴埋めは穴ごとのカードになる", func(t *testing.T) {
+		var cards []models.Card
+		db.Where("front LIKE ?", "%capital%").Order("id").Find(&cards)
+		require.Len(t, cards, 2)
+		assert.Equal(t, "**[...]** is the capital of Japan", cards[0].Front)
+		assert.Equal(t, "**Tokyo** is the capital of Japan", cards[0].Back)
+		assert.Equal(t, "Tokyo is the capital of **[country]**", cards[1].Front)
+		assert.Equal(t, "Tokyo is the capital of **Japan**", cards[1].Back)
+	})
+
+	t.Run("重複をスキップして再インポートできる", func(t *testing.T) {
+		w := postAnkiPackage(r, pkg, map[string]string{"duplicateCheck": "skip", "duplicateScope": "all"})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var again services.AnkiImportReport
+		json.Unmarshal(w.Body.Bytes(), &again)
+		assert.Equal(t, 0, again.Cards)
+		assert.Equal(t, 0, again.Decks)
+	})
+}
+
+func TestImportAnkiInvalidPackage(t *testing.T) {
+	r, _, _, cleanup := setupImportTestRouter(t)
+	defer cleanup()
+
+	t.Run("zip でないファイル", func(t *testing.T) {
+		w := postAnkiPackage(r, []byte("not a zip"), nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("新形式のみのパッケージ", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, _ := zw.Create("collection.anki21b")
+		w.Write([]byte("zstd"))
+		zw.Close()
+
+		resp := postAnkiPackage(r, buf.Bytes(), nil)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Contains(t, resp.Body.String(), "Support older Anki versions")
+	})
+
+	t.Run("不正なオプション", func(t *testing.T) {
+		w := postAnkiPackage(r, buildAnkiPackage(t), map[string]string{"duplicateCheck": "merge"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func postCSV(r *gin.Engine, filename, content string, fields map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", filename)
+	part.Write([]byte(content))
+	for key, value := range fields {
+		mw.WriteField(key, value)
+	}
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", "/api/import/csv", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestImportCSV(t *testing.T) {
+	r, db, user, cleanup := setupImportTestRouter(t)
+	defer cleanup()
+
+	content := "question,answer,tags\n犬,dog,animal\n猫,cat,animal pet\n"
+
+	t.Run("プレビューではカードを作成しない", func(t *testing.T) {
+		w := postCSV(r, "cards.csv", content, map[string]string{"hasHeader": "true"})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var preview services.CSVPreview
+		json.Unmarshal(w.Body.Bytes(), &preview)
+		assert.Equal(t, 2, preview.ValidRows)
+		assert.Equal(t, "question", preview.Mapping.Front)
+		assert.Equal(t, []string{"animal", "pet"}, preview.Rows[1].Tags)
+
+		var count int64
+		db.Model(&models.Card{}).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("新しいデッキにインポートする", func(t *testing.T) {
+		w := postCSV(r, "cards.csv", content, map[string]string{"hasHeader": "true", "dryRun": "false", "deckTitle": "動物"})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var result services.CSVImportResult
+		json.Unmarshal(w.Body.Bytes(), &result)
+		assert.Equal(t, 2, result.Imported)
+		require.NotNil(t, result.Deck)
+		assert.Equal(t, "動物", result.Deck.Title)
+
+		var cards []models.Card
+		require.NoError(t, db.Preload("Tags").Where("deck_id = ?", result.Deck.ID).Order("id").Find(&cards).Error)
+		require.Len(t, cards, 2)
+		assert.Equal(t, "犬", cards[0].Front)
+		assert.Len(t, cards[1].Tags, 2)
+
+		var tags int64
+		db.Model(&models.Tag{}).Where("user_id = ?", user.ID).Count(&tags)
+		assert.Equal(t, int64(2), tags)
+	})
+
+	t.Run("既存のデッキに TSV をインポートする", func(t *testing.T) {
+		deck := &models.Deck{UserID: user.ID, Title: "既存"}
+		require.NoError(t, db.Create(deck).Error)
+
+		w := postCSV(r, "cards.tsv", "a\tb\nc\td\n", map[string]string{"dryRun": "false", "deckId": fmt.Sprintf("%d", deck.ID)})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var count int64
+		db.Model(&models.Card{}).Where("deck_id = ?", deck.ID).Count(&count)
+		assert.Equal(t, int64(2), count)
+	})
+
+	t.Run("不正な行があるとインポートしない", func(t *testing.T) {
+		invalid := "front,back\nok,fine\nmissing,\n"
+
+		w := postCSV(r, "cards.csv", invalid, map[string]string{"hasHeader": "true", "dryRun": "false", "deckTitle": "不正"})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "back is required")
+
+		var decks int64
+		db.Model(&models.Deck{}).Where("title = ?", "不正").Count(&decks)
+		assert.Equal(t, int64(0), decks)
+
+		w = postCSV(r, "cards.csv", invalid, map[string]string{"hasHeader": "true", "dryRun": "false", "deckTitle": "不正", "skipInvalid": "true"})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var result services.CSVImportResult
+		json.Unmarshal(w.Body.Bytes(), &result)
+		assert.Equal(t, 1, result.Imported)
+		require.Len(t, result.Skipped, 1)
+		assert.Equal(t, 3, result.Skipped[0].Line)
+	})
+
+	t.Run("既存のカードと重複する行を確認してスキップする", func(t *testing.T) {
+		deck := &models.Deck{UserID: user.ID, Title: "重複"}
+		require.NoError(t, db.Create(deck).Error)
+		require.NoError(t, services.CreateBasicCard(db, user.ID, &models.Card{DeckID: deck.ID, Front: "犬", Back: "dog"}))
+
+		rows := "front,back\n犬,dog\n猫,cat\n猫,cat\n"
+		fields := map[string]string{"hasHeader": "true", "deckId": fmt.Sprintf("%d", deck.ID), "duplicateCheck": "skip"}
+
+		w := postCSV(r, "cards.csv", rows, fields)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var preview services.CSVPreview
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preview))
+		assert.Equal(t, 2, preview.DuplicateRows)
+		require.Len(t, preview.Rows[0].Duplicates, 1)
+		assert.NotZero(t, preview.Rows[0].Duplicates[0].CardID)
+		assert.Empty(t, preview.Rows[1].Duplicates)
+		require.Len(t, preview.Rows[2].Duplicates, 1)
+		assert.Zero(t, preview.Rows[2].Duplicates[0].CardID, "同じファイルの前の行との重複")
+
+		fields["dryRun"] = "false"
+		w = postCSV(r, "cards.csv", rows, fields)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var result services.CSVImportResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, 1, result.Imported)
+		assert.Len(t, result.Skipped, 2)
+
+		var fronts []string
+		require.NoError(t, db.Model(&models.Card{}).Where("deck_id = ?", deck.ID).Order("id").Pluck("front", &fronts).Error)
+		assert.Equal(t, []string{"犬", "猫"}, fronts)
+	})
+
+	t.Run("重複する行を報告してインポートする", func(t *testing.T) {
+		w := postCSV(r, "cards.csv", "犬,dog\n", map[string]string{
+			"dryRun": "false", "deckTitle": "報告", "duplicateCheck": "flag", "duplicateScope": "all",
+		})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var result services.CSVImportResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, 1, result.Imported)
+		require.Len(t, result.Duplicates, 1)
+		assert.Equal(t, "犬", result.Duplicates[0].Front)
+	})
+
+	t.Run("インポート先が指定されていない", func(t *testing.T) {
+		w := postCSV(r, "cards.csv", content, map[string]string{"hasHeader": "true", "dryRun": "false"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("他のユーザーのデッキ", func(t *testing.T) {
+		other := &models.User{ClerkID: "other_user", Email: "other@example.com"}
+		require.NoError(t, db.Create(other).Error)
+		deck := &models.Deck{UserID: other.ID, Title: "他人"}
+		require.NoError(t, db.Create(deck).Error)
+
+		w := postCSV(r, "cards.csv", content, map[string]string{"hasHeader": "true", "dryRun": "false", "deckId": fmt.Sprintf("%d", deck.ID)})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
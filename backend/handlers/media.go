@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"gorm.io/gorm"
+)
+
+type MediaHandler struct {
+	BaseHandler
+	mediaService *services.MediaService
+}
+
+func NewMediaHandler(db *gorm.DB) *MediaHandler {
+	return &MediaHandler{
+		BaseHandler:  BaseHandler{db: db},
+		mediaService: services.NewMediaService(db, services.NewMediaStorageFromEnv()),
+	}
+}
+
+// Upload attaches an image or audio file to a side of a card
+func (h *MediaHandler) Upload(ctx *gin.Context) {
+	cardID, ok := parseIDParam(ctx, "cardId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	card, ok := h.findOwnedCard(ctx, cardID, user.ID)
+	if !ok {
+		return
+	}
+
+	side := ctx.DefaultPostForm("side", services.MediaSideFront)
+	if side != services.MediaSideFront && side != services.MediaSideBack {
+		handleError(ctx, http.StatusBadRequest, "side must be front or back")
+		return
+	}
+
+	file, header, err := ctx.Request.FormFile("file")
+	if err != nil {
+		handleError(ctx, http.StatusBadRequest, "File is required")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > services.MaxMediaSize {
+		handleError(ctx, http.StatusRequestEntityTooLarge, "File is too large (max 20MB)")
+		return
+	}
+
+	mimeType := header.Header.Get("Content-Type")
+	if !services.IsAllowedMediaType(mimeType) {
+		handleError(ctx, http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported media type: %s", mimeType))
+		return
+	}
+
+	media := &models.Media{
+		UserID:   user.ID,
+		CardID:   &card.ID,
+		Side:     side,
+		Filename: header.Filename,
+		MimeType: mimeType,
+		Size:     header.Size,
+	}
+
+	if err := h.mediaService.Attach(ctx.Request.Context(), media, io.LimitReader(file, services.MaxMediaSize)); err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, media)
+}
+
+// Serve streams the content of a media file owned by the user
+func (h *MediaHandler) Serve(ctx *gin.Context) {
+	media, ok := h.findOwnedMedia(ctx)
+	if !ok {
+		return
+	}
+
+	content, err := h.mediaService.Open(ctx.Request.Context(), media)
+	if err != nil {
+		if errors.Is(err, services.ErrMediaNotFound) {
+			handleError(ctx, http.StatusNotFound, "Media not found")
+			return
+		}
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer content.Close()
+
+	ctx.Header("Cache-Control", "private, max-age=3600")
+	ctx.Header("X-Content-Type-Options", "nosniff")
+	ctx.DataFromReader(http.StatusOK, media.Size, media.MimeType, content, nil)
+}
+
+// Delete removes a media file owned by the user
+func (h *MediaHandler) Delete(ctx *gin.Context) {
+	media, ok := h.findOwnedMedia(ctx)
+	if !ok {
+		return
+	}
+
+	if err := h.mediaService.Delete(ctx.Request.Context(), media); err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+func (h *MediaHandler) findOwnedMedia(ctx *gin.Context) (*models.Media, bool) {
+	mediaID, ok := parseIDParam(ctx, "mediaId")
+	if !ok {
+		return nil, false
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	var media models.Media
+	if err := h.db.First(&media, mediaID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Media not found")
+		return nil, false
+	}
+
+	if media.UserID != user.ID {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return nil, false
+	}
+
+	return &media, true
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func setupMediaTestRouter(t *testing.T) (*gin.Engine, *gorm.DB, string, func()) {
+	storageDir := t.TempDir()
+	t.Setenv("MEDIA_STORAGE_DIR", storageDir)
+
+	db, cleanup := test.SetupTestDB()
+
+	user := test.CreateTestUser(db)
+	test.CreateTestDeck(db, user.ID)
+
+	mediaHandler := NewMediaHandler(db)
+	cardHandler := NewCardHandler(db)
+
+	r := test.SetupRouter()
+
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(user.ClerkID))
+
+	api.POST("/cards/:cardId/media", mediaHandler.Upload)
+	api.GET("/media/:mediaId", mediaHandler.Serve)
+	api.DELETE("/media/:mediaId", mediaHandler.Delete)
+	api.DELETE("/cards/:cardId", cardHandler.DeleteCard)
+
+	return r, db, storageDir, cleanup
+}
+
+func newMediaUploadRequest(t *testing.T, url, side, mimeType string, content []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="diagram.png"`)
+	header.Set("Content-Type", mimeType)
+	part, err := writer.CreatePart(header)
+	assert.NoError(t, err)
+	part.Write(content)
+
+	writer.WriteField("side", side)
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", url, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestMediaUploadServeDelete(t *testing.T) {
+	r, db, storageDir, cleanup := setupMediaTestRouter(t)
+	defer cleanup()
+
+	card := test.CreateTestCard(db, 1)
+	content := []byte("\x89PNG fake image")
+
+	req := newMediaUploadRequest(t, fmt.Sprintf("/api/cards/%d/media", card.ID), "back", "image/png", content)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var media models.Media
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &media))
+	assert.Equal(t, "back", media.Side)
+
+	var stored models.Media
+	db.First(&stored, media.ID)
+	storedPath := filepath.Join(storageDir, filepath.FromSlash(stored.StorageKey))
+	assert.FileExists(t, storedPath)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/media/%d", media.ID), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, content, w.Body.Bytes())
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/media/%d", media.ID), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoFileExists(t, storedPath)
+}
+
+func TestMediaUploadValidation(t *testing.T) {
+	r, db, _, cleanup := setupMediaTestRouter(t)
+	defer cleanup()
+
+	card := test.CreateTestCard(db, 1)
+
+	t.Run("サポートされていない形式の場合", func(t *testing.T) {
+		req := newMediaUploadRequest(t, fmt.Sprintf("/api/cards/%d/media", card.ID), "front", "application/x-msdownload", []byte("MZ"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+
+	t.Run("他のユーザーのメディアの場合", func(t *testing.T) {
+		other := &models.User{ClerkID: "other_clerk_id", Email: "other@example.com", Name: "Other"}
+		db.Create(other)
+		media := &models.Media{UserID: other.ID, MimeType: "image/png", StorageKey: "other/key.png"}
+		db.Create(media)
+
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/media/%d", media.ID), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestDeleteCardRemovesMedia(t *testing.T) {
+	r, db, storageDir, cleanup := setupMediaTestRouter(t)
+	defer cleanup()
+
+	card := test.CreateTestCard(db, 1)
+
+	req := newMediaUploadRequest(t, fmt.Sprintf("/api/cards/%d/media", card.ID), "front", "audio/mp3", []byte("ID3"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var stored models.Media
+	db.Where("card_id = ?", card.ID).First(&stored)
+	storedPath := filepath.Join(storageDir, filepath.FromSlash(stored.StorageKey))
+	assert.FileExists(t, storedPath)
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/cards/%d", card.ID), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var count int64
+	db.Unscoped().Model(&models.Media{}).Where("card_id = ?", card.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	_, err := os.Stat(storedPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"gorm.io/gorm"
+)
+
+type NoteHandler struct {
+	BaseHandler
+	noteService *services.NoteService
+}
+
+func NewNoteHandler(db *gorm.DB) *NoteHandler {
+	mediaService := services.NewMediaService(db, services.NewMediaStorageFromEnv())
+	return &NoteHandler{
+		BaseHandler: BaseHandler{db: db},
+		noteService: services.NewNoteService(db, mediaService),
+	}
+}
+
+type cardTemplateRequest struct {
+	Ord   *int   `json:"ord"` // 既存テンプレートを更新する場合に指定
+	Name  string `json:"name" binding:"required"`
+	Front string `json:"front" binding:"required"`
+	Back  string `json:"back"`
+	Hint  string `json:"hint"`
+}
+
+type noteTypeRequest struct {
+	Name         string                `json:"name" binding:"required"`
+	Fields       []string              `json:"fields" binding:"required,min=1"`
+	Templates    []cardTemplateRequest `json:"templates" binding:"required,min=1,dive"`
+	RenameFields map[string]string     `json:"renameFields"` // 更新時のみ: 旧フィールド名 -> 新フィールド名
+}
+
+func (req *noteTypeRequest) noteType() models.NoteType {
+	noteType := models.NoteType{Name: req.Name, Fields: req.Fields}
+	for _, tmpl := range req.Templates {
+		ord := -1
+		if tmpl.Ord != nil {
+			ord = *tmpl.Ord
+		}
+		noteType.Templates = append(noteType.Templates, models.CardTemplate{
+			Ord:   ord,
+			Name:  tmpl.Name,
+			Front: tmpl.Front,
+			Back:  tmpl.Back,
+			Hint:  tmpl.Hint,
+		})
+	}
+	return noteType
+}
+
+// handleNoteError maps note service errors to responses
+func handleNoteError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrVersionConflict):
+		handleSaveError(ctx, err)
+	case errors.Is(err, services.ErrNoteTypeNotFound):
+		handleError(ctx, http.StatusNotFound, "Note type not found")
+	case errors.Is(err, services.ErrBuiltinNoteType):
+		handleError(ctx, http.StatusForbidden, err.Error())
+	case errors.Is(err, services.ErrNoteTypeInUse):
+		handleError(ctx, http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrInvalidNoteType),
+		errors.Is(err, services.ErrInvalidNote),
+		errors.Is(err, services.ErrInvalidMarkup),
+		errors.Is(err, services.ErrInvalidContentFormat):
+		handleError(ctx, http.StatusBadRequest, err.Error())
+	default:
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *NoteHandler) ListNoteTypes(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	noteTypes, err := h.noteService.ListNoteTypes(user.ID)
+	if err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, noteTypes)
+}
+
+func (h *NoteHandler) GetNoteType(ctx *gin.Context) {
+	noteTypeID, ok := parseIDParam(ctx, "noteTypeId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	noteType, err := h.noteService.FindNoteType(uint(noteTypeID), user.ID)
+	if err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	setETag(ctx, noteType.Version)
+	ctx.JSON(http.StatusOK, noteType)
+}
+
+func (h *NoteHandler) CreateNoteType(ctx *gin.Context) {
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var req noteTypeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	noteType := req.noteType()
+	noteType.UserID = &user.ID
+
+	if err := h.noteService.CreateNoteType(&noteType); err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, noteType)
+}
+
+// UpdateNoteType replaces the fields and templates of a note type and
+// regenerates the cards of every note of that type.
+func (h *NoteHandler) UpdateNoteType(ctx *gin.Context) {
+	noteTypeID, ok := parseIDParam(ctx, "noteTypeId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	noteType, err := h.noteService.FindNoteType(uint(noteTypeID), user.ID)
+	if err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	if !checkIfMatch(ctx, noteType.Version) {
+		return
+	}
+
+	var req noteTypeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.noteService.UpdateNoteType(ctx.Request.Context(), noteType, req.noteType(), req.RenameFields); err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	setETag(ctx, noteType.Version)
+	ctx.JSON(http.StatusOK, noteType)
+}
+
+func (h *NoteHandler) DeleteNoteType(ctx *gin.Context) {
+	noteTypeID, ok := parseIDParam(ctx, "noteTypeId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	noteType, err := h.noteService.FindNoteType(uint(noteTypeID), user.ID)
+	if err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	if err := h.noteService.DeleteNoteType(noteType); err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+type createNoteRequest struct {
+	NoteTypeID    uint              `json:"noteTypeId" binding:"required"`
+	Fields        map[string]string `json:"fields" binding:"required"`
+	ContentFormat string            `json:"contentFormat" binding:"omitempty,oneof=plain markdown"`
+	Markup        bool              `json:"markup"`
+}
+
+// CreateNote creates a note in the deck along with the cards its templates generate
+func (h *NoteHandler) CreateNote(ctx *gin.Context) {
+	deckID, ok := parseIDParam(ctx, "deckId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var deck models.Deck
+	if err := h.db.First(&deck, deckID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Deck not found")
+		return
+	}
+
+	if !h.validateOwnership(&deck, user.ID) {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	var req createNoteRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	noteType, err := h.noteService.FindNoteType(req.NoteTypeID, user.ID)
+	if err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	note := &models.Note{
+		UserID:        user.ID,
+		DeckID:        deck.ID,
+		Fields:        req.Fields,
+		ContentFormat: req.ContentFormat,
+		Markup:        req.Markup,
+	}
+	if err := h.noteService.CreateNote(ctx.Request.Context(), noteType, note); err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, note)
+}
+
+func (h *NoteHandler) ListNotes(ctx *gin.Context) {
+	deckID, ok := parseIDParam(ctx, "deckId")
+	if !ok {
+		return
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var deck models.Deck
+	if err := h.db.First(&deck, deckID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Deck not found")
+		return
+	}
+
+	if !h.validateOwnership(&deck, user.ID) {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	var notes []models.Note
+	if err := h.db.Preload("Cards").Where("deck_id = ?", deck.ID).Order("id").Find(&notes).Error; err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, notes)
+}
+
+func (h *NoteHandler) GetNote(ctx *gin.Context) {
+	note, ok := h.findOwnedNote(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, note)
+}
+
+type updateNoteRequest struct {
+	Fields        map[string]string `json:"fields" binding:"required"`
+	ContentFormat string            `json:"contentFormat" binding:"omitempty,oneof=plain markdown"`
+	Markup        *bool             `json:"markup"`
+}
+
+// UpdateNote replaces the field values of a note and regenerates its cards
+func (h *NoteHandler) UpdateNote(ctx *gin.Context) {
+	note, ok := h.findOwnedNote(ctx)
+	if !ok {
+		return
+	}
+
+	var req updateNoteRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		handleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var noteType models.NoteType
+	if err := h.db.First(&noteType, note.NoteTypeID).Error; err != nil {
+		handleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	note.Fields = req.Fields
+	if req.ContentFormat != "" {
+		note.ContentFormat = req.ContentFormat
+	}
+	if req.Markup != nil {
+		note.Markup = *req.Markup
+	}
+
+	if err := h.noteService.UpdateNote(ctx.Request.Context(), &noteType, note); err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, note)
+}
+
+// DeleteNote deletes a note and all cards generated from it
+func (h *NoteHandler) DeleteNote(ctx *gin.Context) {
+	note, ok := h.findOwnedNote(ctx)
+	if !ok {
+		return
+	}
+
+	if err := h.noteService.DeleteNote(ctx.Request.Context(), note); err != nil {
+		handleNoteError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+// findOwnedNote loads the note of the :noteId parameter with its cards and
+// verifies that it belongs to the current user
+func (h *NoteHandler) findOwnedNote(ctx *gin.Context) (*models.Note, bool) {
+	noteID, ok := parseIDParam(ctx, "noteId")
+	if !ok {
+		return nil, false
+	}
+
+	user, ok := h.getCurrentUser(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	var note models.Note
+	if err := h.db.Preload("Cards").First(&note, noteID).Error; err != nil {
+		handleError(ctx, http.StatusNotFound, "Note not found")
+		return nil, false
+	}
+
+	if note.UserID != user.ID {
+		handleError(ctx, http.StatusForbidden, "Access denied")
+		return nil, false
+	}
+
+	return &note, true
+}
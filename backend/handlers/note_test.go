@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func setupNoteTestRouter(t *testing.T) (*gin.Engine, *gorm.DB, *models.Deck, func()) {
+	t.Setenv("MEDIA_STORAGE_DIR", t.TempDir())
+
+	db, cleanup := test.SetupTestDB()
+
+	user := test.CreateTestUser(db)
+	deck := test.CreateTestDeck(db, user.ID)
+
+	noteHandler := NewNoteHandler(db)
+	cardHandler := NewCardHandler(db)
+
+	r := test.SetupRouter()
+
+	api := r.Group("/api")
+	api.Use(test.MockAuthMiddleware(user.ClerkID))
+
+	api.GET("/note_types", noteHandler.ListNoteTypes)
+	api.POST("/note_types", noteHandler.CreateNoteType)
+	api.PUT("/note_types/:noteTypeId", noteHandler.UpdateNoteType)
+	api.DELETE("/note_types/:noteTypeId", noteHandler.DeleteNoteType)
+	api.POST("/decks/:deckId/notes", noteHandler.CreateNote)
+	api.PUT("/notes/:noteId", noteHandler.UpdateNote)
+	api.DELETE("/notes/:noteId", noteHandler.DeleteNote)
+	api.POST("/decks/:deckId/cards", cardHandler.CreateCard)
+	api.PUT("/cards/:cardId", cardHandler.UpdateCard)
+	api.DELETE("/cards/:cardId", cardHandler.DeleteCard)
+
+	return r, db, deck, cleanup
+}
+
+func serveJSON(r *gin.Engine, method, url string, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func vocabularyNoteType() map[string]interface{} {
+	return map[string]interface{}{
+		"name":   "Vocabulary",
+		"fields": []string{"Word", "Reading", "Meaning", "Example"},
+		"templates": []map[string]interface{}{
+			{"name": "Recognition", "front": "{{Word}}", "back": "{{Reading}}: {{Meaning}}"},
+			{"name": "Example", "front": "{{#Example}}{{Example}}{{/Example}}", "back": "{{Word}}"},
+		},
+	}
+}
+
+func TestNoteTypesAndNotes(t *testing.T) {
+	r, db, deck, cleanup := setupNoteTestRouter(t)
+	defer cleanup()
+
+	w := serveJSON(r, "POST", "/api/note_types", vocabularyNoteType())
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var noteType models.NoteType
+	json.Unmarshal(w.Body.Bytes(), &noteType)
+	assert.Equal(t, 1, noteType.Templates[1].Ord)
+
+	var note models.Note
+	t.Run("テンプレートからカードが生成される", func(t *testing.T) {
+		w := serveJSON(r, "POST", fmt.Sprintf("/api/decks/%d/notes", deck.ID), map[string]interface{}{
+			"noteTypeId": noteType.ID,
+			"fields":     map[string]string{"Word": "猫", "Reading": "ねこ", "Meaning": "cat"},
+		})
+		assert.Equal(t, http.StatusCreated, w.Code)
+		json.Unmarshal(w.Body.Bytes(), &note)
+
+		// Example が空なので 2 枚目のテンプレートはカードを生成しない
+		assert.Len(t, note.Cards, 1)
+		assert.Equal(t, "猫", note.Cards[0].Front)
+		assert.Equal(t, "ねこ: cat", note.Cards[0].Back)
+	})
+
+	t.Run("フィールド更新でカードが追加される", func(t *testing.T) {
+		w := serveJSON(r, "PUT", fmt.Sprintf("/api/notes/%d", note.ID), map[string]interface{}{
+			"fields": map[string]string{"Word": "猫", "Reading": "ねこ", "Meaning": "cat", "Example": "猫が好き"},
+		})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var updated models.Note
+		json.Unmarshal(w.Body.Bytes(), &updated)
+		assert.Len(t, updated.Cards, 2)
+		assert.Equal(t, note.Cards[0].ID, updated.Cards[0].ID)
+		assert.Equal(t, "猫が好き", updated.Cards[1].Front)
+	})
+
+	t.Run("テンプレート編集でカードが再生成される", func(t *testing.T) {
+		body := vocabularyNoteType()
+		body["fields"] = []string{"Word", "Reading", "Definition", "Example"}
+		body["templates"] = []map[string]interface{}{
+			{"ord": 0, "name": "Recognition", "front": "{{Word}}", "back": "{{Definition}} ({{Reading}})"},
+		}
+		body["renameFields"] = map[string]string{"Meaning": "Definition"}
+
+		w := serveJSON(r, "PUT", fmt.Sprintf("/api/note_types/%d", noteType.ID), body)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var cards []models.Card
+		db.Where("note_id = ?", note.ID).Find(&cards)
+		assert.Len(t, cards, 1)
+		assert.Equal(t, note.Cards[0].ID, cards[0].ID)
+		assert.Equal(t, "cat (ねこ)", cards[0].Back)
+
+		var revision models.CardRevision
+		db.Where("card_id = ?", cards[0].ID).Order("id DESC").First(&revision)
+		assert.Equal(t, services.RevisionSourceNote, revision.Source)
+
+		var stored models.Note
+		db.First(&stored, note.ID)
+		assert.Equal(t, "cat", stored.Fields["Definition"])
+	})
+
+	t.Run("未定義のフィールドを参照するテンプレートは拒否される", func(t *testing.T) {
+		body := vocabularyNoteType()
+		body["templates"] = []map[string]interface{}{
+			{"name": "Broken", "front": "{{Kanji}}", "back": "{{Word}}"},
+		}
+		w := serveJSON(r, "POST", "/api/note_types", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("使用中のノートタイプは削除できない", func(t *testing.T) {
+		w := serveJSON(r, "DELETE", fmt.Sprintf("/api/note_types/%d", noteType.ID), nil)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("ノートの削除でカードも削除される", func(t *testing.T) {
+		w := serveJSON(r, "DELETE", fmt.Sprintf("/api/notes/%d", note.ID), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var count int64
+		db.Model(&models.Card{}).Where("note_id = ?", note.ID).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+}
+
+func TestBasicNotes(t *testing.T) {
+	r, db, deck, cleanup := setupNoteTestRouter(t)
+	defer cleanup()
+
+	t.Run("既存カードが Basic ノートに移行される", func(t *testing.T) {
+		card := test.CreateTestCard(db, deck.ID)
+		assert.NoError(t, services.MigrateCardsToNotes(db))
+		assert.NoError(t, services.MigrateCardsToNotes(db))
+
+		db.First(card, card.ID)
+		assert.NotNil(t, card.NoteID)
+
+		var notes []models.Note
+		db.Find(&notes)
+		assert.Len(t, notes, 1)
+		assert.Equal(t, "Test Front", notes[0].Fields["Front"])
+		assert.Equal(t, "Test Hint", notes[0].Fields["Hint"])
+	})
+
+	t.Run("カードの編集がノートに反映される", func(t *testing.T) {
+		w := serveJSON(r, "POST", fmt.Sprintf("/api/decks/%d/cards", deck.ID), map[string]string{"front": "Q", "back": "A"})
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var card models.Card
+		json.Unmarshal(w.Body.Bytes(), &card)
+		assert.NotNil(t, card.NoteID)
+
+		w = serveJSON(r, "PUT", fmt.Sprintf("/api/cards/%d", card.ID), map[string]string{"back": "Answer"})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var note models.Note
+		db.First(&note, *card.NoteID)
+		assert.Equal(t, "Answer", note.Fields["Back"])
+
+		w = serveJSON(r, "DELETE", fmt.Sprintf("/api/cards/%d", card.ID), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Error(t, db.First(&note, *card.NoteID).Error)
+	})
+
+	t.Run("組み込みノートタイプは編集できない", func(t *testing.T) {
+		basic, err := services.EnsureBasicNoteType(db)
+		assert.NoError(t, err)
+
+		body := vocabularyNoteType()
+		w := serveJSON(r, "PUT", fmt.Sprintf("/api/note_types/%d", basic.ID), body)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -46,10 +47,15 @@ func main() {
 	defer services.CloseRedis()
 
 	// Auto migrate
-	if err := db.AutoMigrate(&models.User{}, &models.Deck{}, &models.Card{}, &models.AnswerRecord{}, &models.Subscription{}, &models.CardPreview{}); err != nil {
+	if err := db.AutoMigrate(&models.User{}, &models.Deck{}, &models.Card{}, &models.AnswerRecord{}, &models.Subscription{}, &models.CardPreview{}, &models.CardRevision{}, &models.Media{}, &models.NoteType{}, &models.Note{}, &models.Tag{}, &models.GenerationJob{}); err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
+	// 既存カードを組み込みの Basic ノートに移行
+	if err := services.MigrateCardsToNotes(db); err != nil {
+		log.Fatal("Failed to migrate cards to notes:", err)
+	}
+
 	// シードデータの投入
 	if *seed || gin.Mode() != gin.ReleaseMode {
 		if err := seeds.SeedAll(db); err != nil {
@@ -105,6 +111,13 @@ func main() {
 
 	deckController := controllers.NewDeckController(db)
 	cardController := controllers.NewCardController(db)
+	duplicateController := controllers.NewDuplicateController(db)
+	mediaController := controllers.NewMediaController(db)
+	noteController := controllers.NewNoteController(db)
+	importController := controllers.NewImportController(db)
+	exportController := controllers.NewExportController(db)
+	backupController := controllers.NewBackupController(db)
+	accountController := controllers.NewAccountController(db)
 	webhookController := controllers.NewWebhookController(db)
 
 	// AI生成コントローラーの初期化
@@ -112,6 +125,7 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to initialize AI generate controller:", err)
 	}
+	aiGenerateController.StartJobWorkers(context.Background(), services.JobWorkersFromEnv(2))
 
 	// 音声文字起こしコントローラーの初期化
 	audioTranscribeController, err := controllers.NewAudioTranscribeController(db)
@@ -122,9 +136,18 @@ func main() {
 	fmt.Println("WebhookController initialized")
 	api := r.Group("/api")
 	api.Use(middleware.AuthMiddleware())
+	provisioner := services.NewUserProvisioner(db, services.NewClerkAPIUserLookup())
+	api.Use(middleware.ProvisionUser(provisioner))
 
 	deckController.RegisterRoutes(api)
 	cardController.RegisterRoutes(api)
+	duplicateController.RegisterRoutes(api)
+	mediaController.RegisterRoutes(api)
+	noteController.RegisterRoutes(api)
+	importController.RegisterRoutes(api)
+	exportController.RegisterRoutes(api)
+	backupController.RegisterRoutes(api)
+	accountController.RegisterRoutes(api)
 
 	// Webhookルーティング（認証なし）
 	webhookApi := r.Group("/api")
@@ -134,6 +157,12 @@ func main() {
 	aiGroup := api.Group("/cards")
 	aiGroup.Use(middleware.RedisRateLimiterMiddleware(db, "ai_generate"))
 	aiGroup.POST("/ai_generate", aiGenerateController.GetGenerateCardsHandler())
+	aiGroup.POST("/ai_generate/stream", aiGenerateController.GetGenerateCardsStreamHandler())
+	aiGroup.POST("/ai_generate/jobs", aiGenerateController.GetSubmitGenerateJobHandler())
+
+	// 非同期ジョブの状態取得・キャンセル
+	api.GET("/jobs/:id", aiGenerateController.GetJobHandler())
+	api.POST("/jobs/:id/cancel", aiGenerateController.GetCancelJobHandler())
 
 	// 音声文字起こしルーティング（レート制限付き）
 	audioGroup := api.Group("/audio")
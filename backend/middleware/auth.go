@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -42,7 +43,9 @@ func clerkAuthMiddleware() gin.HandlerFunc {
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Clerkのミドルウェアを使用してトークンを検証
-		wrapped := clerkhttp.WithHeaderAuthorization()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrapped := clerkhttp.WithHeaderAuthorization(
+			clerkhttp.CustomClaimsConstructor(func(context.Context) any { return &ProfileClaims{} }),
+		)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// 更新されたリクエストをGinコンテキストに設定
 			c.Request = r
 			// 認証ミドルウェアを実行
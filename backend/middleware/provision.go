@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/clerk/clerk-sdk-go/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/services"
+)
+
+// ProfileClaims are optional custom claims of the Clerk session token.
+// Add {"email": "{{user.primary_email_address}}", "name": "{{user.first_name}}"}
+// to the session token template to provision users without a Clerk API call.
+type ProfileClaims struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// ProvisionUser creates the models.User of the authenticated Clerk user if it
+// does not exist yet. It must run after AuthMiddleware.
+func ProvisionUser(provisioner *services.UserProvisioner) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clerkID := c.GetString("userID")
+		if clerkID == "" {
+			c.Next()
+			return
+		}
+
+		var profile *services.ClerkProfile
+		if value, ok := c.Get("claims"); ok {
+			if claims, ok := value.(*clerk.SessionClaims); ok {
+				if custom, ok := claims.Custom.(*ProfileClaims); ok && custom.Email != "" {
+					profile = &services.ClerkProfile{ClerkID: clerkID, Email: custom.Email, Name: custom.Name}
+				}
+			}
+		}
+
+		if _, err := provisioner.Ensure(c.Request.Context(), clerkID, profile); err != nil {
+			log.Printf("Failed to provision user %s: %v", clerkID, err)
+			if errors.Is(err, services.ErrEmailInUse) {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to provision user"})
+			return
+		}
+		c.Next()
+	}
+}
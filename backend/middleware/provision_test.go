@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/clerk/clerk-sdk-go/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/services"
+	"github.com/muratayousuke/ai-flashcards/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionUser(t *testing.T) {
+	db, cleanup := test.SetupTestDB()
+	defer cleanup()
+
+	lookup := &test.FakeUserLookup{Profiles: map[string]services.ClerkProfile{
+		"user_lookup": {Email: "lookup@example.com", Name: "Lookup"},
+		"user_claims": {Email: "claims@example.com", Name: "Claims"},
+		"user_moved":  {Email: "moved-new@example.com", Name: "Moved"},
+	}}
+	provisioner := services.NewUserProvisioner(db, lookup)
+
+	request := func(clerkID string, custom *ProfileClaims) *httptest.ResponseRecorder {
+		r := test.SetupRouter()
+		r.GET("/", func(c *gin.Context) {
+			claims := &clerk.SessionClaims{RegisteredClaims: clerk.RegisteredClaims{Subject: clerkID}}
+			if custom != nil {
+				claims.Custom = custom
+			}
+			c.Set("userID", clerkID)
+			c.Set("claims", claims)
+		}, ProvisionUser(provisioner), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("セッションのクレームからユーザーを作成する", func(t *testing.T) {
+		w := request("user_claims", &ProfileClaims{Email: "claims@example.com", Name: "Claims"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var user models.User
+		require.NoError(t, db.Where("clerk_id = ?", "user_claims").First(&user).Error)
+		assert.Equal(t, "claims@example.com", user.Email)
+		assert.Equal(t, "Claims", user.Name)
+		assert.Zero(t, lookup.Calls)
+	})
+
+	t.Run("クレームにメールアドレスがなければ Clerk から取得する", func(t *testing.T) {
+		w := request("user_lookup", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var user models.User
+		require.NoError(t, db.Where("clerk_id = ?", "user_lookup").First(&user).Error)
+		assert.Equal(t, "lookup@example.com", user.Email)
+		assert.Equal(t, 1, lookup.Calls)
+	})
+
+	t.Run("既存のユーザーは取得しない", func(t *testing.T) {
+		w := request("user_lookup", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 1, lookup.Calls)
+
+		var count int64
+		db.Model(&models.User{}).Where("clerk_id = ?", "user_lookup").Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Clerk から取得できない場合は 503", func(t *testing.T) {
+		w := request("user_unknown", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("他のユーザーのメールアドレスの場合は 409", func(t *testing.T) {
+		w := request("user_dup", &ProfileClaims{Email: "claims@example.com"})
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Clerk にいないユーザーのメールアドレスはデータを残して解放する", func(t *testing.T) {
+		stale := models.User{ClerkID: "user_deleted", Email: "recreated@example.com"}
+		require.NoError(t, db.Create(&stale).Error)
+		deck := models.Deck{UserID: stale.ID, Title: "古いデッキ"}
+		require.NoError(t, db.Create(&deck).Error)
+
+		w := request("user_recreated", &ProfileClaims{Email: "recreated@example.com"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var user models.User
+		require.NoError(t, db.Where("clerk_id = ?", "user_recreated").First(&user).Error)
+		assert.Equal(t, "recreated@example.com", user.Email)
+		require.NoError(t, db.First(&stale, stale.ID).Error)
+		assert.Equal(t, fmt.Sprintf("deleted+%d@invalid", stale.ID), stale.Email)
+		assert.NoError(t, db.First(&models.Deck{}, deck.ID).Error)
+	})
+
+	t.Run("メールアドレスを変更した Clerk ユーザーは同期する", func(t *testing.T) {
+		stale := models.User{ClerkID: "user_moved", Email: "moved@example.com"}
+		require.NoError(t, db.Create(&stale).Error)
+
+		w := request("user_new", &ProfileClaims{Email: "moved@example.com"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		require.NoError(t, db.First(&stale, stale.ID).Error)
+		assert.Equal(t, "moved-new@example.com", stale.Email)
+	})
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/muratayousuke/ai-flashcards/ratelimit"
 	"github.com/muratayousuke/ai-flashcards/services"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
@@ -51,6 +52,7 @@ func RedisRateLimiterMiddleware(db *gorm.DB, endpoint string) gin.HandlerFunc {
 		}
 
 		// 月間制限のチェック（無料ユーザーのみ）
+		monthlyCounted := false
 		monthlyLimit := monthlyRateLimits[planType]
 		if monthlyLimit > 0 {
 			allowed, remaining, resetTime, err := checkMonthlyLimit(userIDStr, endpoint, monthlyLimit)
@@ -74,6 +76,7 @@ func RedisRateLimiterMiddleware(db *gorm.DB, endpoint string) gin.HandlerFunc {
 					c.Abort()
 					return
 				}
+				monthlyCounted = true
 			}
 		}
 
@@ -87,7 +90,7 @@ func RedisRateLimiterMiddleware(db *gorm.DB, endpoint string) gin.HandlerFunc {
 		if err != nil {
 			log.Printf("Hourly limit check error: %v", err)
 			// エラー時はリクエストを許可（安全側に倒す）
-			c.Next()
+			serveCounted(c, ratelimit.Charge{UserID: userIDStr, Endpoint: endpoint, Monthly: monthlyCounted, At: time.Now()})
 			return
 		}
 
@@ -108,7 +111,19 @@ func RedisRateLimiterMiddleware(db *gorm.DB, endpoint string) gin.HandlerFunc {
 			return
 		}
 
-		c.Next()
+		serveCounted(c, ratelimit.Charge{UserID: userIDStr, Endpoint: endpoint, Hourly: true, Monthly: monthlyCounted, At: time.Now()})
+	}
+}
+
+// serveCounted runs the handler of a request counted towards the limits.
+// Handlers of asynchronous jobs keep the charge to refund it later.
+func serveCounted(c *gin.Context, charge ratelimit.Charge) {
+	ratelimit.SetCharge(c, charge)
+	c.Next()
+
+	// ユーザーの責任でない失敗はリクエスト数に含めない
+	if ratelimit.RefundMarked(c) {
+		ratelimit.Refund(charge)
 	}
 }
 
@@ -141,7 +156,7 @@ func checkHourlyLimit(userID, endpoint string, limit int) (allowed bool, remaini
 // checkRedisHourlyLimit uses Redis sorted sets for precise sliding window rate limiting (hourly)
 func checkRedisHourlyLimit(userID, endpoint string, limit int) (allowed bool, remaining int, resetTime int64, err error) {
 	ctx := context.Background()
-	key := fmt.Sprintf("rate_limit:v1:%s:%s:1h", userID, endpoint)
+	key := ratelimit.HourlyKey(userID, endpoint)
 	now := time.Now()
 	windowStart := now.Add(-time.Hour).Unix()
 	windowEnd := now.Unix()
@@ -201,9 +216,7 @@ func checkMonthlyLimit(userID, endpoint string, limit int) (allowed bool, remain
 func checkRedisMonthlyLimit(userID, endpoint string, limit int) (allowed bool, remaining int, resetTime int64, err error) {
 	ctx := context.Background()
 	now := time.Now()
-	currentMonth := now.Format("2006-01") // YYYY-MM形式
-
-	key := fmt.Sprintf("rate_limit:monthly:v1:%s:%s:%s", userID, endpoint, currentMonth)
+	key := ratelimit.MonthlyKey(userID, endpoint, now)
 
 	pipe := services.RedisClient.TxPipeline()
 
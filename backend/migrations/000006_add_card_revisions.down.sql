@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_card_revisions_card_id;
+DROP TABLE IF EXISTS card_revisions;
@@ -0,0 +1,14 @@
+CREATE TABLE card_revisions (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    card_id INTEGER NOT NULL REFERENCES cards(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    front TEXT NOT NULL,
+    back TEXT NOT NULL,
+    hint TEXT,
+    source VARCHAR(20) NOT NULL
+);
+
+CREATE INDEX idx_card_revisions_card_id ON card_revisions(card_id);
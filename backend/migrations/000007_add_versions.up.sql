@@ -0,0 +1,2 @@
+ALTER TABLE decks ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE cards ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_media_card_id;
+DROP INDEX IF EXISTS idx_media_user_id;
+DROP TABLE IF EXISTS media;
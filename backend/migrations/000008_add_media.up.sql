@@ -0,0 +1,16 @@
+CREATE TABLE media (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    card_id INTEGER REFERENCES cards(id),
+    side VARCHAR(10) NOT NULL DEFAULT 'front',
+    filename VARCHAR(255),
+    mime_type VARCHAR(100) NOT NULL,
+    size BIGINT,
+    storage_key VARCHAR(255) UNIQUE NOT NULL
+);
+
+CREATE INDEX idx_media_user_id ON media(user_id);
+CREATE INDEX idx_media_card_id ON media(card_id);
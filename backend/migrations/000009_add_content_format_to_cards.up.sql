@@ -0,0 +1 @@
+ALTER TABLE cards ADD COLUMN content_format VARCHAR(20) NOT NULL DEFAULT 'plain';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_cards_note_id;
+ALTER TABLE cards DROP COLUMN IF EXISTS template_ord;
+ALTER TABLE cards DROP COLUMN IF EXISTS note_id;
+DROP TABLE IF EXISTS notes;
+DROP TABLE IF EXISTS note_types;
@@ -0,0 +1,54 @@
+CREATE TABLE note_types (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    user_id INTEGER REFERENCES users(id),
+    name VARCHAR(255) NOT NULL,
+    fields TEXT NOT NULL,
+    templates TEXT NOT NULL,
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE INDEX idx_note_types_user_id ON note_types(user_id);
+
+CREATE TABLE notes (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    deck_id INTEGER NOT NULL REFERENCES decks(id),
+    note_type_id INTEGER NOT NULL REFERENCES note_types(id),
+    fields TEXT NOT NULL,
+    content_format VARCHAR(20) NOT NULL DEFAULT 'plain'
+);
+
+CREATE INDEX idx_notes_user_id ON notes(user_id);
+CREATE INDEX idx_notes_deck_id ON notes(deck_id);
+CREATE INDEX idx_notes_note_type_id ON notes(note_type_id);
+
+ALTER TABLE cards ADD COLUMN note_id INTEGER REFERENCES notes(id);
+ALTER TABLE cards ADD COLUMN template_ord INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX idx_cards_note_id ON cards(note_id);
+
+-- 組み込みの Basic ノートタイプ
+INSERT INTO note_types (name, fields, templates)
+VALUES (
+    'Basic',
+    '["Front","Back","Hint"]',
+    '[{"ord":0,"name":"Card 1","front":"{{Front}}","back":"{{Back}}","hint":"{{Hint}}"}]'
+);
+
+-- 既存カードを 1 枚ずつ Basic ノートに移行する（ノート ID はカード ID と同じにする）
+INSERT INTO notes (id, created_at, updated_at, deleted_at, user_id, deck_id, note_type_id, fields, content_format)
+SELECT c.id, c.created_at, c.updated_at, c.deleted_at, d.user_id, c.deck_id, nt.id,
+       json_build_object('Front', c.front, 'Back', c.back, 'Hint', COALESCE(c.hint, ''))::text,
+       c.content_format
+FROM cards c
+JOIN decks d ON d.id = c.deck_id
+CROSS JOIN (SELECT id FROM note_types WHERE user_id IS NULL AND name = 'Basic') nt;
+
+UPDATE cards SET note_id = id WHERE id IN (SELECT id FROM notes);
+
+SELECT setval('notes_id_seq', COALESCE((SELECT MAX(id) FROM notes), 0) + 1, false);
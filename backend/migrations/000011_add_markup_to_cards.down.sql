@@ -0,0 +1,3 @@
+ALTER TABLE card_previews DROP COLUMN IF EXISTS markup;
+ALTER TABLE notes DROP COLUMN IF EXISTS markup;
+ALTER TABLE cards DROP COLUMN IF EXISTS markup;
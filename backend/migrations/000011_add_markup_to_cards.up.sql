@@ -0,0 +1,3 @@
+ALTER TABLE cards ADD COLUMN markup BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE notes ADD COLUMN markup BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE card_previews ADD COLUMN markup BOOLEAN NOT NULL DEFAULT FALSE;
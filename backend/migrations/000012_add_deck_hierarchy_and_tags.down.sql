@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS card_tags;
+DROP INDEX IF EXISTS idx_tags_user_name;
+DROP TABLE IF EXISTS tags;
+DROP INDEX IF EXISTS idx_decks_parent_id;
+ALTER TABLE decks DROP COLUMN IF EXISTS parent_id;
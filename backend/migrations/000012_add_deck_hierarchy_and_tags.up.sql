@@ -0,0 +1,19 @@
+ALTER TABLE decks ADD COLUMN parent_id INTEGER REFERENCES decks(id);
+CREATE INDEX idx_decks_parent_id ON decks(parent_id);
+
+CREATE TABLE tags (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    name VARCHAR(255) NOT NULL
+);
+
+CREATE UNIQUE INDEX idx_tags_user_name ON tags(user_id, name);
+
+CREATE TABLE card_tags (
+    card_id INTEGER NOT NULL REFERENCES cards(id),
+    tag_id INTEGER NOT NULL REFERENCES tags(id),
+    PRIMARY KEY (card_id, tag_id)
+);
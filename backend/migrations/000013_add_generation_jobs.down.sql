@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_generation_jobs_deleted_at;
+DROP INDEX IF EXISTS idx_generation_jobs_status;
+DROP INDEX IF EXISTS idx_generation_jobs_user_id;
+DROP TABLE IF EXISTS generation_jobs;
@@ -0,0 +1,21 @@
+CREATE TABLE generation_jobs (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    kind VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    stage VARCHAR(20),
+    cards INTEGER NOT NULL DEFAULT 0,
+    input TEXT NOT NULL,
+    media_key TEXT,
+    result TEXT,
+    error TEXT,
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_generation_jobs_user_id ON generation_jobs(user_id);
+CREATE INDEX idx_generation_jobs_status ON generation_jobs(status);
+CREATE INDEX idx_generation_jobs_deleted_at ON generation_jobs(deleted_at);
@@ -0,0 +1,4 @@
+ALTER TABLE card_previews DROP COLUMN IF EXISTS source_text;
+ALTER TABLE card_previews DROP COLUMN IF EXISTS source_ref;
+ALTER TABLE cards DROP COLUMN IF EXISTS source_text;
+ALTER TABLE cards DROP COLUMN IF EXISTS source_ref;
@@ -0,0 +1,4 @@
+ALTER TABLE cards ADD COLUMN source_ref TEXT;
+ALTER TABLE cards ADD COLUMN source_text TEXT;
+ALTER TABLE card_previews ADD COLUMN source_ref TEXT;
+ALTER TABLE card_previews ADD COLUMN source_text TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE generation_jobs DROP COLUMN IF EXISTS media;
+ALTER TABLE generation_jobs ADD COLUMN IF NOT EXISTS media_key TEXT;
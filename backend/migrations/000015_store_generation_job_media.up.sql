@@ -0,0 +1,2 @@
+ALTER TABLE generation_jobs DROP COLUMN media_key;
+ALTER TABLE generation_jobs ADD COLUMN media BYTEA;
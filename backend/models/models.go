@@ -41,6 +41,8 @@ type Deck struct {
 	UserID      uint   `gorm:"not null" json:"userId"`
 	Title       string `gorm:"not null" json:"title"`
 	Description string `json:"description"`
+	ParentID    *uint  `gorm:"index" json:"parentId"`             // サブデッキの場合の親デッキ
+	Version     uint   `gorm:"not null;default:1" json:"version"` // 楽観的排他制御用
 }
 
 type Card struct {
@@ -51,8 +53,97 @@ type Card struct {
 	Hint           string     `json:"hint"`
 	ReviewCount    int        `gorm:"default:0" json:"reviewCount"`
 	LastReview     *time.Time `json:"lastReview"`
-	Status         string     `gorm:"default:'new'" json:"status"`            // new, learning, mastered
-	GenerationType string     `gorm:"default:'manual'" json:"generationType"` // manual, text, image, audio
+	Status         string     `gorm:"default:'new'" json:"status"`                   // new, learning, mastered
+	GenerationType string     `gorm:"default:'manual'" json:"generationType"`        // manual, text, image, audio, document, html, subtitles
+	SourceRef      string     `json:"sourceRef,omitempty"`                           // 生成元の位置（文書のページ "p.3"、字幕の時刻 "00:12:34" など）
+	SourceText     string     `json:"sourceText,omitempty"`                          // 生成元の文（字幕の台詞など）
+	Version        uint       `gorm:"not null;default:1" json:"version"`             // 楽観的排他制御用
+	ContentFormat  string     `gorm:"not null;default:'plain'" json:"contentFormat"` // plain, markdown
+	Markup         bool       `gorm:"not null;default:false" json:"markup"`          // $...$ の数式と漢字[かんじ] のふりがな記法を有効にする
+	NoteID         *uint      `gorm:"index" json:"noteId"`
+	TemplateOrd    int        `gorm:"not null;default:0" json:"templateOrd"` // 生成元テンプレートの ord
+	Media          []Media    `gorm:"foreignKey:CardID" json:"media,omitempty"`
+	Tags           []Tag      `gorm:"many2many:card_tags" json:"tags,omitempty"`
+
+	Rendered *RenderedContent `gorm:"-" json:"rendered,omitempty"` // render=html 指定時のみ
+}
+
+// RenderedContent is the sanitized HTML of a card's fields
+type RenderedContent struct {
+	Front    string            `json:"front"`
+	Back     string            `json:"back"`
+	Hint     string            `json:"hint"`
+	Furigana *RenderedFurigana `json:"furigana,omitempty"` // markup が有効なカードのみ
+}
+
+// RenderedFurigana lists the furigana of each field in order of appearance
+type RenderedFurigana struct {
+	Front []Furigana `json:"front"`
+	Back  []Furigana `json:"back"`
+	Hint  []Furigana `json:"hint"`
+}
+
+type Furigana struct {
+	Base    string `json:"base"`
+	Reading string `json:"reading"`
+}
+
+// NoteType defines the fields of a note and the templates that generate its cards
+type NoteType struct {
+	Model
+	UserID    *uint          `gorm:"index" json:"userId"` // nil は組み込みのノートタイプ
+	Name      string         `gorm:"not null" json:"name"`
+	Fields    []string       `gorm:"serializer:json;type:text;not null" json:"fields"`
+	Templates []CardTemplate `gorm:"serializer:json;type:text;not null" json:"templates"`
+	Version   uint           `gorm:"not null;default:1" json:"version"` // 楽観的排他制御用
+}
+
+// CardTemplate generates one card per note.
+// Front/Back/Hint use {{Field}} placeholders; Back can also use {{FrontSide}}.
+type CardTemplate struct {
+	Ord   int    `json:"ord"` // カードとの対応付けに使う不変の番号
+	Name  string `json:"name"`
+	Front string `json:"front"`
+	Back  string `json:"back"`
+	Hint  string `json:"hint,omitempty"`
+}
+
+type Note struct {
+	Model
+	UserID        uint              `gorm:"not null;index" json:"userId"`
+	DeckID        uint              `gorm:"not null;index" json:"deckId"`
+	NoteTypeID    uint              `gorm:"not null;index" json:"noteTypeId"`
+	Fields        map[string]string `gorm:"serializer:json;type:text;not null" json:"fields"`
+	ContentFormat string            `gorm:"not null;default:'plain'" json:"contentFormat"` // plain, markdown
+	Markup        bool              `gorm:"not null;default:false" json:"markup"`
+	Cards         []Card            `gorm:"foreignKey:NoteID" json:"cards,omitempty"`
+}
+
+type Tag struct {
+	Model
+	UserID uint   `gorm:"not null;uniqueIndex:idx_tags_user_name" json:"userId"`
+	Name   string `gorm:"not null;uniqueIndex:idx_tags_user_name" json:"name"`
+}
+
+type Media struct {
+	Model
+	UserID     uint   `gorm:"not null;index" json:"userId"`
+	CardID     *uint  `gorm:"index" json:"cardId"`
+	Side       string `gorm:"not null;default:'front'" json:"side"` // front, back
+	Filename   string `json:"filename"`
+	MimeType   string `gorm:"not null" json:"mimeType"`
+	Size       int64  `json:"size"`
+	StorageKey string `gorm:"not null;uniqueIndex" json:"-"`
+}
+
+type CardRevision struct {
+	Model
+	CardID uint   `gorm:"not null;index" json:"cardId"`
+	UserID uint   `gorm:"not null" json:"userId"` // この版を作成したユーザー
+	Front  string `gorm:"not null" json:"front"`
+	Back   string `gorm:"not null" json:"back"`
+	Hint   string `json:"hint"`
+	Source string `gorm:"not null" json:"source"` // manual, ai, revert, note
 }
 
 type AnswerRecord struct {
@@ -72,10 +163,29 @@ type CardPreview struct {
 	DeckDescription string    `json:"deckDescription"`
 	Front           string    `gorm:"not null" json:"front"`
 	Back            string    `gorm:"not null" json:"back"`
-	GenerationType  string    `gorm:"not null" json:"generationType"`  // text, image, audio
-	SessionID       string    `gorm:"not null;index" json:"sessionId"` // プレビューセッション識別用
-	ExpiresAt       time.Time `gorm:"not null;index" json:"expiresAt"` // 一定時間後に自動削除
-	OriginalPrompt  string    `json:"originalPrompt"`                  // 再生成時のため
+	GenerationType  string    `gorm:"not null" json:"generationType"`       // text, image, audio, document, html, subtitles
+	SourceRef       string    `json:"sourceRef,omitempty"`                  // 生成元の位置（文書のページ "p.3"、字幕の時刻 "00:12:34" など）
+	SourceText      string    `json:"sourceText,omitempty"`                 // 生成元の文（字幕の台詞など）
+	SessionID       string    `gorm:"not null;index" json:"sessionId"`      // プレビューセッション識別用
+	ExpiresAt       time.Time `gorm:"not null;index" json:"expiresAt"`      // 一定時間後に自動削除
+	OriginalPrompt  string    `json:"originalPrompt"`                       // 再生成時のため
+	Markup          bool      `gorm:"not null;default:false" json:"markup"` // 数式・ふりがな記法で生成したか
+}
+
+// GenerationJob is an AI generation processed in the background
+type GenerationJob struct {
+	Model
+	UserID     uint       `gorm:"not null;index" json:"userId"`
+	Kind       string     `gorm:"not null" json:"kind"`            // generate, preview
+	Status     string     `gorm:"not null;index" json:"status"`    // queued, running, succeeded, failed, canceled
+	Stage      string     `json:"stage"`                           // generating, saving
+	Cards      int        `gorm:"not null;default:0" json:"cards"` // 生成済みのカード数
+	Input      string     `gorm:"type:text;not null" json:"-"`     // 生成パラメータ（JSON）
+	Media      []byte     `json:"-"`                               // 入力ファイル（終了時に削除する）
+	Result     string     `gorm:"type:text" json:"-"`              // 生成結果（JSON）
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
 }
 
 type DeckStats struct {
@@ -0,0 +1,86 @@
+// Package ratelimit holds the request counts shared by the rate limiter
+// middleware and the handlers that give requests back to the user's limits.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muratayousuke/ai-flashcards/services"
+)
+
+const (
+	chargeKey = "rateLimitCharge"
+	refundKey = "rateLimitRefund"
+)
+
+// Charge is a request counted towards a user's limits
+type Charge struct {
+	UserID   string    `json:"userId"`
+	Endpoint string    `json:"endpoint"`
+	Hourly   bool      `json:"hourly"`  // 時間制限に数えたか
+	Monthly  bool      `json:"monthly"` // 月間制限に数えたか
+	At       time.Time `json:"at"`
+}
+
+// SetCharge records the counted request on the context
+func SetCharge(c *gin.Context, charge Charge) {
+	c.Set(chargeKey, charge)
+}
+
+// ChargeOf returns the counted request of the context, if any
+func ChargeOf(c *gin.Context) (Charge, bool) {
+	value, ok := c.Get(chargeKey)
+	if !ok {
+		return Charge{}, false
+	}
+	charge, ok := value.(Charge)
+	return charge, ok
+}
+
+// MarkRefund gives back the request to the user's limits once the handler
+// has finished, for requests that failed through no fault of the user, such
+// as an outage of the AI provider
+func MarkRefund(c *gin.Context) {
+	c.Set(refundKey, true)
+}
+
+// RefundMarked reports whether the handler asked to give back the request
+func RefundMarked(c *gin.Context) bool {
+	return c.GetBool(refundKey)
+}
+
+// Refund removes a counted request from the hourly and monthly limits
+func Refund(charge Charge) {
+	if !services.IsRedisAvailable() {
+		return
+	}
+
+	ctx := context.Background()
+	// 1時間の枠から外れた記録はすでに数えられていない
+	if charge.Hourly && time.Since(charge.At) < time.Hour {
+		// 同じ時間枠の記録はどれを消しても残り回数は同じなので、最新のものを消す
+		if err := services.RedisClient.ZPopMax(ctx, HourlyKey(charge.UserID, charge.Endpoint)).Err(); err != nil {
+			log.Printf("Hourly limit refund error: %v", err)
+		}
+	}
+	// 前月以前の記録は月末で期限が切れている
+	if charge.Monthly && charge.At.Format("2006-01") == time.Now().Format("2006-01") {
+		if err := services.RedisClient.Decr(ctx, MonthlyKey(charge.UserID, charge.Endpoint, charge.At)).Err(); err != nil {
+			log.Printf("Monthly limit refund error: %v", err)
+		}
+	}
+}
+
+// HourlyKey is the sorted set of the user's requests in the last hour
+func HourlyKey(userID, endpoint string) string {
+	return fmt.Sprintf("rate_limit:v1:%s:%s:1h", userID, endpoint)
+}
+
+// MonthlyKey is the counter of the user's requests in the month of now
+func MonthlyKey(userID, endpoint string, now time.Time) string {
+	return fmt.Sprintf("rate_limit:monthly:v1:%s:%s:%s", userID, endpoint, now.Format("2006-01")) // YYYY-MM形式
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+const accountDataFile = "account.json"
+
+// AccountData is the profile and billing part of the personal data export
+type AccountData struct {
+	Email         string                `json:"email"`
+	Name          string                `json:"name"`
+	ClerkID       string                `json:"clerkId"`
+	CreatedAt     time.Time             `json:"createdAt"`
+	Subscriptions []AccountSubscription `json:"subscriptions"`
+}
+
+type AccountSubscription struct {
+	StripeSubscriptionID string     `json:"stripeSubscriptionId"`
+	StripeCustomerID     string     `json:"stripeCustomerId"`
+	Email                string     `json:"email"`
+	Status               string     `json:"status"`
+	PlanType             string     `json:"planType"`
+	CurrentPeriodStart   time.Time  `json:"currentPeriodStart"`
+	CurrentPeriodEnd     time.Time  `json:"currentPeriodEnd"`
+	CanceledAt           *time.Time `json:"canceledAt"`
+	CreatedAt            time.Time  `json:"createdAt"`
+}
+
+// AccountService exports and erases all data of a user
+type AccountService struct {
+	db           *gorm.DB
+	backup       *BackupService
+	mediaService *MediaService
+	canceler     SubscriptionCanceler
+}
+
+func NewAccountService(db *gorm.DB, storage MediaStorage) *AccountService {
+	return NewAccountServiceWithCanceler(db, storage, NewStripeSubscriptionCanceler())
+}
+
+// NewAccountServiceWithCanceler creates the service with the given subscription canceler
+func NewAccountServiceWithCanceler(db *gorm.DB, storage MediaStorage, canceler SubscriptionCanceler) *AccountService {
+	return &AccountService{
+		db:           db,
+		backup:       NewBackupService(db, storage),
+		mediaService: NewMediaService(db, storage),
+		canceler:     canceler,
+	}
+}
+
+// ExportData writes the backup archive of the user with account.json added,
+// so the export covers the profile and subscriptions as well
+func (s *AccountService) ExportData(ctx context.Context, user *models.User, w io.Writer) error {
+	var subscriptions []models.Subscription
+	if err := s.db.WithContext(ctx).Where("user_id = ?", user.ID).Order("id").Find(&subscriptions).Error; err != nil {
+		return err
+	}
+
+	account := AccountData{
+		Email:         user.Email,
+		Name:          user.Name,
+		ClerkID:       user.ClerkID,
+		CreatedAt:     user.CreatedAt,
+		Subscriptions: make([]AccountSubscription, 0, len(subscriptions)),
+	}
+	for _, sub := range subscriptions {
+		account.Subscriptions = append(account.Subscriptions, AccountSubscription{
+			StripeSubscriptionID: sub.StripeSubscriptionID,
+			StripeCustomerID:     sub.StripeCustomerID,
+			Email:                sub.Email,
+			Status:               sub.Status,
+			PlanType:             sub.PlanType,
+			CurrentPeriodStart:   sub.CurrentPeriodStart,
+			CurrentPeriodEnd:     sub.CurrentPeriodEnd,
+			CanceledAt:           sub.CanceledAt,
+			CreatedAt:            sub.CreatedAt,
+		})
+	}
+
+	return s.backup.writeArchive(ctx, user, w, backupFile{accountDataFile, account})
+}
+
+// DeleteAccount permanently removes everything the user owns. The user and
+// subscription rows are anonymized and soft-deleted instead, so that billing
+// records stay consistent and the email and Clerk ID can be used again.
+// Subscriptions are canceled at Stripe first; if that fails nothing is
+// deleted, so the deletion can be retried.
+func (s *AccountService) DeleteAccount(ctx context.Context, user *models.User) error {
+	if err := s.cancelSubscriptions(ctx, user); err != nil {
+		return err
+	}
+
+	var keys []string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		deckIDs := tx.Unscoped().Model(&models.Deck{}).Select("id").Where("user_id = ?", user.ID)
+		cardIDs := tx.Unscoped().Model(&models.Card{}).Select("id").Where("deck_id IN (?)", deckIDs)
+		tagIDs := tx.Unscoped().Model(&models.Tag{}).Select("id").Where("user_id = ?", user.ID)
+
+		if err := tx.Unscoped().Model(&models.Media{}).Where("user_id = ?", user.ID).Pluck("storage_key", &keys).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM card_tags WHERE card_id IN (?) OR tag_id IN (?)", cardIDs, tagIDs).Error; err != nil {
+			return err
+		}
+
+		// 参照する側から順に削除する
+		deletes := []struct {
+			model any
+			query string
+			args  []any
+		}{
+			{&models.Media{}, "user_id = ?", []any{user.ID}},
+			{&models.CardRevision{}, "card_id IN (?) OR user_id = ?", []any{cardIDs, user.ID}},
+			{&models.AnswerRecord{}, "user_id = ?", []any{user.ID}},
+			{&models.Card{}, "deck_id IN (?)", []any{deckIDs}},
+			{&models.Note{}, "user_id = ?", []any{user.ID}},
+			{&models.NoteType{}, "user_id = ?", []any{user.ID}},
+			{&models.Tag{}, "user_id = ?", []any{user.ID}},
+			{&models.CardPreview{}, "user_id = ?", []any{user.ID}},
+			{&models.GenerationJob{}, "user_id = ?", []any{user.ID}},
+			{&models.Deck{}, "user_id = ?", []any{user.ID}},
+		}
+		for _, d := range deletes {
+			if err := tx.Unscoped().Where(d.query, d.args...).Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+
+		anonymous := fmt.Sprintf("deleted-%d@deleted.invalid", user.ID)
+		if err := tx.Unscoped().Model(&models.Subscription{}).Where("user_id = ?", user.ID).
+			Update("email", anonymous).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.Subscription{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]any{
+			"email":    anonymous,
+			"name":     "",
+			"clerk_id": fmt.Sprintf("deleted-%d", user.ID),
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.User{}, user.ID).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mediaService.RemoveObjects(ctx, keys)
+	return nil
+}
+
+// cancelSubscriptions cancels the user's subscriptions that still bill, marking
+// each canceled as soon as Stripe confirms it
+func (s *AccountService) cancelSubscriptions(ctx context.Context, user *models.User) error {
+	var subscriptions []models.Subscription
+	if err := s.db.WithContext(ctx).Where("user_id = ? AND status NOT IN ?", user.ID, []string{"canceled", "incomplete_expired"}).
+		Find(&subscriptions).Error; err != nil {
+		return err
+	}
+
+	for _, sub := range subscriptions {
+		if err := s.canceler.CancelSubscription(ctx, sub.StripeSubscriptionID); err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := s.db.WithContext(ctx).Model(&sub).Updates(map[string]any{"status": "canceled", "canceled_at": now}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
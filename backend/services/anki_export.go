@@ -0,0 +1,730 @@
+package services
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	xhtml "golang.org/x/net/html"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Anki のスケジュール関連の値
+const (
+	ankiQueueNew      = 0
+	ankiQueueReview   = 2
+	ankiDefaultFactor = 2500
+	ankiDefaultDeckID = 1
+	ankiRevlogReview  = 1
+)
+
+// ankiSchema11 creates the tables of a legacy (schema 11) collection, which
+// every Anki version can import
+var ankiSchema11 = []string{
+	`CREATE TABLE col (id integer primary key, crt integer not null, mod integer not null, scm integer not null,
+		ver integer not null, dty integer not null, usn integer not null, ls integer not null, conf text not null,
+		models text not null, decks text not null, dconf text not null, tags text not null)`,
+	`CREATE TABLE notes (id integer primary key, guid text not null, mid integer not null, mod integer not null,
+		usn integer not null, tags text not null, flds text not null, sfld integer not null, csum integer not null,
+		flags integer not null, data text not null)`,
+	`CREATE TABLE cards (id integer primary key, nid integer not null, did integer not null, ord integer not null,
+		mod integer not null, usn integer not null, type integer not null, queue integer not null, due integer not null,
+		ivl integer not null, factor integer not null, reps integer not null, lapses integer not null, left integer not null,
+		odue integer not null, odid integer not null, flags integer not null, data text not null)`,
+	`CREATE TABLE revlog (id integer primary key, cid integer not null, usn integer not null, ease integer not null,
+		ivl integer not null, lastIvl integer not null, factor integer not null, time integer not null, type integer not null)`,
+	`CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null)`,
+	`CREATE INDEX ix_notes_usn ON notes (usn)`,
+	`CREATE INDEX ix_cards_usn ON cards (usn)`,
+	`CREATE INDEX ix_revlog_usn ON revlog (usn)`,
+	`CREATE INDEX ix_cards_nid ON cards (nid)`,
+	`CREATE INDEX ix_cards_sched ON cards (did, queue, due)`,
+	`CREATE INDEX ix_revlog_cid ON revlog (cid)`,
+	`CREATE INDEX ix_notes_csum ON notes (csum)`,
+}
+
+const ankiExportCSS = `.card {
+ font-family: arial;
+ font-size: 20px;
+ text-align: center;
+ color: black;
+ background-color: white;
+}`
+
+// AnkiExporter writes decks as an Anki .apkg package
+type AnkiExporter struct {
+	db      *gorm.DB
+	storage MediaStorage
+}
+
+func NewAnkiExporter(db *gorm.DB, storage MediaStorage) *AnkiExporter {
+	return &AnkiExporter{db: db, storage: storage}
+}
+
+// DeckTree returns the deck followed by all of its descendants
+func DeckTree(db *gorm.DB, root *models.Deck) ([]models.Deck, error) {
+	decks := []models.Deck{*root}
+	parents := []uint{root.ID}
+	for len(parents) > 0 {
+		var children []models.Deck
+		if err := db.Where("user_id = ? AND parent_id IN ?", root.UserID, parents).Order("id").Find(&children).Error; err != nil {
+			return nil, err
+		}
+		parents = parents[:0]
+		for _, child := range children {
+			if !slices.ContainsFunc(decks, func(d models.Deck) bool { return d.ID == child.ID }) {
+				decks = append(decks, child)
+				parents = append(parents, child.ID)
+			}
+		}
+	}
+	return decks, nil
+}
+
+// ankiIDs hands out unique millisecond-timestamp IDs as Anki uses for its rows
+type ankiIDs struct {
+	last int64
+}
+
+func (a *ankiIDs) next(t time.Time) int64 {
+	id := t.UnixMilli()
+	if id <= a.last {
+		id = a.last + 1
+	}
+	a.last = id
+	return id
+}
+
+type ankiExportNote struct {
+	id       int64
+	guid     string
+	modelID  int64
+	noteType *models.NoteType
+	fields   []string
+	tags     []string
+	cards    []*models.Card
+	modified time.Time
+}
+
+type ankiExportMedia struct {
+	media *models.Media
+	name  string // パッケージ内のファイル名
+}
+
+// ankiExport holds the rows of a package while it is being built
+type ankiExport struct {
+	created  time.Time // コレクションの作成日（復習の期日の基準）
+	decks    map[uint]int64
+	models   map[uint]int64
+	notes    []*ankiExportNote
+	cardIDs  map[uint]int64
+	media    []ankiExportMedia
+	colDecks map[string]interface{}
+	colModel map[string]interface{}
+}
+
+// Export writes the decks with their cards, notes, tags, media, scheduling
+// state and review history as an .apkg package. Decks whose parent is not
+// exported become top-level decks.
+func (e *AnkiExporter) Export(ctx context.Context, decks []models.Deck, w io.Writer) error {
+	export, revlogs, err := e.build(ctx, decks)
+	if err != nil {
+		return err
+	}
+
+	colPath, err := writeAnkiCollection(export, revlogs)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(colPath)
+
+	return e.writePackage(ctx, export, colPath, w)
+}
+
+type ankiExportRevlog struct {
+	id     int64
+	cardID int64
+	record models.AnswerRecord
+}
+
+func (e *AnkiExporter) build(ctx context.Context, decks []models.Deck) (*ankiExport, []ankiExportRevlog, error) {
+	db := e.db.WithContext(ctx)
+	export := &ankiExport{
+		created:  time.Now(),
+		decks:    map[uint]int64{},
+		models:   map[uint]int64{},
+		cardIDs:  map[uint]int64{},
+		colDecks: map[string]interface{}{},
+		colModel: map[string]interface{}{},
+	}
+
+	deckIDs := make([]uint, 0, len(decks))
+	byID := map[uint]*models.Deck{}
+	for i := range decks {
+		deckIDs = append(deckIDs, decks[i].ID)
+		byID[decks[i].ID] = &decks[i]
+	}
+
+	var cards []models.Card
+	if err := db.Preload("Media").Preload("Tags").Where("deck_id IN ?", deckIDs).Order("id").Find(&cards).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, card := range cards {
+		if card.CreatedAt.Before(export.created) {
+			export.created = card.CreatedAt
+		}
+	}
+	export.created = export.created.UTC().Truncate(24 * time.Hour)
+
+	// デッキ（Anki はデフォルトデッキを必要とする）
+	var deckIDGen ankiIDs
+	export.colDecks[strconv.Itoa(ankiDefaultDeckID)] = ankiDeckJSON(ankiDefaultDeckID, "Default", "")
+	for _, deck := range decks {
+		id := deckIDGen.next(deck.CreatedAt)
+		export.decks[deck.ID] = id
+		export.colDecks[strconv.FormatInt(id, 10)] = ankiDeckJSON(id, ankiDeckName(&deck, byID), deck.Description)
+	}
+
+	if err := e.buildNotes(db, export, cards); err != nil {
+		return nil, nil, err
+	}
+
+	var revlogs []ankiExportRevlog
+	cardIDs := make([]uint, 0, len(cards))
+	for _, card := range cards {
+		cardIDs = append(cardIDs, card.ID)
+	}
+	var revlogIDs ankiIDs
+	for chunk := range slices.Chunk(cardIDs, 1000) {
+		var records []models.AnswerRecord
+		if err := db.Where("card_id IN ?", chunk).Order("answer_date").Find(&records).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, record := range records {
+			revlogs = append(revlogs, ankiExportRevlog{
+				id:     revlogIDs.next(record.AnswerDate),
+				cardID: export.cardIDs[record.CardID],
+				record: record,
+			})
+		}
+	}
+	slices.SortFunc(revlogs, func(a, b ankiExportRevlog) int { return cmp.Compare(a.id, b.id) })
+
+	return export, revlogs, nil
+}
+
+// ankiDeckName returns the "Parent::Child" name of a deck within the exported decks
+func ankiDeckName(deck *models.Deck, decks map[uint]*models.Deck) string {
+	names := []string{strings.ReplaceAll(deck.Title, "::", ":")}
+	seen := map[uint]bool{deck.ID: true}
+	for deck.ParentID != nil {
+		parent, ok := decks[*deck.ParentID]
+		if !ok || seen[parent.ID] {
+			break
+		}
+		seen[parent.ID] = true
+		names = append([]string{strings.ReplaceAll(parent.Title, "::", ":")}, names...)
+		deck = parent
+	}
+	return strings.Join(names, "::")
+}
+
+// buildNotes groups the cards by note and converts the note fields to Anki HTML.
+// Cards without a note are exported as Basic notes.
+func (e *AnkiExporter) buildNotes(db *gorm.DB, export *ankiExport, cards []models.Card) error {
+	var noteIDs []uint
+	for _, card := range cards {
+		if card.NoteID != nil && !slices.Contains(noteIDs, *card.NoteID) {
+			noteIDs = append(noteIDs, *card.NoteID)
+		}
+	}
+
+	notes := map[uint]*models.Note{}
+	noteTypes := map[uint]*models.NoteType{}
+	for chunk := range slices.Chunk(noteIDs, 1000) {
+		var found []models.Note
+		if err := db.Where("id IN ?", chunk).Find(&found).Error; err != nil {
+			return err
+		}
+		for i := range found {
+			notes[found[i].ID] = &found[i]
+			noteTypes[found[i].NoteTypeID] = nil
+		}
+	}
+	for id := range noteTypes {
+		var noteType models.NoteType
+		if err := db.Unscoped().First(&noteType, id).Error; err != nil {
+			return err
+		}
+		noteTypes[id] = &noteType
+	}
+
+	basic := BasicNoteType()
+	var modelIDs, noteIDGen, cardIDGen ankiIDs
+	modelID := func(noteType *models.NoteType) int64 {
+		if id, ok := export.models[noteType.ID]; ok {
+			return id
+		}
+		id := modelIDs.next(noteType.CreatedAt)
+		export.models[noteType.ID] = id
+		export.colModel[strconv.FormatInt(id, 10)] = ankiModelJSON(id, noteType)
+		return id
+	}
+
+	exported := map[uint]*ankiExportNote{}
+	for i := range cards {
+		card := &cards[i]
+
+		var exportNote *ankiExportNote
+		if note, ok := notes[ptrValue(card.NoteID)]; ok {
+			exportNote = exported[note.ID]
+			if exportNote == nil {
+				noteType := noteTypes[note.NoteTypeID]
+				exportNote = &ankiExportNote{
+					id:       noteIDGen.next(note.CreatedAt),
+					guid:     fmt.Sprintf("aifc-%d", note.ID),
+					modelID:  modelID(noteType),
+					noteType: noteType,
+					modified: note.UpdatedAt,
+				}
+				for _, field := range noteType.Fields {
+					value, err := ankiFieldHTML(note.ContentFormat, note.Markup, note.Fields[field])
+					if err != nil {
+						return fmt.Errorf("note %d: %w", note.ID, err)
+					}
+					exportNote.fields = append(exportNote.fields, value)
+				}
+				exported[note.ID] = exportNote
+				export.notes = append(export.notes, exportNote)
+			}
+		} else {
+			noteType := &basic
+			noteType.ID = 0
+			exportNote = &ankiExportNote{
+				id:       noteIDGen.next(card.CreatedAt),
+				guid:     fmt.Sprintf("aifc-card-%d", card.ID),
+				modelID:  modelID(noteType),
+				noteType: noteType,
+				modified: card.UpdatedAt,
+			}
+			for _, value := range []string{card.Front, card.Back, card.Hint} {
+				converted, err := ankiFieldHTML(card.ContentFormat, card.Markup, value)
+				if err != nil {
+					return fmt.Errorf("card %d: %w", card.ID, err)
+				}
+				exportNote.fields = append(exportNote.fields, converted)
+			}
+			export.notes = append(export.notes, exportNote)
+		}
+
+		exportNote.cards = append(exportNote.cards, card)
+		export.cardIDs[card.ID] = cardIDGen.next(card.CreatedAt)
+		for _, tag := range card.Tags {
+			name := strings.Join(strings.Fields(tag.Name), "_")
+			if !slices.Contains(exportNote.tags, name) {
+				exportNote.tags = append(exportNote.tags, name)
+			}
+		}
+		export.addMedia(exportNote, card)
+	}
+	return nil
+}
+
+func ptrValue(id *uint) uint {
+	if id == nil {
+		return 0
+	}
+	return *id
+}
+
+// addMedia references the card's media from the note fields shown on the
+// matching side of the card
+func (export *ankiExport) addMedia(note *ankiExportNote, card *models.Card) {
+	if len(card.Media) == 0 {
+		return
+	}
+
+	frontField, backField := 0, -1
+	for _, tmpl := range note.noteType.Templates {
+		if tmpl.Ord != card.TemplateOrd {
+			continue
+		}
+		frontRefs := templateRefs(tmpl.Front)
+		if len(frontRefs) > 0 {
+			frontField = max(slices.Index(note.noteType.Fields, frontRefs[0]), 0)
+		}
+		for _, ref := range templateRefs(tmpl.Back) {
+			if !slices.Contains(frontRefs, ref) && slices.Contains(note.noteType.Fields, ref) {
+				backField = slices.Index(note.noteType.Fields, ref)
+				break
+			}
+		}
+	}
+	if backField < 0 {
+		backField = frontField
+	}
+
+	for i := range card.Media {
+		media := &card.Media[i]
+		name := ankiMediaName(media)
+		ref := fmt.Sprintf(`<img src="%s">`, html.EscapeString(name))
+		if strings.HasPrefix(media.MimeType, "audio/") {
+			ref = "[sound:" + name + "]"
+		}
+
+		field := frontField
+		if media.Side == MediaSideBack {
+			field = backField
+		}
+		if !strings.Contains(note.fields[field], ref) {
+			note.fields[field] += ref
+		}
+		export.media = append(export.media, ankiExportMedia{media: media, name: name})
+	}
+}
+
+// ankiMediaName returns a unique filename for the media within the package
+func ankiMediaName(media *models.Media) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|[] `, r) {
+			return '_'
+		}
+		return r
+	}, path.Base(media.Filename))
+	return fmt.Sprintf("%d_%s", media.ID, name)
+}
+
+// ankiFieldHTML renders a field value as the HTML Anki stores. Math markup
+// becomes MathJax \(..\) / \[..\] and furigana <ruby>.
+func ankiFieldHTML(format string, markup bool, value string) (string, error) {
+	var rendered string
+	var err error
+	if markup {
+		rendered, _, err = renderMarkup(format, value, func(tex string, display bool) string {
+			if display {
+				return `\[` + html.EscapeString(tex) + `\]`
+			}
+			return `\(` + html.EscapeString(tex) + `\)`
+		})
+	} else {
+		rendered, err = RenderContentHTML(format, value)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// 1 段落だけのフィールドは <p> で囲まない
+	rendered = strings.TrimSpace(rendered)
+	if strings.HasPrefix(rendered, "<p>") && strings.HasSuffix(rendered, "</p>") && strings.Count(rendered, "<p>") == 1 {
+		rendered = strings.TrimSuffix(strings.TrimPrefix(rendered, "<p>"), "</p>")
+	}
+	return rendered, nil
+}
+
+// ankiTemplateHTML converts a card template to an Anki template: literal
+// text is HTML-escaped and line breaks become <br>
+func ankiTemplateHTML(src string) string {
+	var b strings.Builder
+	for src != "" {
+		open := strings.Index(src, "{{")
+		end := -1
+		if open >= 0 {
+			end = strings.Index(src[open:], "}}")
+		}
+		if open < 0 || end < 0 {
+			b.WriteString(html.EscapeString(src))
+			break
+		}
+		b.WriteString(html.EscapeString(src[:open]))
+		b.WriteString(src[open : open+end+2])
+		src = src[open+end+2:]
+	}
+	return strings.ReplaceAll(b.String(), "\n", "<br>")
+}
+
+func ankiModelJSON(id int64, noteType *models.NoteType) map[string]interface{} {
+	fields := make([]map[string]interface{}, 0, len(noteType.Fields))
+	for i, name := range noteType.Fields {
+		fields = append(fields, map[string]interface{}{
+			"name": name, "ord": i, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []string{},
+		})
+	}
+
+	templates := make([]map[string]interface{}, 0, len(noteType.Templates))
+	var req []interface{}
+	for _, tmpl := range noteType.Templates {
+		qfmt := ankiTemplateHTML(tmpl.Front)
+		// ヒントが単一のフィールドなら Anki のヒント表示にする
+		if hint := strings.TrimSpace(tmpl.Hint); hint != "" {
+			refs := templateRefs(hint)
+			if len(refs) == 1 && hint == "{{"+refs[0]+"}}" {
+				qfmt += fmt.Sprintf("{{#%[1]s}}<br>{{hint:%[1]s}}{{/%[1]s}}", refs[0])
+			}
+		}
+		afmt := ankiTemplateHTML(tmpl.Back)
+		if !strings.Contains(tmpl.Back, "{{"+FrontSideField+"}}") {
+			afmt = "{{FrontSide}}\n\n<hr id=answer>\n\n" + afmt
+		}
+
+		templates = append(templates, map[string]interface{}{
+			"name": tmpl.Name, "ord": tmpl.Ord, "qfmt": qfmt, "afmt": afmt, "did": nil, "bqfmt": "", "bafmt": "",
+		})
+
+		var required []int
+		for _, ref := range templateRefs(tmpl.Front) {
+			if i := slices.Index(noteType.Fields, ref); i >= 0 && !slices.Contains(required, i) {
+				required = append(required, i)
+			}
+		}
+		req = append(req, []interface{}{tmpl.Ord, "any", required})
+	}
+
+	return map[string]interface{}{
+		"id": id, "name": noteType.Name, "type": 0, "mod": noteType.UpdatedAt.Unix(), "usn": -1, "sortf": 0,
+		"did": ankiDefaultDeckID, "tmpls": templates, "flds": fields, "css": ankiExportCSS,
+		"latexPre":  "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n",
+		"latexPost": "\\end{document}", "latexsvg": false, "req": req, "tags": []string{}, "vers": []int{},
+	}
+}
+
+func ankiDeckJSON(id int64, name, description string) map[string]interface{} {
+	return map[string]interface{}{
+		"id": id, "name": name, "desc": html.EscapeString(description), "mod": time.Now().Unix(), "usn": -1,
+		"dyn": 0, "conf": 1, "collapsed": false, "browserCollapsed": false, "extendNew": 10, "extendRev": 50,
+		"newToday": []int{0, 0}, "revToday": []int{0, 0}, "lrnToday": []int{0, 0}, "timeToday": []int{0, 0},
+	}
+}
+
+func ankiDeckConfJSON() map[string]interface{} {
+	return map[string]interface{}{
+		"1": map[string]interface{}{
+			"id": 1, "name": "Default", "mod": 0, "usn": 0, "maxTaken": 60, "autoplay": true, "timer": 0,
+			"replayq": true, "dyn": false,
+			"new": map[string]interface{}{
+				"delays": []float64{1, 10}, "ints": []int{1, 4, 0}, "initialFactor": ankiDefaultFactor,
+				"order": 1, "perDay": 20, "bury": false, "separate": true,
+			},
+			"rev": map[string]interface{}{
+				"perDay": 200, "ease4": 1.3, "ivlFct": 1, "maxIvl": 36500, "hardFactor": 1.2, "bury": false,
+			},
+			"lapse": map[string]interface{}{
+				"delays": []float64{10}, "mult": 0, "minInt": 1, "leechFails": 8, "leechAction": 1,
+			},
+		},
+	}
+}
+
+// ankiSchedule maps the study state of a card onto Anki's card type, queue,
+// due and interval. Learning cards become reviews due a day after their last
+// review and mastered ones reviews with a three-week interval.
+func ankiSchedule(card *models.Card, created time.Time, position int) (cardType, queue, due, interval int) {
+	if card.Status != "learning" && card.Status != "mastered" {
+		return ankiCardNew, ankiQueueNew, position, 0
+	}
+
+	interval = 1
+	if card.Status == "mastered" {
+		interval = ankiMasteredInterval
+	}
+	reviewed := card.UpdatedAt
+	if card.LastReview != nil {
+		reviewed = *card.LastReview
+	}
+	day := int(reviewed.Sub(created) / (24 * time.Hour))
+	return ankiCardReview, ankiQueueReview, max(day, 0) + interval, interval
+}
+
+// ankiSortField returns the sort field and checksum Anki stores for a note
+func ankiSortField(field string) (string, int64) {
+	var b strings.Builder
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(field))
+	for {
+		tt := tokenizer.Next()
+		if tt == xhtml.ErrorToken {
+			break
+		}
+		if tt == xhtml.TextToken {
+			b.Write(tokenizer.Text())
+		}
+	}
+	text := strings.TrimSpace(ankiSoundRef.ReplaceAllString(b.String(), ""))
+
+	sum := sha1.Sum([]byte(text))
+	checksum, _ := strconv.ParseInt(hex.EncodeToString(sum[:])[:8], 16, 64)
+	return text, checksum
+}
+
+// writeAnkiCollection writes the rows to a new SQLite collection and returns its path
+func writeAnkiCollection(export *ankiExport, revlogs []ankiExportRevlog) (string, error) {
+	tmp, err := os.CreateTemp("", "anki-export-*.anki2")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	colPath := tmp.Name()
+
+	col, err := gorm.Open(sqlite.Open(colPath), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		os.Remove(colPath)
+		return "", err
+	}
+	sqlDB, err := col.DB()
+	if err != nil {
+		os.Remove(colPath)
+		return "", err
+	}
+
+	err = col.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range ankiSchema11 {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return insertAnkiRows(tx, export, revlogs)
+	})
+	if closeErr := sqlDB.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(colPath)
+		return "", err
+	}
+	return colPath, nil
+}
+
+func insertAnkiRows(tx *gorm.DB, export *ankiExport, revlogs []ankiExportRevlog) error {
+	now := time.Now()
+	var firstModel int64
+	for _, note := range export.notes {
+		if firstModel == 0 {
+			firstModel = note.modelID
+		}
+	}
+
+	jsonText := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	conf := map[string]interface{}{
+		"nextPos": len(export.notes) + 1, "estTimes": true, "activeDecks": []int{ankiDefaultDeckID},
+		"sortType": "noteFld", "timeLim": 0, "sortBackwards": false, "addToCur": true,
+		"curDeck": ankiDefaultDeckID, "newSpread": 0, "dueCounts": true, "curModel": strconv.FormatInt(firstModel, 10),
+		"collapseTime": 1200,
+	}
+	if err := tx.Exec("INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')",
+		export.created.Unix(), now.UnixMilli(), now.UnixMilli(),
+		jsonText(conf), jsonText(export.colModel), jsonText(export.colDecks), jsonText(ankiDeckConfJSON()),
+	).Error; err != nil {
+		return err
+	}
+
+	position := 0
+	for _, note := range export.notes {
+		tags := ""
+		if len(note.tags) > 0 {
+			tags = " " + strings.Join(note.tags, " ") + " "
+		}
+		sortField, checksum := ankiSortField(note.fields[0])
+		if err := tx.Exec("INSERT INTO notes VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')",
+			note.id, note.guid, note.modelID, note.modified.Unix(), tags, strings.Join(note.fields, "\x1f"), sortField, checksum,
+		).Error; err != nil {
+			return err
+		}
+
+		position++
+		for _, card := range note.cards {
+			cardType, queue, due, interval := ankiSchedule(card, export.created, position)
+			if err := tx.Exec("INSERT INTO cards VALUES (?, ?, ?, ?, ?, -1, ?, ?, ?, ?, ?, ?, 0, 0, 0, 0, 0, '')",
+				export.cardIDs[card.ID], note.id, export.decks[card.DeckID], card.TemplateOrd, card.UpdatedAt.Unix(),
+				cardType, queue, due, interval, ankiDefaultFactor, card.ReviewCount,
+			).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, revlog := range revlogs {
+		ease := 1 // もう一度
+		if revlog.record.IsCorrect {
+			ease = 3 // 普通
+		}
+		if err := tx.Exec("INSERT INTO revlog VALUES (?, ?, -1, ?, 0, 0, 0, ?, ?)",
+			revlog.id, revlog.cardID, ease, revlog.record.StudyTime*1000, ankiRevlogReview,
+		).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePackage zips the collection and the media files
+func (e *AnkiExporter) writePackage(ctx context.Context, export *ankiExport, colPath string, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	if err := addZipFile(zw, "collection.anki2", colPath); err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	for _, media := range export.media {
+		content, err := e.storage.Open(ctx, media.media.StorageKey)
+		if err != nil {
+			if errors.Is(err, ErrMediaNotFound) {
+				log.Printf("Warning: media %d is missing from storage", media.media.ID)
+				continue
+			}
+			return err
+		}
+		key := strconv.Itoa(len(names))
+		entry, err := zw.Create(key)
+		if err == nil {
+			_, err = io.Copy(entry, content)
+		}
+		content.Close()
+		if err != nil {
+			return err
+		}
+		names[key] = media.name
+	}
+
+	entry, err := zw.Create("media")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(entry).Encode(names); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func addZipFile(zw *zip.Writer, name, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	ankiSoundRef     = regexp.MustCompile(`\[sound:([^\]]+)\]`)
+	ankiMath         = regexp.MustCompile(`(?s)\\\((.+?)\\\)|\\\[(.+?)\\\]`)
+	ankiTemplateTag  = regexp.MustCompile(`\{\{\s*([#^/]?)\s*([^}]*?)\s*\}\}`)
+	ankiAnswerPrefix = regexp.MustCompile(`^\s*\{\{\s*FrontSide\s*\}\}\s*(<hr[^>]*>)?`)
+	ankiCloze        = regexp.MustCompile(`(?s)\{\{c(\d+)::(.*?)(?:::(.*?))?\}\}`)
+	ankiBlankLines   = regexp.MustCompile(`\n{3,}`)
+)
+
+// Anki のテンプレートで使える特殊フィールド（対応するフィールドがないので取り除く）
+var ankiSpecialFields = []string{"Tags", "Type", "Deck", "Subdeck", "Card", "CardFlag"}
+
+// convertAnkiHTML converts Anki field HTML to markdown. Images and [sound:]
+// references are removed and returned as media filenames. With markup,
+// MathJax \(..\) / \[..\] become $..$ / $$..$$, <ruby> becomes 漢字[かんじ] and
+// furigana brackets are kept; otherwise they are escaped as text.
+func convertAnkiHTML(src string, markup bool) (string, []string) {
+	var b strings.Builder
+	var media []string
+	var links []string
+	skip := 0 // script/style の中身は出力しない
+
+	tokenizer := html.NewTokenizer(strings.NewReader(src))
+	for {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		if tt == html.TextToken {
+			if skip > 0 {
+				continue
+			}
+			text := ankiSoundRef.ReplaceAllStringFunc(string(tokenizer.Text()), func(ref string) string {
+				media = append(media, ankiSoundRef.FindStringSubmatch(ref)[1])
+				return ""
+			})
+			b.WriteString(escapeAnkiText(text, markup))
+			continue
+		}
+
+		if tt != html.StartTagToken && tt != html.EndTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		start := tt != html.EndTagToken
+
+		switch token.Data {
+		case "script", "style", "rp":
+			if tt == html.StartTagToken {
+				skip++
+			} else if tt == html.EndTagToken && skip > 0 {
+				skip--
+			}
+		case "br":
+			b.WriteString("\n")
+		case "div", "p", "tr", "h1", "h2", "h3", "h4", "h5", "h6":
+			if !start {
+				b.WriteString("\n")
+			}
+		case "ul", "ol":
+			b.WriteString("\n")
+		case "li":
+			if start {
+				b.WriteString("\n- ")
+			}
+		case "hr":
+			b.WriteString("\n\n---\n\n")
+		case "b", "strong":
+			b.WriteString("**")
+		case "i", "em":
+			b.WriteString("*")
+		case "code":
+			b.WriteString("`")
+		case "rt":
+			// <ruby>漢字<rt>かんじ</rt></ruby> はふりがな記法にする
+			switch {
+			case markup && start:
+				b.WriteString("[")
+			case markup:
+				b.WriteString("]")
+			case start:
+				b.WriteString("(")
+			default:
+				b.WriteString(")")
+			}
+		case "img":
+			if src := ankiAttr(token, "src"); src != "" {
+				media = append(media, src)
+			}
+		case "a":
+			if start {
+				href := ankiAttr(token, "href")
+				if !isSafeAnkiLink(href) {
+					href = ""
+				}
+				links = append(links, href)
+				if href != "" {
+					b.WriteString("[")
+				}
+			} else if len(links) > 0 {
+				href := links[len(links)-1]
+				links = links[:len(links)-1]
+				if href != "" {
+					b.WriteString("](" + href + ")")
+				}
+			}
+		}
+	}
+
+	text := strings.ReplaceAll(b.String(), "\u00a0", " ")
+	text = ankiBlankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text), media
+}
+
+func ankiAttr(token html.Token, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func isSafeAnkiLink(href string) bool {
+	return (strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "http://")) &&
+		!strings.ContainsAny(href, " ()")
+}
+
+// escapeAnkiText escapes markdown syntax in text while keeping {{...}}
+// placeholders and clozes verbatim
+func escapeAnkiText(text string, markup bool) string {
+	var b strings.Builder
+	for text != "" {
+		open := strings.Index(text, "{{")
+		end := -1
+		if open >= 0 {
+			end = strings.Index(text[open:], "}}")
+		}
+		if open < 0 || end < 0 {
+			b.WriteString(escapeAnkiSegment(text, markup))
+			break
+		}
+		b.WriteString(escapeAnkiSegment(text[:open], markup))
+		b.WriteString(text[open : open+end+2])
+		text = text[open+end+2:]
+	}
+	return b.String()
+}
+
+func escapeAnkiSegment(text string, markup bool) string {
+	if !markup {
+		return escapeAnkiMarkdown(text, "[]")
+	}
+
+	// MathJax を $..$ / $$..$$ に変換し、数式の中身はエスケープしない
+	var b strings.Builder
+	last := 0
+	for _, m := range ankiMath.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(escapeAnkiMarkdown(text[last:m[0]], "$"))
+		if m[2] >= 0 {
+			b.WriteString("$" + text[m[2]:m[3]] + "$")
+		} else {
+			b.WriteString("$$" + text[m[4]:m[5]] + "$$")
+		}
+		last = m[1]
+	}
+	b.WriteString(escapeAnkiMarkdown(text[last:], "$"))
+	return b.String()
+}
+
+// escapeAnkiMarkdown backslash-escapes markdown punctuation and the extra characters
+func escapeAnkiMarkdown(text, extra string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune(`\*_`+"`"+`<>`, r) || strings.ContainsRune(extra, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// convertAnkiTemplate converts an Anki card template to this app's template
+// syntax. Filters such as text: or furigana: are dropped, type-in answers and
+// special fields are removed, and on the answer side the usual
+// {{FrontSide}}<hr id=answer> prefix is stripped since cards show both sides.
+func convertAnkiTemplate(src string, answer bool) string {
+	if answer {
+		src = ankiAnswerPrefix.ReplaceAllString(src, "")
+	}
+	src = ankiTemplateTag.ReplaceAllStringFunc(src, func(tag string) string {
+		m := ankiTemplateTag.FindStringSubmatch(tag)
+		filters := strings.Split(m[2], ":")
+		name := strings.TrimSpace(filters[len(filters)-1])
+		if slices.Contains(filters[:len(filters)-1], "type") || slices.Contains(ankiSpecialFields, name) {
+			return ""
+		}
+		return "{{" + m[1] + name + "}}"
+	})
+	text, _ := convertAnkiHTML(src, false)
+	return text
+}
+
+// ankiTemplateUsesFurigana reports whether a template renders a field with
+// one of Anki's furigana filters
+func ankiTemplateUsesFurigana(src string) bool {
+	for _, m := range ankiTemplateTag.FindAllStringSubmatch(src, -1) {
+		filters := strings.Split(m[2], ":")
+		for _, filter := range filters[:len(filters)-1] {
+			switch filter {
+			case "furigana", "kanji", "kana":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renderAnkiCloze renders cloze number n of a cloze field. The question hides
+// the deletion behind [...] (or its hint), the answer shows it in bold; other
+// deletions are shown as plain text on both sides.
+func renderAnkiCloze(text string, n int, answer bool) string {
+	return ankiCloze.ReplaceAllStringFunc(text, func(cloze string) string {
+		m := ankiCloze.FindStringSubmatch(cloze)
+		if m[1] != strconv.Itoa(n) {
+			return m[2]
+		}
+		if answer {
+			return "**" + m[2] + "**"
+		}
+		if m[3] != "" {
+			return "**[" + m[3] + "]**"
+		}
+		return "**[...]**"
+	})
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertAnkiHTML(t *testing.T) {
+	cases := []struct {
+		name   string
+		src    string
+		markup bool
+		want   string
+		media  []string
+	}{
+		{"改行と強調", "<div><b>bold</b> &amp; <i>it</i></div><div>line<br>break</div>", false, "**bold** & *it*\nline\nbreak", nil},
+		{"記号のエスケープ", "2*3 [x] a_b", false, `2\*3 \[x\] a\_b`, nil},
+		{"メディア参照", `見る<img src="cat.png">[sound:cat.mp3]`, false, "見る", []string{"cat.png", "cat.mp3"}},
+		{"リンク", `<a href="https://example.com">site</a><a href="javascript:x">bad</a>`, false, "[site](https://example.com)bad", nil},
+		{"スクリプトは除去", "<script>alert(1)</script>ok", false, "ok", nil},
+		{"MathJax を数式記法に変換", `\(x^2\) costs $5`, true, `$x^2$ costs \$5`, nil},
+		{"ふりがなはそのまま", "漢字[かんじ]", true, "漢字[かんじ]", nil},
+		{"ruby をふりがなに変換", "<ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>", true, "漢字[かんじ]", nil},
+		{"記法なしの ruby", "<ruby>漢字<rt>かんじ</rt></ruby>", false, "漢字(かんじ)", nil},
+		{"穴埋めはエスケープしない", "{{c1::a_b}}", false, "{{c1::a_b}}", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, media := convertAnkiHTML(tc.src, tc.markup)
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.media, media)
+		})
+	}
+}
+
+func TestConvertAnkiTemplate(t *testing.T) {
+	assert.Equal(t, "{{Word}}\n{{#Note}}{{Note}}{{/Note}}",
+		convertAnkiTemplate("{{Word}}<br>{{#Note}}{{text:Note}}{{/Note}}{{type:Word}}", false))
+	assert.Equal(t, "{{Meaning}}", convertAnkiTemplate("{{FrontSide}}\n<hr id=answer>\n{{Meaning}}{{Tags}}", true))
+	assert.True(t, ankiTemplateUsesFurigana("{{furigana:Reading}}"))
+	assert.False(t, ankiTemplateUsesFurigana("{{Reading}}"))
+}
+
+func TestRenderAnkiCloze(t *testing.T) {
+	text := "{{c1::Tokyo}} is in {{c2::Japan::country}}"
+	assert.Equal(t, "**[...]** is in Japan", renderAnkiCloze(text, 1, false))
+	assert.Equal(t, "Tokyo is in **[country]**", renderAnkiCloze(text, 2, false))
+	assert.Equal(t, "Tokyo is in **Japan**", renderAnkiCloze(text, 2, true))
+}
@@ -0,0 +1,923 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	MaxAnkiPackageSize = 200 * 1024 * 1024 // 200MB
+	maxAnkiMediaSize   = 20 * 1024 * 1024  // 20MB（メディアのアップロード上限と同じ）
+	maxAnkiCollection  = 512 * 1024 * 1024 // 展開後のコレクションの上限
+)
+
+var (
+	ErrInvalidAnkiPackage     = errors.New("invalid Anki package")
+	ErrUnsupportedAnkiPackage = errors.New("unsupported Anki package")
+)
+
+// Kinds of items reported as skipped by an Anki import
+const (
+	AnkiSkipNote  = "note"
+	AnkiSkipCard  = "card"
+	AnkiSkipMedia = "media"
+)
+
+// Anki のカードタイプ（cards.type）
+const (
+	ankiCardNew        = 0
+	ankiCardLearning   = 1
+	ankiCardReview     = 2
+	ankiCardRelearning = 3
+)
+
+// ankiClozeModel is the model type of cloze deletion note types
+const ankiClozeModel = 1
+
+// ankiMasteredInterval is the review interval in days from which a card counts as mastered
+const ankiMasteredInterval = 21
+
+type AnkiImportOptions struct {
+	IncludeReviews bool   // 復習履歴を AnswerRecord として取り込む
+	DuplicateCheck string // "", DuplicateCheckSkip, DuplicateCheckFlag
+	DuplicateScope string // DuplicateScopeDeck（デフォルト）, DuplicateScopeAll
+}
+
+// AnkiImportSkip describes an item of the package that was not imported
+type AnkiImportSkip struct {
+	Kind   string `json:"kind"`
+	ID     int64  `json:"id,omitempty"` // Anki 側の ID
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// AnkiImportReport summarizes what an Anki import created
+type AnkiImportReport struct {
+	DeckIDs    []uint             `json:"deckIds"`
+	Decks      int                `json:"decks"`
+	NoteTypes  int                `json:"noteTypes"`
+	Notes      int                `json:"notes"`
+	Cards      int                `json:"cards"`
+	Tags       int                `json:"tags"`
+	Media      int                `json:"media"`
+	Reviews    int                `json:"reviews"`
+	Skipped    []AnkiImportSkip   `json:"skipped"`
+	Duplicates []FlaggedDuplicate `json:"duplicates,omitempty"`
+}
+
+func (r *AnkiImportReport) skip(kind string, id int64, name, reason string) {
+	r.Skipped = append(r.Skipped, AnkiImportSkip{Kind: kind, ID: id, Name: name, Reason: reason})
+}
+
+type AnkiImporter struct {
+	db       *gorm.DB
+	storage  MediaStorage
+	detector *DuplicateDetector
+}
+
+func NewAnkiImporter(db *gorm.DB, storage MediaStorage) *AnkiImporter {
+	return &AnkiImporter{db: db, storage: storage, detector: NewDuplicateDetector(db)}
+}
+
+type ankiField struct {
+	Name string `json:"name"`
+	Ord  int    `json:"ord"`
+}
+
+type ankiTemplate struct {
+	Name string `json:"name"`
+	Ord  int    `json:"ord"`
+	Qfmt string `json:"qfmt"`
+	Afmt string `json:"afmt"`
+}
+
+type ankiModel struct {
+	Name      string         `json:"name"`
+	Type      int            `json:"type"`
+	Fields    []ankiField    `json:"flds"`
+	Templates []ankiTemplate `json:"tmpls"`
+}
+
+type ankiDeck struct {
+	Name string `json:"name"`
+	Desc string `json:"desc"`
+}
+
+type ankiNote struct {
+	ID   int64
+	Mid  int64
+	Tags string
+	Flds string
+}
+
+type ankiCard struct {
+	ID   int64
+	Nid  int64
+	Did  int64
+	Ord  int
+	Type int
+	Ivl  int
+	Reps int
+}
+
+type ankiRevlog struct {
+	ID   int64 // 復習日時（ミリ秒）
+	Cid  int64
+	Ease int
+	Time int64 // 回答にかかった時間（ミリ秒）
+}
+
+// ankiPackage is an opened .apkg: the collection database and media entries
+type ankiPackage struct {
+	col      *gorm.DB
+	colPath  string
+	media    map[string]*zip.File // ファイル名 -> zip エントリ
+	mediaErr string               // メディア一覧を読めなかった理由
+}
+
+func openAnkiPackage(r io.ReaderAt, size int64) (*ankiPackage, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAnkiPackage, err)
+	}
+
+	entries := map[string]*zip.File{}
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	collection := entries["collection.anki21"]
+	if collection == nil {
+		if entries["collection.anki21b"] != nil {
+			return nil, fmt.Errorf("%w: the package uses the latest collection format; export it with \"Support older Anki versions\" enabled", ErrUnsupportedAnkiPackage)
+		}
+		collection = entries["collection.anki2"]
+	}
+	if collection == nil {
+		return nil, fmt.Errorf("%w: collection not found", ErrInvalidAnkiPackage)
+	}
+
+	pkg := &ankiPackage{media: map[string]*zip.File{}}
+	if err := pkg.extractCollection(collection); err != nil {
+		pkg.Close()
+		return nil, err
+	}
+
+	// media はファイル名の対応表（"0": "image.png" のような JSON）
+	if entry := entries["media"]; entry != nil {
+		names, err := readAnkiMediaMap(entry)
+		if err != nil {
+			pkg.mediaErr = "media list is in an unsupported format"
+		}
+		for key, name := range names {
+			if file := entries[key]; file != nil {
+				pkg.media[name] = file
+			}
+		}
+	}
+	return pkg, nil
+}
+
+func (p *ankiPackage) extractCollection(entry *zip.File) error {
+	if entry.UncompressedSize64 > maxAnkiCollection {
+		return fmt.Errorf("%w: collection is too large", ErrInvalidAnkiPackage)
+	}
+
+	src, err := entry.Open()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAnkiPackage, err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "anki-*.sqlite")
+	if err != nil {
+		return err
+	}
+	p.colPath = tmp.Name()
+	_, err = io.Copy(tmp, io.LimitReader(src, maxAnkiCollection))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAnkiPackage, err)
+	}
+
+	p.col, err = gorm.Open(sqlite.Open("file:"+p.colPath+"?mode=ro"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAnkiPackage, err)
+	}
+	return nil
+}
+
+func readAnkiMediaMap(entry *zip.File) (map[string]string, error) {
+	src, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	var names map[string]string
+	if err := json.NewDecoder(io.LimitReader(src, maxAnkiMediaSize)).Decode(&names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Close releases the collection database and removes its temporary file
+func (p *ankiPackage) Close() {
+	if p.col != nil {
+		if sqlDB, err := p.col.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
+	if p.colPath != "" {
+		os.Remove(p.colPath)
+	}
+}
+
+// ankiCollection holds the rows of a collection needed for an import
+type ankiCollection struct {
+	models  map[int64]ankiModel
+	decks   map[int64]ankiDeck
+	notes   []ankiNote
+	cards   map[int64][]ankiCard // ノート ID -> カード（ord 順）
+	revlogs []ankiRevlog
+}
+
+func (p *ankiPackage) readCollection(includeReviews bool) (*ankiCollection, error) {
+	var col struct {
+		Models string
+		Decks  string
+	}
+	if err := p.col.Raw("SELECT models, decks FROM col").Scan(&col).Error; err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAnkiPackage, err)
+	}
+
+	collection := &ankiCollection{cards: map[int64][]ankiCard{}}
+	var err error
+	if collection.models, err = decodeAnkiMap[ankiModel](col.Models); err != nil {
+		return nil, fmt.Errorf("%w: note types: %v", ErrInvalidAnkiPackage, err)
+	}
+	if collection.decks, err = decodeAnkiMap[ankiDeck](col.Decks); err != nil {
+		return nil, fmt.Errorf("%w: decks: %v", ErrInvalidAnkiPackage, err)
+	}
+
+	if err := p.col.Raw("SELECT id, mid, tags, flds FROM notes ORDER BY id").Scan(&collection.notes).Error; err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAnkiPackage, err)
+	}
+
+	var cards []ankiCard
+	if err := p.col.Raw("SELECT id, nid, did, ord, type, ivl, reps FROM cards ORDER BY nid, ord").Scan(&cards).Error; err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAnkiPackage, err)
+	}
+	for _, card := range cards {
+		collection.cards[card.Nid] = append(collection.cards[card.Nid], card)
+	}
+
+	if includeReviews {
+		if err := p.col.Raw("SELECT id, cid, ease, time FROM revlog ORDER BY id").Scan(&collection.revlogs).Error; err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidAnkiPackage, err)
+		}
+	}
+	return collection, nil
+}
+
+// decodeAnkiMap decodes the JSON objects of the col table, which are keyed by ID
+func decodeAnkiMap[T any](data string) (map[int64]T, error) {
+	var raw map[string]T
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, err
+	}
+	decoded := make(map[int64]T, len(raw))
+	for key, value := range raw {
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", key)
+		}
+		decoded[id] = value
+	}
+	return decoded, nil
+}
+
+// Import reads an .apkg package and creates its decks, note types, notes,
+// cards, tags and media for the user, optionally with the review history.
+// Everything is created in one transaction; notes that cannot be converted
+// are skipped and listed in the report.
+func (imp *AnkiImporter) Import(ctx context.Context, userID uint, r io.ReaderAt, size int64, opts AnkiImportOptions) (*AnkiImportReport, error) {
+	pkg, err := openAnkiPackage(r, size)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+
+	collection, err := pkg.readCollection(opts.IncludeReviews)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DuplicateCheck != "" && opts.DuplicateScope == "" {
+		opts.DuplicateScope = DuplicateScopeDeck
+	}
+
+	report := &AnkiImportReport{DeckIDs: []uint{}, Skipped: []AnkiImportSkip{}}
+	if pkg.mediaErr != "" {
+		report.skip(AnkiSkipMedia, 0, "media", pkg.mediaErr)
+	}
+
+	var storedKeys []string
+	err = imp.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		mediaService := NewMediaService(tx, imp.storage)
+		state := &ankiImportState{
+			ctx:          ctx,
+			tx:           tx,
+			userID:       userID,
+			opts:         opts,
+			pkg:          pkg,
+			collection:   collection,
+			report:       report,
+			detector:     imp.detector,
+			indexes:      map[int64]*DuplicateIndex{},
+			mediaService: mediaService,
+			noteService:  NewNoteService(tx, mediaService),
+			decks:        map[string]uint{},
+			noteTypes:    map[int64]*models.NoteType{},
+			invalidTypes: map[int64]string{},
+			tags:         map[string]models.Tag{},
+			cards:        map[int64]*models.Card{},
+		}
+		err := state.run()
+		storedKeys = state.storedKeys
+		return err
+	})
+	if err != nil {
+		// ロールバックされたメディアの実体を削除
+		NewMediaService(imp.db, imp.storage).RemoveObjects(ctx, storedKeys)
+		return nil, err
+	}
+	return report, nil
+}
+
+type ankiImportState struct {
+	ctx          context.Context
+	tx           *gorm.DB
+	userID       uint
+	opts         AnkiImportOptions
+	pkg          *ankiPackage
+	collection   *ankiCollection
+	report       *AnkiImportReport
+	detector     *DuplicateDetector
+	indexes      map[int64]*DuplicateIndex // Anki のデッキ ID（全デッキの場合は 0）-> 重複チェック用インデックス
+	mediaService *MediaService
+	noteService  *NoteService
+
+	decks        map[string]uint            // デッキのパス（A::B）-> デッキ ID
+	noteTypes    map[int64]*models.NoteType // Anki のモデル ID -> ノートタイプ
+	invalidTypes map[int64]string           // 変換できなかったモデルと理由
+	tags         map[string]models.Tag
+	cards        map[int64]*models.Card // Anki のカード ID -> 作成したカード
+	storedKeys   []string
+}
+
+func (s *ankiImportState) run() error {
+	for _, note := range s.collection.notes {
+		cards := s.collection.cards[note.ID]
+		if len(cards) == 0 {
+			s.report.skip(AnkiSkipNote, note.ID, "", "note has no cards")
+			continue
+		}
+		model, ok := s.collection.models[note.Mid]
+		if !ok {
+			s.report.skip(AnkiSkipNote, note.ID, "", "unknown note type")
+			continue
+		}
+
+		var err error
+		if model.Type == ankiClozeModel {
+			err = s.importClozeNote(note, model, cards)
+		} else {
+			err = s.importNote(note, model, cards)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.opts.IncludeReviews {
+		return s.importReviews()
+	}
+	return nil
+}
+
+// noteFields returns the field values of a note keyed by field name, in field order
+func noteFields(note ankiNote, model ankiModel) ([]ankiField, []string) {
+	fields := slices.Clone(model.Fields)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Ord < fields[j].Ord })
+
+	values := strings.Split(note.Flds, "\x1f")
+	result := make([]string, len(fields))
+	for i, field := range fields {
+		if field.Ord < len(values) {
+			result[i] = values[field.Ord]
+		}
+	}
+	return fields, result
+}
+
+// usesAnkiMarkup reports whether a note should be imported with math/furigana markup
+func usesAnkiMarkup(model ankiModel, values []string) bool {
+	for _, tmpl := range model.Templates {
+		if ankiTemplateUsesFurigana(tmpl.Qfmt) || ankiTemplateUsesFurigana(tmpl.Afmt) {
+			return true
+		}
+	}
+	for _, value := range values {
+		if ankiMath.MatchString(value) || strings.Contains(value, "<ruby") {
+			return true
+		}
+	}
+	return false
+}
+
+// importNote imports a note of a standard (non-cloze) note type
+func (s *ankiImportState) importNote(note ankiNote, model ankiModel, ankiCards []ankiCard) error {
+	noteType, err := s.noteType(note.Mid, model)
+	if err != nil {
+		return err
+	}
+	if noteType == nil {
+		s.report.skip(AnkiSkipNote, note.ID, model.Name, s.invalidTypes[note.Mid])
+		return nil
+	}
+
+	fields, values := noteFields(note, model)
+	markup := usesAnkiMarkup(model, values)
+
+	convert := func() (map[string]string, map[string][]string) {
+		converted := map[string]string{}
+		fieldMedia := map[string][]string{}
+		for i, field := range fields {
+			converted[field.Name], fieldMedia[field.Name] = convertAnkiHTML(values[i], markup)
+		}
+		return converted, fieldMedia
+	}
+	converted, fieldMedia := convert()
+
+	if front, _, _, err := RenderCardTemplate(noteType.Templates[0], converted); err == nil {
+		duplicate, err := s.checkDuplicate(note.ID, ankiCards[0].Did, front)
+		if err != nil || duplicate {
+			return err
+		}
+	}
+
+	deckID, err := s.deck(ankiCards[0].Did)
+	if err != nil {
+		return err
+	}
+
+	var created *models.Note
+	for {
+		created = &models.Note{
+			UserID:        s.userID,
+			DeckID:        deckID,
+			Fields:        converted,
+			ContentFormat: ContentFormatMarkdown,
+			Markup:        markup,
+		}
+		err := s.noteService.CreateNote(s.ctx, noteType, created)
+		if err == nil {
+			break
+		}
+		if markup && errors.Is(err, ErrInvalidMarkup) {
+			// Anki 側の記法がこのアプリの記法として不正な場合はテキストとして取り込む
+			markup = false
+			converted, fieldMedia = convert()
+			continue
+		}
+		if errors.Is(err, ErrInvalidNote) || errors.Is(err, ErrInvalidContentFormat) {
+			s.report.skip(AnkiSkipNote, note.ID, model.Name, err.Error())
+			return nil
+		}
+		return err
+	}
+	s.report.Notes++
+
+	byOrd := map[int]*models.Card{}
+	for i := range created.Cards {
+		byOrd[created.Cards[i].TemplateOrd] = &created.Cards[i]
+	}
+
+	for _, ankiCard := range ankiCards {
+		card := byOrd[ankiCard.Ord]
+		if card == nil {
+			s.report.skip(AnkiSkipCard, ankiCard.ID, model.Name, "template renders an empty front")
+			continue
+		}
+
+		tmpl := noteType.Templates[slices.IndexFunc(noteType.Templates, func(t models.CardTemplate) bool {
+			return t.Ord == ankiCard.Ord
+		})]
+		frontRefs := templateRefs(tmpl.Front)
+		var front, back []string
+		for _, field := range fields {
+			if slices.Contains(frontRefs, field.Name) {
+				front = append(front, fieldMedia[field.Name]...)
+			} else if slices.Contains(templateRefs(tmpl.Back), field.Name) {
+				back = append(back, fieldMedia[field.Name]...)
+			}
+		}
+
+		if err := s.finishCard(card, note, ankiCard, front, back); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func templateRefs(template string) []string {
+	nodes, err := parseTemplate(template)
+	if err != nil {
+		return nil
+	}
+	return templateFieldRefs(nodes)
+}
+
+// importClozeNote imports each cloze deletion of a note as a Basic card.
+// The first field holds the cloze text, the remaining fields are appended to the back.
+func (s *ankiImportState) importClozeNote(note ankiNote, model ankiModel, ankiCards []ankiCard) error {
+	_, values := noteFields(note, model)
+	if len(values) == 0 {
+		s.report.skip(AnkiSkipNote, note.ID, model.Name, "cloze note has no fields")
+		return nil
+	}
+	markup := usesAnkiMarkup(model, values)
+
+	imported := false
+	for _, ankiCard := range ankiCards {
+		for {
+			text, frontMedia := convertAnkiHTML(values[0], markup)
+			var extra []string
+			var backMedia []string
+			for _, value := range values[1:] {
+				converted, media := convertAnkiHTML(value, markup)
+				if converted != "" {
+					extra = append(extra, converted)
+				}
+				backMedia = append(backMedia, media...)
+			}
+
+			card := models.Card{
+				Front:         renderAnkiCloze(text, ankiCard.Ord+1, false),
+				Back:          strings.Join(append([]string{renderAnkiCloze(text, ankiCard.Ord+1, true)}, extra...), "\n\n"),
+				ContentFormat: ContentFormatMarkdown,
+				Markup:        markup,
+			}
+			if err := SanitizeCard(&card); err != nil {
+				if markup && errors.Is(err, ErrInvalidMarkup) {
+					markup = false
+					continue
+				}
+				s.report.skip(AnkiSkipCard, ankiCard.ID, model.Name, err.Error())
+				break
+			}
+
+			duplicate, err := s.checkDuplicate(note.ID, ankiCard.Did, card.Front)
+			if err != nil {
+				return err
+			}
+			if duplicate {
+				break
+			}
+
+			if card.DeckID, err = s.deck(ankiCard.Did); err != nil {
+				return err
+			}
+
+			if err := CreateBasicCard(s.tx, s.userID, &card); err != nil {
+				return err
+			}
+			imported = true
+			if err := s.finishCard(&card, note, ankiCard, frontMedia, backMedia); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	if imported {
+		s.report.Notes++
+	}
+	return nil
+}
+
+// checkDuplicate records the front in the duplicate index and reports whether
+// the note should be skipped as a duplicate. With DuplicateScopeDeck, fronts
+// are only compared within the same Anki deck since its deck is new.
+func (s *ankiImportState) checkDuplicate(noteID int64, ankiDeckID int64, front string) (bool, error) {
+	if s.opts.DuplicateCheck == "" {
+		return false, nil
+	}
+
+	key := ankiDeckID
+	if s.opts.DuplicateScope == DuplicateScopeAll {
+		key = 0
+	}
+	index, ok := s.indexes[key]
+	if !ok {
+		var err error
+		if index, err = s.detector.NewIndex(s.userID, 0, s.opts.DuplicateScope); err != nil {
+			return false, err
+		}
+		s.indexes[key] = index
+	}
+
+	if matches := index.Match(front); len(matches) > 0 {
+		if s.opts.DuplicateCheck == DuplicateCheckSkip {
+			s.report.skip(AnkiSkipNote, noteID, front, "duplicate")
+			return true, nil
+		}
+		s.report.Duplicates = append(s.report.Duplicates, FlaggedDuplicate{Front: front, Matches: matches})
+	}
+	index.Add(0, 0, front)
+	return false, nil
+}
+
+// finishCard moves a created card to its Anki deck and applies the tags,
+// media and scheduling state of the Anki card
+func (s *ankiImportState) finishCard(card *models.Card, note ankiNote, ankiCard ankiCard, frontMedia, backMedia []string) error {
+	s.report.Cards++
+	s.cards[ankiCard.ID] = card
+
+	deckID, err := s.deck(ankiCard.Did)
+	if err != nil {
+		return err
+	}
+
+	status := "new"
+	switch ankiCard.Type {
+	case ankiCardLearning, ankiCardRelearning:
+		status = "learning"
+	case ankiCardReview:
+		status = "learning"
+		if ankiCard.Ivl >= ankiMasteredInterval {
+			status = "mastered"
+		}
+	}
+	card.DeckID = deckID
+	card.Status = status
+	card.ReviewCount = ankiCard.Reps
+	if err := s.tx.Model(card).UpdateColumns(map[string]interface{}{
+		"deck_id":      card.DeckID,
+		"status":       card.Status,
+		"review_count": card.ReviewCount,
+	}).Error; err != nil {
+		return err
+	}
+
+	if err := s.applyTags(card, strings.Fields(note.Tags)); err != nil {
+		return err
+	}
+	if err := s.attachMedia(card, frontMedia, MediaSideFront); err != nil {
+		return err
+	}
+	return s.attachMedia(card, backMedia, MediaSideBack)
+}
+
+// deck returns the deck for an Anki deck ID, creating it and its parents
+// (from the "Parent::Child" name) on first use
+func (s *ankiImportState) deck(ankiDeckID int64) (uint, error) {
+	deck, ok := s.collection.decks[ankiDeckID]
+	if !ok || strings.TrimSpace(deck.Name) == "" {
+		deck = ankiDeck{Name: "Anki"}
+	}
+
+	parts := strings.Split(deck.Name, "::")
+	var parentID *uint
+	for i, title := range parts {
+		key := strings.Join(parts[:i+1], "::")
+		if id, ok := s.decks[key]; ok {
+			parentID = &id
+			continue
+		}
+
+		created := models.Deck{UserID: s.userID, Title: strings.TrimSpace(title), ParentID: parentID}
+		if created.Title == "" {
+			created.Title = "Anki"
+		}
+		if i == len(parts)-1 {
+			created.Description, _ = convertAnkiHTML(deck.Desc, false)
+		}
+		if err := s.tx.Create(&created).Error; err != nil {
+			return 0, err
+		}
+		s.decks[key] = created.ID
+		s.report.Decks++
+		s.report.DeckIDs = append(s.report.DeckIDs, created.ID)
+		parentID = &created.ID
+	}
+	return *parentID, nil
+}
+
+// noteType returns the note type for an Anki model, creating it on first use.
+// A Front/Back(/Hint) model maps onto the built-in Basic type. nil is returned for
+// models that cannot be converted; the reason is kept in invalidTypes.
+func (s *ankiImportState) noteType(mid int64, model ankiModel) (*models.NoteType, error) {
+	if noteType, ok := s.noteTypes[mid]; ok {
+		return noteType, nil
+	}
+	if _, ok := s.invalidTypes[mid]; ok {
+		return nil, nil
+	}
+
+	fields, _ := noteFields(ankiNote{}, model)
+	if len(model.Templates) == 1 && isAnkiBasicFields(fields) {
+		basic, err := EnsureBasicNoteType(s.tx)
+		if err != nil {
+			return nil, err
+		}
+		s.noteTypes[mid] = basic
+		return basic, nil
+	}
+
+	noteType := &models.NoteType{UserID: &s.userID, Name: model.Name}
+	for _, field := range fields {
+		noteType.Fields = append(noteType.Fields, field.Name)
+	}
+	for _, tmpl := range model.Templates {
+		noteType.Templates = append(noteType.Templates, models.CardTemplate{
+			Ord:   tmpl.Ord,
+			Name:  tmpl.Name,
+			Front: convertAnkiTemplate(tmpl.Qfmt, false),
+			Back:  convertAnkiTemplate(tmpl.Afmt, true),
+		})
+	}
+	sort.Slice(noteType.Templates, func(i, j int) bool { return noteType.Templates[i].Ord < noteType.Templates[j].Ord })
+
+	if err := ValidateNoteType(noteType); err != nil {
+		s.invalidTypes[mid] = err.Error()
+		return nil, nil
+	}
+	// Anki のカードと対応付けるため ord はそのまま保持する
+	if err := s.tx.Create(noteType).Error; err != nil {
+		return nil, err
+	}
+	s.noteTypes[mid] = noteType
+	s.report.NoteTypes++
+	return noteType, nil
+}
+
+// isAnkiBasicFields reports whether a model has the fields of the Basic type:
+// Front and Back, optionally followed by Hint as written by the exporter
+func isAnkiBasicFields(fields []ankiField) bool {
+	names := make([]string, 0, len(fields))
+	for _, field := range fields {
+		names = append(names, field.Name)
+	}
+	return slices.Equal(names, []string{"Front", "Back"}) || slices.Equal(names, []string{"Front", "Back", "Hint"})
+}
+
+func (s *ankiImportState) applyTags(card *models.Card, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var missing []string
+	for _, name := range names {
+		if _, ok := s.tags[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	created, count, err := EnsureTags(s.tx, s.userID, missing)
+	if err != nil {
+		return err
+	}
+	s.report.Tags += count
+	for _, tag := range created {
+		s.tags[tag.Name] = tag
+	}
+
+	tags := make([]models.Tag, 0, len(names))
+	for _, name := range names {
+		tags = append(tags, s.tags[name])
+	}
+	return s.tx.Model(card).Association("Tags").Append(tags)
+}
+
+// attachMedia copies the referenced files of the package to the card
+func (s *ankiImportState) attachMedia(card *models.Card, filenames []string, side string) error {
+	seen := map[string]bool{}
+	for _, filename := range filenames {
+		if seen[filename] {
+			continue
+		}
+		seen[filename] = true
+
+		entry, ok := s.pkg.media[filename]
+		if !ok {
+			s.report.skip(AnkiSkipMedia, 0, filename, "file not found in package")
+			continue
+		}
+		mimeType := mime.TypeByExtension(strings.ToLower(path.Ext(filename)))
+		if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+			mimeType = mimeType[:i]
+		}
+		if !strings.HasPrefix(mimeType, "image/") && !strings.HasPrefix(mimeType, "audio/") {
+			s.report.skip(AnkiSkipMedia, 0, filename, "unsupported media type")
+			continue
+		}
+		if entry.UncompressedSize64 > maxAnkiMediaSize {
+			s.report.skip(AnkiSkipMedia, 0, filename, "file is too large (max 20MB)")
+			continue
+		}
+
+		if err := s.attachFile(card, entry, filename, mimeType, side); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ankiImportState) attachFile(card *models.Card, entry *zip.File, filename, mimeType, side string) error {
+	content, err := entry.Open()
+	if err != nil {
+		s.report.skip(AnkiSkipMedia, 0, filename, err.Error())
+		return nil
+	}
+	defer content.Close()
+
+	media := &models.Media{
+		UserID:   s.userID,
+		CardID:   &card.ID,
+		Side:     side,
+		Filename: path.Base(filename),
+		MimeType: mimeType,
+		Size:     int64(entry.UncompressedSize64),
+	}
+	if err := s.mediaService.Attach(s.ctx, media, io.LimitReader(content, maxAnkiMediaSize)); err != nil {
+		return err
+	}
+	s.storedKeys = append(s.storedKeys, media.StorageKey)
+	s.report.Media++
+	return nil
+}
+
+// importReviews stores the review log of the imported cards as answer records
+func (s *ankiImportState) importReviews() error {
+	var records []models.AnswerRecord
+	lastReview := map[uint]time.Time{}
+	for _, revlog := range s.collection.revlogs {
+		card, ok := s.cards[revlog.Cid]
+		if !ok {
+			continue // 取り込まなかったカードの履歴
+		}
+		if revlog.Ease == 0 {
+			continue // 手動でのスケジュール変更は回答ではない
+		}
+
+		answered := time.UnixMilli(revlog.ID)
+		records = append(records, models.AnswerRecord{
+			UserID:     s.userID,
+			DeckID:     card.DeckID,
+			CardID:     card.ID,
+			IsCorrect:  revlog.Ease > 1, // 1 は「もう一度」
+			StudyTime:  int(revlog.Time / 1000),
+			AnswerDate: answered,
+		})
+		if answered.After(lastReview[card.ID]) {
+			lastReview[card.ID] = answered
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := s.tx.CreateInBatches(records, 500).Error; err != nil {
+		return err
+	}
+	s.report.Reviews = len(records)
+
+	for cardID, reviewed := range lastReview {
+		if err := s.tx.Model(&models.Card{}).Where("id = ?", cardID).UpdateColumn("last_review", reviewed).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ErrNoArticleContent is returned when an HTML page has no readable text
+var ErrNoArticleContent = errors.New("ページから本文を抽出できませんでした")
+
+// Article is the readable content of a web page
+type Article struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// minParagraphRunes is the length from which a paragraph counts towards
+// the score of its container
+const minParagraphRunes = 25
+
+// Elements that never hold the content of an article
+var articleSkipTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Iframe: true, atom.Svg: true, atom.Canvas: true, atom.Object: true, atom.Embed: true,
+	atom.Form: true, atom.Button: true, atom.Input: true, atom.Select: true, atom.Textarea: true,
+	atom.Nav: true, atom.Header: true, atom.Footer: true, atom.Aside: true, atom.Dialog: true,
+}
+
+// ARIA roles of page chrome
+var boilerplateRoles = map[string]bool{
+	"navigation": true, "banner": true, "contentinfo": true, "complementary": true,
+	"search": true, "dialog": true, "alert": true, "menu": true, "menubar": true,
+}
+
+// Words in class names and IDs that mark navigation, ads and other page chrome
+var boilerplateWords = map[string]bool{
+	"ad": true, "ads": true, "advert": true, "advertisement": true, "adsbygoogle": true,
+	"sponsor": true, "sponsored": true, "promo": true, "promotion": true, "banner": true,
+	"cookie": true, "cookies": true, "consent": true, "share": true, "sharing": true, "social": true,
+	"related": true, "recommend": true, "recommended": true, "comment": true, "comments": true,
+	"sidebar": true, "breadcrumb": true, "breadcrumbs": true, "newsletter": true, "subscribe": true,
+	"popup": true, "modal": true, "menu": true, "nav": true, "navbar": true, "navigation": true,
+	"footer": true, "widget": true, "pagination": true,
+}
+
+// Elements rendered on lines of their own
+var articleBlockTags = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true, atom.Main: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Ul: true, atom.Ol: true, atom.Li: true, atom.Dl: true, atom.Dt: true, atom.Dd: true,
+	atom.Pre: true, atom.Blockquote: true, atom.Table: true, atom.Tr: true, atom.Figure: true,
+	atom.Figcaption: true, atom.Hr: true,
+}
+
+// ExtractArticle extracts the title and the main readable text of an HTML
+// page. Scripts, navigation, ads and similar page chrome are dropped. The
+// content is taken from the <article> or <main> element when the page has
+// one, and otherwise from the element holding the most paragraph text.
+func ExtractArticle(data []byte) (*Article, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoArticleContent, err)
+	}
+
+	root := articleRoot(doc)
+	if root == nil {
+		return nil, ErrNoArticleContent
+	}
+
+	var b strings.Builder
+	renderArticleText(&b, root, false)
+	text := cleanDocumentText(b.String())
+	if text == "" {
+		return nil, ErrNoArticleContent
+	}
+
+	return &Article{Title: articleTitle(doc, root), Text: text}, nil
+}
+
+// articleTitle prefers the og:title of the page, then the first heading of
+// the content and then <title>
+func articleTitle(doc, root *html.Node) string {
+	var ogTitle, title string
+	walkHTML(doc, func(n *html.Node) bool {
+		switch n.DataAtom {
+		case atom.Meta:
+			if ogTitle == "" && (htmlAttr(n, "property") == "og:title" || htmlAttr(n, "name") == "og:title") {
+				ogTitle = collapseSpaces(htmlAttr(n, "content"))
+			}
+		case atom.Title:
+			if title == "" {
+				title = collapseSpaces(nodeText(n))
+			}
+		case atom.Body:
+			return false
+		}
+		return true
+	})
+	if ogTitle != "" {
+		return ogTitle
+	}
+
+	var heading string
+	walkHTML(root, func(n *html.Node) bool {
+		if heading != "" {
+			return false
+		}
+		if n.DataAtom == atom.H1 {
+			heading = collapseSpaces(nodeText(n))
+			return false
+		}
+		return true
+	})
+	if heading != "" {
+		return heading
+	}
+	return title
+}
+
+// articleRoot returns the element holding the content of the page
+func articleRoot(doc *html.Node) *html.Node {
+	var articles, mains []*html.Node
+	var body *html.Node
+	scores := map[*html.Node]int{}
+	walkHTML(doc, func(n *html.Node) bool {
+		if isBoilerplate(n) {
+			return false
+		}
+		switch {
+		case n.DataAtom == atom.Body:
+			body = n
+		case n.DataAtom == atom.Article:
+			articles = append(articles, n)
+		case n.DataAtom == atom.Main || htmlAttr(n, "role") == "main":
+			mains = append(mains, n)
+		case n.DataAtom == atom.P:
+			// 段落の文字数を親要素（と祖父要素に半分）の得点にする
+			length := utf8.RuneCountInString(collapseSpaces(visibleText(n)))
+			if length >= minParagraphRunes && n.Parent != nil {
+				scores[n.Parent] += length
+				if n.Parent.Parent != nil {
+					scores[n.Parent.Parent] += length / 2
+				}
+			}
+		}
+		return true
+	})
+
+	if root := longestNode(articles); root != nil {
+		return root
+	}
+	if root := longestNode(mains); root != nil {
+		return root
+	}
+
+	var best *html.Node
+	for n, score := range scores {
+		if best == nil || score > scores[best] {
+			best = n
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return body
+}
+
+// longestNode returns the node with the most visible text
+func longestNode(nodes []*html.Node) *html.Node {
+	var best *html.Node
+	bestLength := 0
+	for _, n := range nodes {
+		if length := utf8.RuneCountInString(collapseSpaces(visibleText(n))); length > bestLength {
+			best, bestLength = n, length
+		}
+	}
+	return best
+}
+
+// isBoilerplate reports whether an element is page chrome rather than content
+func isBoilerplate(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if articleSkipTags[n.DataAtom] || boilerplateRoles[htmlAttr(n, "role")] {
+		return true
+	}
+	if hasHTMLAttr(n, "hidden") || htmlAttr(n, "aria-hidden") == "true" {
+		return true
+	}
+	if style := strings.ReplaceAll(strings.ToLower(htmlAttr(n, "style")), " ", ""); strings.Contains(style, "display:none") {
+		return true
+	}
+
+	// ページ全体や本文の要素はクラス名が何であっても除外しない
+	switch n.DataAtom {
+	case atom.Html, atom.Body, atom.Main, atom.Article:
+		return false
+	}
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(htmlAttr(n, "class")+" "+htmlAttr(n, "id")), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if boilerplateWords[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// renderArticleText writes the visible text of n, putting block elements
+// on lines of their own
+func renderArticleText(b *strings.Builder, n *html.Node, pre bool) {
+	switch n.Type {
+	case html.TextNode:
+		if pre {
+			b.WriteString(n.Data)
+		} else {
+			b.WriteString(collapseSpacesKeepEnds(n.Data))
+		}
+		return
+	case html.ElementNode:
+		if isBoilerplate(n) {
+			return
+		}
+	}
+
+	block := articleBlockTags[n.DataAtom]
+	if block {
+		b.WriteString("\n")
+	}
+	switch n.DataAtom {
+	case atom.Li:
+		b.WriteString("- ")
+	case atom.Br:
+		b.WriteString("\n")
+	case atom.Td, atom.Th:
+		b.WriteString(" ")
+	case atom.Pre:
+		pre = true
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		renderArticleText(b, c, pre)
+	}
+	if block {
+		b.WriteString("\n")
+	}
+}
+
+// visibleText returns the text of n without page chrome
+func visibleText(n *html.Node) string {
+	var b strings.Builder
+	walkHTML(n, func(c *html.Node) bool {
+		if isBoilerplate(c) {
+			return false
+		}
+		if c.Type == html.TextNode {
+			b.WriteString(c.Data)
+			b.WriteString(" ")
+		}
+		return true
+	})
+	return b.String()
+}
+
+// nodeText returns all text of n
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	walkHTML(n, func(c *html.Node) bool {
+		if c.Type == html.TextNode {
+			b.WriteString(c.Data)
+		}
+		return true
+	})
+	return b.String()
+}
+
+// walkHTML calls visit for n and its descendants in document order. The
+// children of a node are skipped when visit returns false.
+func walkHTML(n *html.Node, visit func(n *html.Node) bool) {
+	if !visit(n) {
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkHTML(c, visit)
+	}
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func hasHTMLAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func collapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// collapseSpacesKeepEnds collapses the white space of an inline text node,
+// keeping a single space at either end so that words of adjacent elements
+// stay apart
+func collapseSpacesKeepEnds(s string) string {
+	collapsed := collapseSpaces(s)
+	if collapsed == "" {
+		if s != "" {
+			return " "
+		}
+		return ""
+	}
+	if r, _ := utf8.DecodeRuneInString(s); unicode.IsSpace(r) {
+		collapsed = " " + collapsed
+	}
+	if r, _ := utf8.DecodeLastRuneInString(s); unicode.IsSpace(r) {
+		collapsed += " "
+	}
+	return collapsed
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractArticle(t *testing.T) {
+	t.Run("ナビゲーション・広告・スクリプトを除いて本文を抽出する", func(t *testing.T) {
+		page := `<!DOCTYPE html><html><head>
+<title>光合成のしくみ | 理科ブログ</title>
+<meta property="og:title" content="光合成のしくみ">
+<script>var tracking = "secret";</script><style>p { color: red; }</style>
+</head><body class="nav-open">
+<header><a href="/">理科ブログ</a></header>
+<nav><ul><li>ホーム</li><li>カテゴリ</li></ul></nav>
+<article class="post has-comments">
+  <h1>光合成のしくみ</h1>
+  <p>植物は光の   エネルギーを使って<b>二酸化炭素</b>と水から糖を作ります。</p>
+  <div class="ad-slot">今だけ半額！</div>
+  <ul><li>明反応</li><li>暗反応</li></ul>
+  <pre>6CO2 + 6H2O
+  → C6H12O6 + 6O2</pre>
+  <div class="share-buttons">シェアする</div>
+</article>
+<aside>人気の記事</aside>
+<footer>© 理科ブログ</footer>
+</body></html>`
+
+		article, err := ExtractArticle([]byte(page))
+		require.NoError(t, err)
+		assert.Equal(t, "光合成のしくみ", article.Title)
+		assert.Equal(t, "光合成のしくみ\n\n植物は光の エネルギーを使って二酸化炭素と水から糖を作ります。\n\n- 明反応\n\n- 暗反応\n\n6CO2 + 6H2O\n→ C6H12O6 + 6O2", article.Text)
+	})
+
+	t.Run("article要素がなければ段落の多い要素を本文とする", func(t *testing.T) {
+		page := `<html><head><title>サイト名 - 記事</title></head><body>
+<div id="menu"><p>メニューの項目がここに並んでいますが本文ではありません。</p></div>
+<div class="content">
+  <h1>細胞の構造</h1>
+  <p>細胞は細胞膜に囲まれ、内部に核やミトコンドリアなどの細胞小器官を持ちます。</p>
+  <p>植物細胞には細胞壁と葉緑体があり、動物細胞との違いになっています。</p>
+</div>
+<div class="sidebar"><p>関連リンクがここに並んでいて本文とは関係のない文章です。</p></div>
+</body></html>`
+
+		article, err := ExtractArticle([]byte(page))
+		require.NoError(t, err)
+		assert.Equal(t, "細胞の構造", article.Title)
+		assert.Contains(t, article.Text, "細胞小器官")
+		assert.Contains(t, article.Text, "細胞壁と葉緑体")
+		assert.NotContains(t, article.Text, "メニュー")
+		assert.NotContains(t, article.Text, "関連リンク")
+	})
+
+	t.Run("本文がない", func(t *testing.T) {
+		_, err := ExtractArticle([]byte(`<html><body><nav>ホーム</nav><script>run()</script></body></html>`))
+		assert.ErrorIs(t, err, ErrNoArticleContent)
+	})
+}
+
+func TestPageFetcher(t *testing.T) {
+	t.Run("ローカルのファイルからページを返す", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "example.com", "articles"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com", "articles", "1"), []byte("article"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com", "index.html"), []byte("top"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0o644))
+
+		fetcher := NewLocalPageFetcher(dir)
+		data, err := fetcher.Fetch(context.Background(), "https://example.com/articles/1?ref=top")
+		require.NoError(t, err)
+		assert.Equal(t, "article", string(data))
+
+		data, err = fetcher.Fetch(context.Background(), "https://example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "top", string(data))
+
+		_, err = fetcher.Fetch(context.Background(), "https://example.com/../secret")
+		assert.ErrorIs(t, err, ErrPageNotFound)
+
+		_, err = fetcher.Fetch(context.Background(), "file:///etc/passwd")
+		assert.ErrorIs(t, err, ErrPageURLNotAllowed)
+	})
+
+	t.Run("内部アドレスには接続しない", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<p>internal</p>"))
+		}))
+		defer server.Close()
+
+		_, err := NewHTTPPageFetcher().Fetch(context.Background(), server.URL)
+		assert.ErrorIs(t, err, ErrPageURLNotAllowed)
+	})
+
+	t.Run("無効にした場合は取得しない", func(t *testing.T) {
+		t.Setenv("PAGE_FETCHER", PageFetcherDisabled)
+		_, err := NewPageFetcherFromEnv().Fetch(context.Background(), "https://example.com")
+		assert.ErrorIs(t, err, ErrPageFetchDisabled)
+	})
+}
@@ -0,0 +1,560 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+// BackupFormatVersion is the version of the archive written by Backup.
+// Restore accepts archives up to this version.
+const BackupFormatVersion = 1
+
+const (
+	MaxBackupSize     = 500 * 1024 * 1024 // 500MB
+	maxBackupDataSize = 512 * 1024 * 1024 // 展開後の data.json の上限
+
+	backupFormatName   = "ai-flashcards-backup"
+	backupManifestFile = "manifest.json"
+	backupDataFile     = "data.json"
+	backupMediaDir     = "media/"
+)
+
+var (
+	ErrInvalidBackup            = errors.New("invalid backup archive")
+	ErrUnsupportedBackupVersion = errors.New("unsupported backup version")
+)
+
+// BackupManifest identifies the archive and the account it was taken from
+type BackupManifest struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+}
+
+// backupData holds everything a user owns. IDs are those of the source
+// database and are only used to link the records to each other.
+type backupData struct {
+	Decks         []models.Deck         `json:"decks"`
+	Tags          []models.Tag          `json:"tags"`
+	NoteTypes     []models.NoteType     `json:"noteTypes"` // 組み込みのノートタイプは userId が null
+	Notes         []models.Note         `json:"notes"`
+	Cards         []models.Card         `json:"cards"`
+	CardRevisions []models.CardRevision `json:"cardRevisions"`
+	AnswerRecords []models.AnswerRecord `json:"answerRecords"`
+	Media         []models.Media        `json:"media"` // 実体は media/<id> に格納
+}
+
+// BackupRestoreReport counts the records created by a restore
+type BackupRestoreReport struct {
+	Decks         int `json:"decks"`
+	Tags          int `json:"tags"`
+	NoteTypes     int `json:"noteTypes"`
+	Notes         int `json:"notes"`
+	Cards         int `json:"cards"`
+	CardRevisions int `json:"cardRevisions"`
+	AnswerRecords int `json:"answerRecords"`
+	Media         int `json:"media"`
+}
+
+// BackupService writes and restores full account archives
+type BackupService struct {
+	db      *gorm.DB
+	storage MediaStorage
+}
+
+func NewBackupService(db *gorm.DB, storage MediaStorage) *BackupService {
+	return &BackupService{db: db, storage: storage}
+}
+
+// backupFile is a JSON file written at the top of an archive
+type backupFile struct {
+	name  string
+	value any
+}
+
+// Backup writes a zip archive of everything the user owns to w
+func (s *BackupService) Backup(ctx context.Context, user *models.User, w io.Writer) error {
+	return s.writeArchive(ctx, user, w)
+}
+
+// writeArchive writes the backup archive with additional JSON files
+func (s *BackupService) writeArchive(ctx context.Context, user *models.User, w io.Writer, extra ...backupFile) error {
+	data, err := s.load(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+
+	manifest := BackupManifest{
+		Format:    backupFormatName,
+		Version:   BackupFormatVersion,
+		CreatedAt: time.Now().UTC(),
+		Email:     user.Email,
+		Name:      user.Name,
+	}
+	files := append([]backupFile{{backupManifestFile, manifest}, {backupDataFile, data}}, extra...)
+	for _, file := range files {
+		entry, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if err := json.NewEncoder(entry).Encode(file.value); err != nil {
+			return err
+		}
+	}
+
+	for _, media := range data.Media {
+		if err := s.writeMedia(ctx, zw, &media); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (s *BackupService) load(ctx context.Context, userID uint) (*backupData, error) {
+	db := s.db.WithContext(ctx)
+	data := &backupData{}
+
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&data.Decks).Error; err != nil {
+		return nil, err
+	}
+	deckIDs := make([]uint, 0, len(data.Decks))
+	for _, deck := range data.Decks {
+		deckIDs = append(deckIDs, deck.ID)
+	}
+
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&data.Tags).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&data.Notes).Error; err != nil {
+		return nil, err
+	}
+	// ユーザーのノートタイプに加え、ノートが参照する組み込みのノートタイプも含める
+	if err := db.Where("user_id = ? OR id IN (?)", userID,
+		db.Model(&models.Note{}).Select("note_type_id").Where("user_id = ?", userID),
+	).Order("id").Find(&data.NoteTypes).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Preload("Tags").Where("deck_id IN ?", deckIDs).Order("id").Find(&data.Cards).Error; err != nil {
+		return nil, err
+	}
+	cardIDs := make([]uint, 0, len(data.Cards))
+	for _, card := range data.Cards {
+		cardIDs = append(cardIDs, card.ID)
+	}
+
+	if err := db.Where("card_id IN ?", cardIDs).Order("id").Find(&data.CardRevisions).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ? AND deck_id IN ?", userID, deckIDs).Order("id").Find(&data.AnswerRecords).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&data.Media).Error; err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *BackupService) writeMedia(ctx context.Context, zw *zip.Writer, media *models.Media) error {
+	content, err := s.storage.Open(ctx, media.StorageKey)
+	if err != nil {
+		return fmt.Errorf("failed to read media %d: %w", media.ID, err)
+	}
+	defer content.Close()
+
+	// メディアは圧縮済みの形式がほとんどのため無圧縮で格納する
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%s%d", backupMediaDir, media.ID), Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, content)
+	return err
+}
+
+// Restore imports an archive written by Backup into the user's account in
+// one transaction. The records get new IDs; existing data is kept and tags
+// with the same name are shared.
+func (s *BackupService) Restore(ctx context.Context, userID uint, r io.ReaderAt, size int64) (*BackupRestoreReport, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	entries := map[string]*zip.File{}
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	var manifest BackupManifest
+	if err := readBackupJSON(entries[backupManifestFile], &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format != backupFormatName {
+		return nil, fmt.Errorf("%w: not a flashcards backup", ErrInvalidBackup)
+	}
+	if manifest.Version < 1 || manifest.Version > BackupFormatVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedBackupVersion, manifest.Version)
+	}
+
+	var data backupData
+	if err := readBackupJSON(entries[backupDataFile], &data); err != nil {
+		return nil, err
+	}
+
+	state := &backupRestoreState{
+		ctx:       ctx,
+		userID:    userID,
+		data:      &data,
+		entries:   entries,
+		storage:   s.storage,
+		report:    &BackupRestoreReport{},
+		decks:     map[uint]uint{},
+		tags:      map[uint]models.Tag{},
+		noteTypes: map[uint]uint{},
+		notes:     map[uint]uint{},
+		cards:     map[uint]uint{},
+	}
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		state.tx = tx
+		return state.run()
+	})
+	if err != nil {
+		// ロールバックされたメディアの実体を削除
+		NewMediaService(s.db, s.storage).RemoveObjects(ctx, state.storedKeys)
+		return nil, err
+	}
+	return state.report, nil
+}
+
+func readBackupJSON(entry *zip.File, value any) error {
+	if entry == nil {
+		return fmt.Errorf("%w: missing file", ErrInvalidBackup)
+	}
+	if entry.UncompressedSize64 > maxBackupDataSize {
+		return fmt.Errorf("%w: %s is too large", ErrInvalidBackup, entry.Name)
+	}
+
+	rc, err := entry.Open()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	defer rc.Close()
+
+	if err := json.NewDecoder(io.LimitReader(rc, maxBackupDataSize)).Decode(value); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidBackup, entry.Name, err)
+	}
+	return nil
+}
+
+// backupRestoreState maps the IDs of the archive to the records created by the restore
+type backupRestoreState struct {
+	ctx        context.Context
+	tx         *gorm.DB
+	userID     uint
+	data       *backupData
+	entries    map[string]*zip.File
+	storage    MediaStorage
+	report     *BackupRestoreReport
+	storedKeys []string
+
+	decks     map[uint]uint
+	tags      map[uint]models.Tag
+	noteTypes map[uint]uint
+	notes     map[uint]uint
+	cards     map[uint]uint
+}
+
+func (st *backupRestoreState) run() error {
+	steps := []func() error{
+		st.restoreDecks,
+		st.restoreTags,
+		st.restoreNoteTypes,
+		st.restoreNotes,
+		st.restoreCards,
+		st.restoreCardRevisions,
+		st.restoreAnswerRecords,
+		st.restoreMedia,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *backupRestoreState) restoreDecks() error {
+	for _, deck := range st.data.Decks {
+		oldID := deck.ID
+		deck.Model = restoredModel(deck.Model)
+		deck.UserID = st.userID
+		deck.ParentID = nil
+		if err := st.tx.Create(&deck).Error; err != nil {
+			return err
+		}
+		st.decks[oldID] = deck.ID
+		st.report.Decks++
+	}
+
+	// 親デッキは全デッキの作成後に付け替える
+	for _, deck := range st.data.Decks {
+		if deck.ParentID == nil {
+			continue
+		}
+		parentID, ok := st.decks[*deck.ParentID]
+		if !ok {
+			continue
+		}
+		if err := st.tx.Model(&models.Deck{}).Where("id = ?", st.decks[deck.ID]).Update("parent_id", parentID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *backupRestoreState) restoreTags() error {
+	for _, tag := range st.data.Tags {
+		tags, created, err := EnsureTags(st.tx, st.userID, []string{tag.Name})
+		if err != nil {
+			return err
+		}
+		st.tags[tag.ID] = tags[0]
+		st.report.Tags += created
+	}
+	return nil
+}
+
+func (st *backupRestoreState) restoreNoteTypes() error {
+	for _, noteType := range st.data.NoteTypes {
+		oldID := noteType.ID
+		if noteType.UserID == nil {
+			if noteType.Name != BasicNoteTypeName {
+				return fmt.Errorf("%w: unknown built-in note type %q", ErrInvalidBackup, noteType.Name)
+			}
+			basic, err := EnsureBasicNoteType(st.tx)
+			if err != nil {
+				return err
+			}
+			st.noteTypes[oldID] = basic.ID
+			continue
+		}
+
+		noteType.Model = restoredModel(noteType.Model)
+		noteType.UserID = &st.userID
+		if err := st.tx.Create(&noteType).Error; err != nil {
+			return err
+		}
+		st.noteTypes[oldID] = noteType.ID
+		st.report.NoteTypes++
+	}
+	return nil
+}
+
+func (st *backupRestoreState) restoreNotes() error {
+	for _, note := range st.data.Notes {
+		oldID := note.ID
+		deckID, ok := st.decks[note.DeckID]
+		if !ok {
+			continue
+		}
+		noteTypeID, ok := st.noteTypes[note.NoteTypeID]
+		if !ok {
+			return fmt.Errorf("%w: note %d refers to a missing note type", ErrInvalidBackup, oldID)
+		}
+
+		note.Model = restoredModel(note.Model)
+		note.UserID = st.userID
+		note.DeckID = deckID
+		note.NoteTypeID = noteTypeID
+		note.Cards = nil
+		if err := st.tx.Create(&note).Error; err != nil {
+			return err
+		}
+		st.notes[oldID] = note.ID
+		st.report.Notes++
+	}
+	return nil
+}
+
+func (st *backupRestoreState) restoreCards() error {
+	for _, card := range st.data.Cards {
+		oldID := card.ID
+		deckID, ok := st.decks[card.DeckID]
+		if !ok {
+			continue
+		}
+
+		card.Model = restoredModel(card.Model)
+		card.DeckID = deckID
+		if card.NoteID != nil {
+			noteID, ok := st.notes[*card.NoteID]
+			if !ok {
+				return fmt.Errorf("%w: card %d refers to a missing note", ErrInvalidBackup, oldID)
+			}
+			card.NoteID = &noteID
+		}
+		card.Media = nil
+
+		tags := card.Tags
+		card.Tags = nil
+		for _, tag := range tags {
+			if restored, ok := st.tags[tag.ID]; ok {
+				card.Tags = append(card.Tags, restored)
+			}
+		}
+
+		if err := st.tx.Create(&card).Error; err != nil {
+			return err
+		}
+		st.cards[oldID] = card.ID
+		st.report.Cards++
+	}
+	return nil
+}
+
+func (st *backupRestoreState) restoreCardRevisions() error {
+	for _, revision := range st.data.CardRevisions {
+		cardID, ok := st.cards[revision.CardID]
+		if !ok {
+			continue
+		}
+
+		revision.Model = restoredModel(revision.Model)
+		revision.CardID = cardID
+		revision.UserID = st.userID
+		if err := st.tx.Create(&revision).Error; err != nil {
+			return err
+		}
+		st.report.CardRevisions++
+	}
+	return nil
+}
+
+func (st *backupRestoreState) restoreAnswerRecords() error {
+	records := make([]models.AnswerRecord, 0, len(st.data.AnswerRecords))
+	for _, record := range st.data.AnswerRecords {
+		deckID, ok := st.decks[record.DeckID]
+		if !ok {
+			continue
+		}
+		// 削除済みのカードはバックアップに含まれないため、その履歴は復元しない
+		cardID, ok := st.cards[record.CardID]
+		if !ok {
+			continue
+		}
+
+		record.Model = restoredModel(record.Model)
+		record.UserID = st.userID
+		record.DeckID = deckID
+		record.CardID = cardID
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := st.tx.CreateInBatches(&records, 500).Error; err != nil {
+		return err
+	}
+	st.report.AnswerRecords = len(records)
+	return nil
+}
+
+func (st *backupRestoreState) restoreMedia() error {
+	for _, media := range st.data.Media {
+		entry := st.entries[fmt.Sprintf("%s%d", backupMediaDir, media.ID)]
+		if entry == nil {
+			return fmt.Errorf("%w: content of media %d is missing", ErrInvalidBackup, media.ID)
+		}
+
+		if media.CardID != nil {
+			cardID, ok := st.cards[*media.CardID]
+			if !ok {
+				continue
+			}
+			media.CardID = &cardID
+		}
+
+		// アップロードと同じ種類のファイルのみ復元する
+		if !IsAllowedMediaType(media.MimeType) {
+			return fmt.Errorf("%w: media %d has unsupported type %q", ErrInvalidBackup, media.ID, media.MimeType)
+		}
+
+		key, err := newMediaKey(st.userID, media.Filename)
+		if err != nil {
+			return err
+		}
+		size, err := st.putMedia(key, entry)
+		if err != nil {
+			return err
+		}
+
+		media.Model = restoredModel(media.Model)
+		media.UserID = st.userID
+		media.StorageKey = key
+		media.Size = size
+		if err := st.tx.Create(&media).Error; err != nil {
+			return err
+		}
+		st.report.Media++
+	}
+	return nil
+}
+
+// putMedia stores the content of a media entry and returns its size
+func (st *backupRestoreState) putMedia(key string, entry *zip.File) (int64, error) {
+	tooLarge := fmt.Errorf("%w: %s is too large", ErrInvalidBackup, entry.Name)
+	if entry.UncompressedSize64 > MaxMediaSize {
+		return 0, tooLarge
+	}
+
+	rc, err := entry.Open()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	defer rc.Close()
+
+	// ヘッダーのサイズは偽装できるため、実際に読み込んだ量でも確認する
+	content := &sizeLimitedReader{r: rc, limit: MaxMediaSize, err: tooLarge}
+	if err := st.storage.Put(st.ctx, key, content); err != nil {
+		if errors.Is(err, ErrInvalidBackup) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("failed to store media: %w", err)
+	}
+	st.storedKeys = append(st.storedKeys, key)
+	return content.n, nil
+}
+
+// sizeLimitedReader counts the bytes read and fails with err once more than
+// limit bytes have been read, so an oversized file is never stored whole
+type sizeLimitedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+	err   error
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, l.err
+	}
+	return n, err
+}
+
+// restoredModel drops the ID of an archived record and keeps its timestamps
+func restoredModel(m models.Model) models.Model {
+	return models.Model{CreatedAt: m.CreatedAt, UpdatedAt: m.UpdatedAt}
+}
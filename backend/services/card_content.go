@@ -0,0 +1,300 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// Content formats
+const (
+	ContentFormatPlain    = "plain"
+	ContentFormatMarkdown = "markdown"
+)
+
+// MaxCardContentLength is the maximum number of characters in a card field
+const MaxCardContentLength = 10000
+
+var (
+	ErrInvalidContentFormat = errors.New("invalid content format")
+	ErrUnsafeContent        = errors.New("content contains unsafe markup")
+)
+
+var (
+	markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+	htmlPolicy = func() *bluemonday.Policy {
+		policy := bluemonday.UGCPolicy()
+		policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w-]+$`)).OnElements("code")
+		return policy
+	}()
+
+	safeImageData = regexp.MustCompile(`^data:image/(png|jpeg|gif|webp);`)
+)
+
+// ValidContentFormat reports whether format is a supported content format
+func ValidContentFormat(format string) bool {
+	return format == ContentFormatPlain || format == ContentFormatMarkdown
+}
+
+// SanitizeCard validates the content format of a card and sanitizes its fields in place
+func SanitizeCard(card *models.Card) error {
+	if card.ContentFormat == "" {
+		card.ContentFormat = ContentFormatPlain
+	}
+	if !ValidContentFormat(card.ContentFormat) {
+		return ErrInvalidContentFormat
+	}
+
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"front", &card.Front},
+		{"back", &card.Back},
+		{"hint", &card.Hint},
+	} {
+		sanitized, err := SanitizeContent(card.ContentFormat, *field.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field.name, err)
+		}
+		if card.Markup {
+			if err := ValidateMarkup(card.ContentFormat, sanitized); err != nil {
+				return fmt.Errorf("%s: %w", field.name, err)
+			}
+		}
+		*field.value = sanitized
+	}
+	return nil
+}
+
+// SanitizeContent validates text of the given format and returns it with
+// raw HTML and links with dangerous schemes removed.
+func SanitizeContent(format, content string) (string, error) {
+	if !utf8.ValidString(content) {
+		return "", fmt.Errorf("content is not valid UTF-8")
+	}
+	if utf8.RuneCountInString(content) > MaxCardContentLength {
+		return "", fmt.Errorf("content is too long (max %d characters)", MaxCardContentLength)
+	}
+
+	switch format {
+	case ContentFormatPlain:
+		return content, nil
+	case ContentFormatMarkdown:
+		return sanitizeMarkdown(content)
+	default:
+		return "", ErrInvalidContentFormat
+	}
+}
+
+// RenderContentHTML renders text of the given format to safe HTML
+func RenderContentHTML(format, content string) (string, error) {
+	switch format {
+	case ContentFormatPlain, "":
+		return strings.ReplaceAll(html.EscapeString(content), "\n", "<br>"), nil
+	case ContentFormatMarkdown:
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(content), &buf); err != nil {
+			return "", err
+		}
+		return htmlPolicy.Sanitize(buf.String()), nil
+	default:
+		return "", ErrInvalidContentFormat
+	}
+}
+
+// RenderCard fills the pre-rendered HTML of a card.
+// Cards with markup enabled also get their furigana as structured data.
+func RenderCard(card *models.Card) error {
+	rendered := &models.RenderedContent{}
+	furigana := &models.RenderedFurigana{}
+	for _, field := range []struct {
+		source   string
+		target   *string
+		furigana *[]models.Furigana
+	}{
+		{card.Front, &rendered.Front, &furigana.Front},
+		{card.Back, &rendered.Back, &furigana.Back},
+		{card.Hint, &rendered.Hint, &furigana.Hint},
+	} {
+		if !card.Markup {
+			out, err := RenderContentHTML(card.ContentFormat, field.source)
+			if err != nil {
+				return err
+			}
+			*field.target = out
+			continue
+		}
+
+		out, ruby, err := RenderMarkupHTML(card.ContentFormat, field.source)
+		if err != nil {
+			return err
+		}
+		*field.target = out
+		*field.furigana = ruby
+	}
+	if card.Markup {
+		rendered.Furigana = furigana
+	}
+	card.Rendered = rendered
+	return nil
+}
+
+// sanitizeMarkdown removes raw HTML and dangerous links from markdown source.
+// Removing markup can form new markup (e.g. "<scr<b></b>ipt>"), so the source
+// is re-parsed until it is stable.
+func sanitizeMarkdown(content string) (string, error) {
+	source := []byte(content)
+	for range 5 {
+		cleaned, changed, ok := sanitizeMarkdownPass(source)
+		if !ok {
+			return "", ErrUnsafeContent
+		}
+		if !changed {
+			return string(cleaned), nil
+		}
+		source = cleaned
+	}
+	return "", ErrUnsafeContent
+}
+
+// byteRange is a range of the source to remove, or to replace with replacement
+type byteRange struct {
+	start, stop int
+	replacement []byte
+}
+
+// sanitizeMarkdownPass removes raw HTML and replaces unsafe link destinations
+// with "#". ok is false when an unsafe destination cannot be located in the
+// source, in which case the content is rejected rather than guessed at.
+func sanitizeMarkdownPass(source []byte) (cleaned []byte, changed bool, ok bool) {
+	doc := markdown.Parser().Parse(text.NewReader(source))
+
+	var removals []byteRange
+	located := true
+	// 参照リンクの定義は複数のリンクで共有されるため、同じ範囲は一度だけ置き換える
+	replaced := map[int]bool{}
+	replaceDestination := func(destination []byte) {
+		r, found := sourceRange(source, destination)
+		if !found {
+			located = false
+			return
+		}
+		if !replaced[r.start] {
+			replaced[r.start] = true
+			r.replacement = []byte("#")
+			removals = append(removals, r)
+		}
+	}
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *ast.RawHTML:
+			for i := 0; i < n.Segments.Len(); i++ {
+				segment := n.Segments.At(i)
+				removals = append(removals, byteRange{start: segment.Start, stop: segment.Stop})
+			}
+		case *ast.HTMLBlock:
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				segment := lines.At(i)
+				removals = append(removals, byteRange{start: segment.Start, stop: segment.Stop})
+			}
+			if n.HasClosure() {
+				removals = append(removals, byteRange{start: n.ClosureLine.Start, stop: n.ClosureLine.Stop})
+			}
+		case *ast.Link:
+			if !isSafeURL(n.Destination, false) {
+				replaceDestination(n.Destination)
+			}
+		case *ast.Image:
+			if !isSafeURL(n.Destination, true) {
+				replaceDestination(n.Destination)
+			}
+		case *ast.AutoLink:
+			if !isSafeURL(n.URL(source), false) {
+				replaceDestination(n.Label(source))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	if !located {
+		return nil, false, false
+	}
+	if len(removals) == 0 {
+		return source, false, true
+	}
+	return replaceRanges(source, removals), true, true
+}
+
+// sourceRange returns the range of value in source. The parser returns link
+// destinations as slices of the source, so their position is found from the
+// shared backing array; values copied by the parser are not found.
+func sourceRange(source, value []byte) (byteRange, bool) {
+	start := cap(source) - cap(value)
+	if len(value) == 0 || start < 0 || start+len(value) > len(source) || &source[start] != &value[0] {
+		return byteRange{}, false
+	}
+	return byteRange{start: start, stop: start + len(value)}, true
+}
+
+// replaceRanges removes the ranges from source or replaces them with their
+// replacement. Overlapping parts of later ranges are dropped.
+func replaceRanges(source []byte, ranges []byteRange) []byte {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	var out []byte
+	last := 0
+	for _, r := range ranges {
+		if r.start < last {
+			r.start = last
+		}
+		if r.stop <= r.start {
+			continue
+		}
+		out = append(out, source[last:r.start]...)
+		out = append(out, r.replacement...)
+		last = r.stop
+	}
+	return append(out, source[last:]...)
+}
+
+// isSafeURL allows relative URLs and http(s), mailto and tel links.
+// Inline image data is allowed for images only.
+func isSafeURL(destination []byte, image bool) bool {
+	normalized := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.ToLower(html.UnescapeString(string(destination))))
+
+	colon := strings.IndexByte(normalized, ':')
+	if colon < 0 || strings.ContainsAny(normalized[:colon], "/?#") {
+		return true
+	}
+
+	scheme := normalized[:colon]
+	if slices.Contains([]string{"http", "https", "mailto", "tel"}, scheme) {
+		return true
+	}
+	return image && safeImageData.MatchString(normalized)
+}
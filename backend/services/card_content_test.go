@@ -0,0 +1,62 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"通常のマークダウン", "**bold** and `code`\n\n- item", "**bold** and `code`\n\n- item"},
+		{"インラインスクリプト", "hello <script>alert(1)</script> world", "hello alert(1) world"},
+		{"スクリプトブロック", "<script>\nalert(1)\n</script>\n\ntext", "\ntext"},
+		{"javascriptリンク", "[click](javascript:alert(1))", "[click](#)"},
+		{"自動リンク", "<javascript:alert(1)>", "<#>"},
+		{"コード内のタグは残す", "`<script>`", "`<script>`"},
+		{"分割されたタグ", "x <scr<b></b>ipt>alert(1)", "x alert(1)"},
+		{"安全なリンク", "[Go](https://go.dev)", "[Go](https://go.dev)"},
+		{"同じ文字列の本文は書き換えない", "javascript:alert(1) の例 [x](javascript:alert(1))", "javascript:alert(1) の例 [x](#)"},
+		{"参照リンクは定義を書き換える", "[a][r] と [b][r]\n\n[r]: javascript:alert(1)", "[a][r] と [b][r]\n\n[r]: #"},
+		{"画像", "![x](javascript:alert(1) \"javascript:alert(1)\")", "![x](# \"javascript:alert(1)\")"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sanitized, err := SanitizeContent(ContentFormatMarkdown, tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, sanitized)
+		})
+	}
+}
+
+func TestRenderContentHTML(t *testing.T) {
+	t.Run("プレーンテキストはエスケープされる", func(t *testing.T) {
+		out, err := RenderContentHTML(ContentFormatPlain, "<b>a</b>\nb")
+		assert.NoError(t, err)
+		assert.Equal(t, "&lt;b&gt;a&lt;/b&gt;<br>b", out)
+	})
+
+	t.Run("マークダウンは安全なHTMLになる", func(t *testing.T) {
+		out, err := RenderContentHTML(ContentFormatMarkdown, "**bold** [x](javascript:alert(1)) <img src=x onerror=alert(1)>\n\n```go\nfmt.Println()\n```")
+		assert.NoError(t, err)
+		assert.Contains(t, out, "<strong>bold</strong>")
+		assert.Contains(t, out, `<code class="language-go">`)
+		assert.NotContains(t, out, "javascript:")
+		assert.NotContains(t, out, "onerror")
+	})
+}
+
+func TestSanitizeCard(t *testing.T) {
+	card := &models.Card{Front: "front", Back: "back"}
+	assert.NoError(t, SanitizeCard(card))
+	assert.Equal(t, ContentFormatPlain, card.ContentFormat)
+
+	card.ContentFormat = "html"
+	assert.ErrorIs(t, SanitizeCard(card), ErrInvalidContentFormat)
+}
@@ -0,0 +1,319 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+)
+
+// ErrInvalidMarkup is returned for malformed math or furigana markup
+var ErrInvalidMarkup = errors.New("invalid markup")
+
+// LaTeX commands that can load external resources or redefine macros
+var forbiddenTeXCommand = regexp.MustCompile(`\\(href|url|includegraphics|html[A-Za-z]*|def|gdef|edef|xdef|newcommand|renewcommand|providecommand)\b`)
+
+// Placeholders for rendered math/ruby while the surrounding text is rendered
+const (
+	markupTokenStart = '\uE000'
+	markupTokenEnd   = '\uE001'
+)
+
+type markupSegment struct {
+	text    string // 通常のテキスト（マークダウンのエスケープはそのまま）
+	math    string
+	display bool
+	ruby    *models.Furigana
+}
+
+// ValidateMarkup checks the $...$ / $$...$$ math and 漢字[かんじ] furigana
+// markup of a card field.
+func ValidateMarkup(format, content string) error {
+	_, err := parseMarkup(format, content)
+	return err
+}
+
+// RenderMarkupHTML renders content with math and furigana markup to safe HTML.
+// Math is emitted as <span class="math math-inline|math-display"> holding the
+// escaped TeX source for client-side typesetting, furigana as <ruby>.
+// The furigana are also returned in order of appearance.
+func RenderMarkupHTML(format, content string) (string, []models.Furigana, error) {
+	return renderMarkup(format, content, func(tex string, display bool) string {
+		class := "math math-inline"
+		if display {
+			class = "math math-display"
+		}
+		return fmt.Sprintf(`<span class="%s">%s</span>`, class, html.EscapeString(tex))
+	})
+}
+
+// renderMarkup renders content to safe HTML with the given HTML for math
+func renderMarkup(format, content string, mathHTML func(tex string, display bool) string) (string, []models.Furigana, error) {
+	segments, err := parseMarkup(format, content)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var source strings.Builder
+	var replacements []string
+	var furigana []models.Furigana
+	for _, segment := range segments {
+		switch {
+		case segment.ruby != nil:
+			furigana = append(furigana, *segment.ruby)
+			writeMarkupToken(&source, len(replacements))
+			replacements = append(replacements, fmt.Sprintf(
+				"<ruby>%s<rp>(</rp><rt>%s</rt><rp>)</rp></ruby>",
+				html.EscapeString(segment.ruby.Base), html.EscapeString(segment.ruby.Reading),
+			))
+		case segment.math != "":
+			writeMarkupToken(&source, len(replacements))
+			replacements = append(replacements, mathHTML(segment.math, segment.display))
+		case format == ContentFormatMarkdown:
+			source.WriteString(segment.text)
+		default:
+			source.WriteString(unescapeMarkupText(segment.text))
+		}
+	}
+
+	rendered, err := RenderContentHTML(format, source.String())
+	if err != nil {
+		return "", nil, err
+	}
+
+	// プレースホルダーは描画・サニタイズ後に置き換える
+	for i, replacement := range replacements {
+		rendered = strings.Replace(rendered, markupToken(i), replacement, 1)
+	}
+	return rendered, furigana, nil
+}
+
+func markupToken(i int) string {
+	return string(markupTokenStart) + strconv.Itoa(i) + string(markupTokenEnd)
+}
+
+func writeMarkupToken(b *strings.Builder, i int) {
+	b.WriteString(markupToken(i))
+}
+
+// unescapeMarkupText removes the backslash of \$ and \[ in plain text
+func unescapeMarkupText(text string) string {
+	return strings.NewReplacer(`\$`, "$", `\[`, "[").Replace(text)
+}
+
+// parseMarkup splits content into text, math and furigana segments.
+// In markdown, code spans and fenced code blocks are left as text.
+func parseMarkup(format, content string) ([]markupSegment, error) {
+	var segments []markupSegment
+	var text strings.Builder
+
+	flush := func() {
+		if text.Len() > 0 {
+			segments = append(segments, markupSegment{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	markdown := format == ContentFormatMarkdown
+	inFence := false
+	lineStart := true
+
+	for i := 0; i < len(content); {
+		if markdown && lineStart {
+			line := content[i:]
+			if end := strings.IndexByte(line, '\n'); end >= 0 {
+				line = line[:end+1]
+			}
+			trimmed := strings.TrimLeft(line, " ")
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				inFence = !inFence
+				text.WriteString(line)
+				i += len(line)
+				continue
+			}
+			if inFence {
+				text.WriteString(line)
+				i += len(line)
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(content[i:])
+		lineStart = r == '\n'
+
+		switch {
+		case r == markupTokenStart || r == markupTokenEnd:
+			i += size // プレースホルダーと衝突する文字は取り除く
+
+		case r == '\\':
+			// エスケープされた文字はそのままテキストとして扱う
+			_, next := utf8.DecodeRuneInString(content[i+size:])
+			text.WriteString(content[i : i+size+next])
+			i += size + next
+
+		case r == '`' && markdown:
+			run := len(content[i:]) - len(strings.TrimLeft(content[i:], "`"))
+			fence := content[i : i+run]
+			end := strings.Index(content[i+run:], fence)
+			if end < 0 {
+				text.WriteString(fence)
+				i += run
+				continue
+			}
+			text.WriteString(content[i : i+run+end+run])
+			i += run + end + run
+
+		case r == '$':
+			display := strings.HasPrefix(content[i:], "$$")
+			delimiter := "$"
+			if display {
+				delimiter = "$$"
+			}
+			start := i + len(delimiter)
+			end := findMathEnd(content[start:], delimiter, display)
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unclosed %s", ErrInvalidMarkup, delimiter)
+			}
+			tex := content[start : start+end]
+			if err := validateTeX(tex); err != nil {
+				return nil, err
+			}
+			flush()
+			segments = append(segments, markupSegment{math: strings.TrimSpace(tex), display: display})
+			i = start + end + len(delimiter)
+
+		case r == '[':
+			base, cut := furiganaBase(text.String())
+			if base == "" {
+				text.WriteRune(r)
+				i += size
+				continue
+			}
+
+			end := strings.IndexAny(content[i+1:], "]\n")
+			if end < 0 || content[i+1+end] == '\n' {
+				return nil, fmt.Errorf("%w: unclosed furigana after %q", ErrInvalidMarkup, base)
+			}
+			closing := i + 1 + end
+			if markdown && strings.HasPrefix(content[closing+1:], "(") {
+				// [text](url) はマークダウンのリンク
+				text.WriteRune(r)
+				i += size
+				continue
+			}
+
+			reading := strings.TrimSpace(content[i+1 : closing])
+			if err := validateReading(base, reading); err != nil {
+				return nil, err
+			}
+
+			prefix := text.String()[:cut]
+			text.Reset()
+			text.WriteString(prefix)
+			flush()
+			segments = append(segments, markupSegment{ruby: &models.Furigana{Base: base, Reading: reading}})
+			i = closing + 1
+
+		default:
+			text.WriteString(content[i : i+size])
+			i += size
+		}
+	}
+
+	flush()
+	return segments, nil
+}
+
+// findMathEnd returns the offset of the closing delimiter, skipping escaped
+// characters. Inline math must close on the same line.
+func findMathEnd(s, delimiter string, display bool) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '\n' && !display:
+			return -1
+		case strings.HasPrefix(s[i:], delimiter):
+			return i
+		}
+	}
+	return -1
+}
+
+// validateTeX checks that TeX source is non-empty, has balanced braces and
+// uses no forbidden commands
+func validateTeX(tex string) error {
+	if strings.TrimSpace(tex) == "" {
+		return fmt.Errorf("%w: empty math", ErrInvalidMarkup)
+	}
+	if match := forbiddenTeXCommand.FindString(tex); match != "" {
+		return fmt.Errorf("%w: %s is not allowed in math", ErrInvalidMarkup, match)
+	}
+
+	depth := 0
+	for i := 0; i < len(tex); i++ {
+		switch tex[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("%w: unbalanced braces in math %q", ErrInvalidMarkup, tex)
+			}
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("%w: unbalanced braces in math %q", ErrInvalidMarkup, tex)
+	}
+	return nil
+}
+
+// furiganaBase returns the text that a following [reading] annotates and the
+// offset where it starts: the text after a full-width "｜" marker, or
+// otherwise the trailing run of kanji.
+func furiganaBase(text string) (string, int) {
+	line := text[strings.LastIndexByte(text, '\n')+1:]
+	lineOffset := len(text) - len(line)
+
+	if marker := strings.LastIndex(line, "｜"); marker >= 0 {
+		base := line[marker+len("｜"):]
+		if base != "" && !strings.ContainsAny(base, "[]") {
+			return base, lineOffset + marker
+		}
+	}
+
+	cut := len(line)
+	for cut > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:cut])
+		if !isKanji(r) {
+			break
+		}
+		cut -= size
+	}
+	return line[cut:], lineOffset + cut
+}
+
+func isKanji(r rune) bool {
+	return unicode.Is(unicode.Han, r) || r == '々' || r == '〆' || r == 'ヶ'
+}
+
+// validateReading checks that a furigana reading is non-empty kana
+func validateReading(base, reading string) error {
+	if reading == "" {
+		return fmt.Errorf("%w: empty furigana for %q", ErrInvalidMarkup, base)
+	}
+	for _, r := range reading {
+		if !unicode.In(r, unicode.Hiragana, unicode.Katakana) && r != 'ー' && r != '・' && r != ' ' {
+			return fmt.Errorf("%w: furigana for %q must be kana, got %q", ErrInvalidMarkup, base, reading)
+		}
+	}
+	return nil
+}
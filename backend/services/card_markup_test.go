@@ -0,0 +1,72 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMarkup(t *testing.T) {
+	valid := []string{
+		"$x^2 + y^2 = z^2$",
+		"$$\\frac{a}{b}$$",
+		"漢字[かんじ]を読む",
+		"｜お茶[おちゃ]",
+		"価格は \\$5 です",
+		"配列 a[0]",
+		"`$HOME` はコード",
+	}
+	for _, content := range valid {
+		t.Run(content, func(t *testing.T) {
+			assert.NoError(t, ValidateMarkup(ContentFormatMarkdown, content))
+		})
+	}
+
+	invalid := map[string]string{
+		"閉じていない数式":     "$x + 1",
+		"空の数式":         "$$ $$",
+		"括弧の対応が取れない":   "$\\frac{a}{b$",
+		"禁止されたコマンド":    "$\\href{javascript:alert(1)}{x}$",
+		"閉じていないふりがな":   "漢字[かんじ",
+		"空のふりがな":       "漢字[]",
+		"かな以外のふりがな":    "漢字[kanji]",
+		"改行を含むインライン数式": "$a\nb$",
+	}
+	for name, content := range invalid {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateMarkup(ContentFormatPlain, content)
+			assert.True(t, errors.Is(err, ErrInvalidMarkup), "got %v", err)
+		})
+	}
+}
+
+func TestRenderMarkupHTML(t *testing.T) {
+	t.Run("マークダウンと数式・ふりがな", func(t *testing.T) {
+		out, furigana, err := RenderMarkupHTML(ContentFormatMarkdown, "**東京[とうきょう]** で $a_1 * b_2$")
+		assert.NoError(t, err)
+		assert.Equal(t, "<p><strong><ruby>東京<rp>(</rp><rt>とうきょう</rt><rp>)</rp></ruby></strong> で <span class=\"math math-inline\">a_1 * b_2</span></p>\n", out)
+		assert.Equal(t, []models.Furigana{{Base: "東京", Reading: "とうきょう"}}, furigana)
+	})
+
+	t.Run("プレーンテキストはエスケープされる", func(t *testing.T) {
+		out, _, err := RenderMarkupHTML(ContentFormatPlain, "<b>\\$1</b>\n$$x<y$$")
+		assert.NoError(t, err)
+		assert.Equal(t, "&lt;b&gt;$1&lt;/b&gt;<br><span class=\"math math-display\">x&lt;y</span>", out)
+	})
+
+	t.Run("かな混じりの語は｜で開始位置を指定", func(t *testing.T) {
+		_, furigana, err := RenderMarkupHTML(ContentFormatPlain, "温かい｜お茶[おちゃ]")
+		assert.NoError(t, err)
+		assert.Equal(t, []models.Furigana{{Base: "お茶", Reading: "おちゃ"}}, furigana)
+	})
+}
+
+func TestSanitizeCardMarkup(t *testing.T) {
+	card := &models.Card{Front: "$x", Back: "ok"}
+	assert.NoError(t, SanitizeCard(card), "markup が無効なら検証しない")
+
+	card.Markup = true
+	assert.True(t, errors.Is(SanitizeCard(card), ErrInvalidMarkup))
+}
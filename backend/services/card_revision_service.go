@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+// Revision sources
+const (
+	RevisionSourceManual = "manual"
+	RevisionSourceAI     = "ai"
+	RevisionSourceRevert = "revert"
+	RevisionSourceNote   = "note" // ノートやノートタイプの変更による再生成
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+type CardRevisionService struct {
+	db *gorm.DB
+}
+
+func NewCardRevisionService(db *gorm.DB) *CardRevisionService {
+	return &CardRevisionService{db: db}
+}
+
+// ContentChanged reports whether Front/Back/Hint differ between two versions of a card
+func ContentChanged(before, after *models.Card) bool {
+	return before.Front != after.Front || before.Back != after.Back || before.Hint != after.Hint
+}
+
+// RecordChange stores the new content of a card as a revision.
+// The first time a card changes, its previous content is stored as a baseline
+// revision so that the original version can always be restored.
+// It must be called with the transaction that saved the card.
+func (s *CardRevisionService) RecordChange(tx *gorm.DB, before, after *models.Card, userID uint, source string) error {
+	if !ContentChanged(before, after) {
+		return nil
+	}
+
+	var count int64
+	if err := tx.Model(&models.CardRevision{}).Where("card_id = ?", after.ID).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count == 0 {
+		baseline := &models.CardRevision{
+			CardID: before.ID,
+			UserID: userID,
+			Front:  before.Front,
+			Back:   before.Back,
+			Hint:   before.Hint,
+			Source: baselineSource(before.GenerationType),
+		}
+		baseline.CreatedAt = before.UpdatedAt
+		if err := tx.Create(baseline).Error; err != nil {
+			return err
+		}
+	}
+
+	revision := &models.CardRevision{
+		CardID: after.ID,
+		UserID: userID,
+		Front:  after.Front,
+		Back:   after.Back,
+		Hint:   after.Hint,
+		Source: source,
+	}
+	return tx.Create(revision).Error
+}
+
+// ListRevisions returns the revisions of a card, newest first
+func (s *CardRevisionService) ListRevisions(cardID uint) ([]models.CardRevision, error) {
+	var revisions []models.CardRevision
+	if err := s.db.Where("card_id = ?", cardID).Order("id DESC").Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// Revert restores the content of a card to the given revision.
+// The revert itself is recorded as a new revision.
+func (s *CardRevisionService) Revert(card *models.Card, revisionID uint, userID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var revision models.CardRevision
+		if err := tx.Where("id = ? AND card_id = ?", revisionID, card.ID).First(&revision).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRevisionNotFound
+			}
+			return err
+		}
+
+		before := *card
+		card.Front = revision.Front
+		card.Back = revision.Back
+		card.Hint = revision.Hint
+		card.Version = before.Version + 1
+
+		if err := SaveVersioned(tx, card, before.Version); err != nil {
+			return err
+		}
+		if err := SyncNoteFromCard(tx, card); err != nil {
+			return err
+		}
+
+		return s.RecordChange(tx, &before, card, userID, RevisionSourceRevert)
+	})
+}
+
+// baselineSource maps a card's generation type to a revision source
+func baselineSource(generationType string) string {
+	if generationType == "" || generationType == "manual" {
+		return RevisionSourceManual
+	}
+	return RevisionSourceAI
+}
@@ -0,0 +1,505 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"gorm.io/gorm"
+)
+
+const (
+	MaxCSVImportSize = 10 * 1024 * 1024 // 10MB
+	MaxCSVImportRows = 5000
+)
+
+// Supported CSV encodings
+const (
+	CSVEncodingUTF8     = "utf-8"
+	CSVEncodingUTF16    = "utf-16"
+	CSVEncodingShiftJIS = "shift_jis"
+	CSVEncodingEUCJP    = "euc-jp"
+)
+
+var (
+	ErrInvalidCSV         = errors.New("invalid CSV")
+	ErrCSVInvalidRows     = errors.New("CSV has invalid rows")
+	ErrUnsupportedCharset = errors.New("unsupported text encoding")
+)
+
+// csvDelimiters are the delimiters tried by auto-detection, in order of preference
+var csvDelimiters = []rune{'\t', ',', ';', '|'}
+
+// ヘッダー名から列を自動で割り当てる際の候補（大文字小文字は区別しない）
+var csvHeaderNames = map[string][]string{
+	"front": {"front", "question", "term", "word", "表", "問題", "単語"},
+	"back":  {"back", "answer", "definition", "meaning", "裏", "答え", "意味"},
+	"hint":  {"hint", "ヒント"},
+	"tags":  {"tags", "tag", "タグ"},
+}
+
+// CSVColumnMapping assigns columns to card fields. A column is either a header
+// name or a 0-based column index; empty means the field is not imported.
+type CSVColumnMapping struct {
+	Front string `json:"front"`
+	Back  string `json:"back"`
+	Hint  string `json:"hint"`
+	Tags  string `json:"tags"`
+}
+
+type CSVImportOptions struct {
+	Delimiter     string // 空の場合は自動検出
+	Encoding      string // 空の場合は自動検出
+	HasHeader     bool
+	Mapping       CSVColumnMapping // 空の場合はヘッダー名、なければ 1 列目を表・2 列目を裏とする
+	ContentFormat string
+
+	// 既存のカードとの重複チェック（空の場合はチェックしない）
+	DuplicateCheck string // DuplicateCheckSkip, DuplicateCheckFlag
+	DuplicateScope string // DuplicateScopeDeck（デフォルト）, DuplicateScopeAll
+}
+
+// CSVRow is a parsed row with its validation errors
+type CSVRow struct {
+	Line   int      `json:"line"` // ファイル上の行番号（1 始まり）
+	Front  string   `json:"front"`
+	Back   string   `json:"back"`
+	Hint   string   `json:"hint,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+
+	Duplicates []DuplicateMatch `json:"duplicates,omitempty"` // 表が重複する既存のカードや前の行
+}
+
+// CSVPreview is the result of parsing a CSV file without importing it
+type CSVPreview struct {
+	Encoding  string           `json:"encoding"`
+	Delimiter string           `json:"delimiter"`
+	Header    []string         `json:"header,omitempty"`
+	Mapping   CSVColumnMapping `json:"mapping"`
+	TotalRows int              `json:"totalRows"`
+	ValidRows int              `json:"validRows"`
+	Rows      []CSVRow         `json:"rows"`
+
+	DuplicateRows int `json:"duplicateRows,omitempty"`
+}
+
+// CSVImportResult summarizes a committed CSV import
+type CSVImportResult struct {
+	Deck       *models.Deck       `json:"deck"`
+	Imported   int                `json:"imported"`
+	Skipped    []CSVRow           `json:"skipped"`
+	Duplicates []FlaggedDuplicate `json:"duplicates,omitempty"`
+}
+
+// ParseCSV decodes and parses a CSV/TSV file and validates every row
+func ParseCSV(data []byte, opts CSVImportOptions) (*CSVPreview, error) {
+	if opts.ContentFormat == "" {
+		opts.ContentFormat = ContentFormatPlain
+	}
+	if !ValidContentFormat(opts.ContentFormat) {
+		return nil, ErrInvalidContentFormat
+	}
+
+	text, charset, err := decodeCSVText(data, opts.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	var delimiter rune
+	switch {
+	case opts.Delimiter == "":
+		delimiter = detectCSVDelimiter(text)
+	case opts.Delimiter == `\t` || opts.Delimiter == "tab":
+		delimiter = '\t'
+	case utf8.RuneCountInString(opts.Delimiter) == 1:
+		delimiter, _ = utf8.DecodeRuneInString(opts.Delimiter)
+	default:
+		return nil, fmt.Errorf("%w: delimiter must be a single character", ErrInvalidCSV)
+	}
+
+	records, lines, err := readCSVRecords(text, delimiter)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &CSVPreview{Encoding: charset, Delimiter: string(delimiter), Rows: []CSVRow{}}
+	if opts.HasHeader && len(records) > 0 {
+		preview.Header = records[0]
+		records, lines = records[1:], lines[1:]
+	}
+	if len(records) > MaxCSVImportRows {
+		return nil, fmt.Errorf("%w: too many rows (max %d)", ErrInvalidCSV, MaxCSVImportRows)
+	}
+
+	mapping := opts.Mapping
+	if mapping == (CSVColumnMapping{}) {
+		mapping = defaultCSVMapping(preview.Header)
+	}
+	preview.Mapping = mapping
+
+	columns := map[string]int{}
+	for field, column := range map[string]string{
+		"front": mapping.Front, "back": mapping.Back, "hint": mapping.Hint, "tags": mapping.Tags,
+	} {
+		index, err := csvColumnIndex(column, preview.Header)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidCSV, field, err)
+		}
+		columns[field] = index
+	}
+	if columns["front"] < 0 || columns["back"] < 0 {
+		return nil, fmt.Errorf("%w: front and back columns are required", ErrInvalidCSV)
+	}
+
+	for i, record := range records {
+		if isBlankCSVRecord(record) {
+			continue
+		}
+		row := CSVRow{
+			Line:  lines[i],
+			Front: strings.TrimSpace(csvValue(record, columns["front"])),
+			Back:  strings.TrimSpace(csvValue(record, columns["back"])),
+			Hint:  strings.TrimSpace(csvValue(record, columns["hint"])),
+			Tags:  SplitTags(csvValue(record, columns["tags"])),
+		}
+		row.Errors = validateCSVRow(&row, opts.ContentFormat)
+
+		preview.TotalRows++
+		if len(row.Errors) == 0 {
+			preview.ValidRows++
+		}
+		preview.Rows = append(preview.Rows, row)
+	}
+	return preview, nil
+}
+
+// decodeCSVText converts the file to UTF-8. Without an explicit encoding,
+// a BOM or valid UTF-8 is taken as Unicode and otherwise Shift_JIS and
+// EUC-JP are tried in that order.
+func decodeCSVText(data []byte, charset string) (string, string, error) {
+	switch strings.ToLower(charset) {
+	case "":
+	case CSVEncodingUTF8, "utf8":
+		return string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))), CSVEncodingUTF8, nil
+	case CSVEncodingUTF16, "utf16":
+		text, err := decodeWith(unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), data)
+		return text, CSVEncodingUTF16, err
+	case CSVEncodingShiftJIS, "sjis", "cp932", "windows-31j":
+		text, err := decodeWith(japanese.ShiftJIS, data)
+		return text, CSVEncodingShiftJIS, err
+	case CSVEncodingEUCJP, "eucjp":
+		text, err := decodeWith(japanese.EUCJP, data)
+		return text, CSVEncodingEUCJP, err
+	default:
+		return "", "", fmt.Errorf("%w: %s", ErrUnsupportedCharset, charset)
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("\xef\xbb\xbf")):
+		return string(data[3:]), CSVEncodingUTF8, nil
+	case bytes.HasPrefix(data, []byte("\xff\xfe")) || bytes.HasPrefix(data, []byte("\xfe\xff")):
+		text, err := decodeWith(unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), data)
+		return text, CSVEncodingUTF16, err
+	case utf8.Valid(data):
+		return string(data), CSVEncodingUTF8, nil
+	}
+
+	for _, candidate := range []struct {
+		name     string
+		encoding encoding.Encoding
+	}{
+		{CSVEncodingShiftJIS, japanese.ShiftJIS},
+		{CSVEncodingEUCJP, japanese.EUCJP},
+	} {
+		if text, err := decodeWith(candidate.encoding, data); err == nil {
+			return text, candidate.name, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: could not detect the encoding; specify it explicitly", ErrUnsupportedCharset)
+}
+
+// decodeWith decodes data strictly, failing on bytes that are invalid in the encoding
+func decodeWith(enc encoding.Encoding, data []byte) (string, error) {
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnsupportedCharset, err)
+	}
+	if bytes.ContainsRune(decoded, utf8.RuneError) {
+		return "", fmt.Errorf("%w: the file contains invalid characters", ErrUnsupportedCharset)
+	}
+	return string(decoded), nil
+}
+
+// detectCSVDelimiter picks the delimiter that splits the first lines into
+// the same number of columns, preferring more columns
+func detectCSVDelimiter(text string) rune {
+	sample := text
+	if lines := strings.SplitAfterN(text, "\n", 21); len(lines) > 20 {
+		sample = strings.Join(lines[:20], "")
+	}
+
+	best, bestColumns := ',', 0
+	for _, delimiter := range csvDelimiters {
+		if !strings.ContainsRune(sample, delimiter) {
+			continue
+		}
+		records, _, err := readCSVRecords(sample, delimiter)
+		if err != nil || len(records) == 0 {
+			continue
+		}
+		columns := len(records[0])
+		for _, record := range records[1:] {
+			if len(record) != columns && !isBlankCSVRecord(record) {
+				columns = 0
+				break
+			}
+		}
+		if columns > 1 && columns > bestColumns {
+			best, bestColumns = delimiter, columns
+		}
+	}
+	return best
+}
+
+// readCSVRecords parses the text and returns the records with their line numbers
+func readCSVRecords(text string, delimiter rune) ([][]string, []int, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var records [][]string
+	var lines []int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidCSV, err)
+		}
+		line, _ := reader.FieldPos(0)
+		records = append(records, record)
+		lines = append(lines, line)
+		if len(records) > MaxCSVImportRows+1 {
+			return nil, nil, fmt.Errorf("%w: too many rows (max %d)", ErrInvalidCSV, MaxCSVImportRows)
+		}
+	}
+	return records, lines, nil
+}
+
+func defaultCSVMapping(header []string) CSVColumnMapping {
+	mapping := CSVColumnMapping{Front: "0", Back: "1"}
+	if header == nil {
+		return mapping
+	}
+
+	targets := map[string]*string{"front": &mapping.Front, "back": &mapping.Back, "hint": &mapping.Hint, "tags": &mapping.Tags}
+	for field, names := range csvHeaderNames {
+		for _, column := range header {
+			if slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(name, strings.TrimSpace(column)) }) {
+				*targets[field] = column
+				break
+			}
+		}
+	}
+	return mapping
+}
+
+// csvColumnIndex resolves a header name or column index; -1 means unmapped
+func csvColumnIndex(column string, header []string) (int, error) {
+	column = strings.TrimSpace(column)
+	if column == "" {
+		return -1, nil
+	}
+	for i, name := range header {
+		if strings.TrimSpace(name) == column {
+			return i, nil
+		}
+	}
+	index, err := strconv.Atoi(column)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("unknown column %q", column)
+	}
+	return index, nil
+}
+
+func csvValue(record []string, index int) string {
+	if index < 0 || index >= len(record) {
+		return ""
+	}
+	return record[index]
+}
+
+func isBlankCSVRecord(record []string) bool {
+	for _, value := range record {
+		if strings.TrimSpace(value) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func validateCSVRow(row *CSVRow, format string) []string {
+	var errs []string
+	if row.Front == "" {
+		errs = append(errs, "front is required")
+	}
+	if row.Back == "" {
+		errs = append(errs, "back is required")
+	}
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"front", &row.Front}, {"back", &row.Back}, {"hint", &row.Hint},
+	} {
+		sanitized, err := SanitizeContent(format, *field.value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", field.name, err))
+			continue
+		}
+		*field.value = sanitized
+	}
+	return errs
+}
+
+type CSVImporter struct {
+	db       *gorm.DB
+	detector *DuplicateDetector
+}
+
+func NewCSVImporter(db *gorm.DB) *CSVImporter {
+	return &CSVImporter{db: db, detector: NewDuplicateDetector(db)}
+}
+
+// MarkDuplicates sets the duplicates of each valid row when opts asks for a
+// duplicate check. Rows are compared with the cards of the deck, or of all
+// the user's decks with DuplicateScopeAll, and with the rows before them.
+// deckID is 0 when importing into a new deck.
+func (imp *CSVImporter) MarkDuplicates(userID uint, deckID uint, preview *CSVPreview, opts CSVImportOptions) error {
+	if opts.DuplicateCheck == "" {
+		return nil
+	}
+	scope := opts.DuplicateScope
+	if scope == "" {
+		scope = DuplicateScopeDeck
+	}
+
+	index, err := imp.detector.NewIndex(userID, deckID, scope)
+	if err != nil {
+		return err
+	}
+
+	preview.DuplicateRows = 0
+	for i := range preview.Rows {
+		row := &preview.Rows[i]
+		if len(row.Errors) > 0 {
+			continue
+		}
+
+		row.Duplicates = index.Match(row.Front)
+		if len(row.Duplicates) > 0 {
+			preview.DuplicateRows++
+			// スキップする行は作成されないため、後の行の比較対象にしない
+			if opts.DuplicateCheck == DuplicateCheckSkip {
+				continue
+			}
+		}
+		index.Add(0, deckID, row.Front)
+	}
+	return nil
+}
+
+// Commit creates cards from the parsed rows in one transaction. The deck is
+// created first if it has no ID. Invalid rows fail the import unless
+// skipInvalid is set, in which case they are returned as skipped. Rows marked
+// by MarkDuplicates are skipped or reported according to opts.DuplicateCheck.
+func (imp *CSVImporter) Commit(ctx context.Context, userID uint, deck *models.Deck, preview *CSVPreview, opts CSVImportOptions, skipInvalid bool) (*CSVImportResult, error) {
+	format := opts.ContentFormat
+	if format == "" {
+		format = ContentFormatPlain
+	}
+
+	result := &CSVImportResult{Deck: deck, Skipped: []CSVRow{}}
+	var valid []CSVRow
+	invalid := 0
+	for _, row := range preview.Rows {
+		if len(row.Errors) > 0 {
+			result.Skipped = append(result.Skipped, row)
+			invalid++
+			continue
+		}
+		if len(row.Duplicates) > 0 {
+			if opts.DuplicateCheck == DuplicateCheckSkip {
+				result.Skipped = append(result.Skipped, row)
+				continue
+			}
+			result.Duplicates = append(result.Duplicates, FlaggedDuplicate{Front: row.Front, Matches: row.Duplicates})
+		}
+		valid = append(valid, row)
+	}
+	if invalid > 0 && !skipInvalid {
+		return nil, ErrCSVInvalidRows
+	}
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("%w: no rows to import", ErrInvalidCSV)
+	}
+
+	err := imp.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if deck.ID == 0 {
+			if err := tx.Create(deck).Error; err != nil {
+				return err
+			}
+		}
+
+		tags := map[string]models.Tag{}
+		cards := make([]models.Card, 0, len(valid))
+		for _, row := range valid {
+			card := models.Card{
+				DeckID:        deck.ID,
+				Front:         row.Front,
+				Back:          row.Back,
+				Hint:          row.Hint,
+				ContentFormat: format,
+			}
+
+			var missing []string
+			for _, name := range row.Tags {
+				if _, ok := tags[name]; !ok {
+					missing = append(missing, name)
+				}
+			}
+			ensured, _, err := EnsureTags(tx, userID, missing)
+			if err != nil {
+				return err
+			}
+			for _, tag := range ensured {
+				tags[tag.Name] = tag
+			}
+			for _, name := range row.Tags {
+				card.Tags = append(card.Tags, tags[name])
+			}
+			cards = append(cards, card)
+		}
+		return CreateBasicCards(tx, userID, cards)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Imported = len(valid)
+	return result, nil
+}
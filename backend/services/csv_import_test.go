@@ -0,0 +1,81 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestParseCSV(t *testing.T) {
+	t.Run("Shift_JIS を自動検出する", func(t *testing.T) {
+		data, err := japanese.ShiftJIS.NewEncoder().Bytes([]byte("犬,dog\n猫,cat\n"))
+		require.NoError(t, err)
+
+		preview, err := ParseCSV(data, CSVImportOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, CSVEncodingShiftJIS, preview.Encoding)
+		assert.Equal(t, ",", preview.Delimiter)
+		require.Len(t, preview.Rows, 2)
+		assert.Equal(t, "犬", preview.Rows[0].Front)
+		assert.Equal(t, "cat", preview.Rows[1].Back)
+	})
+
+	t.Run("BOM 付き UTF-16 を読み込める", func(t *testing.T) {
+		enc := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+		data, err := enc.NewEncoder().Bytes([]byte("表\t裏\n"))
+		require.NoError(t, err)
+
+		preview, err := ParseCSV(data, CSVImportOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, CSVEncodingUTF16, preview.Encoding)
+		require.Len(t, preview.Rows, 1)
+		assert.Equal(t, "裏", preview.Rows[0].Back)
+	})
+
+	t.Run("タブ区切りとヘッダー名で列を割り当てる", func(t *testing.T) {
+		data := []byte("Tags\tAnswer\tQuestion\tHint\nanimal, jp\tdog\t犬\tワン\n\tcat\t猫\t\n")
+
+		preview, err := ParseCSV(data, CSVImportOptions{HasHeader: true})
+		require.NoError(t, err)
+		assert.Equal(t, "\t", preview.Delimiter)
+		assert.Equal(t, CSVColumnMapping{Front: "Question", Back: "Answer", Hint: "Hint", Tags: "Tags"}, preview.Mapping)
+		require.Len(t, preview.Rows, 2)
+		assert.Equal(t, CSVRow{Line: 2, Front: "犬", Back: "dog", Hint: "ワン", Tags: []string{"animal", "jp"}}, preview.Rows[0])
+		assert.Equal(t, 3, preview.Rows[1].Line)
+	})
+
+	t.Run("列番号で割り当てる", func(t *testing.T) {
+		data := []byte("a;b;c\n")
+
+		preview, err := ParseCSV(data, CSVImportOptions{Mapping: CSVColumnMapping{Front: "2", Back: "0"}})
+		require.NoError(t, err)
+		assert.Equal(t, ";", preview.Delimiter)
+		assert.Equal(t, "c", preview.Rows[0].Front)
+		assert.Equal(t, "a", preview.Rows[0].Back)
+	})
+
+	t.Run("行ごとの検証エラー", func(t *testing.T) {
+		data := []byte("front,back\n\"multi\nline\",ok\nonly front,\n")
+
+		preview, err := ParseCSV(data, CSVImportOptions{HasHeader: true})
+		require.NoError(t, err)
+		assert.Equal(t, 2, preview.TotalRows)
+		assert.Equal(t, 1, preview.ValidRows)
+		assert.Equal(t, "multi\nline", preview.Rows[0].Front)
+		assert.Equal(t, 4, preview.Rows[1].Line)
+		assert.Equal(t, []string{"back is required"}, preview.Rows[1].Errors)
+	})
+
+	t.Run("存在しない列名", func(t *testing.T) {
+		_, err := ParseCSV([]byte("a,b\n"), CSVImportOptions{HasHeader: true, Mapping: CSVColumnMapping{Front: "x", Back: "b"}})
+		assert.ErrorIs(t, err, ErrInvalidCSV)
+	})
+
+	t.Run("未対応の文字コード", func(t *testing.T) {
+		_, err := ParseCSV([]byte("a,b\n"), CSVImportOptions{Encoding: "latin1"})
+		assert.ErrorIs(t, err, ErrUnsupportedCharset)
+	})
+}
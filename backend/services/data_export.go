@@ -0,0 +1,271 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+// Supported formats of the data export
+const (
+	ExportFormatCSV  = "csv"
+	ExportFormatJSON = "json"
+)
+
+// exportBatchSize is the number of cards loaded at a time while exporting
+const exportBatchSize = 500
+
+var ErrInvalidExportFormat = errors.New("format must be csv or json")
+
+var cardExportHeader = []string{
+	"id", "deckId", "deck", "front", "back", "hint", "contentFormat", "status",
+	"reviewCount", "lastReview", "tags", "createdAt", "updatedAt",
+}
+
+var answerExportHeader = []string{
+	"id", "answerDate", "deckId", "deck", "cardId", "front", "isCorrect", "studyTime",
+}
+
+// CardExportRow is a card as written by the data export
+type CardExportRow struct {
+	ID            uint       `json:"id"`
+	DeckID        uint       `json:"deckId"`
+	Deck          string     `json:"deck"`
+	Front         string     `json:"front"`
+	Back          string     `json:"back"`
+	Hint          string     `json:"hint"`
+	ContentFormat string     `json:"contentFormat"`
+	Status        string     `json:"status"`
+	ReviewCount   int        `json:"reviewCount"`
+	LastReview    *time.Time `json:"lastReview"`
+	Tags          []string   `json:"tags"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+func (r *CardExportRow) csvRecord() []string {
+	return []string{
+		strconv.FormatUint(uint64(r.ID), 10),
+		strconv.FormatUint(uint64(r.DeckID), 10),
+		r.Deck,
+		r.Front,
+		r.Back,
+		r.Hint,
+		r.ContentFormat,
+		r.Status,
+		strconv.Itoa(r.ReviewCount),
+		formatExportTime(r.LastReview),
+		strings.Join(r.Tags, " "),
+		formatExportTime(&r.CreatedAt),
+		formatExportTime(&r.UpdatedAt),
+	}
+}
+
+// AnswerExportRow is an answer record as written by the data export
+type AnswerExportRow struct {
+	ID         uint      `json:"id"`
+	AnswerDate time.Time `json:"answerDate"`
+	DeckID     uint      `json:"deckId"`
+	Deck       string    `json:"deck"`
+	CardID     uint      `json:"cardId"`
+	Front      string    `json:"front"` // カードが削除されている場合は空
+	IsCorrect  bool      `json:"isCorrect"`
+	StudyTime  int       `json:"studyTime"`
+}
+
+func (r *AnswerExportRow) csvRecord() []string {
+	return []string{
+		strconv.FormatUint(uint64(r.ID), 10),
+		formatExportTime(&r.AnswerDate),
+		strconv.FormatUint(uint64(r.DeckID), 10),
+		r.Deck,
+		strconv.FormatUint(uint64(r.CardID), 10),
+		r.Front,
+		strconv.FormatBool(r.IsCorrect),
+		strconv.Itoa(r.StudyTime),
+	}
+}
+
+func formatExportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// AnswerExportFilter selects the answer records to export. Zero times and
+// a zero deck ID mean no bound.
+type AnswerExportFilter struct {
+	UserID uint
+	DeckID uint
+	From   time.Time // この日時を含む
+	To     time.Time // この日時を含まない
+}
+
+// DataExporter writes cards and study history as CSV or JSON. Rows are read
+// and written incrementally so large exports are not held in memory.
+type DataExporter struct {
+	db *gorm.DB
+}
+
+func NewDataExporter(db *gorm.DB) *DataExporter {
+	return &DataExporter{db: db}
+}
+
+func ValidExportFormat(format string) bool {
+	return format == ExportFormatCSV || format == ExportFormatJSON
+}
+
+// ExportCards writes the cards of the given decks
+func (e *DataExporter) ExportCards(ctx context.Context, decks []models.Deck, format string, w io.Writer) error {
+	out, err := newExportWriter(w, format, cardExportHeader)
+	if err != nil {
+		return err
+	}
+
+	titles := make(map[uint]string, len(decks))
+	deckIDs := make([]uint, 0, len(decks))
+	for _, deck := range decks {
+		titles[deck.ID] = deck.Title
+		deckIDs = append(deckIDs, deck.ID)
+	}
+
+	var cards []models.Card
+	err = e.db.WithContext(ctx).Preload("Tags").Where("deck_id IN ?", deckIDs).
+		FindInBatches(&cards, exportBatchSize, func(tx *gorm.DB, batch int) error {
+			for _, card := range cards {
+				row := CardExportRow{
+					ID:            card.ID,
+					DeckID:        card.DeckID,
+					Deck:          titles[card.DeckID],
+					Front:         card.Front,
+					Back:          card.Back,
+					Hint:          card.Hint,
+					ContentFormat: card.ContentFormat,
+					Status:        card.Status,
+					ReviewCount:   card.ReviewCount,
+					LastReview:    card.LastReview,
+					Tags:          make([]string, 0, len(card.Tags)),
+					CreatedAt:     card.CreatedAt,
+					UpdatedAt:     card.UpdatedAt,
+				}
+				for _, tag := range card.Tags {
+					row.Tags = append(row.Tags, tag.Name)
+				}
+				if err := out.write(&row, row.csvRecord()); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return err
+	}
+	return out.close()
+}
+
+// ExportAnswers writes the answer records matching the filter, oldest first
+func (e *DataExporter) ExportAnswers(ctx context.Context, filter AnswerExportFilter, format string, w io.Writer) error {
+	out, err := newExportWriter(w, format, answerExportHeader)
+	if err != nil {
+		return err
+	}
+
+	query := e.db.WithContext(ctx).Model(&models.AnswerRecord{}).
+		Select("answer_records.id, answer_records.answer_date, answer_records.deck_id, COALESCE(decks.title, '') AS deck, "+
+			"answer_records.card_id, COALESCE(cards.front, '') AS front, answer_records.is_correct, answer_records.study_time").
+		Joins("LEFT JOIN decks ON decks.id = answer_records.deck_id").
+		Joins("LEFT JOIN cards ON cards.id = answer_records.card_id AND cards.deleted_at IS NULL").
+		Where("answer_records.user_id = ?", filter.UserID).
+		Order("answer_records.answer_date, answer_records.id")
+	if filter.DeckID != 0 {
+		query = query.Where("answer_records.deck_id = ?", filter.DeckID)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("answer_records.answer_date >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("answer_records.answer_date < ?", filter.To)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row AnswerExportRow
+		if err := e.db.ScanRows(rows, &row); err != nil {
+			return err
+		}
+		if err := out.write(&row, row.csvRecord()); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return out.close()
+}
+
+// exportWriter writes rows either as CSV with a header line or as a JSON array
+type exportWriter struct {
+	buf     *bufio.Writer
+	csv     *csv.Writer
+	json    *json.Encoder
+	written bool
+}
+
+func newExportWriter(w io.Writer, format string, header []string) (*exportWriter, error) {
+	out := &exportWriter{buf: bufio.NewWriter(w)}
+	switch format {
+	case ExportFormatCSV:
+		out.csv = csv.NewWriter(out.buf)
+		if err := out.csv.Write(header); err != nil {
+			return nil, err
+		}
+	case ExportFormatJSON:
+		out.json = json.NewEncoder(out.buf)
+		if _, err := out.buf.WriteString("["); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidExportFormat
+	}
+	return out, nil
+}
+
+func (w *exportWriter) write(value any, record []string) error {
+	if w.csv != nil {
+		return w.csv.Write(record)
+	}
+	if w.written {
+		if _, err := w.buf.WriteString(","); err != nil {
+			return err
+		}
+	}
+	w.written = true
+	return w.json.Encode(value)
+}
+
+func (w *exportWriter) close() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	} else if _, err := w.buf.WriteString("]\n"); err != nil {
+		return err
+	}
+	return w.buf.Flush()
+}
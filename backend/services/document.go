@@ -0,0 +1,199 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// MIME types of documents that text can be extracted from
+const (
+	MIMETypePDF  = "application/pdf"
+	MIMETypeDOCX = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+)
+
+const (
+	MaxDocumentPages   = 500
+	maxDocumentXMLSize = 64 * 1024 * 1024 // 展開後の document.xml の上限
+)
+
+var (
+	ErrInvalidDocument     = errors.New("文書ファイルを読み込めませんでした")
+	ErrUnsupportedDocument = errors.New("サポートされていない文書形式です")
+	ErrDocumentTooLong     = fmt.Errorf("文書のページ数が多すぎます（最大%dページ）", MaxDocumentPages)
+)
+
+// DocumentPage is the text of one page of a document. Number starts at 1.
+type DocumentPage struct {
+	Number int    `json:"number"`
+	Text   string `json:"text"`
+}
+
+// ExtractDocumentPages extracts the text of a PDF or DOCX document page by
+// page. Pages without text, such as scanned pages, are returned empty.
+// DOCX files have no fixed layout, so their pages follow the page breaks
+// recorded by the editor and may differ from the printed pages.
+func ExtractDocumentPages(data []byte, mimeType string) ([]DocumentPage, error) {
+	var (
+		pages []DocumentPage
+		err   error
+	)
+	switch mimeType {
+	case MIMETypePDF:
+		pages, err = extractPDFPages(data)
+	case MIMETypeDOCX:
+		pages, err = extractDOCXPages(data)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDocument, mimeType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) > MaxDocumentPages {
+		return nil, ErrDocumentTooLong
+	}
+	return pages, nil
+}
+
+func extractPDFPages(data []byte) (pages []DocumentPage, err error) {
+	// 壊れたPDFではライブラリがpanicすることがある
+	defer func() {
+		if r := recover(); r != nil {
+			pages, err = nil, fmt.Errorf("%w: %v", ErrInvalidDocument, r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+	count := reader.NumPage()
+	if count > MaxDocumentPages {
+		return nil, ErrDocumentTooLong
+	}
+
+	fonts := map[string]*pdf.Font{}
+	for i := 1; i <= count; i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		// フォントは複数ページで共有されるためキャッシュする
+		for _, name := range page.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+		text, err := page.GetPlainText(fonts)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+		}
+		pages = append(pages, DocumentPage{Number: i, Text: cleanDocumentText(text)})
+	}
+	return pages, nil
+}
+
+func extractDOCXPages(data []byte) ([]DocumentPage, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+	file, err := archive.Open("word/document.xml")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+	defer file.Close()
+
+	var (
+		pages     []DocumentPage
+		text      strings.Builder
+		inText    bool
+		pageBreak bool // 直前が明示的な改ページで、まだ本文がない
+	)
+	newPage := func() {
+		pages = append(pages, DocumentPage{Number: len(pages) + 1, Text: cleanDocumentText(text.String())})
+		text.Reset()
+	}
+
+	decoder := xml.NewDecoder(io.LimitReader(file, maxDocumentXMLSize))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteByte('\t')
+			case "br":
+				if docxAttr(t, "type") == "page" {
+					newPage()
+					pageBreak = true
+				} else {
+					text.WriteByte('\n')
+				}
+			case "lastRenderedPageBreak":
+				// 明示的な改ページの直後にも記録されるため二重に数えない
+				if !pageBreak {
+					newPage()
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+				pageBreak = false
+			}
+		}
+	}
+	newPage()
+	return pages, nil
+}
+
+func docxAttr(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// cleanDocumentText trims the lines of extracted text and drops repeated blank lines
+func cleanDocumentText(text string) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if !blank && len(lines) > 0 {
+				lines = append(lines, "")
+			}
+			blank = true
+			continue
+		}
+		lines = append(lines, line)
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
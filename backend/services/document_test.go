@@ -0,0 +1,85 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/muratayousuke/ai-flashcards/test/fixtures"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildTestPDF builds a PDF with one line of text on each page
+func buildTestPDF(pages ...string) []byte {
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+	for i, text := range pages {
+		content := fmt.Sprintf("BT /F1 12 Tf 72 712 Td (%s) Tj ET", text)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestExtractDocumentPages(t *testing.T) {
+	t.Run("PDFのテキストをページごとに抽出する", func(t *testing.T) {
+		pages, err := ExtractDocumentPages(buildTestPDF("Photosynthesis", "", "Chlorophyll"), MIMETypePDF)
+		require.NoError(t, err)
+		require.Len(t, pages, 3)
+		assert.Equal(t, DocumentPage{Number: 1, Text: "Photosynthesis"}, pages[0])
+		assert.Equal(t, DocumentPage{Number: 2, Text: ""}, pages[1])
+		assert.Equal(t, DocumentPage{Number: 3, Text: "Chlorophyll"}, pages[2])
+	})
+
+	t.Run("DOCXは改ページでページを分ける", func(t *testing.T) {
+		body := `<w:p><w:r><w:t>光合成</w:t></w:r><w:r><w:tab/><w:t xml:space="preserve">とは </w:t></w:r></w:p>` +
+			`<w:p><w:r><w:t>二行目</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:br w:type="page"/></w:r><w:r><w:lastRenderedPageBreak/><w:t>葉緑体</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:lastRenderedPageBreak/><w:t>呼吸</w:t><w:br/><w:t>続き</w:t></w:r></w:p>`
+
+		pages, err := ExtractDocumentPages(fixtures.BuildDOCX(t, body), MIMETypeDOCX)
+		require.NoError(t, err)
+		require.Len(t, pages, 3)
+		assert.Equal(t, "光合成\tとは\n二行目", pages[0].Text)
+		assert.Equal(t, "葉緑体", pages[1].Text)
+		assert.Equal(t, DocumentPage{Number: 3, Text: "呼吸\n続き"}, pages[2])
+	})
+
+	t.Run("壊れたファイル", func(t *testing.T) {
+		_, err := ExtractDocumentPages([]byte("%PDF-1.4\nbroken"), MIMETypePDF)
+		assert.ErrorIs(t, err, ErrInvalidDocument)
+
+		_, err = ExtractDocumentPages([]byte("not a zip"), MIMETypeDOCX)
+		assert.ErrorIs(t, err, ErrInvalidDocument)
+	})
+
+	t.Run("対応していない形式", func(t *testing.T) {
+		_, err := ExtractDocumentPages([]byte("text"), "text/plain")
+		assert.ErrorIs(t, err, ErrUnsupportedDocument)
+	})
+}
@@ -0,0 +1,351 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// Duplicate check modes
+const (
+	DuplicateCheckSkip = "skip" // 重複カードを作成しない
+	DuplicateCheckFlag = "flag" // 作成した上で重複を報告する
+)
+
+// Duplicate check scopes
+const (
+	DuplicateScopeDeck = "deck" // 同じデッキ内のみ
+	DuplicateScopeAll  = "all"  // ユーザーの全デッキ
+)
+
+// DefaultDuplicateThreshold is the minimum similarity for near-duplicates
+const DefaultDuplicateThreshold = 0.85
+
+// MaxDuplicateReportCards is the most cards a duplicate report compares.
+// Reports run in the request, and near-duplicates are found pairwise.
+const MaxDuplicateReportCards = 5000
+
+// ErrTooManyCardsForReport is returned when a report would compare more than
+// MaxDuplicateReportCards cards
+var ErrTooManyCardsForReport = fmt.Errorf("too many cards to check for duplicates (max %d)", MaxDuplicateReportCards)
+
+// DuplicateMatch describes an existing card that a front text duplicates.
+// CardID is 0 when the match is another card of the same batch.
+type DuplicateMatch struct {
+	CardID     uint    `json:"cardId"`
+	DeckID     uint    `json:"deckId"`
+	Front      string  `json:"front"`
+	Similarity float64 `json:"similarity"`
+	Exact      bool    `json:"exact"`
+}
+
+// FlaggedDuplicate pairs a candidate front text with the cards it duplicates
+type FlaggedDuplicate struct {
+	Front   string           `json:"front"`
+	Matches []DuplicateMatch `json:"matches"`
+}
+
+// DuplicateGroup is a set of cards whose fronts are duplicates of each other
+type DuplicateGroup struct {
+	Exact bool          `json:"exact"`
+	Cards []models.Card `json:"cards"`
+}
+
+type DuplicateDetector struct {
+	db        *gorm.DB
+	threshold float64
+}
+
+func NewDuplicateDetector(db *gorm.DB) *DuplicateDetector {
+	return &DuplicateDetector{db: db, threshold: DefaultDuplicateThreshold}
+}
+
+// WithThreshold returns a detector using the given similarity threshold
+func (d *DuplicateDetector) WithThreshold(threshold float64) *DuplicateDetector {
+	if threshold <= 0 || threshold > 1 {
+		return d
+	}
+	return &DuplicateDetector{db: d.db, threshold: threshold}
+}
+
+// DuplicateIndex holds normalized fronts to check candidates against
+type DuplicateIndex struct {
+	threshold float64
+	entries   []duplicateEntry
+	exact     map[string][]int
+}
+
+type duplicateEntry struct {
+	cardID     uint
+	deckID     uint
+	front      string
+	normalized []rune
+}
+
+// NewEmptyIndex returns an index without any card, for comparing cards that
+// are not stored yet with each other.
+func (d *DuplicateDetector) NewEmptyIndex() *DuplicateIndex {
+	return &DuplicateIndex{threshold: d.threshold, exact: map[string][]int{}}
+}
+
+// NewIndex loads the user's cards in the given scope into an index.
+// deckID 0 with DuplicateScopeDeck yields an empty index (e.g. for a new deck).
+func (d *DuplicateDetector) NewIndex(userID uint, deckID uint, scope string) (*DuplicateIndex, error) {
+	index := d.NewEmptyIndex()
+
+	cards, err := d.loadCards(userID, deckID, scope)
+	if err != nil {
+		return nil, err
+	}
+	for _, card := range cards {
+		index.Add(card.ID, card.DeckID, card.Front)
+	}
+	return index, nil
+}
+
+// FindMatches returns the cards in scope that duplicate the given front
+func (d *DuplicateDetector) FindMatches(userID uint, deckID uint, scope string, front string) ([]DuplicateMatch, error) {
+	index, err := d.NewIndex(userID, deckID, scope)
+	if err != nil {
+		return nil, err
+	}
+	return index.Match(front), nil
+}
+
+// Report groups the duplicated cards in scope.
+// With DuplicateScopeAll, only groups containing a card of deckID are returned unless deckID is 0.
+// ErrTooManyCardsForReport is returned when the scope holds more than MaxDuplicateReportCards cards.
+func (d *DuplicateDetector) Report(userID uint, deckID uint, scope string) ([]DuplicateGroup, error) {
+	cards, err := d.loadCards(userID, deckID, scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(cards) > MaxDuplicateReportCards {
+		return nil, ErrTooManyCardsForReport
+	}
+	return d.groupDuplicates(cards, deckID), nil
+}
+
+// groupDuplicates groups the duplicated cards, keeping the groups that
+// contain a card of deckID unless deckID is 0
+func (d *DuplicateDetector) groupDuplicates(cards []models.Card, deckID uint) []DuplicateGroup {
+	normalized := make([][]rune, len(cards))
+	for i, card := range cards {
+		normalized[i] = []rune(NormalizeText(card.Front))
+	}
+
+	// union-find で重複カードをグループ化
+	parent := make([]int, len(cards))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	// 長さの差だけで閾値を下回る組は比較しないよう、短い順に並べて長さが近いものだけを比べる
+	byLength := make([]int, len(cards))
+	for i := range byLength {
+		byLength[i] = i
+	}
+	sort.SliceStable(byLength, func(a, b int) bool {
+		return len(normalized[byLength[a]]) < len(normalized[byLength[b]])
+	})
+
+	exactPairs := map[int]bool{}
+	for a, i := range byLength {
+		for _, j := range byLength[a+1:] {
+			shorter, longer := len(normalized[i]), len(normalized[j])
+			if longer > 0 && 1-float64(longer-shorter)/float64(longer) < d.threshold {
+				break
+			}
+			similarity := d.similarity(normalized[i], normalized[j])
+			if similarity < d.threshold {
+				continue
+			}
+			ri, rj := find(i), find(j)
+			if ri != rj {
+				parent[rj] = ri
+			}
+			if similarity == 1 {
+				exactPairs[i] = true
+				exactPairs[j] = true
+			}
+		}
+	}
+
+	members := map[int][]int{}
+	for i := range cards {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+
+	var groups []DuplicateGroup
+	for _, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+
+		group := DuplicateGroup{Exact: true}
+		includesDeck := deckID == 0
+		for _, i := range indexes {
+			group.Cards = append(group.Cards, cards[i])
+			if !exactPairs[i] {
+				group.Exact = false
+			}
+			if cards[i].DeckID == deckID {
+				includesDeck = true
+			}
+		}
+		if includesDeck {
+			groups = append(groups, group)
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Cards[0].ID < groups[j].Cards[0].ID
+	})
+	return groups
+}
+
+func (d *DuplicateDetector) loadCards(userID uint, deckID uint, scope string) ([]models.Card, error) {
+	var cards []models.Card
+	query := d.db.Model(&models.Card{}).
+		Joins("JOIN decks ON decks.id = cards.deck_id AND decks.deleted_at IS NULL").
+		Where("decks.user_id = ?", userID).
+		Order("cards.id")
+
+	if scope != DuplicateScopeAll {
+		if deckID == 0 {
+			return nil, nil
+		}
+		query = query.Where("cards.deck_id = ?", deckID)
+	}
+
+	if err := query.Find(&cards).Error; err != nil {
+		return nil, err
+	}
+	return cards, nil
+}
+
+func (d *DuplicateDetector) similarity(a, b []rune) float64 {
+	return similarity(a, b, d.threshold)
+}
+
+// Add registers a front text in the index
+func (idx *DuplicateIndex) Add(cardID uint, deckID uint, front string) {
+	normalized := NormalizeText(front)
+	idx.entries = append(idx.entries, duplicateEntry{
+		cardID:     cardID,
+		deckID:     deckID,
+		front:      front,
+		normalized: []rune(normalized),
+	})
+	idx.exact[normalized] = append(idx.exact[normalized], len(idx.entries)-1)
+}
+
+// Match returns the indexed entries that duplicate the given front, most similar first
+func (idx *DuplicateIndex) Match(front string) []DuplicateMatch {
+	normalized := NormalizeText(front)
+	if normalized == "" {
+		return nil
+	}
+
+	var matches []DuplicateMatch
+	seen := map[int]bool{}
+	for _, i := range idx.exact[normalized] {
+		seen[i] = true
+		matches = append(matches, idx.entries[i].match(1))
+	}
+
+	runes := []rune(normalized)
+	for i, entry := range idx.entries {
+		if seen[i] {
+			continue
+		}
+		if s := similarity(runes, entry.normalized, idx.threshold); s >= idx.threshold {
+			matches = append(matches, entry.match(s))
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Similarity > matches[j].Similarity
+	})
+	return matches
+}
+
+func (e duplicateEntry) match(similarity float64) DuplicateMatch {
+	return DuplicateMatch{
+		CardID:     e.cardID,
+		DeckID:     e.deckID,
+		Front:      e.front,
+		Similarity: similarity,
+		Exact:      similarity == 1,
+	}
+}
+
+// NormalizeText folds width, kana and case differences and drops spaces and punctuation
+// so that texts which read the same compare equal.
+func NormalizeText(s string) string {
+	// NFKC で全角英数を半角に、半角カナを全角に揃える
+	s = norm.NFKC.String(s)
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'ァ' && r <= 'ヶ':
+			// カタカナをひらがなに揃える
+			r -= 0x60
+		case unicode.IsSpace(r), unicode.IsPunct(r):
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// similarity returns 1 - normalized edit distance between a and b.
+// Pairs whose length difference alone rules out the threshold are skipped.
+func similarity(a, b []rune, threshold float64) float64 {
+	longest := max(len(a), len(b))
+	if longest == 0 {
+		return 0
+	}
+	diff := len(a) - len(b)
+	if diff < 0 {
+		diff = -diff
+	}
+	if 1-float64(diff)/float64(longest) < threshold {
+		return 0
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
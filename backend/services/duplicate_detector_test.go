@@ -0,0 +1,93 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{"全角英数と半角英数", "ＡＢＣ　１２３", "abc 123"},
+		{"カタカナとひらがな", "カンジ", "かんじ"},
+		{"半角カナと全角カナ", "ｶﾀｶﾅ", "かたかな"},
+		{"濁点付き半角カナ", "ﾃﾞｰﾀ", "データ"},
+		{"句読点と空白", "What is Go?", "what is go"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, NormalizeText(tt.a), NormalizeText(tt.b))
+		})
+	}
+}
+
+func TestDuplicateIndexMatch(t *testing.T) {
+	index := &DuplicateIndex{threshold: DefaultDuplicateThreshold, exact: map[string][]int{}}
+	index.Add(1, 10, "光合成とは何か？")
+	index.Add(2, 10, "What is the capital of France?")
+	index.Add(3, 20, "ミトコンドリアの役割")
+
+	t.Run("完全一致", func(t *testing.T) {
+		matches := index.Match("光合成とは何か")
+		assert.Len(t, matches, 1)
+		assert.Equal(t, uint(1), matches[0].CardID)
+		assert.True(t, matches[0].Exact)
+	})
+
+	t.Run("ほぼ一致", func(t *testing.T) {
+		matches := index.Match("What is the capital of france")
+		assert.Len(t, matches, 1)
+		assert.Equal(t, uint(2), matches[0].CardID)
+
+		matches = index.Match("What's the capital of France?")
+		assert.Len(t, matches, 1)
+		assert.False(t, matches[0].Exact)
+		assert.GreaterOrEqual(t, matches[0].Similarity, DefaultDuplicateThreshold)
+	})
+
+	t.Run("一致しない", func(t *testing.T) {
+		assert.Empty(t, index.Match("What is the capital of Japan?"))
+		assert.Empty(t, index.Match("？"))
+	})
+}
+
+func TestDuplicateDetectorGroupDuplicates(t *testing.T) {
+	detector := &DuplicateDetector{threshold: DefaultDuplicateThreshold}
+	cards := []models.Card{
+		{Model: models.Model{ID: 1}, DeckID: 10, Front: "光合成とは何か？"},
+		{Model: models.Model{ID: 2}, DeckID: 10, Front: "What is the capital of France?"},
+		{Model: models.Model{ID: 3}, DeckID: 20, Front: "光合成とは何か"},
+		{Model: models.Model{ID: 4}, DeckID: 20, Front: "What's the capital of France?"},
+		{Model: models.Model{ID: 5}, DeckID: 20, Front: "ミトコンドリアの役割"},
+		{Model: models.Model{ID: 6}, DeckID: 20, Front: "光"},
+	}
+
+	t.Run("長さの異なるカードを含めてグループ化する", func(t *testing.T) {
+		groups := detector.groupDuplicates(cards, 0)
+		assert.Len(t, groups, 2)
+		assert.True(t, groups[0].Exact)
+		assert.Equal(t, []uint{1, 3}, cardIDs(groups[0].Cards))
+		assert.False(t, groups[1].Exact)
+		assert.Equal(t, []uint{2, 4}, cardIDs(groups[1].Cards))
+	})
+
+	t.Run("デッキのカードを含むグループのみ", func(t *testing.T) {
+		groups := detector.groupDuplicates(cards[2:], 20)
+		assert.Len(t, groups, 0)
+		groups = detector.groupDuplicates(cards, 20)
+		assert.Len(t, groups, 2)
+	})
+}
+
+func cardIDs(cards []models.Card) []uint {
+	ids := make([]uint, len(cards))
+	for i, card := range cards {
+		ids[i] = card.ID
+	}
+	return ids
+}
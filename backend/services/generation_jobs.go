@@ -0,0 +1,350 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+// Statuses of a generation job
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusCanceled  = "canceled"
+)
+
+const (
+	// DefaultJobTimeout bounds a single job. It is well above the request
+	// timeout, which is what jobs are for.
+	DefaultJobTimeout = 10 * time.Minute
+
+	// DefaultJobCancelPollInterval is how often a running job checks whether
+	// it was cancelled through another process
+	DefaultJobCancelPollInterval = 2 * time.Second
+
+	// DefaultJobStaleAfter is how long a queued job may wait without being
+	// picked up, and a running job may outlive its timeout, before it is
+	// considered lost by a restarted or crashed worker
+	DefaultJobStaleAfter = 5 * time.Minute
+
+	// DefaultJobRecoveryInterval is how often workers look for lost jobs
+	DefaultJobRecoveryInterval = time.Minute
+)
+
+// errJobInterrupted is recorded on running jobs whose worker went away
+const errJobInterrupted = "job was interrupted"
+
+var (
+	ErrJobNotFound     = errors.New("job not found")
+	ErrJobFinished     = errors.New("job has already finished")
+	ErrJobsUnavailable = errors.New("background jobs are not available on this deployment")
+)
+
+var activeJobStatuses = []string{JobStatusQueued, JobStatusRunning}
+
+// JobProgressFunc reports the stage of a job and the number of cards so far
+type JobProgressFunc func(stage string, cards int)
+
+// JobProcessor runs a job and returns its result, which is stored as JSON.
+// media is the file submitted with the job, or nil.
+type JobProcessor func(ctx context.Context, job *models.GenerationJob, media []byte, progress JobProgressFunc) (any, error)
+
+// JobRunner persists generation jobs and runs them on background workers.
+// Jobs, including their input files, are kept in the database and cancelled
+// through it, so a job submitted by one process can be run and cancelled by
+// any other.
+type JobRunner struct {
+	db      *gorm.DB
+	queue   JobQueue
+	process JobProcessor
+
+	Timeout            time.Duration
+	CancelPollInterval time.Duration
+	StaleAfter         time.Duration
+	RecoveryInterval   time.Duration
+
+	mu      sync.Mutex
+	running map[uint]context.CancelFunc
+
+	submitDisabled bool
+}
+
+func NewJobRunner(db *gorm.DB, queue JobQueue, process JobProcessor) *JobRunner {
+	return &JobRunner{
+		db:                 db,
+		queue:              queue,
+		process:            process,
+		Timeout:            DefaultJobTimeout,
+		CancelPollInterval: DefaultJobCancelPollInterval,
+		StaleAfter:         DefaultJobStaleAfter,
+		RecoveryInterval:   DefaultJobRecoveryInterval,
+		running:            make(map[uint]context.CancelFunc),
+	}
+}
+
+// DisableSubmit makes Submit refuse jobs with ErrJobsUnavailable, for
+// processes whose jobs no worker would ever run
+func (r *JobRunner) DisableSubmit() {
+	r.submitDisabled = true
+}
+
+// Submit stores the job together with its input file and queues it
+func (r *JobRunner) Submit(ctx context.Context, job *models.GenerationJob, media []byte) error {
+	if r.submitDisabled {
+		return ErrJobsUnavailable
+	}
+
+	// 入力ファイルはジョブと同じ行に保存し、別のプロセスのワーカーからも読めるようにする
+	job.Media = media
+	job.Status = JobStatusQueued
+	if err := r.db.WithContext(ctx).Create(job).Error; err != nil {
+		return err
+	}
+
+	if err := r.queue.Enqueue(ctx, job.ID); err != nil {
+		// 実行されることのないジョブを残さない
+		r.finish(job.ID, JobStatusFailed, "", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Get returns a job of the user
+func (r *JobRunner) Get(ctx context.Context, userID, jobID uint) (*models.GenerationJob, error) {
+	var job models.GenerationJob
+	err := r.db.WithContext(ctx).Omit("media").Where("id = ? AND user_id = ?", jobID, userID).First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Cancel stops a queued or running job of the user. ErrJobFinished is
+// returned with the job when it has already finished.
+func (r *JobRunner) Cancel(ctx context.Context, userID, jobID uint) (*models.GenerationJob, error) {
+	result := r.db.WithContext(ctx).Model(&models.GenerationJob{}).
+		Where("id = ? AND user_id = ? AND status IN ?", jobID, userID, activeJobStatuses).
+		Updates(map[string]any{"status": JobStatusCanceled, "media": nil, "finished_at": time.Now()})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	job, err := r.Get(ctx, userID, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected == 0 {
+		return job, ErrJobFinished
+	}
+
+	// このプロセスで実行中なら即座に中断する（他のプロセスではポーリングで検知される）
+	r.mu.Lock()
+	if cancel, ok := r.running[jobID]; ok {
+		cancel()
+	}
+	r.mu.Unlock()
+	return job, nil
+}
+
+// Start runs the given number of workers until ctx is done. Processes with
+// workers also recover lost jobs, at once and then periodically.
+func (r *JobRunner) Start(ctx context.Context, workers int) {
+	if workers <= 0 {
+		return
+	}
+	for i := 0; i < workers; i++ {
+		go r.work(ctx)
+	}
+	go r.recoverPeriodically(ctx)
+}
+
+// Recover handles jobs lost when a worker crashed or a process restarted.
+// Running jobs that outlived their timeout are failed, and queued jobs that
+// have waited too long, such as those dropped with an in-process queue, are
+// queued again. A job queued twice runs once, as workers claim it first.
+func (r *JobRunner) Recover(ctx context.Context) error {
+	now := time.Now()
+
+	// タイムアウトを過ぎても実行中のままのジョブは、ワーカーが停止したものとみなす
+	err := r.db.WithContext(ctx).Model(&models.GenerationJob{}).
+		Where("status = ? AND started_at < ?", JobStatusRunning, now.Add(-r.Timeout-r.StaleAfter)).
+		Updates(map[string]any{"status": JobStatusFailed, "error": errJobInterrupted, "media": nil, "finished_at": now}).Error
+	if err != nil {
+		return err
+	}
+
+	var jobIDs []uint
+	err = r.db.WithContext(ctx).Model(&models.GenerationJob{}).
+		Where("status = ? AND updated_at < ?", JobStatusQueued, now.Add(-r.StaleAfter)).
+		Order("created_at").Pluck("id", &jobIDs).Error
+	if err != nil {
+		return err
+	}
+	for _, jobID := range jobIDs {
+		// 更新日時を進め、次の確認で同じジョブを重複して積まないようにする
+		result := r.db.WithContext(ctx).Model(&models.GenerationJob{}).
+			Where("id = ? AND status = ?", jobID, JobStatusQueued).Update("updated_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		if err := r.queue.Enqueue(ctx, jobID); err != nil {
+			return err
+		}
+		log.Printf("Requeued stale generation job %d", jobID)
+	}
+	return nil
+}
+
+func (r *JobRunner) recoverPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(r.RecoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Recover(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: failed to recover generation jobs: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *JobRunner) work(ctx context.Context) {
+	for {
+		jobID, err := r.queue.Dequeue(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Warning: failed to dequeue generation job: %v", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		r.run(ctx, jobID)
+	}
+}
+
+func (r *JobRunner) run(ctx context.Context, jobID uint) {
+	var job models.GenerationJob
+	if err := r.db.First(&job, jobID).Error; err != nil {
+		log.Printf("Warning: generation job %d not found: %v", jobID, err)
+		return
+	}
+
+	// キャンセル済みのジョブや他のワーカーが取得したジョブは実行しない
+	startedAt := time.Now()
+	result := r.db.Model(&models.GenerationJob{}).Where("id = ? AND status = ?", jobID, JobStatusQueued).
+		Updates(map[string]any{"status": JobStatusRunning, "started_at": startedAt})
+	if result.Error != nil {
+		log.Printf("Warning: failed to start generation job %d: %v", jobID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+	job.Status = JobStatusRunning
+	job.StartedAt = &startedAt
+
+	jobCtx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	r.track(jobID, cancel)
+	defer r.untrack(jobID)
+	go r.watchCancel(jobCtx, jobID, cancel)
+
+	output, err := r.execute(jobCtx, &job)
+	if err != nil {
+		message := err.Error()
+		if errors.Is(jobCtx.Err(), context.DeadlineExceeded) {
+			message = "job timed out"
+		}
+		r.finish(jobID, JobStatusFailed, "", message)
+		return
+	}
+	r.finish(jobID, JobStatusSucceeded, output, "")
+}
+
+// execute runs the processor and encodes its result
+func (r *JobRunner) execute(ctx context.Context, job *models.GenerationJob) (string, error) {
+	value, err := r.process(ctx, job, job.Media, func(stage string, cards int) {
+		r.progress(job.ID, stage, cards)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	output, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+func (r *JobRunner) progress(jobID uint, stage string, cards int) {
+	err := r.db.Model(&models.GenerationJob{}).Where("id = ? AND status = ?", jobID, JobStatusRunning).
+		Updates(map[string]any{"stage": stage, "cards": cards}).Error
+	if err != nil {
+		log.Printf("Warning: failed to update progress of generation job %d: %v", jobID, err)
+	}
+}
+
+// finish records the outcome unless the job was cancelled in the meantime.
+// The input file is no longer needed and is removed.
+func (r *JobRunner) finish(jobID uint, status, output, message string) {
+	err := r.db.Model(&models.GenerationJob{}).Where("id = ? AND status IN ?", jobID, activeJobStatuses).
+		Updates(map[string]any{"status": status, "result": output, "error": message, "media": nil, "finished_at": time.Now()}).Error
+	if err != nil {
+		log.Printf("Warning: failed to finish generation job %d: %v", jobID, err)
+	}
+}
+
+// watchCancel cancels the job when another process marks it as cancelled
+func (r *JobRunner) watchCancel(ctx context.Context, jobID uint, cancel context.CancelFunc) {
+	ticker := time.NewTicker(r.CancelPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var status string
+			err := r.db.Model(&models.GenerationJob{}).Where("id = ?", jobID).Pluck("status", &status).Error
+			if err == nil && status == JobStatusCanceled {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func (r *JobRunner) track(jobID uint, cancel context.CancelFunc) {
+	r.mu.Lock()
+	r.running[jobID] = cancel
+	r.mu.Unlock()
+}
+
+func (r *JobRunner) untrack(jobID uint) {
+	r.mu.Lock()
+	delete(r.running, jobID)
+	r.mu.Unlock()
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Supported values of JOB_QUEUE
+const (
+	JobQueueMemory = "memory"
+	JobQueueRedis  = "redis"
+)
+
+// redisJobQueueKey is the Redis list holding queued job IDs
+const redisJobQueueKey = "ai_generation_jobs"
+
+// redisDequeueTimeout bounds a single blocking pop so cancellation is noticed
+const redisDequeueTimeout = 5 * time.Second
+
+// JobQueue hands job IDs from the API to the workers
+type JobQueue interface {
+	Enqueue(ctx context.Context, jobID uint) error
+	// Dequeue blocks until a job is available or the context is done
+	Dequeue(ctx context.Context) (uint, error)
+}
+
+// NewJobQueueFromEnv returns the queue configured by the environment.
+// JOB_QUEUE selects the in-process queue (default) or the Redis queue, which
+// lets jobs submitted by one process be run by workers of another.
+func NewJobQueueFromEnv() (JobQueue, error) {
+	switch queue := os.Getenv("JOB_QUEUE"); queue {
+	case "", JobQueueMemory:
+		return NewMemoryJobQueue(), nil
+	case JobQueueRedis:
+		// サーバーレス環境では InitRedis が呼ばれていないため、ここで接続する
+		if RedisClient == nil && os.Getenv("UPSTASH_REDIS_URL") != "" {
+			InitRedis()
+		}
+		if RedisClient == nil {
+			return nil, errors.New("JOB_QUEUE is redis but Redis is not available")
+		}
+		return NewRedisJobQueue(RedisClient), nil
+	default:
+		return nil, fmt.Errorf("unknown JOB_QUEUE %q", queue)
+	}
+}
+
+// SharedJobQueueFromEnv reports whether JOB_QUEUE selects a queue that
+// workers of other processes read
+func SharedJobQueueFromEnv() bool {
+	return os.Getenv("JOB_QUEUE") == JobQueueRedis
+}
+
+// JobWorkersFromEnv returns the number of workers to run in this process,
+// set by JOB_WORKERS
+func JobWorkersFromEnv(defaultWorkers int) int {
+	workers, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || workers < 0 {
+		return defaultWorkers
+	}
+	return workers
+}
+
+// MemoryJobQueue is a JobQueue within the current process
+type MemoryJobQueue struct {
+	jobs chan uint
+}
+
+func NewMemoryJobQueue() *MemoryJobQueue {
+	return &MemoryJobQueue{jobs: make(chan uint, 1024)}
+}
+
+func (q *MemoryJobQueue) Enqueue(ctx context.Context, jobID uint) error {
+	select {
+	case q.jobs <- jobID:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *MemoryJobQueue) Dequeue(ctx context.Context) (uint, error) {
+	select {
+	case jobID := <-q.jobs:
+		return jobID, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// RedisJobQueue is a JobQueue shared by all processes using the same Redis
+type RedisJobQueue struct {
+	client *redis.Client
+}
+
+func NewRedisJobQueue(client *redis.Client) *RedisJobQueue {
+	return &RedisJobQueue{client: client}
+}
+
+func (q *RedisJobQueue) Enqueue(ctx context.Context, jobID uint) error {
+	return q.client.LPush(ctx, redisJobQueueKey, jobID).Err()
+}
+
+func (q *RedisJobQueue) Dequeue(ctx context.Context) (uint, error) {
+	for {
+		result, err := q.client.BRPop(ctx, redisDequeueTimeout, redisJobQueueKey).Result()
+		if errors.Is(err, redis.Nil) {
+			continue // タイムアウト。コンテキストを確認して待ち直す
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+
+		// result は [キー, 値]
+		jobID, err := strconv.ParseUint(result[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid job ID %q in queue: %w", result[1], err)
+		}
+		return uint(jobID), nil
+	}
+}
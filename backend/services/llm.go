@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Supported values of LLM_PROVIDER
+const (
+	LLMProviderGemini = "gemini"
+	LLMProviderOpenAI = "openai"
+	LLMProviderFake   = "fake"
+)
+
+// DefaultGeminiModel is used when LLM_MODEL is not set
+const DefaultGeminiModel = "gemini-2.0-flash"
+
+// ErrEmptyLLMResponse is returned when the model answered without any text
+var ErrEmptyLLMResponse = errors.New("AIからの応答が空です")
+
+// ErrLLMInputUnsupported is returned when the configured model cannot take
+// the given kind of media
+var ErrLLMInputUnsupported = errors.New("この入力形式は現在のAIモデルでは利用できません")
+
+// LLMMedia is binary input such as an image or audio file passed with a prompt
+type LLMMedia struct {
+	MIMEType string
+	Data     []byte
+}
+
+// LLMOptions are the sampling settings of a single generation
+type LLMOptions struct {
+	Temperature float32
+	MaxTokens   int32
+	// Schema constrains the answer to JSON of this shape when the provider
+	// supports structured output. Answers should still be validated, as not
+	// every backend enforces it.
+	Schema *JSONSchema
+}
+
+// JSONSchema is the subset of JSON Schema understood by all providers'
+// structured output modes
+type JSONSchema struct {
+	Name       string                 `json:"-"` // スキーマの識別名（OpenAIのresponse_formatで必須）
+	Type       string                 `json:"type"`
+	Properties map[string]*JSONSchema `json:"properties,omitempty"`
+	Items      *JSONSchema            `json:"items,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+}
+
+// LLMProvider generates text with a large language model. Implementations
+// return the concatenated text of the first candidate.
+type LLMProvider interface {
+	// GenerateText answers a text-only prompt
+	GenerateText(ctx context.Context, prompt string, opts LLMOptions) (string, error)
+	// GenerateMultimodal answers a prompt accompanied by images or audio
+	GenerateMultimodal(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions) (string, error)
+	// GenerateStream answers a prompt with optional media, passing each piece
+	// of text to onChunk as the model produces it, and returns the whole text.
+	// An error from onChunk stops the generation.
+	GenerateStream(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions, onChunk func(chunk string) error) (string, error)
+	// Transcribe converts speech to text following the prompt
+	Transcribe(ctx context.Context, prompt string, audio LLMMedia) (string, error)
+}
+
+// NewLLMProviderFromEnv returns the provider configured by the environment.
+// LLM_PROVIDER selects the implementation (gemini by default) and LLM_MODEL
+// overrides its model name. The openai provider additionally reads
+// LLM_BASE_URL, LLM_API_KEY and LLM_VISION. Calls are retried
+// LLM_MAX_RETRIES times and then passed on to the comma-separated
+// LLM_FALLBACK_MODELS of the same provider in order.
+func NewLLMProviderFromEnv(ctx context.Context) (LLMProvider, error) {
+	provider := os.Getenv("LLM_PROVIDER")
+
+	primary, err := newLLMProvider(ctx, provider, os.Getenv("LLM_MODEL"))
+	if err != nil {
+		return nil, err
+	}
+
+	var fallbacks []LLMProvider
+	for _, model := range strings.Split(os.Getenv("LLM_FALLBACK_MODELS"), ",") {
+		model = strings.TrimSpace(model)
+		if model == "" {
+			continue
+		}
+		fallback, err := newLLMProvider(ctx, provider, model)
+		if err != nil {
+			return nil, err
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+
+	policy := DefaultLLMRetryPolicy
+	if value := os.Getenv("LLM_MAX_RETRIES"); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid LLM_MAX_RETRIES %q", value)
+		}
+		policy.MaxRetries = retries
+	}
+	return NewRetryingProvider(policy, primary, fallbacks...), nil
+}
+
+func newLLMProvider(ctx context.Context, provider, model string) (LLMProvider, error) {
+	switch provider {
+	case "", LLMProviderGemini:
+		if model == "" {
+			model = DefaultGeminiModel
+		}
+		return NewGeminiProvider(ctx, os.Getenv("GEMINI_API_KEY"), model)
+	case LLMProviderOpenAI:
+		vision, _ := strconv.ParseBool(os.Getenv("LLM_VISION"))
+		return NewOpenAIProvider(OpenAIConfig{
+			BaseURL: os.Getenv("LLM_BASE_URL"),
+			APIKey:  os.Getenv("LLM_API_KEY"),
+			Model:   model,
+			Vision:  vision,
+		})
+	case LLMProviderFake:
+		return NewFakeLLMProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM_PROVIDER %q", provider)
+	}
+}
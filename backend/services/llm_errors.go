@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of provider failures. Errors returned by providers match one of
+// these with errors.Is.
+var (
+	// ErrLLMRateLimited means the provider throttled the request (HTTP 429)
+	ErrLLMRateLimited = errors.New("AIサービスの利用が集中しています")
+	// ErrLLMUnavailable means the provider failed or could not be reached
+	ErrLLMUnavailable = errors.New("AIサービスが一時的に利用できません")
+	// ErrLLMBlocked means the provider refused the content for safety reasons
+	ErrLLMBlocked = errors.New("AIサービスにより入力または応答がブロックされました")
+	// ErrLLMRejected means the provider rejected the request itself, for
+	// example because of a wrong API key or model name
+	ErrLLMRejected = errors.New("AIサービスがリクエストを拒否しました")
+)
+
+// LLMError is a classified provider failure
+type LLMError struct {
+	Kind       error // ErrLLMRateLimited などの種類
+	Model      string
+	StatusCode int           // HTTPステータス（不明な場合は0）
+	RetryAfter time.Duration // プロバイダーが指定した再試行までの時間（指定がなければ0）
+	Err        error
+}
+
+func (e *LLMError) Error() string {
+	if e.Model == "" {
+		return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%v (%s): %v", e.Kind, e.Model, e.Err)
+}
+
+func (e *LLMError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// IsRetryableLLMError reports whether the request may succeed when repeated
+func IsRetryableLLMError(err error) bool {
+	return errors.Is(err, ErrLLMRateLimited) || errors.Is(err, ErrLLMUnavailable)
+}
+
+// LLMRetryAfter returns the wait requested by the provider, or 0
+func LLMRetryAfter(err error) time.Duration {
+	var llmErr *LLMError
+	if errors.As(err, &llmErr) {
+		return llmErr.RetryAfter
+	}
+	return 0
+}
+
+// newLLMHTTPError classifies a failed HTTP response of a provider
+func newLLMHTTPError(model string, status int, header http.Header, err error) *LLMError {
+	kind := ErrLLMRejected
+	switch {
+	case status == http.StatusTooManyRequests:
+		kind = ErrLLMRateLimited
+	case status == http.StatusRequestTimeout || status >= 500:
+		kind = ErrLLMUnavailable
+	}
+
+	var retryAfter time.Duration
+	if header != nil {
+		retryAfter = parseRetryAfter(header.Get("Retry-After"), time.Now())
+	}
+	return &LLMError{Kind: kind, Model: model, StatusCode: status, RetryAfter: retryAfter, Err: err}
+}
+
+// newLLMTransportError classifies an error of a request that got no
+// response. Cancellation by the caller is returned as is.
+func newLLMTransportError(ctx context.Context, model string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return &LLMError{Kind: ErrLLMUnavailable, Model: model, Err: err}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
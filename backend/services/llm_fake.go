@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeCardCount is the number of cards the fake provider generates
+const fakeCardCount = 3
+
+// fakeChunkSize is the size of the pieces GenerateStream emits
+const fakeChunkSize = 16
+
+// FakeLLMProvider is a deterministic LLMProvider for tests and offline
+// development. Unless Responses, Response or Err is set, it answers
+// generation prompts with fixed cards in the JSON shape the prompt asks for:
+// a deck object when the prompt mentions "title", a card array otherwise.
+type FakeLLMProvider struct {
+	Responses []string      // 設定されている場合は呼び出しごとに先頭から順に返す
+	Response  string        // 設定されている場合は常にこの文字列を返す
+	Err       error         // 設定されている場合は常にこのエラーを返す
+	Delay     time.Duration // 応答までの待ち時間（コンテキストのキャンセルで中断する）
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func NewFakeLLMProvider() *FakeLLMProvider {
+	return &FakeLLMProvider{}
+}
+
+// Prompts returns the prompts received so far
+func (p *FakeLLMProvider) Prompts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.prompts...)
+}
+
+func (p *FakeLLMProvider) GenerateText(ctx context.Context, prompt string, opts LLMOptions) (string, error) {
+	if err := p.record(ctx, prompt); err != nil {
+		return "", err
+	}
+	if text, ok := p.nextResponse(); ok {
+		return text, nil
+	}
+	if p.Response != "" {
+		return p.Response, nil
+	}
+	return fakeGeneration(prompt), nil
+}
+
+func (p *FakeLLMProvider) GenerateMultimodal(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions) (string, error) {
+	return p.GenerateText(ctx, prompt, opts)
+}
+
+func (p *FakeLLMProvider) GenerateStream(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions, onChunk func(chunk string) error) (string, error) {
+	text, err := p.GenerateText(ctx, prompt, opts)
+	if err != nil {
+		return "", err
+	}
+	for rest := text; rest != ""; {
+		n := min(fakeChunkSize, len(rest))
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if err := onChunk(rest[:n]); err != nil {
+			return "", err
+		}
+		rest = rest[n:]
+	}
+	return text, nil
+}
+
+func (p *FakeLLMProvider) Transcribe(ctx context.Context, prompt string, audio LLMMedia) (string, error) {
+	if err := p.record(ctx, prompt); err != nil {
+		return "", err
+	}
+	if p.Response != "" {
+		return p.Response, nil
+	}
+	return fmt.Sprintf("fake transcript of %d bytes of %s", len(audio.Data), audio.MIMEType), nil
+}
+
+// nextResponse takes the next of Responses
+func (p *FakeLLMProvider) nextResponse() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.Responses) == 0 {
+		return "", false
+	}
+	text := p.Responses[0]
+	p.Responses = p.Responses[1:]
+	return text, true
+}
+
+func (p *FakeLLMProvider) record(ctx context.Context, prompt string) error {
+	p.mu.Lock()
+	p.prompts = append(p.prompts, prompt)
+	p.mu.Unlock()
+
+	if p.Delay > 0 {
+		select {
+		case <-time.After(p.Delay):
+		case <-ctx.Done():
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.Err
+}
+
+func fakeGeneration(prompt string) string {
+	type card struct {
+		Front string `json:"front"`
+		Back  string `json:"back"`
+	}
+	cards := make([]card, 0, fakeCardCount)
+	for i := 1; i <= fakeCardCount; i++ {
+		cards = append(cards, card{
+			Front: fmt.Sprintf("Fake question %d", i),
+			Back:  fmt.Sprintf("Fake answer %d", i),
+		})
+	}
+
+	var value any = struct {
+		Cards []card `json:"cards"`
+	}{cards}
+	if strings.Contains(prompt, `"title"`) {
+		value = struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+			Cards       []card `json:"cards"`
+		}{"Fake deck", "Generated by the fake LLM provider", cards}
+	}
+	out, _ := json.Marshal(value)
+	return string(out)
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GeminiProvider is an LLMProvider backed by the Gemini API
+type GeminiProvider struct {
+	client    *genai.Client
+	modelName string
+}
+
+func NewGeminiProvider(ctx context.Context, apiKey, model string) (*GeminiProvider, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, err
+	}
+	return &GeminiProvider{client: client, modelName: model}, nil
+}
+
+func (p *GeminiProvider) GenerateText(ctx context.Context, prompt string, opts LLMOptions) (string, error) {
+	return p.generate(ctx, opts, genai.Text(prompt))
+}
+
+func (p *GeminiProvider) GenerateMultimodal(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions) (string, error) {
+	return p.generate(ctx, opts, geminiParts(prompt, media)...)
+}
+
+func (p *GeminiProvider) GenerateStream(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions, onChunk func(chunk string) error) (string, error) {
+	iter := p.model(opts).GenerateContentStream(ctx, geminiParts(prompt, media)...)
+
+	var text strings.Builder
+	for {
+		resp, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return "", p.classify(ctx, err)
+		}
+		chunk := geminiText(resp)
+		if chunk == "" {
+			continue
+		}
+		text.WriteString(chunk)
+		if err := onChunk(chunk); err != nil {
+			return "", err
+		}
+	}
+
+	if text.Len() == 0 {
+		return "", ErrEmptyLLMResponse
+	}
+	return text.String(), nil
+}
+
+func (p *GeminiProvider) Transcribe(ctx context.Context, prompt string, audio LLMMedia) (string, error) {
+	// 文字起こしは正確性を重視
+	opts := LLMOptions{Temperature: 0.1, MaxTokens: 2000}
+	return p.GenerateMultimodal(ctx, prompt, []LLMMedia{audio}, opts)
+}
+
+func (p *GeminiProvider) model(opts LLMOptions) *genai.GenerativeModel {
+	model := p.client.GenerativeModel(p.modelName)
+	model.SetTemperature(opts.Temperature)
+	model.SetMaxOutputTokens(opts.MaxTokens)
+	if opts.Schema != nil {
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = geminiSchema(opts.Schema)
+	}
+	return model
+}
+
+var geminiTypes = map[string]genai.Type{
+	"object":  genai.TypeObject,
+	"array":   genai.TypeArray,
+	"string":  genai.TypeString,
+	"integer": genai.TypeInteger,
+	"number":  genai.TypeNumber,
+	"boolean": genai.TypeBoolean,
+}
+
+// geminiSchema converts a schema to its Gemini form. Gemini orders object
+// properties alphabetically in its answer.
+func geminiSchema(schema *JSONSchema) *genai.Schema {
+	if schema == nil {
+		return nil
+	}
+
+	result := &genai.Schema{
+		Type:     geminiTypes[schema.Type],
+		Items:    geminiSchema(schema.Items),
+		Required: schema.Required,
+	}
+	if schema.Properties != nil {
+		result.Properties = make(map[string]*genai.Schema, len(schema.Properties))
+		for name, property := range schema.Properties {
+			result.Properties[name] = geminiSchema(property)
+		}
+	}
+	return result
+}
+
+func (p *GeminiProvider) generate(ctx context.Context, opts LLMOptions, parts ...genai.Part) (string, error) {
+	resp, err := p.model(opts).GenerateContent(ctx, parts...)
+	if err != nil {
+		return "", p.classify(ctx, err)
+	}
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+		return "", ErrEmptyLLMResponse
+	}
+	return geminiText(resp), nil
+}
+
+// classify converts an error of the Gemini API into an LLMError
+func (p *GeminiProvider) classify(ctx context.Context, err error) error {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return &LLMError{Kind: ErrLLMBlocked, Model: p.modelName, Err: err}
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		llmErr := newLLMHTTPError(p.modelName, apiErr.Code, apiErr.Header, err)
+		if llmErr.RetryAfter == 0 {
+			llmErr.RetryAfter = geminiRetryDelay(apiErr.Details)
+		}
+		return llmErr
+	}
+	return newLLMTransportError(ctx, p.modelName, err)
+}
+
+// geminiRetryDelay reads the google.rpc.RetryInfo detail Gemini attaches to
+// quota errors
+func geminiRetryDelay(details []any) time.Duration {
+	for _, detail := range details {
+		info, ok := detail.(map[string]any)
+		if !ok {
+			continue
+		}
+		if typ, _ := info["@type"].(string); !strings.HasSuffix(typ, "google.rpc.RetryInfo") {
+			continue
+		}
+		if delay, _ := info["retryDelay"].(string); delay != "" {
+			if d, err := time.ParseDuration(delay); err == nil {
+				return d
+			}
+		}
+	}
+	return 0
+}
+
+func geminiParts(prompt string, media []LLMMedia) []genai.Part {
+	parts := []genai.Part{genai.Text(prompt)}
+	for _, m := range media {
+		parts = append(parts, genai.Blob{MIMEType: m.MIMEType, Data: m.Data})
+	}
+	return parts
+}
+
+// geminiText concatenates the text parts of the first candidate
+func geminiText(resp *genai.GenerateContentResponse) string {
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return ""
+	}
+	var text strings.Builder
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if textPart, ok := part.(genai.Text); ok {
+			text.WriteString(string(textPart))
+		}
+	}
+	return text.String()
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultOpenAIBaseURL is used when LLM_BASE_URL is not set
+const DefaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// maxOpenAIErrorBody limits how much of an error response is read
+const maxOpenAIErrorBody = 4096
+
+// DefaultOpenAIResponseHeaderTimeout bounds the wait for a server to start
+// answering. Without streaming, local servers only answer once the whole
+// completion is generated, so it is well above a typical generation.
+const DefaultOpenAIResponseHeaderTimeout = 3 * time.Minute
+
+// OpenAIConfig configures an OpenAI-compatible Chat Completions backend
+type OpenAIConfig struct {
+	BaseURL string // 例: http://localhost:11434/v1 (Ollama)
+	APIKey  string // ローカルサーバーでは空でよい
+	Model   string
+	Vision  bool // 画像入力を受け付けるモデルかどうか
+	Client  *http.Client
+
+	// 応答の開始を待つ時間（Client を指定しない場合のみ使う。0 なら既定値）
+	ResponseHeaderTimeout time.Duration
+}
+
+// OpenAIProvider is an LLMProvider speaking the OpenAI Chat Completions API,
+// which is also served by Ollama, vLLM and the llama.cpp server
+type OpenAIProvider struct {
+	config OpenAIConfig
+}
+
+func NewOpenAIProvider(config OpenAIConfig) (*OpenAIProvider, error) {
+	if config.Model == "" {
+		return nil, fmt.Errorf("LLM_MODEL is required for the openai provider")
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultOpenAIBaseURL
+	}
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	if config.Client == nil {
+		config.Client = newOpenAIHTTPClient(config.ResponseHeaderTimeout)
+	}
+	return &OpenAIProvider{config: config}, nil
+}
+
+// newOpenAIHTTPClient returns a client that gives up on a server that does
+// not connect or answer, so that a stalled local server does not hold a
+// request or job until its deadline. The body has no timeout, as streamed
+// completions last as long as the generation.
+func newOpenAIHTTPClient(responseHeaderTimeout time.Duration) *http.Client {
+	if responseHeaderTimeout <= 0 {
+		responseHeaderTimeout = DefaultOpenAIResponseHeaderTimeout
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+	return &http.Client{Transport: transport}
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"` // string または []openAIContentPart
+}
+
+type openAIChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []openAIMessage       `json:"messages"`
+	Temperature    float32               `json:"temperature"`
+	MaxTokens      int32                 `json:"max_tokens,omitempty"`
+	Stream         bool                  `json:"stream,omitempty"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+type openAIResponseFormat struct {
+	Type       string           `json:"type"`
+	JSONSchema openAIJSONSchema `json:"json_schema"`
+}
+
+type openAIJSONSchema struct {
+	Name   string         `json:"name"`
+	Schema map[string]any `json:"schema"`
+	Strict bool           `json:"strict"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+}
+
+// openAIStreamChunk is a server-sent event of a streamed completion
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+type openAIErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *OpenAIProvider) GenerateText(ctx context.Context, prompt string, opts LLMOptions) (string, error) {
+	return p.chat(ctx, prompt, opts)
+}
+
+func (p *OpenAIProvider) GenerateMultimodal(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions) (string, error) {
+	content, err := p.content(prompt, media)
+	if err != nil {
+		return "", err
+	}
+	return p.chat(ctx, content, opts)
+}
+
+func (p *OpenAIProvider) GenerateStream(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions, onChunk func(chunk string) error) (string, error) {
+	content, err := p.content(prompt, media)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := p.post(ctx, content, opts, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // コメント行やイベント区切り
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("invalid chat completion chunk: %w", err)
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		text.WriteString(chunk.Choices[0].Delta.Content)
+		if err := onChunk(chunk.Choices[0].Delta.Content); err != nil {
+			return "", err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", newLLMTransportError(ctx, p.config.Model, err)
+	}
+
+	if text.Len() == 0 {
+		return "", ErrEmptyLLMResponse
+	}
+	return text.String(), nil
+}
+
+// Transcribe is not available, as Chat Completions servers generally do not
+// accept audio input
+func (p *OpenAIProvider) Transcribe(ctx context.Context, prompt string, audio LLMMedia) (string, error) {
+	return "", fmt.Errorf("%w: %s", ErrLLMInputUnsupported, audio.MIMEType)
+}
+
+// content builds the message content, attaching images as data URLs
+func (p *OpenAIProvider) content(prompt string, media []LLMMedia) (any, error) {
+	if len(media) == 0 {
+		return prompt, nil
+	}
+
+	parts := []openAIContentPart{{Type: "text", Text: prompt}}
+	for _, m := range media {
+		if !p.config.Vision || !strings.HasPrefix(m.MIMEType, "image/") {
+			return nil, fmt.Errorf("%w: %s", ErrLLMInputUnsupported, m.MIMEType)
+		}
+		parts = append(parts, openAIContentPart{
+			Type: "image_url",
+			ImageURL: &openAIImageURL{
+				URL: "data:" + m.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(m.Data),
+			},
+		})
+	}
+	return parts, nil
+}
+
+func (p *OpenAIProvider) chat(ctx context.Context, content any, opts LLMOptions) (string, error) {
+	resp, err := p.post(ctx, content, opts, false)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var chatResp openAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&chatResp); err != nil {
+		return "", fmt.Errorf("invalid chat completion response: %w", err)
+	}
+	if len(chatResp.Choices) == 0 || chatResp.Choices[0].Message.Content == "" {
+		return "", ErrEmptyLLMResponse
+	}
+	return chatResp.Choices[0].Message.Content, nil
+}
+
+// post sends a chat completion request and returns the response when it succeeded
+func (p *OpenAIProvider) post(ctx context.Context, content any, opts LLMOptions, stream bool) (*http.Response, error) {
+	body, err := json.Marshal(openAIChatRequest{
+		Model:          p.config.Model,
+		Messages:       []openAIMessage{{Role: "user", Content: content}},
+		Temperature:    opts.Temperature,
+		MaxTokens:      opts.MaxTokens,
+		Stream:         stream,
+		ResponseFormat: openAIFormat(opts.Schema),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.BaseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.APIKey)
+	}
+
+	resp, err := p.config.Client.Do(req)
+	if err != nil {
+		return nil, newLLMTransportError(ctx, p.config.Model, err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxOpenAIErrorBody))
+	message := strings.TrimSpace(string(data))
+	var apiErr openAIErrorResponse
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+		message = apiErr.Error.Message
+	}
+	err = fmt.Errorf("chat completion failed with status %d: %s", resp.StatusCode, message)
+	return nil, newLLMHTTPError(p.config.Model, resp.StatusCode, resp.Header, err)
+}
+
+// openAIFormat requests structured output strictly following the schema,
+// which must have an object at the top level as strict mode requires
+func openAIFormat(schema *JSONSchema) *openAIResponseFormat {
+	if schema == nil {
+		return nil
+	}
+	return &openAIResponseFormat{
+		Type: "json_schema",
+		JSONSchema: openAIJSONSchema{
+			Name:   schema.Name,
+			Schema: openAISchema(schema),
+			Strict: true,
+		},
+	}
+}
+
+// openAISchema converts a schema to JSON Schema, closing every object as
+// strict mode requires
+func openAISchema(schema *JSONSchema) map[string]any {
+	result := map[string]any{"type": schema.Type}
+	if schema.Items != nil {
+		result["items"] = openAISchema(schema.Items)
+	}
+	if schema.Type == "object" {
+		properties := make(map[string]any, len(schema.Properties))
+		for name, property := range schema.Properties {
+			properties[name] = openAISchema(property)
+		}
+		result["properties"] = properties
+		result["required"] = schema.Required
+		result["additionalProperties"] = false
+	}
+	return result
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIProvider(t *testing.T) {
+	var received map[string]any
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		received = nil
+		_ = json.NewDecoder(r.Body).Decode(&received)
+
+		if received["model"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": {"message": "model \"missing\" not found"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "[{\"front\": \"Q\", \"back\": \"A\"}]"}}]}`))
+	}))
+	defer server.Close()
+
+	opts := LLMOptions{Temperature: 0.7, MaxTokens: 2000}
+
+	t.Run("テキスト生成", func(t *testing.T) {
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: server.URL + "/v1/", APIKey: "secret", Model: "llama3"})
+		require.NoError(t, err)
+
+		text, err := provider.GenerateText(context.Background(), "prompt", opts)
+		require.NoError(t, err)
+		assert.Equal(t, `[{"front": "Q", "back": "A"}]`, text)
+
+		assert.Equal(t, "Bearer secret", auth)
+		assert.Equal(t, "llama3", received["model"])
+		assert.EqualValues(t, 2000, received["max_tokens"])
+		messages := received["messages"].([]any)
+		require.Len(t, messages, 1)
+		assert.Equal(t, "prompt", messages[0].(map[string]any)["content"])
+	})
+
+	t.Run("構造化出力", func(t *testing.T) {
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: server.URL + "/v1", Model: "llama3"})
+		require.NoError(t, err)
+
+		schema := &JSONSchema{
+			Name: "deck",
+			Type: "object",
+			Properties: map[string]*JSONSchema{
+				"title": {Type: "string"},
+				"cards": {Type: "array", Items: &JSONSchema{Type: "string"}},
+			},
+			Required: []string{"title", "cards"},
+		}
+		_, err = provider.GenerateText(context.Background(), "prompt", LLMOptions{Schema: schema})
+		require.NoError(t, err)
+
+		format := received["response_format"].(map[string]any)
+		assert.Equal(t, "json_schema", format["type"])
+		jsonSchema := format["json_schema"].(map[string]any)
+		assert.Equal(t, "deck", jsonSchema["name"])
+		assert.Equal(t, true, jsonSchema["strict"])
+		root := jsonSchema["schema"].(map[string]any)
+		assert.Equal(t, false, root["additionalProperties"])
+		assert.Equal(t, "array", root["properties"].(map[string]any)["cards"].(map[string]any)["type"])
+
+		_, err = provider.GenerateText(context.Background(), "prompt", opts)
+		require.NoError(t, err)
+		assert.NotContains(t, received, "response_format")
+	})
+
+	t.Run("APIキーなしのローカルサーバー", func(t *testing.T) {
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: server.URL + "/v1", Model: "llama3"})
+		require.NoError(t, err)
+
+		_, err = provider.GenerateText(context.Background(), "prompt", opts)
+		require.NoError(t, err)
+		assert.Empty(t, auth)
+	})
+
+	t.Run("画像入力", func(t *testing.T) {
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: server.URL + "/v1", Model: "llava", Vision: true})
+		require.NoError(t, err)
+
+		_, err = provider.GenerateMultimodal(context.Background(), "prompt",
+			[]LLMMedia{{MIMEType: "image/png", Data: []byte("png")}}, opts)
+		require.NoError(t, err)
+
+		content := received["messages"].([]any)[0].(map[string]any)["content"].([]any)
+		require.Len(t, content, 2)
+		assert.Equal(t, "text", content[0].(map[string]any)["type"])
+		image := content[1].(map[string]any)
+		assert.Equal(t, "image_url", image["type"])
+		assert.Equal(t, "data:image/png;base64,cG5n", image["image_url"].(map[string]any)["url"])
+	})
+
+	t.Run("対応していない入力", func(t *testing.T) {
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: server.URL + "/v1", Model: "llama3"})
+		require.NoError(t, err)
+
+		_, err = provider.GenerateMultimodal(context.Background(), "prompt",
+			[]LLMMedia{{MIMEType: "image/png", Data: []byte("png")}}, opts)
+		assert.ErrorIs(t, err, ErrLLMInputUnsupported)
+
+		_, err = provider.Transcribe(context.Background(), "prompt", LLMMedia{MIMEType: "audio/wav"})
+		assert.ErrorIs(t, err, ErrLLMInputUnsupported)
+	})
+
+	t.Run("APIエラー", func(t *testing.T) {
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: server.URL + "/v1", Model: "missing"})
+		require.NoError(t, err)
+
+		_, err = provider.GenerateText(context.Background(), "prompt", opts)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `model "missing" not found`)
+	})
+
+	t.Run("ストリーミング", func(t *testing.T) {
+		stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			assert.Equal(t, true, req["stream"])
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte(": keep-alive\n\n" +
+				`data: {"choices": [{"delta": {"role": "assistant"}}]}` + "\n\n" +
+				`data: {"choices": [{"delta": {"content": "[{\"front\""}}]}` + "\n\n" +
+				`data: {"choices": [{"delta": {"content": ": \"Q\"}]"}}]}` + "\n\n" +
+				"data: [DONE]\n\n"))
+		}))
+		defer stream.Close()
+
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: stream.URL, Model: "llama3"})
+		require.NoError(t, err)
+
+		var chunks []string
+		text, err := provider.GenerateStream(context.Background(), "prompt", nil, opts, func(chunk string) error {
+			chunks = append(chunks, chunk)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{`[{"front"`, `: "Q"}]`}, chunks)
+		assert.Equal(t, `[{"front": "Q"}]`, text)
+	})
+
+	t.Run("応答を始めないサーバーは待ち続けない", func(t *testing.T) {
+		release := make(chan struct{})
+		stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer stalled.Close()
+		defer close(release)
+
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: stalled.URL, Model: "llama3", ResponseHeaderTimeout: 50 * time.Millisecond})
+		require.NoError(t, err)
+
+		_, err = provider.GenerateText(context.Background(), "prompt", opts)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "timeout awaiting response headers")
+	})
+
+	t.Run("モデル未指定", func(t *testing.T) {
+		_, err := NewOpenAIProvider(OpenAIConfig{BaseURL: server.URL})
+		assert.Error(t, err)
+	})
+}
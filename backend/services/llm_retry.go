@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// LLMRetryPolicy controls how failed model calls are repeated
+type LLMRetryPolicy struct {
+	MaxRetries int           // 1つのモデルで再試行する回数
+	BaseDelay  time.Duration // 最初の再試行までの待ち時間の基準
+	MaxDelay   time.Duration // 待ち時間の上限。これより長いRetry-Afterは待たずに次のモデルへ移る
+}
+
+// DefaultLLMRetryPolicy is used unless LLM_MAX_RETRIES overrides the retries
+var DefaultLLMRetryPolicy = LLMRetryPolicy{
+	MaxRetries: 2,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   10 * time.Second,
+}
+
+// RetryingProvider is an LLMProvider that repeats calls failing with a
+// rate limit or an outage, waiting with exponential backoff and full jitter
+// or as long as the provider asks. When a model keeps failing, the call
+// moves on to the next provider of the fallback chain.
+type RetryingProvider struct {
+	providers []LLMProvider
+	policy    LLMRetryPolicy
+	wait      func(ctx context.Context, d time.Duration) error
+}
+
+func NewRetryingProvider(policy LLMRetryPolicy, primary LLMProvider, fallbacks ...LLMProvider) *RetryingProvider {
+	return &RetryingProvider{
+		providers: append([]LLMProvider{primary}, fallbacks...),
+		policy:    policy,
+		wait:      waitContext,
+	}
+}
+
+func (p *RetryingProvider) GenerateText(ctx context.Context, prompt string, opts LLMOptions) (string, error) {
+	return p.do(ctx, IsRetryableLLMError, func(provider LLMProvider) (string, error) {
+		return provider.GenerateText(ctx, prompt, opts)
+	})
+}
+
+func (p *RetryingProvider) GenerateMultimodal(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions) (string, error) {
+	return p.do(ctx, IsRetryableLLMError, func(provider LLMProvider) (string, error) {
+		return provider.GenerateMultimodal(ctx, prompt, media, opts)
+	})
+}
+
+// GenerateStream only repeats calls that failed before any output was
+// passed on, as the receiver cannot take back what it has been given
+func (p *RetryingProvider) GenerateStream(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions, onChunk func(chunk string) error) (string, error) {
+	started := false
+	retryable := func(err error) bool {
+		return !started && IsRetryableLLMError(err)
+	}
+	return p.do(ctx, retryable, func(provider LLMProvider) (string, error) {
+		return provider.GenerateStream(ctx, prompt, media, opts, func(chunk string) error {
+			started = true
+			return onChunk(chunk)
+		})
+	})
+}
+
+func (p *RetryingProvider) Transcribe(ctx context.Context, prompt string, audio LLMMedia) (string, error) {
+	return p.do(ctx, IsRetryableLLMError, func(provider LLMProvider) (string, error) {
+		return provider.Transcribe(ctx, prompt, audio)
+	})
+}
+
+// do runs call on each provider of the chain in turn until it succeeds or
+// fails with an error that retryable rejects
+func (p *RetryingProvider) do(ctx context.Context, retryable func(err error) bool, call func(provider LLMProvider) (string, error)) (string, error) {
+	var lastErr error
+	for i, provider := range p.providers {
+		for attempt := 0; ; attempt++ {
+			text, err := call(provider)
+			if err == nil || !retryable(err) {
+				return text, err
+			}
+			lastErr = err
+
+			if attempt >= p.policy.MaxRetries {
+				break
+			}
+			delay, ok := p.backoff(attempt, err)
+			if !ok {
+				break
+			}
+			// 期限までに再試行できない場合は待たずに失敗する
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				return "", lastErr
+			}
+			if err := p.wait(ctx, delay); err != nil {
+				return "", err
+			}
+		}
+
+		if i < len(p.providers)-1 {
+			log.Printf("Warning: falling back to the next model after: %v", lastErr)
+		}
+	}
+	return "", lastErr
+}
+
+// backoff returns how long to wait before the given retry. false means the
+// provider asked for a longer wait than the policy allows.
+func (p *RetryingProvider) backoff(attempt int, err error) (time.Duration, bool) {
+	if after := LLMRetryAfter(err); after > 0 {
+		return after, after <= p.policy.MaxDelay
+	}
+
+	delay := p.policy.BaseDelay << attempt
+	if delay <= 0 || delay > p.policy.MaxDelay {
+		delay = p.policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0, true
+	}
+	return rand.N(delay) + 1, true
+}
+
+func waitContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
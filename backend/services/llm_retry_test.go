@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedProvider fails with the given errors in turn and then answers
+type scriptedProvider struct {
+	FakeLLMProvider
+	name  string
+	errs  []error
+	calls int
+}
+
+func (p *scriptedProvider) GenerateText(ctx context.Context, prompt string, opts LLMOptions) (string, error) {
+	p.calls++
+	if len(p.errs) > 0 {
+		err := p.errs[0]
+		p.errs = p.errs[1:]
+		return "", err
+	}
+	return p.name, nil
+}
+
+func (p *scriptedProvider) GenerateStream(ctx context.Context, prompt string, media []LLMMedia, opts LLMOptions, onChunk func(chunk string) error) (string, error) {
+	p.calls++
+	if err := onChunk("partial"); err != nil {
+		return "", err
+	}
+	return "", &LLMError{Kind: ErrLLMUnavailable, Err: errors.New("connection reset")}
+}
+
+func newTestRetryingProvider(policy LLMRetryPolicy, providers ...LLMProvider) (*RetryingProvider, *[]time.Duration) {
+	var waits []time.Duration
+	p := NewRetryingProvider(policy, providers[0], providers[1:]...)
+	p.wait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	return p, &waits
+}
+
+func TestRetryingProvider(t *testing.T) {
+	policy := LLMRetryPolicy{MaxRetries: 2, BaseDelay: 100 * time.Millisecond, MaxDelay: 10 * time.Second}
+	rateLimited := &LLMError{Kind: ErrLLMRateLimited, StatusCode: http.StatusTooManyRequests, Err: errors.New("quota")}
+	unavailable := &LLMError{Kind: ErrLLMUnavailable, StatusCode: http.StatusServiceUnavailable, Err: errors.New("overloaded")}
+
+	t.Run("一時的なエラーはバックオフして再試行する", func(t *testing.T) {
+		primary := &scriptedProvider{name: "primary", errs: []error{rateLimited, unavailable}}
+		p, waits := newTestRetryingProvider(policy, primary)
+
+		text, err := p.GenerateText(context.Background(), "prompt", LLMOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "primary", text)
+		assert.Equal(t, 3, primary.calls)
+
+		require.Len(t, *waits, 2)
+		assert.LessOrEqual(t, (*waits)[0], 100*time.Millisecond)
+		assert.LessOrEqual(t, (*waits)[1], 200*time.Millisecond)
+		for _, wait := range *waits {
+			assert.Positive(t, wait)
+		}
+	})
+
+	t.Run("Retry-Afterの時間だけ待つ", func(t *testing.T) {
+		throttled := &LLMError{Kind: ErrLLMRateLimited, RetryAfter: 3 * time.Second, Err: errors.New("quota")}
+		primary := &scriptedProvider{name: "primary", errs: []error{throttled}}
+		p, waits := newTestRetryingProvider(policy, primary)
+
+		_, err := p.GenerateText(context.Background(), "prompt", LLMOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []time.Duration{3 * time.Second}, *waits)
+	})
+
+	t.Run("再試行しても失敗する場合は次のモデルを使う", func(t *testing.T) {
+		primary := &scriptedProvider{name: "primary", errs: []error{unavailable, unavailable, unavailable}}
+		fallback := &scriptedProvider{name: "fallback"}
+		p, _ := newTestRetryingProvider(policy, primary, fallback)
+
+		text, err := p.GenerateText(context.Background(), "prompt", LLMOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "fallback", text)
+		assert.Equal(t, 3, primary.calls)
+		assert.Equal(t, 1, fallback.calls)
+	})
+
+	t.Run("長すぎるRetry-Afterは待たずに次のモデルを使う", func(t *testing.T) {
+		throttled := &LLMError{Kind: ErrLLMRateLimited, RetryAfter: time.Minute, Err: errors.New("daily quota")}
+		primary := &scriptedProvider{name: "primary", errs: []error{throttled}}
+		fallback := &scriptedProvider{name: "fallback"}
+		p, waits := newTestRetryingProvider(policy, primary, fallback)
+
+		text, err := p.GenerateText(context.Background(), "prompt", LLMOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "fallback", text)
+		assert.Equal(t, 1, primary.calls)
+		assert.Empty(t, *waits)
+	})
+
+	t.Run("全てのモデルが失敗した場合は最後のエラーを返す", func(t *testing.T) {
+		primary := &scriptedProvider{errs: []error{unavailable, unavailable, unavailable}}
+		fallback := &scriptedProvider{errs: []error{rateLimited, rateLimited, rateLimited}}
+		p, _ := newTestRetryingProvider(policy, primary, fallback)
+
+		_, err := p.GenerateText(context.Background(), "prompt", LLMOptions{})
+		assert.ErrorIs(t, err, ErrLLMRateLimited)
+	})
+
+	t.Run("再試行しても変わらないエラーはそのまま返す", func(t *testing.T) {
+		rejected := &LLMError{Kind: ErrLLMRejected, StatusCode: http.StatusBadRequest, Err: errors.New("invalid model")}
+		primary := &scriptedProvider{errs: []error{rejected}}
+		fallback := &scriptedProvider{name: "fallback"}
+		p, _ := newTestRetryingProvider(policy, primary, fallback)
+
+		_, err := p.GenerateText(context.Background(), "prompt", LLMOptions{})
+		assert.ErrorIs(t, err, ErrLLMRejected)
+		assert.Equal(t, 1, primary.calls)
+		assert.Equal(t, 0, fallback.calls)
+	})
+
+	t.Run("期限までに再試行できない場合は待たない", func(t *testing.T) {
+		throttled := &LLMError{Kind: ErrLLMRateLimited, RetryAfter: 5 * time.Second, Err: errors.New("quota")}
+		primary := &scriptedProvider{errs: []error{throttled}}
+		p, waits := newTestRetryingProvider(policy, primary)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := p.GenerateText(ctx, "prompt", LLMOptions{})
+		assert.ErrorIs(t, err, ErrLLMRateLimited)
+		assert.Empty(t, *waits)
+	})
+
+	t.Run("出力が始まったストリームは再試行しない", func(t *testing.T) {
+		primary := &scriptedProvider{}
+		fallback := &scriptedProvider{}
+		p, _ := newTestRetryingProvider(policy, primary, fallback)
+
+		var chunks []string
+		_, err := p.GenerateStream(context.Background(), "prompt", nil, LLMOptions{}, func(chunk string) error {
+			chunks = append(chunks, chunk)
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrLLMUnavailable)
+		assert.Equal(t, []string{"partial"}, chunks)
+		assert.Equal(t, 1, primary.calls)
+		assert.Equal(t, 0, fallback.calls)
+	})
+}
+
+func TestOpenAIProviderErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer throttled":
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error": {"message": "rate limit reached"}}`))
+		case "Bearer broken":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error": {"message": "invalid api key"}}`))
+		}
+	}))
+	defer server.Close()
+
+	generate := func(apiKey string) error {
+		provider, err := NewOpenAIProvider(OpenAIConfig{BaseURL: server.URL, APIKey: apiKey, Model: "gpt-4o-mini"})
+		require.NoError(t, err)
+		_, err = provider.GenerateText(context.Background(), "prompt", LLMOptions{})
+		return err
+	}
+
+	err := generate("throttled")
+	assert.ErrorIs(t, err, ErrLLMRateLimited)
+	assert.Equal(t, 7*time.Second, LLMRetryAfter(err))
+	assert.Contains(t, err.Error(), "rate limit reached")
+
+	assert.ErrorIs(t, generate("broken"), ErrLLMUnavailable)
+
+	err = generate("wrong")
+	assert.ErrorIs(t, err, ErrLLMRejected)
+	assert.False(t, IsRetryableLLMError(err))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Wed, 01 Jan 2025 00:01:30 GMT", now))
+	assert.Zero(t, parseRetryAfter("Tue, 31 Dec 2024 23:59:00 GMT", now))
+	assert.Zero(t, parseRetryAfter("", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+}
+
+func TestGeminiRetryDelay(t *testing.T) {
+	details := []any{
+		map[string]any{"@type": "type.googleapis.com/google.rpc.QuotaFailure"},
+		map[string]any{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "34s"},
+	}
+	assert.Equal(t, 34*time.Second, geminiRetryDelay(details))
+	assert.Zero(t, geminiRetryDelay(nil))
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"slices"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+// MaxMediaSize is the largest media file stored for a card
+const MaxMediaSize = 20 * 1024 * 1024 // 20MB
+
+// AllowedMediaTypes are the image and audio types media files may have
+var AllowedMediaTypes = []string{
+	"image/png", "image/jpeg", "image/webp", "image/heic", "image/heif",
+	"audio/wav", "audio/mp3", "audio/mpeg", "audio/aiff", "audio/aac", "audio/ogg", "audio/flac", "audio/webm",
+}
+
+// IsAllowedMediaType reports whether a media file may have the MIME type
+func IsAllowedMediaType(mimeType string) bool {
+	return slices.Contains(AllowedMediaTypes, mimeType)
+}
+
+// Media sides
+const (
+	MediaSideFront = "front"
+	MediaSideBack  = "back"
+)
+
+type MediaService struct {
+	db      *gorm.DB
+	storage MediaStorage
+}
+
+func NewMediaService(db *gorm.DB, storage MediaStorage) *MediaService {
+	return &MediaService{db: db, storage: storage}
+}
+
+// Storage returns the underlying storage backend
+func (s *MediaService) Storage() MediaStorage {
+	return s.storage
+}
+
+// Attach stores the content and records it as media of the card
+func (s *MediaService) Attach(ctx context.Context, media *models.Media, r io.Reader) error {
+	key, err := newMediaKey(media.UserID, media.Filename)
+	if err != nil {
+		return err
+	}
+	media.StorageKey = key
+
+	if err := s.storage.Put(ctx, key, r); err != nil {
+		return fmt.Errorf("failed to store media: %w", err)
+	}
+
+	if err := s.db.WithContext(ctx).Create(media).Error; err != nil {
+		s.RemoveObjects(ctx, []string{key})
+		return err
+	}
+	return nil
+}
+
+// Open returns the content of the media
+func (s *MediaService) Open(ctx context.Context, media *models.Media) (io.ReadCloser, error) {
+	return s.storage.Open(ctx, media.StorageKey)
+}
+
+// Delete removes the media record and its stored content
+func (s *MediaService) Delete(ctx context.Context, media *models.Media) error {
+	if err := s.db.WithContext(ctx).Unscoped().Delete(media).Error; err != nil {
+		return err
+	}
+	s.RemoveObjects(ctx, []string{media.StorageKey})
+	return nil
+}
+
+// DeleteForCards removes the media referenced by the given cards within tx
+// and returns the storage keys to remove once the transaction commits.
+func (s *MediaService) DeleteForCards(tx *gorm.DB, cardIDs []uint) ([]string, error) {
+	if len(cardIDs) == 0 {
+		return nil, nil
+	}
+
+	var keys []string
+	if err := tx.Model(&models.Media{}).Where("card_id IN ?", cardIDs).Pluck("storage_key", &keys).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Where("card_id IN ?", cardIDs).Delete(&models.Media{}).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RemoveObjects deletes stored content, logging failures instead of returning them
+// because the database records are already gone.
+func (s *MediaService) RemoveObjects(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := s.storage.Delete(ctx, key); err != nil {
+			log.Printf("Warning: failed to delete media object %s: %v", key, err)
+		}
+	}
+}
+
+func newMediaKey(userID uint, filename string) (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%s%s", userID, hex.EncodeToString(bytes), path.Ext(path.Base(filename))), nil
+}
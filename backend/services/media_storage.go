@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrMediaNotFound is returned when a stored object does not exist
+var ErrMediaNotFound = errors.New("media not found")
+
+// MediaStorage stores media file contents under opaque keys
+type MediaStorage interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// NewMediaStorageFromEnv returns the storage backend configured by the environment.
+// MEDIA_STORAGE_DIR sets the directory of the local filesystem backend.
+func NewMediaStorageFromEnv() MediaStorage {
+	dir := os.Getenv("MEDIA_STORAGE_DIR")
+	if dir == "" {
+		dir = "media"
+	}
+	return NewLocalMediaStorage(dir)
+}
+
+// LocalMediaStorage stores media on the local filesystem
+type LocalMediaStorage struct {
+	baseDir string
+}
+
+func NewLocalMediaStorage(baseDir string) *LocalMediaStorage {
+	return &LocalMediaStorage{baseDir: baseDir}
+}
+
+func (s *LocalMediaStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// 途中で失敗した場合に壊れたファイルを残さないよう一時ファイル経由で書き込む
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalMediaStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrMediaNotFound
+	}
+	return file, err
+}
+
+func (s *LocalMediaStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path resolves a key inside the base directory, rejecting keys that escape it
+func (s *LocalMediaStorage) path(key string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid media key: %q", key)
+	}
+	return filepath.Join(s.baseDir, cleaned), nil
+}
@@ -0,0 +1,534 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+// BasicNoteTypeName is the name of the built-in Front/Back/Hint note type
+const BasicNoteTypeName = "Basic"
+
+var (
+	ErrNoteTypeNotFound = errors.New("note type not found")
+	ErrNoteTypeInUse    = errors.New("note type is in use")
+	ErrBuiltinNoteType  = errors.New("built-in note types cannot be modified")
+	ErrInvalidNote      = errors.New("invalid note")
+)
+
+// BasicNoteType returns the definition of the built-in note type.
+// Its fields map one-to-one onto the columns of a card.
+func BasicNoteType() models.NoteType {
+	return models.NoteType{
+		Name:   BasicNoteTypeName,
+		Fields: []string{"Front", "Back", "Hint"},
+		Templates: []models.CardTemplate{
+			{Ord: 0, Name: "Card 1", Front: "{{Front}}", Back: "{{Back}}", Hint: "{{Hint}}"},
+		},
+	}
+}
+
+// EnsureBasicNoteType returns the built-in note type, creating it if necessary
+func EnsureBasicNoteType(db *gorm.DB) (*models.NoteType, error) {
+	var noteType models.NoteType
+	err := db.Where("user_id IS NULL AND name = ?", BasicNoteTypeName).First(&noteType).Error
+	if err == nil {
+		return &noteType, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	noteType = BasicNoteType()
+	if err := db.Create(&noteType).Error; err != nil {
+		return nil, err
+	}
+	return &noteType, nil
+}
+
+// isBasicNoteType reports whether the note type is the built-in one
+func isBasicNoteType(noteType *models.NoteType) bool {
+	return noteType.UserID == nil && noteType.Name == BasicNoteTypeName
+}
+
+func basicNoteFields(card *models.Card) map[string]string {
+	return map[string]string{
+		"Front": card.Front,
+		"Back":  card.Back,
+		"Hint":  card.Hint,
+	}
+}
+
+// MigrateCardsToNotes wraps every card that has no note in a note of the
+// built-in Basic type. It is safe to run repeatedly.
+func MigrateCardsToNotes(db *gorm.DB) error {
+	basic, err := EnsureBasicNoteType(db)
+	if err != nil {
+		return err
+	}
+
+	var lastID uint
+	for {
+		var cards []models.Card
+		if err := db.Where("note_id IS NULL AND id > ?", lastID).Order("id").Limit(500).Find(&cards).Error; err != nil {
+			return err
+		}
+		if len(cards) == 0 {
+			return nil
+		}
+		lastID = cards[len(cards)-1].ID
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			deckOwners := map[uint]uint{}
+			for i := range cards {
+				card := &cards[i]
+				userID, ok := deckOwners[card.DeckID]
+				if !ok {
+					var deck models.Deck
+					if err := tx.Unscoped().Select("id", "user_id").First(&deck, card.DeckID).Error; err != nil {
+						if errors.Is(err, gorm.ErrRecordNotFound) {
+							continue // デッキが存在しないカードは移行しない
+						}
+						return err
+					}
+					userID = deck.UserID
+					deckOwners[card.DeckID] = userID
+				}
+
+				if err := attachNote(tx, basic, userID, card); err != nil {
+					return err
+				}
+				if err := tx.Model(card).UpdateColumns(map[string]interface{}{
+					"note_id":      card.NoteID,
+					"template_ord": card.TemplateOrd,
+				}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CreateBasicCard creates a card along with a Basic note holding its content
+func CreateBasicCard(db *gorm.DB, userID uint, card *models.Card) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		basic, err := EnsureBasicNoteType(tx)
+		if err != nil {
+			return err
+		}
+		if err := attachNote(tx, basic, userID, card); err != nil {
+			return err
+		}
+		return tx.Create(card).Error
+	})
+}
+
+// CreateBasicCards creates cards along with a Basic note for each of them
+func CreateBasicCards(db *gorm.DB, userID uint, cards []models.Card) error {
+	if len(cards) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		basic, err := EnsureBasicNoteType(tx)
+		if err != nil {
+			return err
+		}
+		for i := range cards {
+			if err := attachNote(tx, basic, userID, &cards[i]); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&cards).Error
+	})
+}
+
+// attachNote creates a Basic note from the card content and links the card to it
+func attachNote(tx *gorm.DB, basic *models.NoteType, userID uint, card *models.Card) error {
+	note := &models.Note{
+		UserID:        userID,
+		DeckID:        card.DeckID,
+		NoteTypeID:    basic.ID,
+		Fields:        basicNoteFields(card),
+		ContentFormat: card.ContentFormat,
+		Markup:        card.Markup,
+	}
+	if note.ContentFormat == "" {
+		note.ContentFormat = ContentFormatPlain
+	}
+	if err := tx.Create(note).Error; err != nil {
+		return err
+	}
+	card.NoteID = &note.ID
+	card.TemplateOrd = basic.Templates[0].Ord
+	return nil
+}
+
+// SyncNoteFromCard copies edits made directly to a card back to its note.
+// Only Basic notes are synced; cards of other note types keep the edit
+// until the note or its note type is next changed.
+func SyncNoteFromCard(tx *gorm.DB, card *models.Card) error {
+	if card.NoteID == nil {
+		return nil
+	}
+
+	var note models.Note
+	if err := tx.First(&note, *card.NoteID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var noteType models.NoteType
+	if err := tx.First(&noteType, note.NoteTypeID).Error; err != nil {
+		return err
+	}
+	if !isBasicNoteType(&noteType) {
+		return nil
+	}
+
+	note.Fields = basicNoteFields(card)
+	note.ContentFormat = card.ContentFormat
+	note.Markup = card.Markup
+	return tx.Model(&note).Select("fields", "content_format", "markup").Updates(&note).Error
+}
+
+// PruneNotes deletes the given notes if they no longer have any cards
+func PruneNotes(tx *gorm.DB, noteIDs ...uint) error {
+	if len(noteIDs) == 0 {
+		return nil
+	}
+	return tx.Where("id IN ?", noteIDs).
+		Where("NOT EXISTS (SELECT 1 FROM cards WHERE cards.note_id = notes.id AND cards.deleted_at IS NULL)").
+		Delete(&models.Note{}).Error
+}
+
+type NoteService struct {
+	db              *gorm.DB
+	revisionService *CardRevisionService
+	mediaService    *MediaService
+}
+
+func NewNoteService(db *gorm.DB, mediaService *MediaService) *NoteService {
+	return &NoteService{
+		db:              db,
+		revisionService: NewCardRevisionService(db),
+		mediaService:    mediaService,
+	}
+}
+
+// ListNoteTypes returns the built-in note types and those of the user
+func (s *NoteService) ListNoteTypes(userID uint) ([]models.NoteType, error) {
+	if _, err := EnsureBasicNoteType(s.db); err != nil {
+		return nil, err
+	}
+
+	var noteTypes []models.NoteType
+	if err := s.db.Where("user_id IS NULL OR user_id = ?", userID).Order("id").Find(&noteTypes).Error; err != nil {
+		return nil, err
+	}
+	return noteTypes, nil
+}
+
+// FindNoteType returns a note type that is built in or owned by the user
+func (s *NoteService) FindNoteType(id uint, userID uint) (*models.NoteType, error) {
+	var noteType models.NoteType
+	if err := s.db.Where("user_id IS NULL OR user_id = ?", userID).First(&noteType, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoteTypeNotFound
+		}
+		return nil, err
+	}
+	return &noteType, nil
+}
+
+// CreateNoteType validates and stores a note type of the user.
+// Template ords are assigned in order.
+func (s *NoteService) CreateNoteType(noteType *models.NoteType) error {
+	for i := range noteType.Templates {
+		noteType.Templates[i].Ord = i
+	}
+	if err := ValidateNoteType(noteType); err != nil {
+		return err
+	}
+	return s.db.Create(noteType).Error
+}
+
+// UpdateNoteType replaces the name, fields and templates of a note type and
+// regenerates the cards of all its notes. renames maps old field names to new
+// ones so that note values follow a renamed field; values of removed fields are dropped.
+func (s *NoteService) UpdateNoteType(ctx context.Context, noteType *models.NoteType, update models.NoteType, renames map[string]string) error {
+	if noteType.UserID == nil {
+		return ErrBuiltinNoteType
+	}
+
+	for from, to := range renames {
+		if !slices.Contains(noteType.Fields, from) || !slices.Contains(update.Fields, to) {
+			return fmt.Errorf("%w: cannot rename field %q to %q", ErrInvalidNoteType, from, to)
+		}
+	}
+	if err := assignTemplateOrds(noteType.Templates, update.Templates); err != nil {
+		return err
+	}
+	if err := ValidateNoteType(&update); err != nil {
+		return err
+	}
+
+	expected := noteType.Version
+	noteType.Name = update.Name
+	noteType.Fields = update.Fields
+	noteType.Templates = update.Templates
+	noteType.Version = expected + 1
+
+	var mediaKeys []string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := SaveVersioned(tx, noteType, expected); err != nil {
+			return err
+		}
+
+		var notes []models.Note
+		if err := tx.Where("note_type_id = ?", noteType.ID).Find(&notes).Error; err != nil {
+			return err
+		}
+		for i := range notes {
+			note := &notes[i]
+			note.Fields = remapFields(note.Fields, noteType.Fields, renames)
+			if err := tx.Model(note).Select("fields").Updates(note).Error; err != nil {
+				return err
+			}
+
+			keys, err := s.generateCards(tx, noteType, note)
+			if err != nil {
+				return fmt.Errorf("note %d: %w", note.ID, err)
+			}
+			mediaKeys = append(mediaKeys, keys...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mediaService.RemoveObjects(ctx, mediaKeys)
+	return nil
+}
+
+// DeleteNoteType deletes a note type of the user that has no notes
+func (s *NoteService) DeleteNoteType(noteType *models.NoteType) error {
+	if noteType.UserID == nil {
+		return ErrBuiltinNoteType
+	}
+
+	var count int64
+	if err := s.db.Model(&models.Note{}).Where("note_type_id = ?", noteType.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrNoteTypeInUse
+	}
+	return s.db.Delete(noteType).Error
+}
+
+// CreateNote stores a note and generates its cards
+func (s *NoteService) CreateNote(ctx context.Context, noteType *models.NoteType, note *models.Note) error {
+	if err := prepareNote(noteType, note); err != nil {
+		return err
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Cards").Create(note).Error; err != nil {
+			return err
+		}
+		_, err := s.generateCards(tx, noteType, note)
+		return err
+	})
+}
+
+// UpdateNote replaces the field values of a note and regenerates its cards
+func (s *NoteService) UpdateNote(ctx context.Context, noteType *models.NoteType, note *models.Note) error {
+	if err := prepareNote(noteType, note); err != nil {
+		return err
+	}
+
+	var mediaKeys []string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(note).Select("fields", "content_format", "markup").Updates(note).Error; err != nil {
+			return err
+		}
+		keys, err := s.generateCards(tx, noteType, note)
+		mediaKeys = keys
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mediaService.RemoveObjects(ctx, mediaKeys)
+	return nil
+}
+
+// DeleteNote deletes a note together with its cards and their media
+func (s *NoteService) DeleteNote(ctx context.Context, note *models.Note) error {
+	var mediaKeys []string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var cardIDs []uint
+		if err := tx.Model(&models.Card{}).Where("note_id = ?", note.ID).Pluck("id", &cardIDs).Error; err != nil {
+			return err
+		}
+		if len(cardIDs) > 0 {
+			keys, err := s.mediaService.DeleteForCards(tx, cardIDs)
+			if err != nil {
+				return err
+			}
+			mediaKeys = keys
+			if err := tx.Delete(&models.Card{}, cardIDs).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(note).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mediaService.RemoveObjects(ctx, mediaKeys)
+	return nil
+}
+
+// prepareNote validates the field names of a note and sanitizes their values
+func prepareNote(noteType *models.NoteType, note *models.Note) error {
+	if note.ContentFormat == "" {
+		note.ContentFormat = ContentFormatPlain
+	}
+	if !ValidContentFormat(note.ContentFormat) {
+		return ErrInvalidContentFormat
+	}
+
+	fields := make(map[string]string, len(noteType.Fields))
+	for name, value := range note.Fields {
+		if !slices.Contains(noteType.Fields, name) {
+			return fmt.Errorf("%w: unknown field %q", ErrInvalidNote, name)
+		}
+		sanitized, err := SanitizeContent(note.ContentFormat, value)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidNote, name, err)
+		}
+		if note.Markup {
+			if err := ValidateMarkup(note.ContentFormat, sanitized); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidNote, name, err)
+			}
+		}
+		fields[name] = sanitized
+	}
+	note.NoteTypeID = noteType.ID
+	note.Fields = fields
+	return nil
+}
+
+// remapFields renames note values according to renames and keeps only the given fields
+func remapFields(values map[string]string, fields []string, renames map[string]string) map[string]string {
+	renamed := make(map[string]string, len(values))
+	for name, value := range values {
+		if to, ok := renames[name]; ok {
+			name = to
+		}
+		if slices.Contains(fields, name) {
+			renamed[name] = value
+		}
+	}
+	return renamed
+}
+
+// generateCards brings the cards of a note in line with its note type.
+// Cards are matched to templates by ord: existing cards are updated (and
+// revisioned), missing ones are created, and cards whose template was removed
+// or now renders an empty front are deleted. The storage keys of the deleted
+// cards' media are returned for removal after commit.
+func (s *NoteService) generateCards(tx *gorm.DB, noteType *models.NoteType, note *models.Note) ([]string, error) {
+	var existing []models.Card
+	if err := tx.Where("note_id = ?", note.ID).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	byOrd := make(map[int]*models.Card, len(existing))
+	for i := range existing {
+		byOrd[existing[i].TemplateOrd] = &existing[i]
+	}
+
+	var cards []models.Card
+	kept := map[uint]bool{}
+	for _, tmpl := range noteType.Templates {
+		front, back, hint, err := RenderCardTemplate(tmpl, note.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("%w: template %q: %v", ErrInvalidNote, tmpl.Name, err)
+		}
+		if strings.TrimSpace(front) == "" {
+			continue
+		}
+
+		card, ok := byOrd[tmpl.Ord]
+		if !ok {
+			card = &models.Card{DeckID: note.DeckID, NoteID: &note.ID, TemplateOrd: tmpl.Ord}
+		}
+		before := *card
+		card.Front = front
+		card.Back = back
+		card.Hint = hint
+		card.ContentFormat = note.ContentFormat
+		card.Markup = note.Markup
+		if err := SanitizeCard(card); err != nil {
+			return nil, fmt.Errorf("%w: template %q: %v", ErrInvalidNote, tmpl.Name, err)
+		}
+
+		switch {
+		case card.ID == 0:
+			if err := tx.Create(card).Error; err != nil {
+				return nil, err
+			}
+		case ContentChanged(&before, card) || before.ContentFormat != card.ContentFormat || before.Markup != card.Markup:
+			card.Version = before.Version + 1
+			if err := SaveVersioned(tx, card, before.Version); err != nil {
+				return nil, err
+			}
+			if err := s.revisionService.RecordChange(tx, &before, card, note.UserID, RevisionSourceNote); err != nil {
+				return nil, err
+			}
+		}
+		kept[card.ID] = true
+		cards = append(cards, *card)
+	}
+
+	if len(cards) == 0 {
+		return nil, fmt.Errorf("%w: no template generates a card for the note", ErrInvalidNote)
+	}
+
+	var stale []uint
+	for _, card := range existing {
+		if !kept[card.ID] {
+			stale = append(stale, card.ID)
+		}
+	}
+
+	var mediaKeys []string
+	if len(stale) > 0 {
+		keys, err := s.mediaService.DeleteForCards(tx, stale)
+		if err != nil {
+			return nil, err
+		}
+		mediaKeys = keys
+		if err := tx.Delete(&models.Card{}, stale).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	note.Cards = cards
+	return mediaKeys, nil
+}
@@ -0,0 +1,235 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+)
+
+// FrontSideField is the placeholder for the rendered front in a back template
+const FrontSideField = "FrontSide"
+
+var ErrInvalidNoteType = errors.New("invalid note type")
+
+// templateNode is either literal text, a {{Field}} placeholder or a
+// {{#Field}}...{{/Field}} / {{^Field}}...{{/Field}} section.
+type templateNode struct {
+	text     string
+	field    string
+	section  byte // '#' は値がある時、'^' は値が空の時に中身を出力
+	children []templateNode
+}
+
+func parseTemplate(src string) ([]templateNode, error) {
+	root := &templateNode{}
+	stack := []*templateNode{root}
+
+	for src != "" {
+		parent := stack[len(stack)-1]
+
+		open := strings.Index(src, "{{")
+		if open < 0 {
+			parent.children = append(parent.children, templateNode{text: src})
+			break
+		}
+		if open > 0 {
+			parent.children = append(parent.children, templateNode{text: src[:open]})
+		}
+
+		end := strings.Index(src[open:], "}}")
+		if end < 0 {
+			return nil, errors.New("unclosed {{")
+		}
+		tag := strings.TrimSpace(src[open+2 : open+end])
+		src = src[open+end+2:]
+
+		if tag == "" {
+			return nil, errors.New("empty placeholder")
+		}
+
+		switch tag[0] {
+		case '#', '^':
+			parent.children = append(parent.children, templateNode{
+				field:   strings.TrimSpace(tag[1:]),
+				section: tag[0],
+			})
+			stack = append(stack, &parent.children[len(parent.children)-1])
+		case '/':
+			name := strings.TrimSpace(tag[1:])
+			if len(stack) == 1 || parent.field != name {
+				return nil, fmt.Errorf("unexpected {{/%s}}", name)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			parent.children = append(parent.children, templateNode{field: tag})
+		}
+	}
+
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("unclosed section {{%c%s}}", stack[len(stack)-1].section, stack[len(stack)-1].field)
+	}
+	return root.children, nil
+}
+
+func renderTemplateNodes(b *strings.Builder, nodes []templateNode, fields map[string]string) {
+	for _, node := range nodes {
+		switch {
+		case node.section == '#':
+			if strings.TrimSpace(fields[node.field]) != "" {
+				renderTemplateNodes(b, node.children, fields)
+			}
+		case node.section == '^':
+			if strings.TrimSpace(fields[node.field]) == "" {
+				renderTemplateNodes(b, node.children, fields)
+			}
+		case node.field != "":
+			b.WriteString(fields[node.field])
+		default:
+			b.WriteString(node.text)
+		}
+	}
+}
+
+// templateFieldRefs returns the field names referenced by the nodes
+func templateFieldRefs(nodes []templateNode) []string {
+	var refs []string
+	for _, node := range nodes {
+		if node.field != "" {
+			refs = append(refs, node.field)
+		}
+		refs = append(refs, templateFieldRefs(node.children)...)
+	}
+	return refs
+}
+
+// RenderTemplate expands a card template with the given field values
+func RenderTemplate(template string, fields map[string]string) (string, error) {
+	nodes, err := parseTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	renderTemplateNodes(&b, nodes, fields)
+	return b.String(), nil
+}
+
+// RenderCardTemplate renders the front, back and hint of a card from note fields.
+// A blank front means the template generates no card for the note.
+func RenderCardTemplate(tmpl models.CardTemplate, fields map[string]string) (front, back, hint string, err error) {
+	if front, err = RenderTemplate(tmpl.Front, fields); err != nil {
+		return "", "", "", err
+	}
+
+	backFields := make(map[string]string, len(fields)+1)
+	for name, value := range fields {
+		backFields[name] = value
+	}
+	backFields[FrontSideField] = front
+
+	if back, err = RenderTemplate(tmpl.Back, backFields); err != nil {
+		return "", "", "", err
+	}
+	if hint, err = RenderTemplate(tmpl.Hint, fields); err != nil {
+		return "", "", "", err
+	}
+	return front, back, hint, nil
+}
+
+// ValidateNoteType checks field names and that every template is well-formed
+// and only references fields of the note type.
+func ValidateNoteType(noteType *models.NoteType) error {
+	if strings.TrimSpace(noteType.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidNoteType)
+	}
+	if len(noteType.Fields) == 0 {
+		return fmt.Errorf("%w: at least one field is required", ErrInvalidNoteType)
+	}
+	if len(noteType.Templates) == 0 {
+		return fmt.Errorf("%w: at least one template is required", ErrInvalidNoteType)
+	}
+
+	for i, field := range noteType.Fields {
+		switch {
+		case strings.TrimSpace(field) != field || field == "":
+			return fmt.Errorf("%w: invalid field name %q", ErrInvalidNoteType, field)
+		case strings.ContainsAny(field, "{}#^/"):
+			return fmt.Errorf("%w: field name %q contains reserved characters", ErrInvalidNoteType, field)
+		case field == FrontSideField:
+			return fmt.Errorf("%w: %q is a reserved field name", ErrInvalidNoteType, field)
+		case slices.Contains(noteType.Fields[:i], field):
+			return fmt.Errorf("%w: duplicate field %q", ErrInvalidNoteType, field)
+		}
+	}
+
+	names := map[string]bool{}
+	ords := map[int]bool{}
+	for _, tmpl := range noteType.Templates {
+		if strings.TrimSpace(tmpl.Name) == "" {
+			return fmt.Errorf("%w: template name is required", ErrInvalidNoteType)
+		}
+		if names[tmpl.Name] {
+			return fmt.Errorf("%w: duplicate template %q", ErrInvalidNoteType, tmpl.Name)
+		}
+		if tmpl.Ord < 0 || ords[tmpl.Ord] {
+			return fmt.Errorf("%w: template %q has an invalid ord", ErrInvalidNoteType, tmpl.Name)
+		}
+		names[tmpl.Name] = true
+		ords[tmpl.Ord] = true
+
+		for _, side := range []struct {
+			name      string
+			source    string
+			frontSide bool
+		}{
+			{"front", tmpl.Front, false},
+			{"back", tmpl.Back, true},
+			{"hint", tmpl.Hint, false},
+		} {
+			nodes, err := parseTemplate(side.source)
+			if err != nil {
+				return fmt.Errorf("%w: template %q %s: %v", ErrInvalidNoteType, tmpl.Name, side.name, err)
+			}
+			refs := templateFieldRefs(nodes)
+			for _, ref := range refs {
+				if ref == FrontSideField && side.frontSide {
+					continue
+				}
+				if !slices.Contains(noteType.Fields, ref) {
+					return fmt.Errorf("%w: template %q %s references unknown field %q", ErrInvalidNoteType, tmpl.Name, side.name, ref)
+				}
+			}
+			if side.name == "front" && len(refs) == 0 {
+				return fmt.Errorf("%w: template %q front must reference a field", ErrInvalidNoteType, tmpl.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// assignTemplateOrds gives templates without an ord (negative) a new ord.
+// Templates keep the ord of the previous template they replace so that
+// existing cards and their study history stay attached.
+func assignTemplateOrds(previous, templates []models.CardTemplate) error {
+	next := 0
+	known := map[int]bool{}
+	for _, tmpl := range previous {
+		known[tmpl.Ord] = true
+		next = max(next, tmpl.Ord+1)
+	}
+
+	for _, tmpl := range templates {
+		if tmpl.Ord >= 0 && !known[tmpl.Ord] {
+			return fmt.Errorf("%w: unknown template ord %d", ErrInvalidNoteType, tmpl.Ord)
+		}
+	}
+	for i := range templates {
+		if templates[i].Ord < 0 {
+			templates[i].Ord = next
+			next++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	fields := map[string]string{"Word": "猫", "Reading": "ねこ", "Example": ""}
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"プレースホルダー", "{{Word}} ({{ Reading }})", "猫 (ねこ)"},
+		{"値がある時のセクション", "{{#Reading}}読み: {{Reading}}{{/Reading}}", "読み: ねこ"},
+		{"値が空のセクション", "{{#Example}}例: {{Example}}{{/Example}}", ""},
+		{"反転セクション", "{{^Example}}例文なし{{/Example}}", "例文なし"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := RenderTemplate(tt.template, fields)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+
+	t.Run("閉じていないセクションはエラー", func(t *testing.T) {
+		_, err := RenderTemplate("{{#Word}}x", fields)
+		assert.Error(t, err)
+	})
+}
+
+func TestRenderCardTemplate(t *testing.T) {
+	tmpl := models.CardTemplate{Front: "{{Meaning}}", Back: "{{FrontSide}} = {{Word}}"}
+
+	front, back, hint, err := RenderCardTemplate(tmpl, map[string]string{"Word": "猫", "Meaning": "cat"})
+	assert.NoError(t, err)
+	assert.Equal(t, "cat", front)
+	assert.Equal(t, "cat = 猫", back)
+	assert.Empty(t, hint)
+}
+
+func TestValidateNoteType(t *testing.T) {
+	valid := func() models.NoteType {
+		return models.NoteType{
+			Name:   "Vocabulary",
+			Fields: []string{"Word", "Reading", "Meaning"},
+			Templates: []models.CardTemplate{
+				{Ord: 0, Name: "Recognition", Front: "{{Word}}", Back: "{{Reading}} {{Meaning}}"},
+				{Ord: 1, Name: "Recall", Front: "{{Meaning}}", Back: "{{FrontSide}} {{Word}}"},
+			},
+		}
+	}
+
+	t.Run("正常なノートタイプ", func(t *testing.T) {
+		noteType := valid()
+		assert.NoError(t, ValidateNoteType(&noteType))
+	})
+
+	t.Run("組み込みの Basic", func(t *testing.T) {
+		noteType := BasicNoteType()
+		assert.NoError(t, ValidateNoteType(&noteType))
+	})
+
+	invalid := map[string]func(*models.NoteType){
+		"未定義のフィールド参照":   func(n *models.NoteType) { n.Templates[0].Front = "{{Kanji}}" },
+		"表面の FrontSide": func(n *models.NoteType) { n.Templates[0].Front = "{{FrontSide}}" },
+		"フィールドを参照しない表面": func(n *models.NoteType) { n.Templates[0].Front = "static" },
+		"重複したフィールド":     func(n *models.NoteType) { n.Fields = append(n.Fields, "Word") },
+		"予約されたフィールド名":   func(n *models.NoteType) { n.Fields = append(n.Fields, "FrontSide") },
+		"重複したテンプレート名":   func(n *models.NoteType) { n.Templates[1].Name = "Recognition" },
+		"重複した ord":      func(n *models.NoteType) { n.Templates[1].Ord = 0 },
+		"対応の取れないセクション":  func(n *models.NoteType) { n.Templates[0].Back = "{{#Word}}x{{/Reading}}" },
+	}
+	for name, mutate := range invalid {
+		t.Run(name, func(t *testing.T) {
+			noteType := valid()
+			mutate(&noteType)
+			err := ValidateNoteType(&noteType)
+			assert.True(t, errors.Is(err, ErrInvalidNoteType), "got %v", err)
+		})
+	}
+}
+
+func TestAssignTemplateOrds(t *testing.T) {
+	previous := []models.CardTemplate{{Ord: 0, Name: "A"}, {Ord: 2, Name: "B"}}
+
+	templates := []models.CardTemplate{{Ord: 2, Name: "B"}, {Ord: -1, Name: "C"}}
+	assert.NoError(t, assignTemplateOrds(previous, templates))
+	assert.Equal(t, 2, templates[0].Ord)
+	assert.Equal(t, 3, templates[1].Ord)
+
+	assert.Error(t, assignTemplateOrds(previous, []models.CardTemplate{{Ord: 5, Name: "X"}}))
+}
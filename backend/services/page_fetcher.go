@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Page fetchers selectable with PAGE_FETCHER
+const (
+	PageFetcherHTTP     = "http"
+	PageFetcherLocal    = "local"
+	PageFetcherDisabled = "none"
+)
+
+// MaxFetchedPageSize is the largest page a fetcher reads
+const MaxFetchedPageSize = 5 * 1024 * 1024 // 5MB
+
+var (
+	ErrPageFetchDisabled = errors.New("URLからの取得は無効になっています")
+	ErrPageURLNotAllowed = errors.New("このURLは取得できません")
+	ErrPageNotFound      = errors.New("ページが見つかりません")
+	ErrPageFetchFailed   = errors.New("ページの取得に失敗しました")
+)
+
+// PageFetcher retrieves the HTML of a web page
+type PageFetcher interface {
+	Fetch(ctx context.Context, rawURL string) ([]byte, error)
+}
+
+// NewPageFetcherFromEnv returns the fetcher configured by PAGE_FETCHER:
+// http (default) fetches pages from the web, local reads them from
+// PAGE_FETCHER_DIR for tests and offline deployments, and none disables
+// fetching.
+func NewPageFetcherFromEnv() PageFetcher {
+	switch os.Getenv("PAGE_FETCHER") {
+	case PageFetcherLocal:
+		return NewLocalPageFetcher(os.Getenv("PAGE_FETCHER_DIR"))
+	case PageFetcherDisabled:
+		return disabledPageFetcher{}
+	default:
+		return NewHTTPPageFetcher()
+	}
+}
+
+// parsePageURL accepts absolute http and https URLs only
+func parsePageURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: %s", ErrPageURLNotAllowed, rawURL)
+	}
+	return u, nil
+}
+
+// HTTPPageFetcher fetches pages over HTTP. It refuses to connect to
+// loopback, private and other non-public addresses, so that users cannot
+// reach internal services through it.
+type HTTPPageFetcher struct {
+	client *http.Client
+}
+
+func NewHTTPPageFetcher() *HTTPPageFetcher {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// リダイレクト先を含め、名前解決後の接続先ごとに検査する
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("%w: %s", ErrPageURLNotAllowed, host)
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+	}
+	return &HTTPPageFetcher{client: &http.Client{Transport: transport, Timeout: 30 * time.Second}}
+}
+
+func (f *HTTPPageFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := parsePageURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPageURLNotAllowed, err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrPageURLNotAllowed) {
+			return nil, ErrPageURLNotAllowed
+		}
+		return nil, fmt.Errorf("%w: %v", ErrPageFetchFailed, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, ErrPageNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: HTTP %d", ErrPageFetchFailed, resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("%w: HTMLではありません（%s）", ErrPageFetchFailed, mediaType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxFetchedPageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPageFetchFailed, err)
+	}
+	if len(body) > MaxFetchedPageSize {
+		return nil, fmt.Errorf("%w: ページが大きすぎます", ErrPageFetchFailed)
+	}
+	return body, nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+// LocalPageFetcher serves pages from files instead of the web. The page of
+// https://example.com/articles/1 is read from <dir>/example.com/articles/1,
+// and a URL ending in a slash from the index.html of its directory.
+type LocalPageFetcher struct {
+	dir string
+}
+
+func NewLocalPageFetcher(dir string) *LocalPageFetcher {
+	return &LocalPageFetcher{dir: dir}
+}
+
+func (f *LocalPageFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := parsePageURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// path.Clean で .. を取り除き、ディレクトリの外を読まないようにする
+	name := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") || name == "/" {
+		name = path.Join(name, "index.html")
+	}
+	data, err := os.ReadFile(filepath.Join(f.dir, u.Hostname(), filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrPageNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPageFetchFailed, err)
+	}
+	return data, nil
+}
+
+// disabledPageFetcher is used when PAGE_FETCHER is none
+type disabledPageFetcher struct{}
+
+func (disabledPageFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	return nil, ErrPageFetchDisabled
+}
@@ -141,5 +141,6 @@ func (s *StatsService) updateCardStatus(cardID uint, isCorrect bool) error {
 		}
 	}
 
-	return s.db.Save(&card).Error
+	// 学習状態のみを更新し、内容の編集とは競合させない
+	return s.db.Model(&card).Select("review_count", "last_review", "status").Updates(&card).Error
 }
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/subscription"
+)
+
+// SubscriptionCanceler cancels subscriptions at the payment provider
+type SubscriptionCanceler interface {
+	CancelSubscription(ctx context.Context, subscriptionID string) error
+}
+
+// StripeSubscriptionCanceler cancels Stripe subscriptions immediately
+type StripeSubscriptionCanceler struct {
+	key string
+}
+
+// NewStripeSubscriptionCanceler uses STRIPE_SECRET_KEY, the key of the Stripe webhook
+func NewStripeSubscriptionCanceler() *StripeSubscriptionCanceler {
+	return &StripeSubscriptionCanceler{key: os.Getenv("STRIPE_SECRET_KEY")}
+}
+
+// CancelSubscription cancels the subscription. A subscription Stripe no
+// longer has counts as canceled, so retries succeed.
+func (c *StripeSubscriptionCanceler) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	if c.key == "" {
+		return fmt.Errorf("cannot cancel subscription %s: STRIPE_SECRET_KEY is not set", subscriptionID)
+	}
+
+	client := subscription.Client{B: stripe.GetBackend(stripe.APIBackend), Key: c.key}
+	params := &stripe.SubscriptionCancelParams{}
+	params.Context = ctx
+	if _, err := client.Cancel(subscriptionID, params); err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+			return nil
+		}
+		return fmt.Errorf("failed to cancel subscription %s: %w", subscriptionID, err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+	textunicode "golang.org/x/text/encoding/unicode"
+)
+
+// MaxSubtitleCues is the largest number of cues read from a subtitle file
+const MaxSubtitleCues = 5000
+
+var (
+	ErrInvalidSubtitles = errors.New("字幕ファイルを読み込めませんでした")
+	ErrSubtitlesTooLong = fmt.Errorf("字幕が長すぎます（最大%dキュー）", MaxSubtitleCues)
+)
+
+var (
+	subtitleTimingLine = regexp.MustCompile(`^\s*(\S+)\s+-->\s+(\S+)`)
+	// WebVTT の <v 話者> や <c.色>、SRT の <i> や {\an8} などの書式
+	subtitleTagPattern = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+)
+
+// SubtitleCue is a cue of a subtitle file. Index numbers the cues from 1 in
+// the order they are kept, whatever identifiers the file uses.
+type SubtitleCue struct {
+	Index int           `json:"index"`
+	Start time.Duration `json:"start"`
+	End   time.Duration `json:"end"`
+	Text  string        `json:"text"`
+}
+
+// Timestamp returns the start of the cue as hh:mm:ss
+func (c SubtitleCue) Timestamp() string {
+	return FormatSubtitleTime(c.Start)
+}
+
+// FormatSubtitleTime formats a position in a video as hh:mm:ss
+func FormatSubtitleTime(d time.Duration) string {
+	seconds := int(d / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// ParseSubtitles parses an SRT or WebVTT file. Both formats are cues
+// separated by blank lines, each with a "start --> end" timing line, so they
+// are read alike: blocks without a timing line, such as the WEBVTT header
+// and NOTE or STYLE blocks, are skipped. Formatting tags are removed, the
+// lines of a cue are joined and a cue repeating the previous one, as
+// rolling captions do, is dropped.
+func ParseSubtitles(data []byte) ([]SubtitleCue, error) {
+	text, err := decodeSubtitles(data)
+	if err != nil {
+		return nil, err
+	}
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+
+	var cues []SubtitleCue
+	var block []string
+	flush := func() error {
+		defer func() { block = block[:0] }()
+		cue, ok, err := parseSubtitleBlock(block)
+		if err != nil || !ok || (len(cues) > 0 && cues[len(cues)-1].Text == cue.Text) {
+			return err
+		}
+		if len(cues) == MaxSubtitleCues {
+			return ErrSubtitlesTooLong
+		}
+		cue.Index = len(cues) + 1
+		cues = append(cues, cue)
+		return nil
+	}
+	// 末尾に空行を足し、最後のブロックも空行で区切られるようにする
+	for _, line := range append(strings.Split(text, "\n"), "") {
+		if strings.TrimSpace(line) != "" {
+			block = append(block, line)
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cues) == 0 {
+		return nil, fmt.Errorf("%w: 字幕が含まれていません", ErrInvalidSubtitles)
+	}
+	return cues, nil
+}
+
+// decodeSubtitles returns the text of a subtitle file. UTF-8 and UTF-16
+// files with a byte order mark are accepted, and other files that are not
+// valid UTF-8 are read as Shift_JIS, which older Japanese subtitles use.
+func decodeSubtitles(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		data = data[3:]
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}), bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		decoded, err := textunicode.UTF16(textunicode.BigEndian, textunicode.ExpectBOM).NewDecoder().Bytes(data)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidSubtitles, err)
+		}
+		data = decoded
+	case !utf8.Valid(data):
+		decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(data)
+		if err != nil || bytes.ContainsRune(decoded, utf8.RuneError) {
+			return "", fmt.Errorf("%w: 文字コードを判別できません", ErrInvalidSubtitles)
+		}
+		data = decoded
+	}
+	return string(data), nil
+}
+
+// parseSubtitleBlock parses the lines of one blank-line separated block. ok
+// is false for blocks that are not cues or have no text.
+func parseSubtitleBlock(lines []string) (cue SubtitleCue, ok bool, err error) {
+	for i, line := range lines {
+		match := subtitleTimingLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		// タイミング行より前の行はキューの番号や識別子なので読み飛ばす
+		if cue.Start, err = parseSubtitleTime(match[1]); err != nil {
+			return cue, false, err
+		}
+		if cue.End, err = parseSubtitleTime(match[2]); err != nil {
+			return cue, false, err
+		}
+		cue.Text = cueText(lines[i+1:])
+		return cue, cue.Text != "", nil
+	}
+	return cue, false, nil
+}
+
+// parseSubtitleTime parses hh:mm:ss,ttt (SRT) and hh:mm:ss.ttt or
+// mm:ss.ttt (WebVTT)
+func parseSubtitleTime(s string) (time.Duration, error) {
+	invalid := fmt.Errorf("%w: 不正なタイムスタンプ %q", ErrInvalidSubtitles, s)
+
+	clock, fraction, _ := strings.Cut(strings.Replace(s, ",", ".", 1), ".")
+	parts := strings.Split(clock, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, invalid
+	}
+
+	var d time.Duration
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, invalid
+		}
+		d = d*60 + time.Duration(n)
+	}
+	d *= time.Second
+
+	if fraction != "" {
+		n, err := strconv.Atoi(fraction)
+		if err != nil || n < 0 || len(fraction) > 3 {
+			return 0, invalid
+		}
+		for i := len(fraction); i < 3; i++ {
+			n *= 10
+		}
+		d += time.Duration(n) * time.Millisecond
+	}
+	return d, nil
+}
+
+// cueText joins the lines of a cue without formatting tags and entities
+func cueText(lines []string) string {
+	var text string
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(html.UnescapeString(subtitleTagPattern.ReplaceAllString(line, ""))), " ")
+		if line == "" {
+			continue
+		}
+		text = joinSubtitleLines(text, line)
+	}
+	return text
+}
+
+// joinSubtitleLines joins two lines of a cue, with a space unless both sides
+// are Japanese or Chinese text, which is written without spaces
+func joinSubtitleLines(a, b string) string {
+	if a == "" {
+		return b
+	}
+	last, _ := utf8.DecodeLastRuneInString(a)
+	first, _ := utf8.DecodeRuneInString(b)
+	if isCJK(last) && isCJK(first) {
+		return a + b
+	}
+	return a + " " + b
+}
+
+// isCJK reports whether r is a kanji, kana, Japanese punctuation or a
+// full-width character
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) ||
+		(r >= '\u3000' && r <= '\u303f') || (r >= '\uff00' && r <= '\uffef')
+}
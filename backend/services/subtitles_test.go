@@ -0,0 +1,72 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func TestParseSubtitles(t *testing.T) {
+	t.Run("SRTのキューと時刻を読み込む", func(t *testing.T) {
+		srt := "\ufeff1\r\n00:00:01,500 --> 00:00:03,000\r\n<i>今日は</i>\r\n雨ですね。\r\n\r\n" +
+			"2\r\n00:01:02,000 --> 00:01:04,250\r\n{\\an8}It's raining\r\ncats and dogs.\r\n \r\n" +
+			"3\r\n01:00:00,000 --> 01:00:02,000\r\n\r\n"
+
+		cues, err := ParseSubtitles([]byte(srt))
+		require.NoError(t, err)
+		require.Len(t, cues, 2)
+		assert.Equal(t, SubtitleCue{Index: 1, Start: 1500 * time.Millisecond, End: 3 * time.Second, Text: "今日は雨ですね。"}, cues[0])
+		assert.Equal(t, "It's raining cats and dogs.", cues[1].Text)
+		assert.Equal(t, "00:01:02", cues[1].Timestamp())
+		assert.Equal(t, 64250*time.Millisecond, cues[1].End)
+	})
+
+	t.Run("WebVTTのヘッダーやコメントを読み飛ばす", func(t *testing.T) {
+		vtt := `WEBVTT - 字幕
+
+NOTE
+作成者のメモ
+
+STYLE
+::cue { color: yellow; }
+
+intro
+00:05.000 --> 00:07.000 align:start position:10%
+<v 先生>それでは<c.yellow>始めましょう</c>。
+
+00:07.000 --> 00:09.000
+<v 先生>それでは<c.yellow>始めましょう</c>。
+
+1:02:03.4 --> 1:02:05.000
+Tom &amp; Jerry
+`
+
+		cues, err := ParseSubtitles([]byte(vtt))
+		require.NoError(t, err)
+		require.Len(t, cues, 2, "直前と同じ字幕は除く")
+		assert.Equal(t, SubtitleCue{Index: 1, Start: 5 * time.Second, End: 7 * time.Second, Text: "それでは始めましょう。"}, cues[0])
+		assert.Equal(t, SubtitleCue{Index: 2, Start: time.Hour + 2*time.Minute + 3400*time.Millisecond, End: time.Hour + 2*time.Minute + 5*time.Second, Text: "Tom & Jerry"}, cues[1])
+		assert.Equal(t, "01:02:03", cues[1].Timestamp())
+	})
+
+	t.Run("Shift_JISの字幕を読み込む", func(t *testing.T) {
+		data, err := japanese.ShiftJIS.NewEncoder().Bytes([]byte("1\n00:00:01,000 --> 00:00:02,000\n字幕の日本語\n"))
+		require.NoError(t, err)
+
+		cues, err := ParseSubtitles(data)
+		require.NoError(t, err)
+		require.Len(t, cues, 1)
+		assert.Equal(t, "字幕の日本語", cues[0].Text)
+	})
+
+	t.Run("字幕として読み込めない", func(t *testing.T) {
+		_, err := ParseSubtitles([]byte("ただのテキストです"))
+		assert.ErrorIs(t, err, ErrInvalidSubtitles)
+
+		_, err = ParseSubtitles([]byte("1\n00:00:aa,000 --> 00:00:02,000\nテキスト\n"))
+		assert.ErrorIs(t, err, ErrInvalidSubtitles)
+	})
+}
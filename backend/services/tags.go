@@ -0,0 +1,45 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+// SplitTags splits a tag list on whitespace, commas and semicolons and drops duplicates
+func SplitTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ',' || r == ';' || r == '、'
+	}) {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// EnsureTags returns the user's tags with the given names, creating missing
+// ones. The number of newly created tags is also returned.
+func EnsureTags(tx *gorm.DB, userID uint, names []string) ([]models.Tag, int, error) {
+	tags := make([]models.Tag, 0, len(names))
+	created := 0
+	for _, name := range names {
+		var tag models.Tag
+		err := tx.Where("user_id = ? AND name = ?", userID, name).First(&tag).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			tag = models.Tag{UserID: userID, Name: name}
+			err = tx.Create(&tag).Error
+			created++
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, created, nil
+}
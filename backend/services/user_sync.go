@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/clerk/clerk-sdk-go/v2"
+	clerkuser "github.com/clerk/clerk-sdk-go/v2/user"
+	"github.com/muratayousuke/ai-flashcards/models"
+	"gorm.io/gorm"
+)
+
+// ErrEmailInUse is returned when the email already belongs to another user
+var ErrEmailInUse = errors.New("email is already used by another user")
+
+// ErrClerkUserNotFound is returned when the user does not exist in Clerk
+var ErrClerkUserNotFound = errors.New("user not found in Clerk")
+
+// ClerkProfile is the part of a Clerk user stored in models.User
+type ClerkProfile struct {
+	ClerkID string
+	Email   string // プライマリのメールアドレス
+	Name    string
+}
+
+// UpsertClerkUser creates the user of a Clerk profile or updates its email
+// and name. Applying the same profile again is a no-op, so webhook replays
+// and out-of-order deliveries are safe. created reports whether a new user
+// was inserted.
+func UpsertClerkUser(db *gorm.DB, profile ClerkProfile) (user *models.User, created bool, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var other models.User
+		err := tx.Where("email = ? AND clerk_id <> ?", profile.Email, profile.ClerkID).First(&other).Error
+		if err == nil {
+			return ErrEmailInUse
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		user = &models.User{}
+		err = tx.Where("clerk_id = ?", profile.ClerkID).First(user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			user = &models.User{ClerkID: profile.ClerkID, Email: profile.Email, Name: profile.Name}
+			created = true
+			return tx.Create(user).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		if user.Email == profile.Email && user.Name == profile.Name {
+			return nil
+		}
+		user.Email = profile.Email
+		user.Name = profile.Name
+		return tx.Model(user).Updates(map[string]any{"email": user.Email, "name": user.Name}).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return user, created, nil
+}
+
+// ClerkUserLookup fetches a user's profile from Clerk
+type ClerkUserLookup interface {
+	LookupUser(ctx context.Context, clerkID string) (*ClerkProfile, error)
+}
+
+// ClerkAPIUserLookup looks users up with the Clerk Backend API
+type ClerkAPIUserLookup struct{}
+
+func NewClerkAPIUserLookup() *ClerkAPIUserLookup {
+	return &ClerkAPIUserLookup{}
+}
+
+func (l *ClerkAPIUserLookup) LookupUser(ctx context.Context, clerkID string) (*ClerkProfile, error) {
+	u, err := clerkuser.Get(ctx, clerkID)
+	if err != nil {
+		var apiErr *clerk.APIErrorResponse
+		if errors.As(err, &apiErr) && apiErr.HTTPStatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %s", ErrClerkUserNotFound, clerkID)
+		}
+		return nil, fmt.Errorf("failed to get Clerk user %s: %w", clerkID, err)
+	}
+
+	profile := &ClerkProfile{ClerkID: u.ID}
+	if u.FirstName != nil {
+		profile.Name = *u.FirstName
+	}
+	for _, address := range u.EmailAddresses {
+		if profile.Email == "" || (u.PrimaryEmailAddressID != nil && address.ID == *u.PrimaryEmailAddressID) {
+			profile.Email = address.EmailAddress
+		}
+	}
+	return profile, nil
+}
+
+// UserProvisioner creates users on their first authenticated request, for
+// when the Clerk user.created webhook was never delivered
+type UserProvisioner struct {
+	db     *gorm.DB
+	lookup ClerkUserLookup
+}
+
+func NewUserProvisioner(db *gorm.DB, lookup ClerkUserLookup) *UserProvisioner {
+	return &UserProvisioner{db: db, lookup: lookup}
+}
+
+// Ensure returns the user of the Clerk ID, creating it if necessary. The
+// profile from the session claims is used when it has an email; otherwise
+// the user is looked up in Clerk.
+func (p *UserProvisioner) Ensure(ctx context.Context, clerkID string, claims *ClerkProfile) (*models.User, error) {
+	var user models.User
+	err := p.db.WithContext(ctx).Where("clerk_id = ?", clerkID).First(&user).Error
+	if err == nil {
+		return &user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	profile := claims
+	if profile == nil || profile.Email == "" {
+		if profile, err = p.lookup.LookupUser(ctx, clerkID); err != nil {
+			return nil, err
+		}
+	}
+	if profile.Email == "" {
+		return nil, fmt.Errorf("user %s has no email address in Clerk", clerkID)
+	}
+	profile.ClerkID = clerkID
+
+	provisioned, _, err := UpsertClerkUser(p.db.WithContext(ctx), *profile)
+	if errors.Is(err, ErrEmailInUse) {
+		if err = p.releaseEmail(ctx, profile.Email); err == nil {
+			provisioned, _, err = UpsertClerkUser(p.db.WithContext(ctx), *profile)
+		}
+	}
+	if err != nil {
+		// 同じユーザーの並行リクエストが先に作成した場合
+		if p.db.WithContext(ctx).Where("clerk_id = ?", clerkID).First(&user).Error == nil {
+			return &user, nil
+		}
+		return nil, err
+	}
+	log.Printf("Provisioned user %d for Clerk user %s", provisioned.ID, clerkID)
+	return provisioned, nil
+}
+
+// releaseEmail frees the email held by a user whose Clerk account has moved
+// on. When the other Clerk user is not found, its email is replaced with a
+// tombstone; its data is kept, as the row may belong to another Clerk
+// instance, and is erased only by the user.deleted webhook. When the other
+// Clerk user changed its email, its row is synced. ErrEmailInUse is returned
+// if the other Clerk user still has the email.
+func (p *UserProvisioner) releaseEmail(ctx context.Context, email string) error {
+	var other models.User
+	if err := p.db.WithContext(ctx).Where("email = ?", email).First(&other).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	profile, err := p.lookup.LookupUser(ctx, other.ClerkID)
+	if errors.Is(err, ErrClerkUserNotFound) {
+		tombstone := releasedEmail(other.ID)
+		log.Printf("Releasing email of user %d: Clerk user %s not found, email set to %s", other.ID, other.ClerkID, tombstone)
+		return p.db.WithContext(ctx).Model(&other).Update("email", tombstone).Error
+	}
+	if err != nil {
+		return err
+	}
+	if profile.Email == email {
+		return ErrEmailInUse
+	}
+
+	profile.ClerkID = other.ClerkID
+	_, _, err = UpsertClerkUser(p.db.WithContext(ctx), *profile)
+	return err
+}
+
+// releasedEmail is the email of a user whose email was given to another
+// user. The .invalid domain never receives mail.
+func releasedEmail(userID uint) string {
+	return fmt.Sprintf("deleted+%d@invalid", userID)
+}
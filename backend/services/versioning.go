@@ -0,0 +1,28 @@
+package services
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrVersionConflict is returned when a record was modified by someone else
+var ErrVersionConflict = errors.New("version conflict")
+
+// SaveVersioned saves a record only if its version in the database still equals
+// expectedVersion. The caller must set the new version on the record beforehand.
+func SaveVersioned(tx *gorm.DB, record interface{}, expectedVersion uint) error {
+	result := tx.Model(record).
+		Where("version = ?", expectedVersion).
+		Select("*").
+		Omit(clause.Associations, "created_at").
+		Updates(record)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
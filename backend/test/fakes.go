@@ -0,0 +1,38 @@
+package test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/muratayousuke/ai-flashcards/services"
+)
+
+// FakeUserLookup is a services.ClerkUserLookup returning fixed profiles
+type FakeUserLookup struct {
+	Profiles map[string]services.ClerkProfile
+	Calls    int
+}
+
+func (f *FakeUserLookup) LookupUser(ctx context.Context, clerkID string) (*services.ClerkProfile, error) {
+	f.Calls++
+	profile, ok := f.Profiles[clerkID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", services.ErrClerkUserNotFound, clerkID)
+	}
+	return &profile, nil
+}
+
+// FakeSubscriptionCanceler is a services.SubscriptionCanceler recording the
+// canceled subscriptions
+type FakeSubscriptionCanceler struct {
+	Canceled []string
+	Err      error
+}
+
+func (f *FakeSubscriptionCanceler) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Canceled = append(f.Canceled, subscriptionID)
+	return nil
+}
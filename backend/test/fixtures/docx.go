@@ -0,0 +1,42 @@
+// Package fixtures builds the sample files uploaded in tests. It does not
+// depend on the application packages so that their own tests can use it.
+package fixtures
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// BuildDOCX builds a DOCX file with the given document body
+func BuildDOCX(t testing.TB, body string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("word/document.xml")
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>%s</w:body></w:document>`, body)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// BuildDOCXPages builds a DOCX file with one paragraph per page
+func BuildDOCXPages(t testing.TB, pages ...string) []byte {
+	t.Helper()
+
+	var body strings.Builder
+	for i, page := range pages {
+		if i > 0 {
+			body.WriteString(`<w:p><w:r><w:br w:type="page"/></w:r></w:p>`)
+		}
+		fmt.Fprintf(&body, `<w:p><w:r><w:t>%s</w:t></w:r></w:p>`, page)
+	}
+	return BuildDOCX(t, body.String())
+}
@@ -21,7 +21,7 @@ func SetupTestDB() (*gorm.DB, func()) {
 		panic("Failed to connect to test database")
 	}
 
-	db.AutoMigrate(&models.User{}, &models.Deck{}, &models.Card{})
+	db.AutoMigrate(&models.User{}, &models.Deck{}, &models.Card{}, &models.AnswerRecord{}, &models.CardRevision{}, &models.Media{}, &models.NoteType{}, &models.Note{}, &models.Tag{}, &models.Subscription{}, &models.CardPreview{}, &models.GenerationJob{})
 
 	cleanup := func() {
 		sqlDB, _ := db.DB()